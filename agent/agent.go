@@ -0,0 +1,197 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package agent runs mender-shell inside another program.
+//
+// The embedding contract:
+//   - several Daemons may run in a process, each with its own sessions,
+//     session settings and metrics; only the first one using D-Bus exports
+//     the sessions over it;
+//   - the configuration is validated by the caller, and not modified after
+//     New;
+//   - the logging (format, level and sink) belongs to the host program,
+//     the Daemon leaves it as it is;
+//   - a Daemon runs once; Run returns when the context is cancelled or
+//     Shutdown is called, and a new Daemon has to be created to run again.
+package agent
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/mendersoftware/mender-shell/app"
+	"github.com/mendersoftware/mender-shell/client/mender"
+	"github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/connection"
+)
+
+var ErrAlreadyRun = errors.New("the mender-shell daemon has already run")
+
+// Daemon is mender-shell as a library
+type Daemon struct {
+	config        *config.MenderShellConfig
+	tokenProvider mender.TokenProvider
+	dialer        connection.Dialer
+	keepLogging   bool
+	hooks         *Hooks
+
+	mutex   sync.Mutex
+	daemon  *app.MenderShellDaemon
+	started bool
+	stopped bool
+	done    chan struct{}
+}
+
+// New returns a Daemon running with the given configuration; the token
+// provider hands it the JWT tokens, when nil it gets them from the Mender
+// client over D-Bus, as the mender-shell program does
+func New(config *config.MenderShellConfig, tokenProvider mender.TokenProvider) *Daemon {
+	return &Daemon{
+		config:        config,
+		tokenProvider: tokenProvider,
+		keepLogging:   true,
+		done:          make(chan struct{}),
+	}
+}
+
+// ConfigureLogging makes the Daemon set the log format, level and sink from
+// its configuration, as the mender-shell program does; it has to be called
+// before Run
+func (d *Daemon) ConfigureLogging() {
+	d.keepLogging = false
+}
+
+// SetHooks sets the hooks called on the connection and session lifecycle
+// events; it has to be called before Run
+func (d *Daemon) SetHooks(hooks Hooks) {
+	d.hooks = &hooks
+}
+
+// SetDialer makes the Daemon connect to the server over the transport of
+// dialer, e.g.: a tunnel, instead of a TCP connection; it has to be called
+// before Run
+func (d *Daemon) SetDialer(dialer connection.Dialer) {
+	d.dialer = dialer
+}
+
+// Run runs the daemon until the context is cancelled or Shutdown is called
+func (d *Daemon) Run(ctx context.Context) error {
+	d.mutex.Lock()
+	if d.started || d.stopped {
+		d.mutex.Unlock()
+		return ErrAlreadyRun
+	}
+	d.started = true
+	d.daemon = app.NewDaemon(d.config)
+	if d.tokenProvider != nil {
+		d.daemon.SetTokenProvider(d.tokenProvider)
+	}
+	if d.dialer != nil {
+		d.daemon.SetDialer(d.dialer)
+	}
+	if d.keepLogging {
+		d.daemon.KeepLogging()
+	}
+	var dispatcher *hookDispatcher
+	if d.hooks != nil {
+		dispatcher = newHookDispatcher(*d.hooks)
+		d.daemon.SetLifecycleObserver(dispatcher)
+	}
+	d.mutex.Unlock()
+
+	defer func() {
+		if dispatcher != nil {
+			dispatcher.close()
+		}
+		close(d.done)
+	}()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			d.daemon.StopDaemon()
+		case <-stopped:
+		}
+	}()
+	return d.daemon.Run()
+}
+
+// Shutdown stops the daemon, and waits for Run to return or the context to
+// be done
+func (d *Daemon) Shutdown(ctx context.Context) error {
+	d.mutex.Lock()
+	d.stopped = true
+	if !d.started {
+		d.mutex.Unlock()
+		return nil
+	}
+	d.daemon.StopDaemon()
+	d.mutex.Unlock()
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PrintStatus makes the running daemon log its status
+func (d *Daemon) PrintStatus() {
+	if daemon := d.running(); daemon != nil {
+		daemon.PrintStatus()
+	}
+}
+
+// DumpDiagnostics makes the running daemon dump the stacks of its
+// goroutines and its state, see DiagnosticsDir
+func (d *Daemon) DumpDiagnostics() {
+	if daemon := d.running(); daemon != nil {
+		daemon.DumpDiagnostics()
+	}
+}
+
+// ReloadConfig makes the running daemon reload its configuration from the
+// given file
+func (d *Daemon) ReloadConfig(path string) {
+	if daemon := d.running(); daemon != nil {
+		daemon.ReloadConfig(path)
+	}
+}
+
+// Handover makes the running daemon start the program again, handing its
+// sessions over to the new process, and stop; see EnableHandover
+func (d *Daemon) Handover() {
+	if daemon := d.running(); daemon != nil {
+		daemon.Handover()
+	}
+}
+
+// Stats returns a snapshot of the recent timings of the running daemon, see
+// app.Stats; the zero Stats if it is not running
+func (d *Daemon) Stats() app.Stats {
+	if daemon := d.running(); daemon != nil {
+		return daemon.Stats()
+	}
+	return app.Stats{}
+}
+
+func (d *Daemon) running() *app.MenderShellDaemon {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.daemon
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package agent
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	authmocks "github.com/mendersoftware/mender-shell/client/mender/mocks"
+	"github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/connection/connectiontest"
+)
+
+func newTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+}
+
+func newTestConfig(serverURL string) *config.MenderShellConfig {
+	return &config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ServerURL: serverURL,
+			User:      "root",
+		},
+	}
+}
+
+func runInBackground(d *Daemon, ctx context.Context) chan error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- d.Run(ctx)
+	}()
+	return errs
+}
+
+func TestDaemonRun(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	testCases := map[string]struct {
+		token string
+		stop  func(d *Daemon, cancel context.CancelFunc) error
+	}{
+		"cancel": {
+			token: "token",
+			stop: func(d *Daemon, cancel context.CancelFunc) error {
+				cancel()
+				return nil
+			},
+		},
+		"shutdown": {
+			token: "token",
+			stop: func(d *Daemon, cancel context.CancelFunc) error {
+				ctx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancelShutdown()
+				return d.Shutdown(ctx)
+			},
+		},
+		"shutdown while waiting for the token": {
+			stop: func(d *Daemon, cancel context.CancelFunc) error {
+				ctx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancelShutdown()
+				return d.Shutdown(ctx)
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			provider := &authmocks.TokenProvider{}
+			provider.On("Token").Return(tc.token, nil)
+
+			d := New(newTestConfig(s.URL), provider)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errs := runInBackground(d, ctx)
+			time.Sleep(500 * time.Millisecond)
+			if tc.token != "" {
+				assert.False(t, d.Stats().ConnectedAt.IsZero())
+			} else {
+				assert.True(t, d.Stats().ConnectedAt.IsZero())
+			}
+
+			assert.NoError(t, tc.stop(d, cancel))
+			select {
+			case err := <-errs:
+				assert.NoError(t, err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("the daemon did not stop")
+			}
+
+			assert.Equal(t, ErrAlreadyRun, d.Run(context.Background()))
+		})
+	}
+}
+
+func TestDaemonsRunTogether(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+
+	provider := &authmocks.TokenProvider{}
+	provider.On("Token").Return("token", nil)
+
+	first := New(newTestConfig(s.URL), provider)
+	second := New(newTestConfig(s.URL), provider)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	firstErrs := runInBackground(first, ctx)
+	secondErrs := runInBackground(second, ctx)
+	time.Sleep(500 * time.Millisecond)
+	assert.False(t, first.Stats().ConnectedAt.IsZero())
+	assert.False(t, second.Stats().ConnectedAt.IsZero())
+
+	cancel()
+	for _, errs := range []chan error{firstErrs, secondErrs} {
+		select {
+		case err := <-errs:
+			assert.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("the daemon did not stop")
+		}
+	}
+}
+
+func TestDaemonSetDialer(t *testing.T) {
+	s := newTestServer()
+	defer s.Close()
+	dialer := connectiontest.NewDialer(s.Config.Handler)
+	defer dialer.Close()
+
+	provider := &authmocks.TokenProvider{}
+	provider.On("Token").Return("token", nil)
+
+	d := New(newTestConfig("http://mender.invalid"), provider)
+	d.SetDialer(dialer)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := runInBackground(d, ctx)
+	time.Sleep(500 * time.Millisecond)
+	assert.False(t, d.Stats().ConnectedAt.IsZero())
+	assert.Equal(t, []string{"mender.invalid:80"}, dialer.Addresses())
+
+	cancel()
+	select {
+	case err := <-errs:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the daemon did not stop")
+	}
+}
+
+func TestDaemonShutdownNotRunning(t *testing.T) {
+	d := New(newTestConfig("https://localhost"), nil)
+	assert.NoError(t, d.Shutdown(context.Background()))
+	assert.Equal(t, ErrAlreadyRun, d.Run(context.Background()))
+
+	//nothing to print or reload
+	d.PrintStatus()
+	d.ReloadConfig("/nonexistent")
+}
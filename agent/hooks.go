@@ -0,0 +1,116 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package agent
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+//events waiting for the hooks at most, the next ones are dropped
+const hookQueueLength = 256
+
+// SessionInfo identifies a session to the hooks
+type SessionInfo struct {
+	// ID of the session
+	ID string
+	// UserID is the id of the user who opened the session
+	UserID string
+}
+
+// Hooks are called on the connection and session lifecycle events, e.g.: to
+// feed the telemetry of the host program; all of them are optional.
+//
+// The hooks don't block the daemon: they are called one at a time, in the
+// order of the events, from a goroutine of their own. A slow hook delays the
+// next ones; if more than 256 events are waiting, the new ones are dropped.
+// Run returns once the hooks of all the events before the end ran.
+type Hooks struct {
+	// OnConnected is called when the connection to the server is made,
+	// and again after every reconnection
+	OnConnected func()
+	// OnDisconnected is called when the connection to the server is lost
+	// or closed, with the reason; app.ErrShuttingDown when the daemon stops
+	OnDisconnected func(err error)
+	// OnSessionOpened is called when the shell of a session started
+	OnSessionOpened func(info SessionInfo)
+	// OnSessionClosed is called when the shell of a session is closed,
+	// with the reason, e.g.: the session timed out
+	OnSessionClosed func(info SessionInfo, reason string)
+}
+
+// hookDispatcher calls the hooks in order, from its own goroutine
+type hookDispatcher struct {
+	hooks  Hooks
+	events chan func()
+	done   chan struct{}
+}
+
+func newHookDispatcher(hooks Hooks) *hookDispatcher {
+	h := &hookDispatcher{
+		hooks:  hooks,
+		events: make(chan func(), hookQueueLength),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(h.done)
+		for event := range h.events {
+			event()
+		}
+	}()
+	return h
+}
+
+func (h *hookDispatcher) dispatch(name string, event func()) {
+	select {
+	case h.events <- event:
+	default:
+		log.Warnf("the hooks are falling behind, dropping the %s event", name)
+	}
+}
+
+//waits for the hooks of the events dispatched so far to run
+func (h *hookDispatcher) close() {
+	close(h.events)
+	<-h.done
+}
+
+func (h *hookDispatcher) Connected() {
+	if h.hooks.OnConnected != nil {
+		h.dispatch("connected", h.hooks.OnConnected)
+	}
+}
+
+func (h *hookDispatcher) Disconnected(err error) {
+	if h.hooks.OnDisconnected != nil {
+		h.dispatch("disconnected", func() {
+			h.hooks.OnDisconnected(err)
+		})
+	}
+}
+
+func (h *hookDispatcher) SessionOpened(sessionId string, userId string) {
+	if h.hooks.OnSessionOpened != nil {
+		h.dispatch("session opened", func() {
+			h.hooks.OnSessionOpened(SessionInfo{ID: sessionId, UserID: userId})
+		})
+	}
+}
+
+func (h *hookDispatcher) SessionClosed(sessionId string, userId string, reason string) {
+	if h.hooks.OnSessionClosed != nil {
+		h.dispatch("session closed", func() {
+			h.hooks.OnSessionClosed(SessionInfo{ID: sessionId, UserID: userId}, reason)
+		})
+	}
+}
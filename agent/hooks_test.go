@@ -0,0 +1,184 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package agent
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/user"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	"github.com/mendersoftware/mender-shell/app"
+	authmocks "github.com/mendersoftware/mender-shell/client/mender/mocks"
+	"github.com/mendersoftware/mender-shell/session"
+)
+
+func writeShellMessage(c *websocket.Conn, msgType string, sessionId string, data []byte) error {
+	message, err := msgpack.Marshal(&ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   msgType,
+			SessionID: sessionId,
+			Properties: map[string]interface{}{
+				"status": wsshell.NormalMessage,
+			},
+		},
+		Body: data,
+	})
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.BinaryMessage, message)
+}
+
+//opens a shell, and stops it once it started
+func newSessionServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if writeShellMessage(c, wsshell.MessageTypeSpawnShell, "", []byte("user-id-hooks")) != nil {
+			return
+		}
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			m := &ws.ProtoMsg{}
+			if msgpack.Unmarshal(data, m) != nil {
+				continue
+			}
+			if m.Header.MsgType == wsshell.MessageTypeSpawnShell {
+				writeShellMessage(c, wsshell.MessageTypeStopShell, m.Header.SessionID, nil)
+			}
+		}
+	}))
+}
+
+type recordedEvents struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (r *recordedEvents) add(event string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *recordedEvents) get() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+func TestDaemonHooks(t *testing.T) {
+	s := newSessionServer()
+	defer s.Close()
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+
+	provider := &authmocks.TokenProvider{}
+	provider.On("Token").Return("token", nil)
+
+	config := newTestConfig(s.URL)
+	config.ShellCommand = "/bin/sh"
+	config.User = currentUser.Username
+	config.Terminal.Width = 80
+	config.Terminal.Height = 24
+	//StopShell waits twice the write timeout
+	config.WriteTimeoutSeconds = 1
+	d := New(config, provider)
+
+	events := &recordedEvents{}
+	closed := make(chan struct{})
+	d.SetHooks(Hooks{
+		OnConnected: func() {
+			events.add("connected")
+		},
+		OnDisconnected: func(err error) {
+			events.add(fmt.Sprintf("disconnected: %v", err))
+		},
+		OnSessionOpened: func(info SessionInfo) {
+			events.add("opened: " + info.UserID)
+		},
+		OnSessionClosed: func(info SessionInfo, reason string) {
+			events.add("closed: " + info.UserID + ": " + reason)
+			close(closed)
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := runInBackground(d, ctx)
+	select {
+	case <-closed:
+	case <-time.After(20 * time.Second):
+		t.Fatal("the session was not closed")
+	}
+
+	cancel()
+	select {
+	case err := <-errs:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the daemon did not stop")
+	}
+	assert.Equal(t, []string{
+		"connected",
+		"opened: user-id-hooks",
+		"closed: user-id-hooks: " + session.SessionStoppedReason,
+		"disconnected: " + app.ErrShuttingDown.Error(),
+	}, events.get())
+}
+
+func TestHookDispatcherDropsEvents(t *testing.T) {
+	release := make(chan struct{})
+	count := 0
+	h := newHookDispatcher(Hooks{
+		OnConnected: func() {
+			<-release
+			count++
+		},
+	})
+	//the first event is being handled, the queue fills up behind it
+	for i := 0; i < hookQueueLength+2; i++ {
+		h.Connected()
+	}
+	close(release)
+	h.close()
+	assert.True(t, count >= hookQueueLength && count <= hookQueueLength+1)
+
+	//the hooks not set are skipped
+	h = newHookDispatcher(Hooks{})
+	h.Disconnected(nil)
+	h.SessionOpened("id", "user")
+	h.SessionClosed("id", "user", "reason")
+	h.close()
+}
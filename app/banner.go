@@ -0,0 +1,72 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bannerVariables are the variables the SessionBanner can use
+type bannerVariables struct {
+	DeviceID string
+	Operator string
+	UserID   string
+	Time     string
+}
+
+//returns the banner sent at the start of a session of the given user, nil
+//if there is none; a missing banner file or an invalid template do not
+//prevent the session from starting
+func (d *MenderShellDaemon) sessionBanner(text string, userId string) []byte {
+	if text == "" {
+		return nil
+	}
+	if filepath.IsAbs(text) {
+		data, err := ioutil.ReadFile(text)
+		if err != nil {
+			log.Warnf("can't read the session banner: %s", err.Error())
+			return nil
+		}
+		text = string(data)
+	}
+
+	banner := []byte(text)
+	t, err := template.New("banner").Option("missingkey=error").Parse(text)
+	if err == nil {
+		var b bytes.Buffer
+		err = t.Execute(&b, &bannerVariables{
+			DeviceID: d.deviceId,
+			Operator: d.operator(userId),
+			UserID:   userId,
+			Time:     time.Now().UTC().Format(time.RFC3339),
+		})
+		if err == nil {
+			banner = b.Bytes()
+		}
+	}
+	if err != nil {
+		log.Warnf("invalid session banner template, sending it as is: %s", err.Error())
+	}
+
+	//the terminal is in raw mode, the lines need the carriage return
+	text = strings.ReplaceAll(string(banner), "\r\n", "\n")
+	return []byte(strings.ReplaceAll(text, "\n", "\r\n"))
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionBanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-banner")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	bannerFile := path.Join(dir, "banner.txt")
+	assert.NoError(t, ioutil.WriteFile(bannerFile, []byte("Device {{.DeviceID}}\n"), 0644))
+
+	testCases := map[string]struct {
+		banner string
+		result string
+	}{
+		"none": {},
+		"text": {
+			banner: "Authorized access only\n",
+			result: "Authorized access only\r\n",
+		},
+		"variables": {
+			banner: "{{.Operator}} as {{.UserID}} on {{.DeviceID}}",
+			result: "operator@mender.io as user-id on device-id",
+		},
+		"file": {
+			banner: bannerFile,
+			result: "Device device-id\r\n",
+		},
+		"missing file": {
+			banner: path.Join(dir, "missing.txt"),
+		},
+		"invalid template": {
+			banner: "Hello {{.Operator",
+			result: "Hello {{.Operator",
+		},
+		"unknown variable": {
+			banner: "Hello {{.Nobody}}",
+			result: "Hello {{.Nobody}}",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := &MenderShellDaemon{
+				deviceId:            "device-id",
+				authorizedUserClaim: "email",
+				authenticatedUser:   "operator@mender.io",
+			}
+			assert.Equal(t, tc.result, string(d.sessionBanner(tc.banner, "user-id")))
+		})
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/filetransfer"
+	"github.com/mendersoftware/mender-shell/portforward"
+	"github.com/mendersoftware/mender-shell/shell"
+)
+
+// ProtocolVersion is the version of the protocol spoken with the server
+const ProtocolVersion = 1
+
+// The features the device supports, advertised to the server
+const (
+	FeatureShell          = "shell"
+	FeatureExec           = "exec"
+	FeatureFileTransfer   = "file_transfer"
+	FeaturePortForward    = "port_forward"
+	FeatureResumeSessions = "resume_sessions"
+)
+
+var (
+	ErrFeatureNotSupported = errors.New("the feature is not supported by the server")
+)
+
+var supportedFeatures = []string{
+	FeatureShell,
+	FeatureExec,
+	FeatureFileTransfer,
+	FeaturePortForward,
+	FeatureResumeSessions,
+}
+
+//the feature each message type belongs to
+var messageFeatures = map[string]string{
+	wsshell.MessageTypeSpawnShell:           FeatureShell,
+	wsshell.MessageTypeStopShell:            FeatureShell,
+	wsshell.MessageTypeShellCommand:         FeatureShell,
+	shell.MessageTypeResizeShell:            FeatureShell,
+	shell.MessageTypeExecCommand:            FeatureExec,
+	filetransfer.MessageTypeUploadStart:     FeatureFileTransfer,
+	filetransfer.MessageTypeUploadChunk:     FeatureFileTransfer,
+	filetransfer.MessageTypeDownloadRequest: FeatureFileTransfer,
+	portforward.MessageTypePortForwardOpen:  FeaturePortForward,
+	portforward.MessageTypePortForwardData:  FeaturePortForward,
+	portforward.MessageTypePortForwardClose: FeaturePortForward,
+	shell.MessageTypeResumeSessions:         FeatureResumeSessions,
+}
+
+// Capabilities are the protocol version and the features agreed on with
+// the server
+type Capabilities struct {
+	// false until the server answered the capabilities of the device; all
+	// the features are enabled meanwhile, for the servers which predate
+	// the negotiation
+	Negotiated      bool
+	ProtocolVersion int
+	Features        []string
+}
+
+// Supports returns true if the feature can be used with the server
+func (c Capabilities) Supports(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultCapabilities() Capabilities {
+	return Capabilities{
+		ProtocolVersion: ProtocolVersion,
+		Features:        append([]string{}, supportedFeatures...),
+	}
+}
+
+// Capabilities returns the protocol version and the features agreed on with
+// the server
+func (d *MenderShellDaemon) Capabilities() Capabilities {
+	d.capabilitiesMutex.Lock()
+	defer d.capabilitiesMutex.Unlock()
+	if d.capabilities == nil {
+		return defaultCapabilities()
+	}
+	c := *d.capabilities
+	c.Features = append([]string{}, c.Features...)
+	return c
+}
+
+//advertises the capabilities of the device on a new connection; until the
+//server answers all the features are enabled
+func (d *MenderShellDaemon) advertiseCapabilities(webSock *connection.Connection) error {
+	d.capabilitiesMutex.Lock()
+	d.capabilities = nil
+	d.capabilitiesMutex.Unlock()
+	return d.responseMessage(webSock, &shell.MenderShellMessage{
+		Type:   shell.MessageTypeCapabilities,
+		Status: wsshell.NormalMessage,
+		Properties: map[string]interface{}{
+			shell.PropertyProtocolVersion: ProtocolVersion,
+			shell.PropertyFeatures:        supportedFeatures,
+		},
+	})
+}
+
+//agrees on the lowest of the protocol versions, and on the features both the
+//device and the server support
+func (d *MenderShellDaemon) negotiateCapabilities(properties map[string]interface{}) {
+	version := ProtocolVersion
+	if v, ok := propertyInt64(properties, shell.PropertyProtocolVersion); ok && v > 0 && v < int64(version) {
+		version = int(v)
+	}
+	serverFeatures, _ := propertyStrings(properties, shell.PropertyFeatures)
+	capabilities := &Capabilities{
+		Negotiated:      true,
+		ProtocolVersion: version,
+	}
+	for _, feature := range supportedFeatures {
+		for _, f := range serverFeatures {
+			if f == feature {
+				capabilities.Features = append(capabilities.Features, feature)
+				break
+			}
+		}
+	}
+	log.Infof("negotiated protocol version %d with the server, features: %v", version, capabilities.Features)
+
+	d.capabilitiesMutex.Lock()
+	defer d.capabilitiesMutex.Unlock()
+	d.capabilities = capabilities
+}
+
+//rejects the messages of the features not agreed on with the server, with
+//an error message of the same type; returns false if the message was
+//rejected
+func (d *MenderShellDaemon) featureEnabled(webSock *connection.Connection, message *shell.MenderShellMessage) bool {
+	feature, ok := messageFeatures[message.Type]
+	if !ok {
+		return true
+	}
+	capabilities := d.Capabilities()
+	if !capabilities.Negotiated || capabilities.Supports(feature) {
+		return true
+	}
+	log.Warnf("rejecting the %s message: the %s feature was not agreed on with the server", message.Type, feature)
+	if webSock != nil {
+		d.responseMessage(webSock, &shell.MenderShellMessage{
+			Type:      message.Type,
+			Status:    wsshell.ErrorMessage,
+			SessionId: message.SessionId,
+			Data:      []byte(ErrFeatureNotSupported.Error() + ": " + feature),
+		})
+	}
+	return false
+}
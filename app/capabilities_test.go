@@ -0,0 +1,123 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/filetransfer"
+	"github.com/mendersoftware/mender-shell/shell"
+)
+
+func TestNegotiateCapabilities(t *testing.T) {
+	testCases := map[string]struct {
+		properties   map[string]interface{}
+		capabilities Capabilities
+	}{
+		"same version, all the features": {
+			properties: map[string]interface{}{
+				shell.PropertyProtocolVersion: int8(1),
+				shell.PropertyFeatures:        []interface{}{"shell", "exec", "file_transfer", "port_forward", "resume_sessions"},
+			},
+			capabilities: Capabilities{
+				Negotiated:      true,
+				ProtocolVersion: 1,
+				Features:        supportedFeatures,
+			},
+		},
+		"newer server": {
+			properties: map[string]interface{}{
+				shell.PropertyProtocolVersion: int8(3),
+				shell.PropertyFeatures:        []interface{}{"shell", "file_transfer", "x11_forward"},
+			},
+			capabilities: Capabilities{
+				Negotiated:      true,
+				ProtocolVersion: 1,
+				Features:        []string{FeatureShell, FeatureFileTransfer},
+			},
+		},
+		"no features": {
+			properties: map[string]interface{}{
+				shell.PropertyProtocolVersion: int8(1),
+			},
+			capabilities: Capabilities{
+				Negotiated:      true,
+				ProtocolVersion: 1,
+				Features:        []string{},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := &MenderShellDaemon{}
+			assert.Equal(t, defaultCapabilities(), d.Capabilities())
+			err := d.routeMessage(nil, &shell.MenderShellMessage{
+				Type:       shell.MessageTypeCapabilities,
+				Properties: tc.properties,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.capabilities, d.Capabilities())
+		})
+	}
+}
+
+func TestMenderShellCapabilities(t *testing.T) {
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{})
+	err := d.advertiseCapabilities(ws)
+	assert.NoError(t, err)
+	m := waitForIdleSessionMessage(shell.MessageTypeCapabilities, 4*time.Second)
+	if assert.NotNil(t, m) {
+		version, _ := propertyInt64(m.Properties, shell.PropertyProtocolVersion)
+		assert.Equal(t, int64(ProtocolVersion), version)
+		features, _ := propertyStrings(m.Properties, shell.PropertyFeatures)
+		assert.Equal(t, supportedFeatures, features)
+	}
+
+	//the servers which predate the negotiation get all the features
+	assert.False(t, d.Capabilities().Negotiated)
+	assert.True(t, d.featureEnabled(ws, &shell.MenderShellMessage{Type: filetransfer.MessageTypeUploadStart}))
+
+	err = d.routeMessage(ws, &shell.MenderShellMessage{
+		Type: shell.MessageTypeCapabilities,
+		Properties: map[string]interface{}{
+			shell.PropertyProtocolVersion: int8(1),
+			shell.PropertyFeatures:        []interface{}{FeatureShell},
+		},
+	})
+	assert.NoError(t, err)
+	assert.True(t, d.Capabilities().Negotiated)
+
+	err = d.routeMessage(ws, &shell.MenderShellMessage{
+		Type:      filetransfer.MessageTypeUploadStart,
+		SessionId: "upload-session",
+	})
+	assert.NoError(t, err)
+	m = waitForIdleSessionMessage(filetransfer.MessageTypeUploadStart, 4*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, "upload-session", m.SessionId)
+		assert.Equal(t, ErrFeatureNotSupported.Error()+": "+FeatureFileTransfer, string(m.Data))
+	}
+
+	//a new connection negotiates again
+	err = d.advertiseCapabilities(ws)
+	assert.NoError(t, err)
+	assert.False(t, d.Capabilities().Negotiated)
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mendersoftware/mender-shell/client/dbus"
+	"github.com/mendersoftware/mender-shell/client/mender"
+	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/deviceconnect"
+)
+
+// DefaultCheckTimeout is the time each step of the Check gets by default
+const DefaultCheckTimeout = 30 * time.Second
+
+// ErrCheckTimeout is returned when a step of the Check does not complete
+// in time
+var ErrCheckTimeout = errors.New("timed out")
+
+// ErrCheckFailed is returned when any step of the Check failed
+var ErrCheckFailed = errors.New("the check failed")
+
+//runs f, giving up after timeout; f keeps running in the background
+func withTimeout(timeout time.Duration, f func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return ErrCheckTimeout
+	}
+}
+
+// Check verifies the device can serve the sessions: it connects to the
+// Authentication Manager, fetches a JWT token and opens the websocket to the
+// server, the same way the daemon does. It prints a PASS or FAIL line for
+// every step to out, skipping the steps after a failure; each step gets up
+// to timeout. It is meant to run once, from the command line: what a timed
+// out step leaves behind is released at exit.
+func (d *MenderShellDaemon) Check(out io.Writer, timeout time.Duration) error {
+	var provider mender.TokenProvider
+	var jwtToken string
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{
+			name: "certificates",
+			run: func() error {
+				_, err := connection.LoadServerTrust(d.serverCertificate)
+				if err == nil && d.clientCertificate != "" {
+					_, err = connection.LoadClientCertificate(d.clientCertificate, d.clientKey, d.clientKeyPassphrase)
+				}
+				return err
+			},
+		},
+		{
+			name: "authentication manager",
+			run: func() (err error) {
+				if d.customTokenProvider != nil {
+					provider = d.customTokenProvider
+					return nil
+				}
+				var dbusAPI dbus.DBusAPI
+				if d.usesDBus() {
+					dbusAPI, err = dbus.GetDBusAPI()
+					if err != nil {
+						return err
+					}
+					loop := dbusAPI.MainLoopNew()
+					go dbusAPI.MainLoopRun(loop)
+				}
+				provider, err = d.connectAuthClient(dbusAPI)
+				return err
+			},
+		},
+		{
+			name: "JWT token",
+			run: func() (err error) {
+				jwtToken, err = provider.Refresh()
+				if err == nil && jwtToken == "" {
+					err = errors.New("the device is not authorized")
+				}
+				d.followServerOfToken(jwtToken)
+				return err
+			},
+		},
+		{
+			name: "websocket",
+			run: func() error {
+				webSock, err := deviceconnect.Connect(d.getServerUrl(), d.deviceConnectUrl, d.skipVerify, d.serverCertificate, jwtToken, d.connectionOptions()...)
+				if err != nil {
+					return err
+				}
+				return webSock.CloseNormally("check done")
+			},
+		},
+	}
+
+	var failed error
+	for _, step := range steps {
+		if failed != nil {
+			fmt.Fprintf(out, "SKIP %s\n", step.name)
+			continue
+		}
+		err := withTimeout(timeout, step.run)
+		if err != nil {
+			fmt.Fprintf(out, "FAIL %s: %s\n", step.name, err.Error())
+			failed = ErrCheckFailed
+			continue
+		}
+		fmt.Fprintf(out, "PASS %s\n", step.name)
+	}
+	return failed
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+
+	authmocks "github.com/mendersoftware/mender-shell/client/mender/mocks"
+	"github.com/mendersoftware/mender-shell/config"
+)
+
+func TestCheck(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.ReadMessage()
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "mender-shell-check")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := path.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("token"), 0600))
+	emptyTokenFile := path.Join(dir, "empty-token")
+	assert.NoError(t, ioutil.WriteFile(emptyTokenFile, []byte(""), 0600))
+
+	provider := &authmocks.TokenProvider{}
+	provider.On("Refresh").Return("token", nil)
+
+	testCases := map[string]struct {
+		serverURL string
+		tokenFile string
+		provider  *authmocks.TokenProvider
+		output    string
+		err       bool
+	}{
+		"ok": {
+			serverURL: s.URL,
+			tokenFile: tokenFile,
+			output: "PASS certificates\n" +
+				"PASS authentication manager\n" +
+				"PASS JWT token\n" +
+				"PASS websocket\n",
+		},
+		"token provider": {
+			serverURL: s.URL,
+			tokenFile: path.Join(dir, "missing"),
+			provider:  provider,
+			output: "PASS certificates\n" +
+				"PASS authentication manager\n" +
+				"PASS JWT token\n" +
+				"PASS websocket\n",
+		},
+		"no token file": {
+			serverURL: s.URL,
+			tokenFile: path.Join(dir, "missing"),
+			output: "PASS certificates\n" +
+				"FAIL authentication manager: ",
+			err: true,
+		},
+		"not authorized": {
+			serverURL: s.URL,
+			tokenFile: emptyTokenFile,
+			output: "PASS certificates\n" +
+				"PASS authentication manager\n" +
+				"FAIL JWT token: the device is not authorized\n" +
+				"SKIP websocket\n",
+			err: true,
+		},
+		"server unreachable": {
+			serverURL: "http://127.0.0.1:1",
+			tokenFile: tokenFile,
+			output: "PASS certificates\n" +
+				"PASS authentication manager\n" +
+				"PASS JWT token\n" +
+				"FAIL websocket: ",
+			err: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ServerURL:       tc.serverURL,
+					StaticTokenFile: tc.tokenFile,
+				},
+			})
+			if tc.provider != nil {
+				d.SetTokenProvider(tc.provider)
+			}
+			var out bytes.Buffer
+			err := d.Check(&out, 4*time.Second)
+			if tc.err {
+				assert.Equal(t, ErrCheckFailed, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Contains(t, out.String(), tc.output)
+		})
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	err := withTimeout(time.Second, func() error {
+		return nil
+	})
+	assert.NoError(t, err)
+
+	err = withTimeout(100*time.Millisecond, func() error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	assert.Equal(t, ErrCheckTimeout, err)
+}
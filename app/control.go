@@ -0,0 +1,76 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-shell/control"
+)
+
+var errNotConnected = errors.New("not connected")
+
+//the commands of the control socket, answered from the same session
+//registry, connection state and metrics the daemon uses; they run on the
+//goroutines of the control socket, so they read them only through the
+//locked session registry and the getters of the daemon
+func (d *MenderShellDaemon) controlCommands() map[string]control.Command {
+	return map[string]control.Command{
+		"sessions": func(out io.Writer, args []string) error {
+			for _, s := range d.activeSessions() {
+				fmt.Fprintf(out, "%s %s %s\n", s.SessionID, s.UserID, s.StartedAt)
+			}
+			return nil
+		},
+		"state": func(out io.Writer, args []string) error {
+			fmt.Fprintf(out, "%s %s%s\n", d.ConnectionState().String(), d.getServerUrl(), d.deviceConnectUrl)
+			return nil
+		},
+		"metrics": func(out io.Writer, args []string) error {
+			_, err := d.metrics.WriteTo(out)
+			return err
+		},
+		"reconnect": func(out io.Writer, args []string) error {
+			return d.forceReconnect()
+		},
+	}
+}
+
+//closes the websocket, so that the main loop reconnects to the server
+func (d *MenderShellDaemon) forceReconnect() error {
+	webSock := d.getWebSock()
+	if webSock == nil {
+		return errNotConnected
+	}
+	log.Info("reconnect requested over the control socket")
+	return webSock.Close()
+}
+
+//serves the control socket, if enabled; it returns nil if it is not
+func (d *MenderShellDaemon) startControlSocket() *control.Server {
+	if d.controlSocket == "" {
+		return nil
+	}
+	server := control.NewServer(d.controlSocket, d.controlCommands())
+	if err := server.Start(); err != nil {
+		log.Errorf("failed to serve the control socket %s: %s", d.controlSocket, err.Error())
+		return nil
+	}
+	log.Infof("serving the control socket %s", d.controlSocket)
+	return server
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/session"
+)
+
+func TestControlCommands(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ServerURL: "https://mender.io",
+		},
+	})
+	commands := d.controlCommands()
+
+	out := &bytes.Buffer{}
+	assert.NoError(t, commands["state"](out, nil))
+	assert.Equal(t, "Disconnected https://mender.io"+config.DefaultDeviceConnectPath+"\n", out.String())
+
+	out.Reset()
+	d.metrics.Reconnected()
+	assert.NoError(t, commands["metrics"](out, nil))
+	assert.Contains(t, out.String(), "mender_shell_reconnects_total 1\n")
+
+	out.Reset()
+	assert.NoError(t, commands["sessions"](out, nil))
+	assert.Equal(t, "", out.String())
+
+	assert.Equal(t, errNotConnected, commands["reconnect"](out, nil))
+
+	s := httptest.NewServer(http.HandlerFunc(oneMsgMainServerLoop))
+	defer s.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+	assert.NoError(t, err)
+	webSock, err := connection.NewConnection(*u, "token", time.Second, 526, time.Second, true, "")
+	assert.NoError(t, err)
+	d.setWebSock(webSock)
+	assert.NoError(t, commands["reconnect"](out, nil))
+	assert.Error(t, webSock.WriteMessage(&ws.ProtoMsg{}))
+}
+
+func TestControlCommandsWhileSessionsChange(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ServerURL: "https://mender.io",
+		},
+	})
+	commands := d.controlCommands()
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 8
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			s, err := d.sessions.NewMenderShellSession(&sync.Mutex{}, nil, "user-id-control",
+				session.NoExpirationTimeout, session.NoExpirationTimeout)
+			if assert.NoError(t, err) {
+				d.sessions.MenderShellDeleteById(s.GetId())
+			}
+			d.setServerUrl(fmt.Sprintf("https://%d.mender.io", i))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		assert.NoError(t, commands["sessions"](ioutil.Discard, nil))
+		assert.NoError(t, commands["state"](ioutil.Discard, nil))
+	}
+}
+
+func TestStartControlSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "control.sock")
+
+	d := NewDaemon(&config.MenderShellConfig{})
+	assert.Nil(t, d.startControlSocket())
+
+	d.controlSocket = socket
+	server := d.startControlSocket()
+	if !assert.NotNil(t, server) {
+		return
+	}
+	defer server.Stop()
+
+	conn, err := net.Dial("unix", socket)
+	assert.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintln(conn, "state")
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, "Disconnected "))
+	line, err = reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "OK\n", line)
+
+	d.controlSocket = path.Join(dir, "missing", "control.sock")
+	assert.Nil(t, d.startControlSocket())
+}
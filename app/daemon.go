@@ -14,9 +14,17 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"os/user"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,77 +33,498 @@ import (
 	"github.com/mendersoftware/go-lib-micro/ws"
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 
+	"github.com/mendersoftware/mender-shell/cgroup"
 	"github.com/mendersoftware/mender-shell/client/dbus"
 	"github.com/mendersoftware/mender-shell/client/mender"
 	configuration "github.com/mendersoftware/mender-shell/config"
 	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/dbusapi"
 	"github.com/mendersoftware/mender-shell/deviceconnect"
+	"github.com/mendersoftware/mender-shell/filetransfer"
+	"github.com/mendersoftware/mender-shell/logging"
+	"github.com/mendersoftware/mender-shell/metrics"
+	"github.com/mendersoftware/mender-shell/portforward"
 	"github.com/mendersoftware/mender-shell/procps"
 	"github.com/mendersoftware/mender-shell/session"
 	"github.com/mendersoftware/mender-shell/shell"
+	"github.com/mendersoftware/mender-shell/systemd"
 )
 
-var lastExpiredSessionSweep = time.Now()
+const metricsPath = "/metrics"
+
+// RestrictedShellCommandName is the mender-shell command run as the shell of
+// the sessions in the restricted shell mode
+const RestrictedShellCommandName = "restricted-shell"
+
+// NamespaceInitCommandName is the mender-shell command setting the session
+// namespaces up before running the shell in them
+const NamespaceInitCommandName = "namespace-init"
+
+//max bytes of the command output sent in a single message
+const commandOutputChunkSize = 4096
+
+//room for the header of a message read from the server, i.e.: the type,
+//the session id and the properties, on top of its data
+const messageHeaderSize = 1024
+
 var expiredSessionsSweepFrequency = time.Second * 32
 
 var (
 	ErrNilParameterUnexpected = errors.New("unexpected nil parameter")
+	ErrUserNotAuthorized      = errors.New("user not authorized to open a shell")
+	ErrShellDisabled          = errors.New("the shell is disabled on the device")
+	ErrShuttingDown           = errors.New("shutting down")
 )
 
+// SessionTimedOutMessage is the reason sent with the stop shell message
+// when a session is terminated because of the idle timeout
+const SessionTimedOutMessage = "session timed out"
+
+// SessionMaxDurationMessage is the reason sent with the stop shell message
+// when a session is terminated because it reached the max session duration
+const SessionMaxDurationMessage = "session reached the max duration"
+
+// ShellExitedMessage is the reason sent with the stop shell message when a
+// session is closed because its shell exited
+const ShellExitedMessage = "the shell exited"
+
+// ShellCrashedMessage is the reason sent with the stop shell message when a
+// session is closed because its shell crashed
+const ShellCrashedMessage = "the shell crashed"
+
+//times the crashed shell of a session is respawned at most, so a shell
+//crashing right away is not started over and over
+const maxShellRespawns = 3
+
+// SessionAbandonedMessage is the reason sent with the stop shell message when
+// a session is terminated because no input was received since it was opened
+const SessionAbandonedMessage = "no input received since the session was opened"
+
+// SessionKilledMessage is the reason sent with the stop shell message when a
+// session is killed on the device, e.g.: over DBus
+const SessionKilledMessage = "session killed on the device"
+
+// SessionShutdownMessage is shown in the terminals of the sessions, and sent
+// as the reason with the stop shell message, when the daemon shuts down
+const SessionShutdownMessage = "mender-shell is shutting down"
+
+// SessionRevokedMessage is the reason sent with the stop shell message when a
+// session is revoked by the server, or because the device is not authorized
+// anymore
+const SessionRevokedMessage = "session revoked"
+
 type MenderShellDaemon struct {
-	writeMutex              *sync.Mutex
-	stop                    bool
-	printStatus             bool
-	username                string
-	shell                   string
-	serverUrl               string
-	serverCertificate       string
-	skipVerify              bool
-	deviceConnectUrl        string
-	expireSessionsAfter     time.Duration
-	expireSessionsAfterIdle time.Duration
-	terminalString          string
-	terminalWidth           uint16
-	terminalHeight          uint16
-	uid                     uint64
-	gid                     uint64
-	shellsSpawned           uint
-	debug                   bool
+	writeMutex             *sync.Mutex
+	webSockMutex           sync.Mutex
+	webSock                *connection.Connection
+	connectionState        *connection.StateMachine
+	reconnectBackoff       connection.Backoff
+	reconnectBreaker       connection.CircuitBreaker
+	shutdown               context.Context
+	cancelShutdown         context.CancelFunc
+	shutdownOnce           sync.Once
+	readyOnce              sync.Once
+	capabilities           *Capabilities
+	capabilitiesMutex      sync.Mutex
+	watchdogInterval       time.Duration
+	lastWatchdogPing       time.Time
+	tokenProvider          mender.TokenProvider
+	deviceIdentity         string
+	customTokenProvider    mender.TokenProvider
+	dialer                 connection.Dialer
+	idleTimeoutGracePeriod time.Duration
+	maxDurationWarning     time.Duration
+	pingInterval           time.Duration
+	pingTimeout            time.Duration
+	connectTimeout         time.Duration
+	writeTimeout           time.Duration
+	tcpKeepAliveIdle       time.Duration
+	tcpKeepAliveInterval   time.Duration
+	tcpKeepAliveCount      int
+	enableCompression      bool
+	compressionThreshold   int
+	flowControlWindow      int
+	metrics                *metrics.Metrics
+	metricsBindAddress     string
+	sessions               *session.Registry
+	lastSessionSweep       time.Time
+	diagnosticsDir         string
+	dumpingDiagnostics     int32
+	controlSocket          string
+	stop                   bool
+	printStatus            bool
+	config                 *configuration.MenderShellConfig
+	reloadConfigMutex      sync.Mutex
+	reloadConfigFile       string
+	live                   *liveConfig
+	liveMutex              sync.RWMutex
+	killSessionsMutex      sync.Mutex
+	killSessions           []string
+	handoverRequested      bool
+	handoverMutex          sync.Mutex
+	uploadChunkSize        int64
+	maxMessageSize         int64
+	uploads                map[string]*filetransfer.Upload
+	uploadsMutex           sync.Mutex
+	portForwards           map[string]*portforward.Forward
+	portForwardsMutex      sync.Mutex
+	serverUrl              string
+	serverUrlMutex         sync.Mutex
+	followTokenServer      bool
+	serverCertificate      string
+	pinServerCertificate   bool
+	serverPublicKey        string
+	staticTokenFile        string
+	authenticatedUser      string
+	deviceId               string
+	authorizedUserClaim    string
+	authenticatedClaims    map[string]interface{}
+	skipVerify             bool
+	proxy                  *url.URL
+	socks5Proxy            *url.URL
+	bindInterface          string
+	bindAddress            net.IP
+	dialNetwork            string
+	tokenQueryParameter    string
+	minTLSVersion          uint16
+	tlsCipherSuites        []uint16
+	clientCertificate      string
+	clientKey              string
+	clientKeyPassphrase    string
+	deviceConnectUrl       string
+	terminalString         string
+	shellsSpawned          uint
+	shellsMutex            sync.Mutex
+	dbusMethodTimeout      time.Duration
+	dbusRetries            int
+	tokenRefreshJitter     float64
+	authManagerWaitTimeout time.Duration
+	debug                  bool
+	keepLogging            bool
+	lifecycleObserver      LifecycleObserver
+	disconnectError        error
+	disconnectErrorMutex   sync.Mutex
+	stats                  stats
 }
 
 func NewDaemon(config *configuration.MenderShellConfig) *MenderShellDaemon {
 	daemon := MenderShellDaemon{
-		writeMutex:              &sync.Mutex{},
-		stop:                    false,
-		username:                config.User,
-		shell:                   config.ShellCommand,
-		serverUrl:               config.ServerURL,
-		serverCertificate:       config.ServerCertificate,
-		skipVerify:              config.SkipVerify,
-		expireSessionsAfter:     time.Second * time.Duration(config.Sessions.ExpireAfter),
-		expireSessionsAfterIdle: time.Second * time.Duration(config.Sessions.ExpireAfterIdle),
-		deviceConnectUrl:        configuration.DefaultDeviceConnectPath,
-		terminalString:          configuration.DefaultTerminalString,
-		terminalWidth:           config.Terminal.Width,
-		terminalHeight:          config.Terminal.Height,
-		shellsSpawned:           0,
-		debug:                   true,
-	}
-
-	if config.Sessions.MaxPerUser > 0 {
-		session.MaxUserSessions = int(config.Sessions.MaxPerUser)
+		writeMutex:             &sync.Mutex{},
+		stop:                   false,
+		config:                 config,
+		live:                   newLiveConfig(config),
+		uploadChunkSize:        config.FileTransfer.ChunkSize,
+		maxMessageSize:         config.MaxMessageBytes,
+		uploads:                map[string]*filetransfer.Upload{},
+		authorizedUserClaim:    config.AuthorizedUserClaim,
+		portForwards:           map[string]*portforward.Forward{},
+		serverUrl:              config.ServerURL,
+		serverCertificate:      config.ServerCertificate,
+		pinServerCertificate:   config.PinServerCertificate,
+		serverPublicKey:        config.ServerPublicKey,
+		staticTokenFile:        config.StaticTokenFile,
+		skipVerify:             config.SkipVerify,
+		proxy:                  config.ProxyURL(),
+		socks5Proxy:            config.Socks5ProxyURL(),
+		bindInterface:          config.BindInterface,
+		bindAddress:            config.BindIP(),
+		dialNetwork:            config.DialNetwork,
+		followTokenServer:      config.FollowTokenServer,
+		clientCertificate:      config.ClientCertificate,
+		clientKey:              config.ClientKey,
+		clientKeyPassphrase:    config.ClientKeyPassphrase,
+		deviceConnectUrl:       configuration.DefaultDeviceConnectPath,
+		terminalString:         configuration.DefaultTerminalString,
+		idleTimeoutGracePeriod: configuration.IdleTimeoutGracePeriod,
+		maxDurationWarning:     configuration.MaxSessionDurationWarning,
+		pingInterval:           time.Second * time.Duration(config.PingIntervalSeconds),
+		pingTimeout:            time.Second * time.Duration(config.PingTimeoutSeconds),
+		connectTimeout:         time.Second * time.Duration(config.ConnectTimeoutSeconds),
+		writeTimeout:           time.Second * time.Duration(config.WriteTimeoutSeconds),
+		tcpKeepAliveIdle:       time.Second * time.Duration(config.TCPKeepAliveIdleSeconds),
+		tcpKeepAliveInterval:   time.Second * time.Duration(config.TCPKeepAliveIntervalSeconds),
+		tcpKeepAliveCount:      int(config.TCPKeepAliveCount),
+		enableCompression:      config.EnableCompression,
+		compressionThreshold:   int(config.CompressionThreshold),
+		flowControlWindow:      int(config.FlowControlWindowBytes),
+		connectionState:        connection.NewStateMachine(),
+		metrics:                metrics.NewMetrics(),
+		metricsBindAddress:     config.MetricsBindAddress,
+		diagnosticsDir:         config.DiagnosticsDir,
+		controlSocket:          config.ControlSocket,
+		shellsSpawned:          0,
+		dbusMethodTimeout:      time.Second * time.Duration(config.DBusMethodTimeout),
+		dbusRetries:            int(config.DBusTransientErrorRetries),
+		tokenRefreshJitter:     float64(config.TokenRefreshJitterPercent) / 100,
+		authManagerWaitTimeout: time.Second * time.Duration(config.AuthManagerWaitTimeoutSeconds),
+		debug:                  true,
+	}
+
+	daemon.shutdown, daemon.cancelShutdown = context.WithCancel(context.Background())
+	daemon.configureReconnect(config)
+	daemon.sessions = session.NewRegistry(daemon.metrics)
+	daemon.lastSessionSweep = time.Now()
+	daemon.configureSessions(config)
+	daemon.connectionState.Subscribe(func(t connection.Transition) {
+		log.WithField(logging.EventField, logging.EventConnectionState).
+			Infof("connection state: %s -> %s", t.From, t.To)
+		daemon.notifyConnectionState(t.To)
+		daemon.observeTransition(t)
+	})
+	if daemon.uploadChunkSize <= 0 {
+		daemon.uploadChunkSize = configuration.DefaultFileTransferChunkSize
+	}
+	if daemon.maxMessageSize <= 0 {
+		daemon.maxMessageSize = configuration.DefaultMaxMessageSize
+	}
+	if daemon.pingInterval == 0 {
+		daemon.pingInterval = configuration.DefaultPingInterval
+	}
+	if daemon.pingTimeout == 0 {
+		daemon.pingTimeout = configuration.DefaultPingTimeout
+	}
+	if daemon.connectTimeout == 0 {
+		daemon.connectTimeout = configuration.DefaultConnectTimeout
+	}
+	if daemon.writeTimeout == 0 {
+		daemon.writeTimeout = configuration.DefaultWriteTimeout
+	}
+	if !config.TCPKeepAliveEnabled() {
+		//no probes
+		daemon.tcpKeepAliveIdle = 0
+	} else if daemon.tcpKeepAliveIdle == 0 {
+		daemon.tcpKeepAliveIdle = configuration.DefaultTCPKeepAliveIdle
+	}
+	if daemon.tcpKeepAliveInterval == 0 {
+		daemon.tcpKeepAliveInterval = configuration.DefaultTCPKeepAliveInterval
+	}
+	if daemon.tcpKeepAliveCount == 0 {
+		daemon.tcpKeepAliveCount = configuration.DefaultTCPKeepAliveCount
+	}
+	if daemon.compressionThreshold == 0 {
+		daemon.compressionThreshold = configuration.DefaultCompressionThreshold
+	}
+	if daemon.authManagerWaitTimeout == 0 {
+		daemon.authManagerWaitTimeout = configuration.DefaultAuthManagerWaitTimeout
+	}
+	//the TLS settings are validated with the configuration
+	if version, err := connection.TLSVersion(config.MinTLSVersion); err == nil {
+		daemon.minTLSVersion = version
+	} else {
+		daemon.minTLSVersion, _ = connection.TLSVersion(connection.DefaultMinTLSVersion)
+	}
+	daemon.tlsCipherSuites, _ = connection.CipherSuites(config.TLSCipherSuites)
+	//the token goes in the Authorization header, unless a query parameter is set
+	if config.TokenPlacement == connection.TokenInQuery {
+		daemon.tokenQueryParameter = config.TokenQueryParameter
+		if daemon.tokenQueryParameter == "" {
+			daemon.tokenQueryParameter = connection.DefaultTokenQueryParameter
+		}
 	}
 	return &daemon
 }
 
+//sets the delays between the reconnect attempts
+func (d *MenderShellDaemon) configureReconnect(config *configuration.MenderShellConfig) {
+	stableAfter := time.Second * time.Duration(config.ReconnectStableSeconds)
+	if stableAfter == 0 {
+		stableAfter = configuration.DefaultReconnectStable
+	}
+	d.reconnectBackoff.SetIntervals(
+		time.Second*time.Duration(config.ReconnectIntervalMin),
+		time.Second*time.Duration(config.ReconnectIntervalMax),
+		stableAfter,
+	)
+	d.reconnectBreaker.SetLimits(
+		uint(config.ReconnectFailureThreshold),
+		time.Second*time.Duration(config.ReconnectCooldownSeconds),
+	)
+}
+
+//sets the session limits and settings, applied to the new sessions
+func (d *MenderShellDaemon) configureSessions(config *configuration.MenderShellConfig) {
+	if config.LogSessionCommands {
+		log.Warnf("the command lines entered in the sessions are logged")
+	}
+	sessionCgroup := ""
+	if config.SessionCgroup != "" {
+		if err := cgroup.Check(config.SessionCgroup); err != nil {
+			log.Warnf("the shells will not be moved to the cgroup %s: %s",
+				config.SessionCgroup, err.Error())
+		} else {
+			sessionCgroup = config.SessionCgroup
+		}
+	}
+	namespaces := sessionNamespaces(config.SessionNamespaces, sessionCgroup)
+	//the sessions starting meanwhile see either the old or the new settings
+	d.sessions.Configure(func(settings *session.Settings) {
+		if config.Sessions.MaxPerUser > 0 {
+			settings.MaxUserSessions = int(config.Sessions.MaxPerUser)
+		}
+		if config.MaxSessions > 0 {
+			settings.MaxSessions = int(config.MaxSessions)
+		} else {
+			settings.MaxSessions = configuration.DefaultMaxSessions
+		}
+		settings.RecordingDir = config.SessionRecordingDir
+		settings.CommandLogging = config.LogSessionCommands
+		settings.PreSessionScript = config.PreSessionScript
+		settings.PostSessionScript = config.PostSessionScript
+		if config.SessionScriptTimeoutSeconds > 0 {
+			settings.SessionScriptTimeout = time.Second * time.Duration(config.SessionScriptTimeoutSeconds)
+		} else {
+			settings.SessionScriptTimeout = configuration.DefaultSessionScriptTimeout
+		}
+		settings.MaxOutputBytesPerSecond = config.MaxOutputBytesPerSecond
+		settings.MaxInputBytesPerSecond = config.MaxInputBytesPerSecond
+		settings.MaxInputMessageSize = int(config.MaxInputMessageBytes)
+		if config.Sessions.ScrollbackBytes > 0 {
+			settings.ScrollbackSize = int(config.Sessions.ScrollbackBytes)
+		} else {
+			settings.ScrollbackSize = configuration.DefaultScrollbackSize
+		}
+		if config.PtyReadBufferBytes > 0 {
+			settings.PtyReadBufferSize = int(config.PtyReadBufferBytes)
+		} else {
+			settings.PtyReadBufferSize = shell.DefaultReadBufferSize
+		}
+		if config.OutputBufferBytes > 0 {
+			settings.OutputBufferSize = int(config.OutputBufferBytes)
+		} else {
+			settings.OutputBufferSize = configuration.DefaultOutputBufferSize
+		}
+		if config.OutputFlushIntervalMilliseconds > 0 {
+			settings.OutputFlushInterval = time.Millisecond * time.Duration(config.OutputFlushIntervalMilliseconds)
+		} else {
+			settings.OutputFlushInterval = configuration.DefaultOutputFlushInterval
+		}
+		if config.OutputQueueLength > 0 {
+			settings.OutputQueueLength = int(config.OutputQueueLength)
+		} else {
+			settings.OutputQueueLength = configuration.DefaultOutputQueueLength
+		}
+		settings.UTF8SafeOutput = !config.RawOutputFraming
+		settings.SanitizeOutput = config.SanitizeOutput
+		settings.InterceptInterrupt = config.InterceptInterrupt
+		settings.Cgroup = sessionCgroup
+		settings.Namespaces = namespaces
+	})
+}
+
+//the namespaces and the cgroup the shells start in, through the
+//namespace-init command of mender-shell itself; nil if none, or if the
+//namespaces are not supported and there is no cgroup. Without the command
+//the shells are moved to the cgroup once they started
+func sessionNamespaces(names []string, cgroupDir string) *shell.Namespaces {
+	flags, err := shell.NamespaceFlags(names)
+	if err != nil {
+		flags = 0
+	}
+	if flags != 0 {
+		if err := shell.CheckNamespaces(flags); err != nil {
+			log.Warnf("the shells will not run in the %s namespaces: %s", strings.Join(names, ", "), err.Error())
+			flags = 0
+		}
+	}
+	if flags == 0 && cgroupDir == "" {
+		return nil
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		log.Warnf("the shells will not run in the %s namespaces, nor start in the cgroup: %s",
+			strings.Join(names, ", "), err.Error())
+		return nil
+	}
+	return &shell.Namespaces{Flags: flags, Init: []string{executable, NamespaceInitCommandName}, Cgroup: cgroupDir}
+}
+
 func (d *MenderShellDaemon) StopDaemon() {
 	d.stop = true
+	d.setConnectionState(connection.StateShuttingDown)
+	if d.cancelShutdown != nil {
+		d.cancelShutdown()
+	}
+}
+
+//waits for the given delay, returns false if the daemon started shutting
+//down in the meantime
+func (d *MenderShellDaemon) waitOrShutdown(delay time.Duration) bool {
+	var done <-chan struct{}
+	if d.shutdown != nil {
+		done = d.shutdown.Done()
+	}
+	select {
+	case <-time.After(delay):
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// ConnectionState returns the current state of the connection to the server
+func (d *MenderShellDaemon) ConnectionState() connection.State {
+	if d.connectionState == nil {
+		return connection.StateDisconnected
+	}
+	return d.connectionState.CurrentState()
+}
+
+//moves the connection to the given state; once shutting down the daemon
+//stays there, so the refused transitions are only logged
+func (d *MenderShellDaemon) setConnectionState(state connection.State) {
+	if d.connectionState == nil {
+		return
+	}
+	if err := d.connectionState.Transition(state); err != nil {
+		log.Debugf("connection state: %s", err.Error())
+	}
 }
 
 func (d *MenderShellDaemon) PrintStatus() {
 	d.printStatus = true
 }
 
+// ReloadConfig makes the daemon reload its configuration from the given file
+func (d *MenderShellDaemon) ReloadConfig(path string) {
+	d.reloadConfigMutex.Lock()
+	defer d.reloadConfigMutex.Unlock()
+	d.reloadConfigFile = path
+}
+
+// KillSession makes the daemon terminate the session, telling the server;
+// it fails if there is no such active session. It is called from the D-Bus
+// thread: the session is looked up through the locked session registry, and
+// the main loop terminates it
+func (d *MenderShellDaemon) KillSession(sessionId string) error {
+	s := d.sessions.MenderShellSessionGetById(sessionId)
+	if s == nil {
+		return session.ErrSessionNotFound
+	}
+	if status := s.GetStatus(); status != session.ActiveSession && status != session.HangedSession {
+		return session.ErrSessionShellNotRunning
+	}
+	d.killSessionsMutex.Lock()
+	defer d.killSessionsMutex.Unlock()
+	d.killSessions = append(d.killSessions, sessionId)
+	return nil
+}
+
+func (d *MenderShellDaemon) sessionsToKill() []string {
+	d.killSessionsMutex.Lock()
+	defer d.killSessionsMutex.Unlock()
+	ids := d.killSessions
+	d.killSessions = nil
+	return ids
+}
+
+func (d *MenderShellDaemon) shouldReloadConfig() string {
+	d.reloadConfigMutex.Lock()
+	defer d.reloadConfigMutex.Unlock()
+	path := d.reloadConfigFile
+	d.reloadConfigFile = ""
+	return path
+}
+
 func (d *MenderShellDaemon) shouldStop() bool {
 	return d.stop
 }
@@ -105,317 +534,1518 @@ func (d *MenderShellDaemon) shouldPrintStatus() bool {
 }
 
 func (d *MenderShellDaemon) timeToSweepSessions() bool {
-	if d.expireSessionsAfter == time.Duration(0) && d.expireSessionsAfterIdle == time.Duration(0) {
+	live := d.liveConfig()
+	if live.expireSessionsAfter == time.Duration(0) && live.expireSessionsAfterIdle == time.Duration(0) {
 		return false
 	}
 
 	now := time.Now()
-	nextSweepAt := lastExpiredSessionSweep.Add(expiredSessionsSweepFrequency)
+	nextSweepAt := d.lastSessionSweep.Add(expiredSessionsSweepFrequency)
 	if now.After(nextSweepAt) {
-		lastExpiredSessionSweep = now
+		d.lastSessionSweep = now
 		return true
 	} else {
 		return false
 	}
 }
 
+func (d *MenderShellDaemon) getWebSock() *connection.Connection {
+	d.webSockMutex.Lock()
+	defer d.webSockMutex.Unlock()
+	return d.webSock
+}
+
+func (d *MenderShellDaemon) setWebSock(webSock *connection.Connection) {
+	d.webSockMutex.Lock()
+	defer d.webSockMutex.Unlock()
+	d.webSock = webSock
+}
+
+//the server URL changes when the device follows its token to another
+//server, while the control socket and the diagnostics read it
+func (d *MenderShellDaemon) getServerUrl() string {
+	d.serverUrlMutex.Lock()
+	defer d.serverUrlMutex.Unlock()
+	return d.serverUrl
+}
+
+func (d *MenderShellDaemon) setServerUrl(serverUrl string) {
+	d.serverUrlMutex.Lock()
+	defer d.serverUrlMutex.Unlock()
+	d.serverUrl = serverUrl
+}
+
+//the max size of the messages read from the server: MaxMessageBytes, or an
+//upload chunk with its header if bigger, when the uploads are enabled
+func (d *MenderShellDaemon) readLimit() int64 {
+	live := d.liveConfig()
+	limit := d.maxMessageSize
+	if len(live.uploadPaths) > 0 && d.uploadChunkSize+messageHeaderSize > limit {
+		limit = d.uploadChunkSize + messageHeaderSize
+	}
+	return limit
+}
+
+//the options of the websocket connections to the server; without a
+//configured proxy the connection honors the proxy environment variables,
+//the client certificate is reloaded on every connection
+func (d *MenderShellDaemon) connectionOptions() []connection.Option {
+	opts := []connection.Option{connection.WithConnectTimeout(d.connectTimeout)}
+	if d.proxy != nil {
+		opts = append(opts, connection.WithProxy(d.proxy))
+	}
+	if d.socks5Proxy != nil {
+		opts = append(opts, connection.WithSOCKS5Proxy(d.socks5Proxy))
+	}
+	if d.pinServerCertificate {
+		opts = append(opts, connection.WithPinnedServerCertificate(d.serverCertificate))
+	}
+	if d.clientCertificate != "" {
+		opts = append(opts, connection.WithClientCertificate(d.clientCertificate, d.clientKey, d.clientKeyPassphrase))
+	}
+	if d.bindInterface != "" || d.bindAddress != nil {
+		opts = append(opts, connection.WithBind(d.bindInterface, d.bindAddress))
+	}
+	if d.dialNetwork != "" {
+		opts = append(opts, connection.WithDialNetwork(d.dialNetwork))
+	}
+	if d.dialer != nil {
+		opts = append(opts, connection.WithDialer(d.dialer))
+	}
+	if d.tokenQueryParameter != "" {
+		opts = append(opts, connection.WithTokenInQuery(d.tokenQueryParameter))
+	}
+	opts = append(opts, connection.WithTLS(d.minTLSVersion, d.tlsCipherSuites))
+	opts = append(opts, connection.WithTCPKeepAlive(d.tcpKeepAliveIdle, d.tcpKeepAliveInterval, d.tcpKeepAliveCount))
+	if d.enableCompression {
+		opts = append(opts, connection.WithCompression())
+	}
+	if d.deviceIdentity != "" {
+		opts = append(opts, connection.WithHeader(deviceconnect.DeviceIdentityHeader, d.deviceIdentity))
+	}
+	return opts
+}
+
+//the device identity sent to the server with the websocket handshake, as a
+//JSON object; empty if the token provider can't tell it, the connection
+//goes on without it
+func deviceIdentity(provider mender.TokenProvider) string {
+	identityProvider, ok := provider.(mender.DeviceIdentityProvider)
+	if !ok {
+		return ""
+	}
+	identity, err := identityProvider.GetDeviceIdentity()
+	if err != nil {
+		log.Warnf("can't get the device identity, connecting without it: %s", err.Error())
+		return ""
+	}
+	data, err := json.Marshal(identity)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+//serves the metrics on d.metricsBindAddress, at the /metrics path
+func (d *MenderShellDaemon) startMetricsServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, d.metrics)
+	server := &http.Server{
+		Addr:    d.metricsBindAddress,
+		Handler: mux,
+	}
+	go func() {
+		log.Infof("serving the metrics on %s%s", d.metricsBindAddress, metricsPath)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("failed to serve the metrics on %s: %s", d.metricsBindAddress, err.Error())
+		}
+	}()
+	return server
+}
+
+//stores the user named by the AuthorizedUserClaim of the JWT token, if set,
+//and the claims of the token the message policy is checked against
+func (d *MenderShellDaemon) setAuthenticatedUser(jwtToken string) {
+	d.authenticatedUser = ""
+	if d.authorizedUserClaim != "" {
+		user, err := mender.GetJWTTokenClaim(jwtToken, d.authorizedUserClaim)
+		if err != nil {
+			log.Debugf("can't get the %s claim of the JWT token: %s", d.authorizedUserClaim, err.Error())
+		}
+		d.authenticatedUser = user
+	}
+	d.authenticatedClaims, _ = mender.GetJWTTokenClaims(jwtToken)
+	//the subject of the device token is the device id
+	d.deviceId, _ = mender.GetJWTTokenSubject(jwtToken)
+}
+
+//returns the user the server opens the shell of userId for: the one named
+//by the AuthorizedUserClaim of the JWT token if set, userId otherwise
+func (d *MenderShellDaemon) operator(userId string) string {
+	if d.authorizedUserClaim != "" {
+		return d.authenticatedUser
+	}
+	return userId
+}
+
+//returns true if the operator can open a shell; any user can if the
+//authorized users are not configured
+func (c *liveConfig) userAuthorized(operator string) bool {
+	if len(c.authorizedUsers) == 0 {
+		return true
+	}
+	for _, user := range c.authorizedUsers {
+		if user == operator {
+			return true
+		}
+	}
+	return false
+}
+
+//returns a fresh JWT token to re-authenticate with after losing the connection,
+//falls back to the given token if a new one can't be obtained; the sessions
+//are revoked if the device is not authorized anymore
+func (d *MenderShellDaemon) refreshJWTToken(token string) string {
+	if d.tokenProvider == nil {
+		return token
+	}
+	newToken, err := d.tokenProvider.Refresh()
+	if err == nil && newToken == "" {
+		err = mender.ErrUnauthorized
+	}
+	if errors.Is(err, mender.ErrUnauthorized) {
+		//retrying does not help: the sessions are not kept for a resume
+		//the device is not authorized for anymore; the connection is lost
+		//already, the server closes them on its side
+		log.WithField(logging.EventField, logging.EventAuthFailed).
+			Warnf("main-loop: the device is not authorized anymore, revoking all the sessions: %v", err)
+		d.revokeSessions(nil, nil, "")
+		return token
+	}
+	if err != nil {
+		log.Warnf("main-loop: failed to fetch a new JWT token, using the current one: %v", err)
+		if newToken, err = d.tokenProvider.Token(); err != nil || newToken == "" {
+			return token
+		}
+		return newToken
+	}
+	d.metrics.TokenRefreshed()
+	return newToken
+}
+
+//switches to the server the JWT token was issued for, if followTokenServer
+//is set and the token names a server other than the current one; the new
+//server is used from the next connection on
+func (d *MenderShellDaemon) followServerOfToken(token string) {
+	if !d.followTokenServer || token == "" {
+		return
+	}
+	currentURL := d.getServerUrl()
+	serverURL, err := mender.GetJWTTokenServerURL(token)
+	if err != nil {
+		log.Debugf("can't get the server of the JWT token, keeping %s: %s", currentURL, err.Error())
+		return
+	}
+	serverURL = strings.TrimSuffix(serverURL, "/")
+	if serverURL == currentURL {
+		return
+	}
+	if u, err := url.Parse(serverURL); err != nil || u.Scheme == "" || u.Host == "" {
+		log.Warnf("the JWT token was issued for %q, which is not a server URL; keeping %s", serverURL, currentURL)
+		return
+	}
+	log.Warnf("the JWT token was issued for the server %s: the device migrated from %s, connecting to %s from now on",
+		serverURL, currentURL, serverURL)
+	d.setServerUrl(serverURL)
+}
+
+//tries to reconnect at most configuration.MaxReconnectAttempts times,
+//and for at most reconnectWindow, if set; the attempts are spaced by the
+//delays of reconnectBackoff, or by the cooldown of reconnectBreaker once it
+//opened, and stop as soon as the daemon shuts down
 func (d *MenderShellDaemon) wsReconnect(token string) (webSock *connection.Connection, err error) {
-	for reconnectAttempts := configuration.MaxReconnectAttempts; reconnectAttempts > 0; reconnectAttempts-- {
-		webSock, err = deviceconnect.Connect(d.serverUrl, d.deviceConnectUrl, d.skipVerify, d.serverCertificate, token)
+	live := d.liveConfig()
+	var deadline time.Time
+	if live.reconnectWindow > 0 {
+		deadline = time.Now().Add(live.reconnectWindow)
+	}
+	for attempt := 1; attempt <= configuration.MaxReconnectAttempts; attempt++ {
+		delay := d.reconnectBackoff.Next()
+		if d.reconnectBreaker.Open() {
+			delay = d.reconnectBreaker.CooldownDelay()
+		}
+		if !deadline.IsZero() && delay > time.Until(deadline) {
+			delay = time.Until(deadline)
+			if delay < 0 {
+				delay = 0
+			}
+		}
+		log.Infof("reconnect attempt %d in %s", attempt, delay)
+		if !d.waitOrShutdown(delay) {
+			log.Info("shutting down, not reconnecting")
+			return nil, ErrShuttingDown
+		}
+		connectStart := time.Now()
+		serverUrl := d.getServerUrl()
+		webSock, err = deviceconnect.Connect(serverUrl, d.deviceConnectUrl, d.skipVerify, d.serverCertificate, token, d.connectionOptions()...)
 		if err != nil {
-			if reconnectAttempts == 1 {
-				log.Errorf("main-loop webSock failed to re-connect to %s%s, error: %s; giving up after %d tries", d.serverUrl, d.deviceConnectUrl, err.Error(), configuration.MaxReconnectAttempts)
+			d.reconnectFailed()
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				log.Errorf("main-loop webSock failed to re-connect to %s%s, error: %s; giving up after %s", serverUrl, d.deviceConnectUrl, err.Error(), live.reconnectWindow)
 				return nil, err
 			}
-			log.Errorf("main-loop webSock failed to connect to %s%s, error: %s", d.serverUrl, d.deviceConnectUrl, err.Error())
-			time.Sleep(time.Second)
+			if attempt == configuration.MaxReconnectAttempts {
+				log.Errorf("main-loop webSock failed to re-connect to %s%s, error: %s; giving up after %d tries", serverUrl, d.deviceConnectUrl, err.Error(), configuration.MaxReconnectAttempts)
+				return nil, err
+			}
+			log.Errorf("main-loop webSock failed to connect to %s%s, error: %s", serverUrl, d.deviceConnectUrl, err.Error())
 		} else {
 			log.Info("reconnected")
-			session.UpdateWSConnection(webSock)
+			d.stats.connected(time.Since(connectStart))
+			d.reconnectBackoff.Connected()
+			if d.reconnectBreaker.Succeeded() {
+				log.WithField(logging.EventField, logging.EventConnectionState).
+					Info("the server answered, reconnect circuit breaker closed")
+				d.metrics.ReconnectCircuitClosed()
+			}
+			d.metrics.Reconnected()
+			webSock.SetWriteTimeout(d.writeTimeout)
+			webSock.SetReadLimit(d.readLimit())
+			webSock.SetCompressionThreshold(d.compressionThreshold)
+			webSock.SetFlowControl(d.flowControlWindow)
+			webSock.SetPingObserver(d.stats.pinged)
+			webSock.StartPing(d.pingInterval, d.pingTimeout)
+			if err := d.advertiseCapabilities(webSock); err != nil {
+				log.Errorf("failed to advertise the capabilities: %s", err.Error())
+			}
+			d.sessions.UpdateWSConnection(webSock)
 			return webSock, nil
 		}
 	}
-	return nil, errors.New("failed to reconnect after " + strconv.Itoa(configuration.MaxReconnectAttempts) + " tries")
+	return nil, errors.New("failed to reconnect after " + strconv.Itoa(configuration.MaxReconnectAttempts) + " tries")
+}
+
+//records a failed reconnect attempt; once too many failed in a row the
+//breaker opens, and the attempts are spaced by its cooldown
+func (d *MenderShellDaemon) reconnectFailed() {
+	if !d.reconnectBreaker.Failed() {
+		return
+	}
+	log.WithField(logging.EventField, logging.EventConnectionState).
+		Errorf("%d reconnect attempts failed in a row, reconnect circuit breaker open: probing the server every %s",
+			d.reconnectBreaker.Failures(), d.reconnectBreaker.CooldownDelay())
+	d.metrics.ReconnectCircuitOpened()
+}
+
+//commandOutput sends the output of a command run with the exec message to
+//the server, in chunks, over the current websocket
+type commandOutput struct {
+	d         *MenderShellDaemon
+	ctx       context.Context
+	sessionId string
+	stream    string
+}
+
+func (o *commandOutput) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += commandOutputChunkSize {
+		end := i + commandOutputChunkSize
+		if end > len(p) {
+			end = len(p)
+		}
+		webSock := o.d.getWebSock()
+		if webSock == nil {
+			return i, errors.New("not connected")
+		}
+		err := webSock.WriteMessageContext(o.ctx, &ws.ProtoMsg{
+			Header: ws.ProtoHdr{
+				Proto:     ws.ProtoTypeShell,
+				MsgType:   shell.MessageTypeExecCommand,
+				SessionID: o.sessionId,
+				Properties: map[string]interface{}{
+					"status":             wsshell.NormalMessage,
+					shell.PropertyStream: o.stream,
+				},
+			},
+			Body: p[i:end],
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return len(p), nil
+}
+
+//runs the command without a terminal, streaming its stdout and stderr, and
+//sends its exit code when it finishes
+func (d *MenderShellDaemon) runCommand(sessionId string, shellUser *shell.ShellUser, args []string, live *liveConfig) {
+	ctx := logging.WithSessionID(context.Background(), sessionId)
+	logger := logging.FromContext(ctx)
+	logger.Infof("running the command %q", args)
+
+	env := shell.ShellEnvironment(shellUser, live.shell, d.terminalString, live.sessionEnv, live.inheritEnv)
+	exitCode, err := shell.ExecuteCommand(shellUser, args, env,
+		&commandOutput{d: d, ctx: ctx, sessionId: sessionId, stream: shell.StreamStdout},
+		&commandOutput{d: d, ctx: ctx, sessionId: sessionId, stream: shell.StreamStderr})
+
+	exit := &shell.MenderShellMessage{
+		Type:       shell.MessageTypeExecExit,
+		Status:     wsshell.NormalMessage,
+		SessionId:  sessionId,
+		Properties: map[string]interface{}{shell.PropertyExitCode: exitCode},
+	}
+	if err != nil {
+		logger.Errorf("failed to run the command %q: %s", args, err.Error())
+		exit.Status = wsshell.ErrorMessage
+		exit.Data = []byte("failed to run the command: " + err.Error())
+	} else {
+		logger.Infof("the command %q exited with %d", args, exitCode)
+	}
+
+	webSock := d.getWebSock()
+	if webSock == nil {
+		logger.Errorf("failed to send the command exit code: not connected")
+		return
+	}
+	if err := d.responseMessage(webSock, exit); err != nil {
+		logger.Errorf("failed to send the command exit code: %s", err.Error())
+	}
+}
+
+//the configuration options applied without restarting the daemon; they
+//take effect on the new sessions, the active ones are left alone
+var liveConfigOptions = map[string]bool{
+	"ShellCommand":                    true,
+	"ShellArguments":                  true,
+	"SessionEnv":                      true,
+	"InheritEnv":                      true,
+	"AllowedCommands":                 true,
+	"AuthorizedUsers":                 true,
+	"MessagePolicy":                   true,
+	"FileTransfer":                    true,
+	"PortForwardTargets":              true,
+	"User":                            true,
+	"Terminal":                        true,
+	"Sessions":                        true,
+	"ReconnectWindow":                 true,
+	"ReconnectIntervalMin":            true,
+	"ReconnectIntervalMax":            true,
+	"ReconnectStableSeconds":          true,
+	"ReconnectFailureThreshold":       true,
+	"ReconnectCooldownSeconds":        true,
+	"IdleTimeoutSeconds":              true,
+	"InitialInputTimeoutSeconds":      true,
+	"MaxSessionDurationSeconds":       true,
+	"MaxSessions":                     true,
+	"ShutdownGracePeriodSeconds":      true,
+	"MaxOutputBytesPerSecond":         true,
+	"MaxInputBytesPerSecond":          true,
+	"MaxInputMessageBytes":            true,
+	"OutputBufferBytes":               true,
+	"OutputFlushIntervalMilliseconds": true,
+	"OutputQueueLength":               true,
+	"PtyReadBufferBytes":              true,
+	"SanitizeOutput":                  true,
+	"RawOutputFraming":                true,
+	"InterceptInterrupt":              true,
+	"RespawnShell":                    true,
+	"EnableHandover":                  true,
+	"RestrictedShell":                 true,
+	"EnableShell":                     true,
+	"RestrictedCommands":              true,
+	"LogLevel":                        true,
+	"LogFormat":                       true,
+	"LogSecretKeys":                   true,
+	"LogSink":                         true,
+	"LogSyslogFacility":               true,
+	"SessionRecordingDir":             true,
+	"LogSessionCommands":              true,
+	"SessionCgroup":                   true,
+	"SessionNamespaces":               true,
+	"SessionBanner":                   true,
+	"SessionWorkingDir":               true,
+	"PreSessionScript":                true,
+	"PostSessionScript":               true,
+	"SessionScriptTimeoutSeconds":     true,
+}
+
+//the command the sessions run in the terminal: the configured shell or, in
+//the restricted shell mode, mender-shell itself interpreting only the
+//restricted commands
+func (c *liveConfig) shellCommandLine() (string, []string, error) {
+	if !c.restrictedShell {
+		return c.shell, c.shellArguments, nil
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return "", nil, err
+	}
+	args := []string{RestrictedShellCommandName}
+	for _, command := range c.restrictedCommands {
+		args = append(args, "--allow", command)
+	}
+	return executable, args, nil
+}
+
+//reloads the configuration from path and applies the options which can be
+//changed live; an invalid configuration is not applied
+func (d *MenderShellDaemon) reloadConfig(path string) {
+	if d.config == nil {
+		return
+	}
+	log.Infof("reloading the configuration from %s", path)
+	changed, err := d.config.Reload(path)
+	if err != nil {
+		log.Errorf("failed to reload the configuration, keeping the current one: %s", err.Error())
+		return
+	}
+
+	config := d.config.Snapshot()
+	d.setLiveConfig(newLiveConfig(config))
+	d.configureReconnect(config)
+	d.configureSessions(config)
+	d.setupLogging()
+
+	for _, name := range changed {
+		if liveConfigOptions[name] {
+			log.Infof("configuration option %s changed", name)
+		} else {
+			log.Warnf("configuration option %s changed, it takes effect after a restart", name)
+		}
+	}
+}
+
+// KeepLogging makes the daemon leave the log format, sink and level as they
+// are, configured by the program embedding it; it has to be called before Run
+func (d *MenderShellDaemon) KeepLogging() {
+	d.keepLogging = true
+}
+
+//sets the log format, sink and level
+func (d *MenderShellDaemon) setupLogging() {
+	live := d.liveConfig()
+	if d.keepLogging {
+		return
+	}
+	logging.SetSecretKeys(live.logSecretKeys)
+	if err := logging.SetFormat(live.logFormat); err != nil {
+		log.Errorf("invalid log format %s: %s", live.logFormat, err.Error())
+	}
+	if err := logging.SetSink(live.logSink, live.logSyslogFacility); err != nil {
+		log.Warnf("can't send the events to %s, they only go to the log output: %s", live.logSink, err.Error())
+	}
+	if live.logLevel != "" {
+		level, err := log.ParseLevel(live.logLevel)
+		if err == nil {
+			log.SetLevel(level)
+			return
+		}
+		log.Errorf("invalid log level %s: %s", live.logLevel, err.Error())
+	}
+	if d.debug {
+		log.SetLevel(log.DebugLevel)
+	}
+}
+
+func (d *MenderShellDaemon) outputStatus() {
+	log.Infof("mender-shell daemon v%s", configuration.VersionString())
+	log.Info(" status: ")
+	capabilities := d.Capabilities()
+	log.Infof("  protocol version: %d negotiated: %t features: %v",
+		capabilities.ProtocolVersion, capabilities.Negotiated, capabilities.Features)
+	log.Infof("  sessions: %d", d.sessions.MenderShellSessionGetCount())
+	sessionIds := d.sessions.MenderShellSessionGetSessionIds()
+	for _, id := range sessionIds {
+		s := d.sessions.MenderShellSessionGetById(id)
+		if s == nil {
+			continue
+		}
+		log.Infof("   id:%s status:%d started:%s", id, s.GetStatus(), s.GetStartedAtFmt())
+		log.Infof("   expires:%s active:%s", s.GetExpiresAtFmt(), s.GetActiveAtFmt())
+		log.Infof("   shell:%s", s.GetShellCommandPath())
+	}
+	d.printStatus = false
+}
+
+func (d *MenderShellDaemon) messageMainLoop(webSock *connection.Connection, token string) (err error) {
+	log.Info("messageMainLoop: starting")
+	d.setWebSock(webSock)
+	for {
+		if d.shouldStop() {
+			log.Debug("messageMainLoop: returning")
+			break
+		}
+
+		if d.shouldPrintStatus() {
+			d.outputStatus()
+		}
+
+		var message *shell.MenderShellMessage
+		log.Debugf("messageMainLoop: calling readMessage")
+		message, err = d.readMessage(webSock)
+		log.Debugf("messageMainLoop: calling readMessage: %v,%v", message, err)
+		if err != nil {
+			log.Errorf("main-loop: error reading message: %s; attempting reconnect.", err.Error())
+			d.setDisconnectError(err)
+			d.setConnectionState(connection.StateReconnecting)
+			if webSock != nil {
+				err = webSock.Close()
+				if err != nil {
+					log.Errorf("main-loop: error on closing the connection: %s", err.Error())
+				}
+			}
+			if d.shouldStop() {
+				continue
+			}
+
+			//the sessions and their shells survive the reconnect: they are
+			//resumed by session id on the new connection
+			token = d.refreshJWTToken(token)
+			d.followServerOfToken(token)
+			webSock, err = d.wsReconnect(token)
+			d.setWebSock(webSock)
+			if err != nil {
+				log.Errorf("main-loop: failed to reconnect, terminating all sessions.")
+				d.setConnectionState(connection.StateDisconnected)
+				d.terminateAllSessions()
+			} else {
+				d.setConnectionState(connection.StateConnected)
+			}
+			continue
+		}
+
+		log.Debugf("got message: type:%s data length:%d", message.Type, len(message.Data))
+		err = d.routeMessage(webSock, message)
+		if err != nil {
+			log.Debugf("error routing message")
+		}
+	}
+
+	log.Debug("messageMainLoop: returning")
+	return err
+}
+
+//creates the client getting the JWT tokens, from the static token file if
+//set, or from the Mender client over the given dbus, and connects it
+func (d *MenderShellDaemon) connectAuthClient(dbusAPI dbus.DBusAPI) (client mender.AuthClient, err error) {
+	if d.staticTokenFile != "" {
+		log.Infof("mender-shell using the static JWT token from %s", d.staticTokenFile)
+		client, err = mender.NewStaticAuthClientFromFile(d.staticTokenFile, configuration.StaticTokenFileWatchInterval)
+		if err != nil {
+			log.Errorf("mender-shell failed to load the static JWT token, error: %s", err.Error())
+			return nil, err
+		}
+	} else {
+		//new dbus client
+		opts := []mender.AuthClientOption{
+			mender.WithMethodTimeout(d.dbusMethodTimeout),
+			mender.WithRefreshJitter(d.tokenRefreshJitter),
+			mender.WithOnTokenFetched(d.stats.tokenFetched),
+		}
+		if d.dbusRetries > 0 {
+			opts = append(opts, mender.WithTransientErrorRetries(d.dbusRetries))
+		}
+		client, err = mender.NewAuthClient(dbusAPI, opts...)
+		if err != nil {
+			log.Errorf("mender-shall dbus failed to create client, error: %s", err.Error())
+			return nil, err
+		}
+	}
+
+	if d.serverPublicKey != "" {
+		key, err := mender.LoadVerificationKey(d.serverPublicKey)
+		if err != nil {
+			log.Errorf("mender-shell failed to load the server public key %s, error: %s", d.serverPublicKey, err.Error())
+			return nil, err
+		}
+		client.SetVerificationKey(key)
+	}
+
+	//connection to dbus
+	err = client.Connect(mender.DBusObjectName, mender.DBusObjectPath, mender.DBusInterfaceName)
+	if err != nil {
+		log.Errorf("mender-shall dbus failed to connect, error: %s", err.Error())
+		return nil, err
+	}
+	d.waitForAuthManager(client)
+	return client, nil
+}
+
+// waitForAuthManager waits up to authManagerWaitTimeout for the Mender client
+// to own the Authentication Manager name on the bus, which it may not have
+// claimed yet on a cold boot; on timeout it goes on, and the token is
+// waited for as usual
+func (d *MenderShellDaemon) waitForAuthManager(client mender.AuthClient) {
+	parent := context.Background()
+	if d.shutdown != nil {
+		parent = d.shutdown
+	}
+	ctx, cancel := context.WithTimeout(parent, d.authManagerWaitTimeout)
+	defer cancel()
+	err := client.WaitForAuthManager(ctx)
+	if err != nil {
+		log.Warnf("the Authentication Manager is not available on the bus: %s", err.Error())
+	}
+}
+
+// SetTokenProvider makes the daemon authenticate to the server with the JWT
+// tokens of provider, instead of the ones of the Mender Authentication
+// Manager over DBus, or of StaticTokenFile; the DBus API exporting the
+// sessions is not started either. It has to be called before Run
+func (d *MenderShellDaemon) SetTokenProvider(provider mender.TokenProvider) {
+	d.customTokenProvider = provider
+}
+
+// SetDialer makes the daemon connect to the server over the transport of
+// dialer, instead of a TCP connection; it has to be called before Run
+func (d *MenderShellDaemon) SetDialer(dialer connection.Dialer) {
+	d.dialer = dialer
+}
+
+//the DBus connection is needed for the Authentication Manager only
+func (d *MenderShellDaemon) usesDBus() bool {
+	return d.customTokenProvider == nil && d.staticTokenFile == ""
+}
+
+//returns true if Token returns "" meaning that we lost auth status
+//see below for some notes
+func deviceUnauth(provider mender.TokenProvider) bool {
+	jwtToken, err := provider.Token()
+	if err == nil {
+		//in case there is an error, it can mean that client was stopped, and/or there is
+		//a problem with DBus communication. the decision here is: we only assume that
+		//the device is unauthorized when there is a successful response from DBus
+		//in hope to save someone when mender-shell is the last access point
+		return jwtToken == ""
+	}
+	return false
+}
+
+//waits for the Mender client to get the JWT token, pinging the systemd
+//watchdog meanwhile, as the device may stay unauthorized for long
+func (d *MenderShellDaemon) waitForJWTToken(provider mender.TokenProvider) (jwtToken string, err error) {
+	for {
+		jwtToken, err = provider.Token()
+		if jwtToken != "" {
+			log.Infof("JWT token is available.")
+			break
+		}
+		d.pingWatchdog()
+		if !d.waitOrShutdown(time.Second) {
+			return "", ErrShuttingDown
+		}
+	}
+	return jwtToken, nil
+}
+
+//starts all needed elements of the mender-shell daemon
+// * executes given shell (shell.ExecuteShell)
+// * get dbus API and starts the dbus main loop (dbus.GetDBusAPI(), go dbusAPI.MainLoopRun(loop))
+// * creates a new dbus client and connects to dbus (mender.NewAuthClient(dbusAPI), client.Connect(...)),
+//   unless a token provider was set with SetTokenProvider
+// * gets the JWT token from the token provider (provider.Token())
+// * connects to the backend and returns a new websocket (deviceconnect.Connect(...))
+// * starts the message flow between the shell and websocket (shell.NewMenderShell(...))
+func (d *MenderShellDaemon) Run() error {
+	d.setupLogging()
+	defer d.abortUploads()
+	defer d.closePortForwards()
+
+	log.Infof("daemon Run starting")
+	d.setupWatchdog()
+	if d.metricsBindAddress != "" {
+		metricsServer := d.startMetricsServer()
+		defer metricsServer.Close()
+	}
+	if controlServer := d.startControlSocket(); controlServer != nil {
+		defer controlServer.Stop()
+	}
+
+	//fail early on a server certificate the websocket can't be verified with
+	_, err := connection.LoadServerTrust(d.serverCertificate)
+	if err != nil {
+		log.Errorf("mender-shell failed to load the server certificate %s, error: %s", d.serverCertificate, err.Error())
+		return err
+	}
+
+	if d.clientCertificate != "" {
+		_, err = connection.LoadClientCertificate(d.clientCertificate, d.clientKey, d.clientKeyPassphrase)
+		if err != nil {
+			log.Errorf("mender-shell failed to load the client certificate, error: %s", err.Error())
+			return err
+		}
+	}
+
+	var dbusAPI dbus.DBusAPI
+	notifiers := sessionNotifiers{}
+	if d.usesDBus() {
+		log.Info("mender-shell connecting dbus and getting the token")
+		//dbus main loop, required.
+		dbusAPI, err = dbus.GetDBusAPI()
+		if err != nil {
+			return err
+		}
+		loop := dbusAPI.MainLoopNew()
+		go dbusAPI.MainLoopRun(loop)
+		defer dbusAPI.MainLoopQuit(loop)
+
+		//the other agents on the device can follow the sessions
+		sessionsAPI, err := dbusapi.NewSessionsAPI(dbusAPI, d.activeSessions, d.KillSession)
+		if err == nil {
+			err = sessionsAPI.Start(dbus.GBusTypeSystem)
+		}
+		if err != nil {
+			log.Warnf("mender-shell failed to export the sessions over dbus, error: %s", err.Error())
+		} else {
+			notifiers = append(notifiers, sessionsAPI)
+			defer sessionsAPI.Stop()
+		}
+	}
+	if d.lifecycleObserver != nil {
+		notifiers = append(notifiers, &observerNotifier{observer: d.lifecycleObserver, sessions: d.sessions})
+	}
+	if len(notifiers) > 0 {
+		d.sessions.SetNotifier(notifiers)
+		defer func() {
+			d.sessions.SetNotifier(nil)
+		}()
+	}
+
+	//the sessions handed over by the previous process, if any, before the
+	//time it waits for them to be taken over runs out
+	d.adoptSessions()
+
+	provider := d.customTokenProvider
+	if provider == nil {
+		client, err := d.connectAuthClient(dbusAPI)
+		if err != nil {
+			return err
+		}
+		defer client.Disconnect()
+		provider = client
+	}
+	d.tokenProvider = provider
+
+	log.Infof("waiting for JWT token")
+	d.setConnectionState(connection.StateAuthenticating)
+	jwtToken, err := d.waitForJWTToken(provider)
+	if err == ErrShuttingDown {
+		log.Info("shutting down, not connecting")
+		return nil
+	}
+	log.Debugf("mender-shell got len(JWT)=%d", len(jwtToken))
+	d.setAuthenticatedUser(jwtToken)
+	d.deviceIdentity = deviceIdentity(provider)
+	d.followServerOfToken(jwtToken)
+
+	//make websocket connection to the backend, this will be used to exchange messages
+	serverUrl := d.getServerUrl()
+	log.Infof("mender-shell connecting websocket; url: %s%s", serverUrl, d.deviceConnectUrl)
+	connectStart := time.Now()
+	ws, err := deviceconnect.Connect(serverUrl, d.deviceConnectUrl, d.skipVerify, d.serverCertificate, jwtToken, d.connectionOptions()...)
+	if err != nil {
+		log.Errorf("mender-shall ws failed to connect to %s%s, error: %s", serverUrl, d.deviceConnectUrl, err.Error())
+		d.setConnectionState(connection.StateDisconnected)
+		return err
+	}
+	d.stats.connected(time.Since(connectStart))
+	d.setConnectionState(connection.StateConnected)
+	d.reconnectBackoff.Connected()
+	d.sessions.UpdateWSConnection(ws)
+	//the pings let us notice a dead connection, the closed connection makes
+	//messageMainLoop reconnect or terminate the sessions
+	ws.SetWriteTimeout(d.writeTimeout)
+	ws.SetReadLimit(d.readLimit())
+	ws.SetCompressionThreshold(d.compressionThreshold)
+	ws.SetFlowControl(d.flowControlWindow)
+	ws.SetPingObserver(d.stats.pinged)
+	ws.StartPing(d.pingInterval, d.pingTimeout)
+	if err := d.advertiseCapabilities(ws); err != nil {
+		log.Errorf("failed to advertise the capabilities: %s", err.Error())
+	}
+
+	go d.messageMainLoop(ws, jwtToken)
+
+	log.Infof("mender-shell entering main loop.")
+	for {
+		if d.shouldStop() {
+			break
+		}
+		d.pingWatchdog()
+
+		if d.shouldPrintStatus() {
+			d.outputStatus()
+		}
+
+		if path := d.shouldReloadConfig(); path != "" {
+			d.reloadConfig(path)
+		}
+
+		if d.shouldHandover() {
+			d.handOver()
+			continue
+		}
+
+		if deviceUnauth(provider) {
+			log.WithField(logging.EventField, logging.EventAuthFailed).
+				Warnf("device was denied authorization, terminating all shells.")
+			d.terminateAllSessions()
+			log.Infof("waiting for JWT token")
+			d.setDisconnectError(ErrDeviceNotAuthorized)
+			d.setConnectionState(connection.StateAuthenticating)
+			jwtToken, err = d.waitForJWTToken(provider)
+			if err != nil {
+				//shall we make waitForJWTToken wait even if there is an error?
+				//now we just stop
+				break
+			}
+			d.setAuthenticatedUser(jwtToken)
+			d.metrics.TokenRefreshed()
+
+			//in here technically it is possible we close a closed connection
+			//but it is not a critical error; closing the connection makes
+			//messageMainLoop reconnect with the new token
+			if ws := d.getWebSock(); ws != nil {
+				ws.Close()
+			}
+		}
+
+		if d.timeToSweepSessions() {
+			shellStoppedCount, sessionStoppedCount, totalExpiredLeft, err := d.sessions.MenderSessionTerminateExpired()
+			if err != nil {
+				log.Errorf("main-loop: failed to terminate some expired sessions, left: %d", totalExpiredLeft)
+			} else if sessionStoppedCount != 0 {
+				log.Infof("main-loop: stopped %d sessions, %d shells, expired sessions left: %d", shellStoppedCount, sessionStoppedCount, totalExpiredLeft)
+			}
+		}
+
+		d.killRequestedSessions()
+		d.closeExitedShells()
+		d.terminateIdleSessions()
+		d.terminateAbandonedSessions()
+		d.terminateLongSessions()
+
+		time.Sleep(time.Second)
+	}
+	d.gracefulShutdown()
+	return nil
+}
+
+// terminateIdleSessions warns the sessions without input for longer than the
+// idle timeout, and terminates them when the grace period passes as well
+func (d *MenderShellDaemon) terminateIdleSessions() {
+	live := d.liveConfig()
+	if live.idleTimeout == time.Duration(0) {
+		return
+	}
+
+	webSock := d.getWebSock()
+	for _, id := range d.sessions.MenderShellSessionGetSessionIds() {
+		s := d.sessions.MenderShellSessionGetById(id)
+		if s == nil || s.GetStatus() != session.ActiveSession {
+			continue
+		}
+
+		logger := logging.FromContext(s.Context())
+		idleFor := s.IdleFor()
+		if idleFor < live.idleTimeout {
+			continue
+		}
+
+		if !s.IsIdleWarned() {
+			s.SetIdleWarned()
+			logger.Infof("session %s idle for %s, sending warning", id, idleFor)
+			if webSock == nil {
+				continue
+			}
+			err := d.responseMessage(webSock, &shell.MenderShellMessage{
+				Type:      wsshell.MessageTypeShellCommand,
+				Status:    wsshell.NormalMessage,
+				SessionId: id,
+				Data: []byte(fmt.Sprintf("\r\nsession idle for too long, it will be "+
+					"terminated in %s without any input\r\n", d.idleTimeoutGracePeriod)),
+			})
+			if err != nil {
+				logger.Errorf("failed to send the idle warning to session %s: %s", id, err.Error())
+			}
+			continue
+		}
+
+		if idleFor < live.idleTimeout+d.idleTimeoutGracePeriod {
+			continue
+		}
+
+		logger.Infof("session %s idle for %s, terminating", id, idleFor)
+		d.terminateSession(webSock, s, SessionTimedOutMessage, shell.CloseIdleTimeout)
+	}
+}
+
+// terminateAbandonedSessions terminates the sessions without any input since
+// they were opened for longer than the initial input timeout, e.g.: opened by
+// mistake and left behind, without the warning of the idle timeout
+func (d *MenderShellDaemon) terminateAbandonedSessions() {
+	live := d.liveConfig()
+	if live.initialInputTimeout == time.Duration(0) {
+		return
+	}
+
+	webSock := d.getWebSock()
+	for _, id := range d.sessions.MenderShellSessionGetSessionIds() {
+		s := d.sessions.MenderShellSessionGetById(id)
+		if s == nil || s.GetStatus() != session.ActiveSession || s.ReceivedInput() {
+			continue
+		}
+
+		openFor := s.OpenFor()
+		if openFor < live.initialInputTimeout {
+			continue
+		}
+
+		logging.FromContext(s.Context()).Infof("session %s without any input for %s since it was opened, terminating",
+			id, openFor)
+		d.terminateSession(webSock, s, SessionAbandonedMessage, shell.CloseInitialInputTimeout)
+	}
 }
 
-func (d *MenderShellDaemon) outputStatus() {
-	log.Infof("mender-shell daemon v%s", configuration.VersionString())
-	log.Info(" status: ")
-	log.Infof("  sessions: %d", session.MenderShellSessionGetCount())
-	sessionIds := session.MenderShellSessionGetSessionIds()
-	for _, id := range sessionIds {
-		s := session.MenderShellSessionGetById(id)
-		log.Infof("   id:%s status:%d started:%s", id, s.GetStatus(), s.GetStartedAtFmt())
-		log.Infof("   expires:%s active:%s", s.GetExpiresAtFmt(), s.GetActiveAtFmt())
-		log.Infof("   shell:%s", s.GetShellCommandPath())
+// terminateLongSessions warns the sessions open for almost the max session
+// duration, and terminates them when they reach it, regardless of their
+// activity
+func (d *MenderShellDaemon) terminateLongSessions() {
+	live := d.liveConfig()
+	if live.maxSessionDuration == time.Duration(0) {
+		return
 	}
-	d.printStatus = false
-}
 
-func (d *MenderShellDaemon) messageMainLoop(webSock *connection.Connection, token string) (err error) {
-	log.Info("messageMainLoop: starting")
-	for {
-		if d.shouldStop() {
-			log.Debug("messageMainLoop: returning")
-			break
+	webSock := d.getWebSock()
+	for _, id := range d.sessions.MenderShellSessionGetSessionIds() {
+		s := d.sessions.MenderShellSessionGetById(id)
+		if s == nil || s.GetStatus() != session.ActiveSession {
+			continue
 		}
 
-		if d.shouldPrintStatus() {
-			d.outputStatus()
+		logger := logging.FromContext(s.Context())
+		openFor := s.OpenFor()
+		if openFor >= live.maxSessionDuration {
+			logger.Warnf("session %s open for %s, over the max session duration of %s: "+
+				"forcibly terminating it", id, openFor, live.maxSessionDuration)
+			d.terminateSession(webSock, s, SessionMaxDurationMessage, shell.CloseMaxDuration)
+			continue
 		}
 
-		var message *shell.MenderShellMessage
-		log.Debugf("messageMainLoop: calling readMessage")
-		message, err = d.readMessage(webSock)
-		log.Debugf("messageMainLoop: calling readMessage: %v,%v", message, err)
-		if err != nil {
-			log.Errorf("main-loop: error reading message: %s; attempting reconnect.", err.Error())
-			if webSock != nil {
-				err = webSock.Close()
-				if err != nil {
-					log.Errorf("main-loop: error on closing the connection: %s", err.Error())
-				}
-			}
-			time.Sleep(time.Second)
+		if openFor < live.maxSessionDuration-d.maxDurationWarning || s.IsDurationWarned() {
 			continue
 		}
-
-		log.Debugf("got message: type:%s data length:%d", message.Type, len(message.Data))
-		err = d.routeMessage(webSock, message)
+		s.SetDurationWarned()
+		logger.Infof("session %s open for %s, sending the max duration warning", id, openFor)
+		if webSock == nil {
+			continue
+		}
+		err := d.responseMessage(webSock, &shell.MenderShellMessage{
+			Type:      wsshell.MessageTypeShellCommand,
+			Status:    wsshell.NormalMessage,
+			SessionId: id,
+			Data: []byte(fmt.Sprintf("\r\nsession reaching the max duration, it will be "+
+				"terminated in %s\r\n", live.maxSessionDuration-openFor)),
+		})
 		if err != nil {
-			log.Debugf("error routing message")
+			logger.Errorf("failed to send the max duration warning to session %s: %s", id, err.Error())
 		}
 	}
-
-	log.Debug("messageMainLoop: returning")
-	return err
 }
 
-//returns true if GetJWTToken returns "" meaning that we lost auth status
-//see below for some notes
-func deviceUnauth(client mender.AuthClient) bool {
-	jwtToken, err := client.GetJWTToken()
-	if err == nil {
-		//in case there is an error, it can mean that client was stopped, and/or there is
-		//a problem with DBus communication. the decision here is: we only assume that
-		//the device is unauthorized when there is a successful response from DBus
-		//in hope to save someone when mender-shell is the last access point
-		return jwtToken == ""
+// killRequestedSessions terminates the sessions KillSession was called with
+func (d *MenderShellDaemon) killRequestedSessions() {
+	webSock := d.getWebSock()
+	for _, id := range d.sessionsToKill() {
+		s := d.sessions.MenderShellSessionGetById(id)
+		if s == nil {
+			continue
+		}
+		logging.FromContext(s.Context()).Warnf("session %s killed on the device, terminating it", id)
+		d.terminateSession(webSock, s, SessionKilledMessage, shell.ClosePolicyDenied)
 	}
-	return false
 }
 
-func waitForJWTToken(client mender.AuthClient) (jwtToken string, err error) {
-	for {
-		jwtToken, err = client.GetJWTToken()
-		if jwtToken != "" {
-			log.Infof("JWT token is available.")
-			break
+// revokeSessions terminates the sessions with the revoked reason: the ones
+// with the given ids, or else the ones of the user id, or else all of them
+func (d *MenderShellDaemon) revokeSessions(webSock *connection.Connection, ids []string, userId string) {
+	revokeAll := len(ids) == 0 && userId == ""
+	if len(ids) == 0 {
+		ids = d.sessions.MenderShellSessionGetSessionIds()
+	} else {
+		for _, id := range ids {
+			d.closePortForward(id)
 		}
-		time.Sleep(time.Second)
 	}
-	return jwtToken, nil
+	for _, id := range ids {
+		s := d.sessions.MenderShellSessionGetById(id)
+		if s == nil || (userId != "" && s.GetUserId() != userId) {
+			continue
+		}
+		logging.FromContext(s.Context()).WithField(logging.EventField, logging.EventSessionRevoked).
+			Warnf("session %s of user %s revoked, terminating it", id, s.GetUserId())
+		d.terminateSession(webSock, s, SessionRevokedMessage, shell.CloseRevoked)
+	}
+	if revokeAll {
+		d.abortUploads()
+		d.closePortForwards()
+	}
 }
 
-//starts all needed elements of the mender-shell daemon
-// * executes given shell (shell.ExecuteShell)
-// * get dbus API and starts the dbus main loop (dbus.GetDBusAPI(), go dbusAPI.MainLoopRun(loop))
-// * creates a new dbus client and connects to dbus (mender.NewAuthClient(dbusAPI), client.Connect(...))
-// * gets the JWT token from the mender-client via dbus (client.GetJWTToken())
-// * connects to the backend and returns a new websocket (deviceconnect.Connect(...))
-// * starts the message flow between the shell and websocket (shell.NewMenderShell(...))
-func (d *MenderShellDaemon) Run() error {
-	if d.debug {
-		log.SetLevel(log.DebugLevel)
+// closeExitedShells closes the sessions whose shell exited on its own,
+// telling the server how it exited; a crashed shell is respawned in the same
+// session instead, if enabled, up to maxShellRespawns times
+func (d *MenderShellDaemon) closeExitedShells() {
+	live := d.liveConfig()
+	d.shellsMutex.Lock()
+	defer d.shellsMutex.Unlock()
+	webSock := d.getWebSock()
+	for _, id := range d.sessions.MenderShellSessionGetSessionIds() {
+		s := d.sessions.MenderShellSessionGetById(id)
+		if s == nil {
+			continue
+		}
+		exit := s.ShellExited()
+		if exit == nil {
+			continue
+		}
+
+		logger := logging.FromContext(s.Context())
+		reason := ShellExitedMessage
+		status := wsshell.NormalMessage
+		closeCode := shell.CloseNormalExit
+		if exit.Crashed() {
+			reason = ShellCrashedMessage
+			status = wsshell.ErrorMessage
+			closeCode = shell.CloseInternalError
+		}
+		logger.Infof("session %s: the shell (pid %d) %s", id, s.GetShellPid(), exit)
+
+		respawned := false
+		s.SetCloseReason(reason + ": " + exit.String())
+		if exit.Crashed() && live.respawnShell && s.GetRespawnCount() < maxShellRespawns {
+			lead := []byte("\r\n" + reason + " (" + exit.String() + "), starting a new one\r\n")
+			respawned = s.RespawnShell(lead) == nil
+		} else {
+			s.CloseExitedShell()
+		}
+
+		if webSock != nil {
+			properties := map[string]interface{}{shell.PropertyExitCode: exit.ExitCode}
+			if exit.Crashed() {
+				properties[shell.PropertySignal] = exit.Signal
+			}
+			err := d.responseMessage(webSock, &shell.MenderShellMessage{
+				Type:       shell.MessageTypeShellExit,
+				Status:     status,
+				SessionId:  id,
+				Data:       []byte(reason + ": " + exit.String()),
+				Properties: properties,
+			})
+			if err != nil {
+				logger.Errorf("failed to send the shell exit of session %s: %s", id, err.Error())
+			}
+		}
+		if respawned {
+			logger.Infof("session %s: respawned the shell, pid %d", id, s.GetShellPid())
+			continue
+		}
+
+		if d.shellsSpawned > 0 {
+			d.shellsSpawned--
+		}
+		if err := d.sessions.MenderShellDeleteById(id); err != nil {
+			logger.Errorf("failed to delete session %s: %s", id, err.Error())
+		}
+		if webSock == nil {
+			continue
+		}
+		err := d.responseMessage(webSock, &shell.MenderShellMessage{
+			Type:       wsshell.MessageTypeStopShell,
+			Status:     status,
+			SessionId:  id,
+			Data:       []byte(reason),
+			Properties: closeCodeProperties(closeCode),
+		})
+		if err != nil {
+			logger.Errorf("failed to send the %q reason to session %s: %s", reason, id, err.Error())
+		}
 	}
+}
 
-	log.Infof("daemon Run starting")
-	u, err := user.Lookup(d.username)
-	if err == nil && u == nil {
-		return errors.New("unknown error while getting a user id")
+//stops the shell of the session and deletes it, sending the stop shell
+//message with the reason and the close code
+func (d *MenderShellDaemon) terminateSession(webSock *connection.Connection, s *session.MenderShellSession, reason string, closeCode shell.CloseCode) {
+	d.shellsMutex.Lock()
+	defer d.shellsMutex.Unlock()
+	id := s.GetId()
+	//the message loop may have stopped it in the meantime
+	if d.sessions.MenderShellSessionGetById(id) != s {
+		return
 	}
-	if err != nil {
-		return err
+	logger := logging.FromContext(s.Context())
+	if reason != "" {
+		s.SetCloseReason(reason)
 	}
-
-	d.uid, err = strconv.ParseUint(u.Uid, 10, 32)
-	if err != nil {
-		return err
+	err := s.StopShell()
+	if err != nil && procps.ProcessExists(s.GetShellPid()) {
+		logger.Errorf("could not terminate shell (pid %d) for session %s: %s",
+			s.GetShellPid(), id, err.Error())
+		return
 	}
-
-	d.gid, err = strconv.ParseUint(u.Gid, 10, 32)
-	if err != nil {
-		return err
+	if d.shellsSpawned == 0 {
+		logger.Error("can't decrement shellsSpawned count: it is 0.")
+	} else {
+		d.shellsSpawned--
 	}
-
-	log.Info("mender-shell connecting dbus and getting the token")
-	//dbus main loop, required.
-	dbusAPI, err := dbus.GetDBusAPI()
-	loop := dbusAPI.MainLoopNew()
-	go dbusAPI.MainLoopRun(loop)
-	defer dbusAPI.MainLoopQuit(loop)
-
-	//new dbus client
-	client, err := mender.NewAuthClient(dbusAPI)
-	if err != nil {
-		log.Errorf("mender-shall dbus failed to create client, error: %s", err.Error())
-		return err
+	if err = d.sessions.MenderShellDeleteById(id); err != nil {
+		logger.Errorf("failed to delete session %s: %s", id, err.Error())
 	}
-
-	//connection to dbus
-	err = client.Connect(mender.DBusObjectName, mender.DBusObjectPath, mender.DBusInterfaceName)
-	if err != nil {
-		log.Errorf("mender-shall dbus failed to connect, error: %s", err.Error())
-		return err
+	if webSock == nil {
+		return
 	}
-
-	log.Infof("waiting for JWT token (GetJWTToken)")
-	jwtToken, err := waitForJWTToken(client)
-	log.Debugf("mender-shell got len(JWT)=%d", len(jwtToken))
-
-	//make websocket connection to the backend, this will be used to exchange messages
-	log.Infof("mender-shell connecting websocket; url: %s%s", d.serverUrl, d.deviceConnectUrl)
-	ws, err := deviceconnect.Connect(d.serverUrl, d.deviceConnectUrl, d.skipVerify, d.serverCertificate, jwtToken)
+	err = d.responseMessage(webSock, &shell.MenderShellMessage{
+		Type:       wsshell.MessageTypeStopShell,
+		Status:     wsshell.ErrorMessage,
+		SessionId:  id,
+		Data:       []byte(reason),
+		Properties: closeCodeProperties(closeCode),
+	})
 	if err != nil {
-		log.Errorf("mender-shall ws failed to connect to %s%s, error: %s", d.serverUrl, d.deviceConnectUrl, err.Error())
-		return err
+		logger.Errorf("failed to send the %q reason to session %s: %s", reason, id, err.Error())
 	}
+}
 
-	go d.messageMainLoop(ws, jwtToken)
+// spawnShellFailed tells the server the shell of the session was not started,
+// with the error and the close code
+func (d *MenderShellDaemon) spawnShellFailed(webSock *connection.Connection, id string, err error, closeCode shell.CloseCode) error {
+	return d.responseMessage(webSock, &shell.MenderShellMessage{
+		Type:       wsshell.MessageTypeSpawnShell,
+		Status:     wsshell.ErrorMessage,
+		SessionId:  id,
+		Data:       []byte("failed to start shell: " + err.Error()),
+		Properties: closeCodeProperties(closeCode),
+	})
+}
 
-	log.Infof("mender-shell entering main loop.")
-	for {
-		if d.shouldStop() {
-			break
-		}
+// closeCodeProperties returns the properties carrying the close code of a
+// session
+func closeCodeProperties(closeCode shell.CloseCode) map[string]interface{} {
+	return map[string]interface{}{shell.PropertyCloseCode: int(closeCode)}
+}
 
-		if d.shouldPrintStatus() {
-			d.outputStatus()
+// resumeSessions matches the local sessions with the ids of the sessions the
+// server still considers open after a reconnect: the sessions in both are
+// resumed, sending their scrollback to redraw the terminal, the local ones
+// the server lost are terminated, and the server is told to close the ones
+// which are gone from the device
+func (d *MenderShellDaemon) resumeSessions(webSock *connection.Connection, ids []string) {
+	open := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		open[id] = true
+	}
+	for _, id := range d.sessions.MenderShellSessionGetSessionIds() {
+		s := d.sessions.MenderShellSessionGetById(id)
+		if s == nil {
+			continue
+		}
+		logger := logging.FromContext(s.Context())
+		if !open[id] {
+			logger.Infof("session %s is not open on the server, terminating it", id)
+			d.terminateSession(nil, s, "", shell.CloseInternalError)
+			continue
+		}
+		delete(open, id)
+		logger.Infof("resuming session %s", id)
+		err := d.responseMessage(webSock, &shell.MenderShellMessage{
+			Type:      shell.MessageTypeSessionResumed,
+			Status:    wsshell.NormalMessage,
+			SessionId: id,
+			Data:      s.Scrollback(),
+			Properties: map[string]interface{}{
+				shell.PropertyReplay: true,
+			},
+		})
+		if err != nil {
+			logger.Errorf("failed to resume session %s: %s", id, err.Error())
+		}
+	}
+	for id := range open {
+		err := d.responseMessage(webSock, &shell.MenderShellMessage{
+			Type:       wsshell.MessageTypeStopShell,
+			Status:     wsshell.ErrorMessage,
+			SessionId:  id,
+			Data:       []byte(session.ErrSessionNotFound.Error()),
+			Properties: closeCodeProperties(shell.CloseInternalError),
+		})
+		if err != nil {
+			log.Errorf("failed to close session %s on the server: %s", id, err.Error())
 		}
+	}
+}
 
-		if deviceUnauth(client) {
-			log.Warnf("device was denied authorization, terminating all shells.")
-			shellsCount, sessionsCount, err := session.MenderSessionTerminateAll()
-			if err == nil {
-				log.Infof("terminated %d sessions, %d shells", shellsCount, sessionsCount)
-			} else {
-				log.Errorf("error terminating all sessions: %s", err.Error())
+// gracefulShutdown tells the sessions the daemon is shutting down, hangs up
+// their shells, giving them shutdownGracePeriod to exit, and closes the
+// websocket with the shell.CloseShutdown code; it runs only once
+func (d *MenderShellDaemon) gracefulShutdown() {
+	live := d.liveConfig()
+	d.shutdownOnce.Do(func() {
+		notifySystemd(systemd.Stopping)
+		log.Info("shutting down the sessions")
+		webSock := d.getWebSock()
+		ids := d.sessions.MenderShellSessionGetSessionIds()
+		for _, id := range ids {
+			if s := d.sessions.MenderShellSessionGetById(id); s != nil {
+				s.SetCloseReason(SessionShutdownMessage)
+			}
+			if webSock == nil {
+				continue
 			}
-			log.Infof("waiting for JWT token (GetJWTToken)")
-			jwtToken, err = waitForJWTToken(client)
+			err := d.responseMessage(webSock, &shell.MenderShellMessage{
+				Type:      wsshell.MessageTypeShellCommand,
+				Status:    wsshell.NormalMessage,
+				SessionId: id,
+				Data:      []byte("\r\n" + SessionShutdownMessage + "\r\n"),
+			})
 			if err != nil {
-				//shall we make waitForJWTToken wait even if there is an error?
-				//now we just stop
-				break
+				log.Errorf("failed to tell session %s about the shutdown: %s", id, err.Error())
 			}
+		}
 
-			//in here technically it is possible we close a closed connection
-			//but it is not a critical error, the important thing is not to leave
-			//any messageMainLoop running -- since it waits forever on readMessage
-			ws.Close()
-			ws, _ = d.wsReconnect(jwtToken)
-			go d.messageMainLoop(ws, jwtToken)
+		d.shellsMutex.Lock()
+		shellsCount, sessionsCount, err := d.sessions.MenderSessionShutdownAll(live.shutdownGracePeriod)
+		if err == nil {
+			log.Infof("shut down %d sessions, %d shells", sessionsCount, shellsCount)
+		} else {
+			log.Errorf("error shutting down the sessions: %s", err.Error())
+		}
+		if uint(shellsCount) > d.shellsSpawned {
+			d.shellsSpawned = 0
+		} else {
+			d.shellsSpawned -= uint(shellsCount)
 		}
+		d.shellsMutex.Unlock()
+		d.abortUploads()
+		d.closePortForwards()
 
-		if d.timeToSweepSessions() {
-			shellStoppedCount, sessionStoppedCount, totalExpiredLeft, err := session.MenderSessionTerminateExpired()
+		if webSock == nil {
+			return
+		}
+		for _, id := range ids {
+			err = d.responseMessage(webSock, &shell.MenderShellMessage{
+				Type:       wsshell.MessageTypeStopShell,
+				Status:     wsshell.ErrorMessage,
+				SessionId:  id,
+				Data:       []byte(SessionShutdownMessage),
+				Properties: closeCodeProperties(shell.CloseShutdown),
+			})
 			if err != nil {
-				log.Errorf("main-loop: failed to terminate some expired sessions, left: %d", totalExpiredLeft)
-			} else if sessionStoppedCount != 0 {
-				log.Infof("main-loop: stopped %d sessions, %d shells, expired sessions left: %d", shellStoppedCount, sessionStoppedCount, totalExpiredLeft)
+				log.Errorf("failed to send the %q reason to session %s: %s", SessionShutdownMessage, id, err.Error())
 			}
 		}
+		if err = webSock.CloseWithCode(int(shell.CloseShutdown), SessionShutdownMessage); err != nil {
+			log.Debugf("failed to close the websocket: %s", err.Error())
+		}
+	})
+}
 
-		time.Sleep(time.Second)
+func (d *MenderShellDaemon) terminateAllSessions() {
+	d.shellsMutex.Lock()
+	defer d.shellsMutex.Unlock()
+	shellsCount, sessionsCount, err := d.sessions.MenderSessionTerminateAll()
+	if err == nil {
+		log.Infof("terminated %d sessions, %d shells", shellsCount, sessionsCount)
+	} else {
+		log.Errorf("error terminating all sessions: %s", err.Error())
 	}
-	return nil
+	if uint(shellsCount) > d.shellsSpawned {
+		d.shellsSpawned = 0
+	} else {
+		d.shellsSpawned -= uint(shellsCount)
+	}
+	d.abortUploads()
+	d.closePortForwards()
 }
 
 func (d *MenderShellDaemon) responseMessage(webSock *connection.Connection, m *shell.MenderShellMessage) (err error) {
 	msg := &ws.ProtoMsg{
 		Header: ws.ProtoHdr{
-			Proto:     ws.ProtoTypeShell,
-			MsgType:   m.Type,
-			SessionID: m.SessionId,
-			Properties: map[string]interface{}{
-				"status": m.Status,
-			},
+			Proto:      ws.ProtoTypeShell,
+			MsgType:    m.Type,
+			SessionID:  m.SessionId,
+			Properties: map[string]interface{}{},
 		},
 		Body: m.Data,
 	}
-	log.Debugf("responseMessage: webSock.WriteMessage(%+v)", msg)
-	err = webSock.WriteMessage(msg)
+	for name, value := range m.Properties {
+		msg.Header.Properties[name] = value
+	}
+	msg.Header.Properties["status"] = m.Status
+	//the session may be gone, e.g.: its shell failed to start
+	ctx := logging.WithSessionID(context.Background(), m.SessionId)
+	logging.FromContext(ctx).Debugf("responseMessage: webSock.WriteMessage(%+v)", msg)
+	err = webSock.WriteMessageContext(ctx, msg)
 	return err
 }
 
+//the sessions with a running shell, listed by the DBus sessions API
+func (d *MenderShellDaemon) activeSessions() []dbusapi.Session {
+	var sessions []dbusapi.Session
+	for _, id := range d.sessions.MenderShellSessionGetSessionIds() {
+		s := d.sessions.MenderShellSessionGetById(id)
+		if s == nil {
+			continue
+		}
+		if status := s.GetStatus(); status == session.ActiveSession || status == session.HangedSession {
+			sessions = append(sessions, dbusapi.Session{
+				SessionID: id,
+				UserID:    s.GetUserId(),
+				StartedAt: s.GetStartedAt().Format(time.RFC3339),
+			})
+		}
+	}
+	return sessions
+}
+
+//writes the message over the current websocket, which may change while
+//a transfer or a forwarded connection runs in the background
+func (d *MenderShellDaemon) sendMessage(m *shell.MenderShellMessage) error {
+	webSock := d.getWebSock()
+	if webSock == nil {
+		return errors.New("not connected")
+	}
+	return d.responseMessage(webSock, m)
+}
+
 func (d *MenderShellDaemon) routeMessage(webSock *connection.Connection, message *shell.MenderShellMessage) (err error) {
+	//the session id is attached to all the log lines of the message
+	logger := logging.FromContext(logging.WithSessionID(context.Background(), message.SessionId))
+	live := d.liveConfig()
+	if !d.featureEnabled(webSock, message) || !d.messageAuthorized(webSock, message, live.messagePolicy) {
+		return nil
+	}
 	switch message.Type {
+	case shell.MessageTypeCapabilities:
+		d.negotiateCapabilities(message.Properties)
 	case wsshell.MessageTypeSpawnShell:
+		if !live.shellEnabled {
+			logger.WithField(logging.EventField, logging.EventPolicyDenied).
+				Warnf("rejecting the shell of user id %q: the shell is disabled", string(message.Data))
+			return d.spawnShellFailed(webSock, message.SessionId, ErrShellDisabled, shell.ClosePolicyDenied)
+		}
+		//the main loop terminates the sessions too, the shells are started
+		//and stopped one at a time
+		d.shellsMutex.Lock()
+		defer d.shellsMutex.Unlock()
 		if d.shellsSpawned >= configuration.MaxShellsSpawned {
+			d.spawnShellFailed(webSock, message.SessionId, session.ErrSessionTooManyShellsAlreadyRunning, shell.ClosePolicyDenied)
 			return session.ErrSessionTooManyShellsAlreadyRunning
 		}
-		s := session.MenderShellSessionGetById(message.SessionId)
+		operator := d.operator(string(message.Data))
+		if !live.userAuthorized(operator) {
+			logger.WithField(logging.EventField, logging.EventAuthFailed).
+				Warnf("rejecting the shell of user id %q: the user %q "+
+					"is not in the authorized users", string(message.Data), operator)
+			return d.spawnShellFailed(webSock, message.SessionId, ErrUserNotAuthorized, shell.ClosePolicyDenied)
+		}
+		s := d.sessions.MenderShellSessionGetById(message.SessionId)
+		newSession := s == nil
 		if s == nil {
 			userId := string(message.Data)
-			s, err = session.NewMenderShellSession(d.writeMutex, webSock, userId, d.expireSessionsAfter, d.expireSessionsAfterIdle)
+			s, err = d.sessions.NewMenderShellSession(d.writeMutex, webSock, userId, live.expireSessionsAfter, live.expireSessionsAfterIdle)
 			if err != nil {
+				d.spawnShellFailed(webSock, message.SessionId, err, shell.ClosePolicyDenied)
 				return err
 			}
-			log.Debugf("created a new session: %s", s.GetId())
+			logger.Debugf("created a new session: %s", s.GetId())
 		}
+		logger = logging.FromContext(s.Context())
 
-		log.Debugf("starting shell session_id=%s", s.GetId())
-		err = s.StartShell(s.GetId(), session.MenderShellTerminalSettings{
-			Uid:            uint32(d.uid),
-			Gid:            uint32(d.gid),
-			Shell:          d.shell,
-			TerminalString: d.terminalString,
-			Height:         d.terminalHeight,
-			Width:          d.terminalWidth,
-		})
+		logger.Debugf("starting shell session_id=%s", s.GetId())
+		s.SetAuthenticatedUser(operator)
+		s.SetBanner(d.sessionBanner(live.banner, s.GetUserId()))
+		//the user is resolved for every session, it may have changed since
+		//the daemon started
+		shellUser, err := shell.LookupShellUser(live.username)
+		var shellCommand string
+		var shellArguments []string
+		if err == nil {
+			shellCommand, shellArguments, err = live.shellCommandLine()
+		}
+		if err == nil {
+			height, width := terminalSize(message.Properties, live.terminalHeight, live.terminalWidth)
+			term, env := terminalEnv(message.Properties, d.terminalString, live.sessionEnv)
+			workingDir := live.sessionWorkingDir
+			if workingDir == "" && live.username != "" {
+				workingDir = shellUser.Home
+			}
+			err = s.StartShell(s.GetId(), session.MenderShellTerminalSettings{
+				Uid:            shellUser.Uid,
+				Gid:            shellUser.Gid,
+				Groups:         shellUser.Groups,
+				UserName:       shellUser.Name,
+				HomeDir:        shellUser.Home,
+				Shell:          shellCommand,
+				ShellArguments: shellArguments,
+				Env:            env,
+				InheritEnv:     live.inheritEnv,
+				TerminalString: term,
+				Height:         height,
+				Width:          width,
+				WorkingDir:     workingDir,
+			})
+		}
 
-		message := "Shell started"
-		status := wsshell.NormalMessage
 		if err != nil {
-			log.Errorf("failed to start shell: %s", err.Error())
-			message = "failed to start shell: " + err.Error()
-			status = wsshell.ErrorMessage
-		} else {
-			log.Debugf("started shell")
-			d.shellsSpawned++
+			logger.Errorf("failed to start shell: %s", err.Error())
+			if newSession {
+				//do not keep the sessions that never had a running shell
+				d.sessions.MenderShellDeleteById(s.GetId())
+			}
+			//MaxSessions limits the shells of all the sessions sharing
+			//the connection; the pre-session script can reject a session
+			closeCode := shell.CloseInternalError
+			if errors.Is(err, session.ErrSessionTooManySessions) || errors.Is(err, session.ErrPreSessionScriptFailed) {
+				closeCode = shell.ClosePolicyDenied
+			}
+			return d.spawnShellFailed(webSock, s.GetId(), err, closeCode)
 		}
+		logger.Debugf("started shell")
+		d.shellsSpawned++
 
 		err = d.responseMessage(webSock, &shell.MenderShellMessage{
 			Type:      wsshell.MessageTypeSpawnShell,
-			Status:    status,
+			Status:    wsshell.NormalMessage,
 			SessionId: s.GetId(),
-			Data:      []byte(message),
+			Data:      []byte("Shell started"),
 		})
 		return err
 	case wsshell.MessageTypeStopShell:
+		d.shellsMutex.Lock()
+		defer d.shellsMutex.Unlock()
 		if len(message.SessionId) < 1 {
 			userId := string(message.Data)
 			if len(userId) < 1 {
-				log.Error("routeMessage: StopShellMessage: sessionId not given and userId empty")
+				logger.Error("routeMessage: StopShellMessage: sessionId not given and userId empty")
 				return errors.New("StopShellMessage: sessionId not given and userId empty")
 			}
-			shellsStoppedCount, err := session.MenderShellStopByUserId(userId)
+			shellsStoppedCount, err := d.sessions.MenderShellStopByUserId(userId)
 			if err == nil {
 				if shellsStoppedCount > d.shellsSpawned {
-					log.Errorf("StopByUserId: the shells stopped count (%d)"+
+					logger.Errorf("StopByUserId: the shells stopped count (%d)"+
 						"greater than total shells spawned (%d). resetting shells"+
 						"spawned to 0.", shellsStoppedCount, d.shellsSpawned)
 					d.shellsSpawned = 0
 				} else {
-					log.Debugf("StopByUserId: stopped %d shells.", shellsStoppedCount)
+					logger.Debugf("StopByUserId: stopped %d shells.", shellsStoppedCount)
 					d.shellsSpawned -= shellsStoppedCount
 				}
 			}
 			return err
 		}
-		s := session.MenderShellSessionGetById(message.SessionId)
+		s := d.sessions.MenderShellSessionGetById(message.SessionId)
 		if s == nil {
-			log.Infof("routeMessage: StopShellMessage: session not found for id %s", message.SessionId)
+			logger.Infof("routeMessage: StopShellMessage: session not found for id %s", message.SessionId)
 			return err
 		}
 
@@ -428,48 +2058,214 @@ func (d *MenderShellDaemon) routeMessage(webSock *connection.Connection, message
 				Data:      []byte("failed to stop shell: " + err.Error()),
 			})
 			if rErr != nil {
-				log.Errorf("failed to send response (%s) to failed stop-shell command (%s)", rErr.Error(), err.Error())
+				logger.Errorf("failed to send response (%s) to failed stop-shell command (%s)", rErr.Error(), err.Error())
 			} else {
-				log.Errorf("failed to stop shell: %s", err.Error())
+				logger.Errorf("failed to stop shell: %s", err.Error())
 			}
 			if procps.ProcessExists(s.GetShellPid()) {
-				log.Errorf("could not terminate shell (pid %d) for session %s, user"+
+				logger.Errorf("could not terminate shell (pid %d) for session %s, user"+
 					"will not be able to start another one if the limit is reached.",
 					s.GetShellPid(),
 					s.GetId())
 				return errors.New("could not terminate shell: " + err.Error() + ".")
 			} else {
-				log.Infof("shell exit rc: %s", err.Error())
+				logger.Infof("shell exit rc: %s", err.Error())
 				if d.shellsSpawned == 0 {
-					log.Error("can't decrement shellsSpawned count: it is 0.")
+					logger.Error("can't decrement shellsSpawned count: it is 0.")
 				} else {
 					d.shellsSpawned--
 				}
 			}
 		} else {
 			if d.shellsSpawned == 0 {
-				log.Error("can't decrement shellsSpawned count: it is 0.")
+				logger.Error("can't decrement shellsSpawned count: it is 0.")
 			} else {
 				d.shellsSpawned--
 			}
 		}
-		return session.MenderShellDeleteById(s.GetId())
+		return d.sessions.MenderShellDeleteById(s.GetId())
 	case wsshell.MessageTypeShellCommand:
-		s := session.MenderShellSessionGetById(message.SessionId)
+		s := d.sessions.MenderShellSessionGetById(message.SessionId)
 		if s == nil {
-			log.Debugf("routeMessage: session not found for id %s", message.SessionId)
+			logger.Debugf("routeMessage: session not found for id %s", message.SessionId)
 			return session.ErrSessionNotFound
 		}
 
 		err = s.ShellCommand(message)
+		if errors.Is(err, session.ErrSessionInputTooLarge) || errors.Is(err, session.ErrSessionInputQueueFull) {
+			return d.responseMessage(webSock, &shell.MenderShellMessage{
+				Type:      wsshell.MessageTypeShellCommand,
+				Status:    wsshell.ErrorMessage,
+				SessionId: message.SessionId,
+				Data:      []byte(err.Error()),
+			})
+		}
+		if err != nil {
+			logger.Debugf("routeMessage: shell command execution error, session_id=%s", message.SessionId)
+			return err
+		}
+	case shell.MessageTypeExecCommand:
+		args := shell.ParseCommandLine(string(message.Data))
+		if !shell.CommandAllowed(args, live.allowedCommands) {
+			logger.Warnf("routeMessage: command not allowed: %q", string(message.Data))
+			return d.responseMessage(webSock, &shell.MenderShellMessage{
+				Type:      shell.MessageTypeExecExit,
+				Status:    wsshell.ErrorMessage,
+				SessionId: message.SessionId,
+				Data:      []byte(shell.ErrCommandNotAllowed.Error() + ": " + string(message.Data)),
+			})
+		}
+
+		shellUser, err := shell.LookupShellUser(live.username)
+		if err != nil {
+			logger.Errorf("failed to run the command: %s", err.Error())
+			return d.responseMessage(webSock, &shell.MenderShellMessage{
+				Type:      shell.MessageTypeExecExit,
+				Status:    wsshell.ErrorMessage,
+				SessionId: message.SessionId,
+				Data:      []byte("failed to run the command: " + err.Error()),
+			})
+		}
+		go d.runCommand(message.SessionId, shellUser, args, live)
+	case filetransfer.MessageTypeUploadStart:
+		return d.startUpload(webSock, message, live)
+	case filetransfer.MessageTypeUploadChunk:
+		return d.uploadChunk(webSock, message)
+	case filetransfer.MessageTypeDownloadRequest:
+		path, _ := message.Properties[filetransfer.PropertyPath].(string)
+		go d.downloadFile(message.SessionId, path, live)
+	case portforward.MessageTypePortForwardOpen:
+		target, _ := message.Properties[portforward.PropertyTarget].(string)
+		go d.openPortForward(message.SessionId, target, live.portForwardTargets)
+	case portforward.MessageTypePortForwardData:
+		return d.portForwardData(message)
+	case portforward.MessageTypePortForwardClose:
+		d.closePortForward(message.SessionId)
+	case shell.MessageTypeResumeSessions:
+		ids, _ := propertyStrings(message.Properties, shell.PropertySessionIds)
+		d.resumeSessions(webSock, ids)
+	case shell.MessageTypeRevoke:
+		ids, _ := propertyStrings(message.Properties, shell.PropertySessionIds)
+		d.revokeSessions(webSock, ids, string(message.Data))
+	case shell.MessageTypeResizeShell:
+		s := d.sessions.MenderShellSessionGetById(message.SessionId)
+		if s == nil {
+			logger.Debugf("routeMessage: session not found for id %s", message.SessionId)
+			return session.ErrSessionNotFound
+		}
+
+		height, width := terminalSize(message.Properties, 0, 0)
+		err = s.ResizeShell(height, width)
 		if err != nil {
-			log.Debugf("routeMessage: shell command execution error, session_id=%s", message.SessionId)
+			logger.Debugf("routeMessage: failed to resize the terminal to %dx%d, session_id=%s: %s",
+				height, width, message.SessionId, err.Error())
 			return err
 		}
 	}
 	return nil
 }
 
+//returns the terminal size carried in the message properties, falling back
+//to the given defaults for the missing ones
+func terminalSize(properties map[string]interface{}, height uint16, width uint16) (uint16, uint16) {
+	if v, ok := propertyUint16(properties, shell.PropertyTerminalHeight); ok {
+		height = v
+	}
+	if v, ok := propertyUint16(properties, shell.PropertyTerminalWidth); ok {
+		width = v
+	}
+	return height, width
+}
+
+//returns the TERM and the environment of a new session: the TERM and the
+//locale variables carried in the message properties override the configured
+//ones for this session only, the invalid ones are ignored
+func terminalEnv(properties map[string]interface{}, term string, env map[string]string) (string, map[string]string) {
+	sessionEnv := make(map[string]string, len(env))
+	for name, value := range env {
+		sessionEnv[name] = value
+	}
+	if v, ok := properties[shell.PropertyTerm].(string); ok && v != "" {
+		if shell.ValidTerm(v) {
+			term = v
+			//the configured TERM would override it
+			delete(sessionEnv, "TERM")
+		} else {
+			log.Warnf("ignoring the invalid TERM %q of the new session", v)
+		}
+	}
+	locale, _ := propertyStrings(properties, shell.PropertyLocale)
+	for _, variable := range locale {
+		nameValue := strings.SplitN(variable, "=", 2)
+		if len(nameValue) != 2 || !shell.ValidLocale(nameValue[0], nameValue[1]) {
+			log.Warnf("ignoring the invalid locale variable %q of the new session", variable)
+			continue
+		}
+		sessionEnv[nameValue[0]] = nameValue[1]
+	}
+	return term, sessionEnv
+}
+
+//msgpack decodes the integers to the smallest type holding the value
+func propertyInt64(properties map[string]interface{}, name string) (int64, bool) {
+	switch v := properties[name].(type) {
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	case float64:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
+
+//returns the list of strings carried in the message property, msgpack
+//decodes the lists as []interface{}
+func propertyStrings(properties map[string]interface{}, name string) ([]string, bool) {
+	switch v := properties[name].(type) {
+	case []string:
+		return v, true
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, value := range v {
+			s, ok := value.(string)
+			if !ok {
+				return nil, false
+			}
+			values = append(values, s)
+		}
+		return values, true
+	default:
+		return nil, false
+	}
+}
+
+func propertyUint16(properties map[string]interface{}, name string) (uint16, bool) {
+	value, ok := propertyInt64(properties, name)
+	if !ok || value <= 0 || value > math.MaxUint16 {
+		return 0, false
+	}
+	return uint16(value), true
+}
+
 func (d *MenderShellDaemon) readMessage(webSock *connection.Connection) (*shell.MenderShellMessage, error) {
 	if webSock == nil {
 		return nil, ErrNilParameterUnexpected
@@ -487,10 +2283,11 @@ func (d *MenderShellDaemon) readMessage(webSock *connection.Connection) (*shell.
 	}
 
 	m := &shell.MenderShellMessage{
-		Type:      msg.Header.MsgType,
-		SessionId: msg.Header.SessionID,
-		Status:    status,
-		Data:      msg.Body,
+		Type:       msg.Header.MsgType,
+		SessionId:  msg.Header.SessionID,
+		Status:     status,
+		Data:       msg.Body,
+		Properties: msg.Header.Properties,
 	}
 
 	return m, nil
@@ -14,6 +14,11 @@
 package app
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"math/rand"
@@ -22,13 +27,16 @@ import (
 	"net/url"
 	"os"
 	"os/user"
+	"path"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/vmihailenco/msgpack"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
@@ -37,8 +45,13 @@ import (
 	dbusmocks "github.com/mendersoftware/mender-shell/client/dbus/mocks"
 	authmocks "github.com/mendersoftware/mender-shell/client/mender/mocks"
 
+	"github.com/mendersoftware/mender-shell/client/mender"
 	"github.com/mendersoftware/mender-shell/config"
 	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/connection/connectiontest"
+	"github.com/mendersoftware/mender-shell/deviceconnect"
+	"github.com/mendersoftware/mender-shell/logging"
+	"github.com/mendersoftware/mender-shell/metrics"
 	"github.com/mendersoftware/mender-shell/session"
 	"github.com/mendersoftware/mender-shell/shell"
 )
@@ -82,10 +95,11 @@ func readMessage(webSock *websocket.Conn) (*shell.MenderShellMessage, error) {
 	}
 
 	m := &shell.MenderShellMessage{
-		Type:      msg.Header.MsgType,
-		SessionId: msg.Header.SessionID,
-		Status:    wsshell.NormalMessage,
-		Data:      msg.Body,
+		Type:       msg.Header.MsgType,
+		SessionId:  msg.Header.SessionID,
+		Status:     wsshell.NormalMessage,
+		Data:       msg.Body,
+		Properties: msg.Header.Properties,
 	}
 
 	return m, nil
@@ -146,7 +160,8 @@ func TestMenderShellSessionStart(t *testing.T) {
 	d := NewDaemon(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
-			User:         currentUser.Name,
+			MaxSessions:  16,
+			User:         currentUser.Username,
 			Terminal: config.TerminalConfig{
 				Width:  24,
 				Height: 80,
@@ -255,7 +270,8 @@ func TestMenderShellStopByUserId(t *testing.T) {
 	d := NewDaemon(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
-			User:         currentUser.Name,
+			MaxSessions:  16,
+			User:         currentUser.Username,
 			Terminal: config.TerminalConfig{
 				Width:  24,
 				Height: 80,
@@ -269,7 +285,7 @@ func TestMenderShellStopByUserId(t *testing.T) {
 		t.Logf("route message error: %s", err.Error())
 	}
 
-	sessions := session.MenderShellSessionsGetByUserId("user-id-unit-tests-a00908-f6723467-561234ff")
+	sessions := d.sessions.MenderShellSessionsGetByUserId("user-id-unit-tests-a00908-f6723467-561234ff")
 	assert.True(t, len(sessions) > 0)
 	assert.NotNil(t, sessions[0])
 	sessionsCount := d.shellsSpawned
@@ -294,26 +310,28 @@ func TestMenderShellStopByUserId(t *testing.T) {
 	assert.Equal(t, sessionsCount-1, d.shellsSpawned)
 }
 
-func newShellMulti(w http.ResponseWriter, r *http.Request) {
-	var upgrader = websocket.Upgrader{}
-	c, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		return
-	}
-	defer c.Close()
-	for i := 0; i < session.MaxUserSessions; i++ {
+//requests one shell more than maxUserSessions
+func newShellMulti(maxUserSessions int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var upgrader = websocket.Upgrader{}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		for i := 0; i < maxUserSessions; i++ {
+			sendMessage(c, wsshell.MessageTypeSpawnShell, "", "user-id-unit-tests-7f00f6723467-561234ff")
+		}
 		sendMessage(c, wsshell.MessageTypeSpawnShell, "", "user-id-unit-tests-7f00f6723467-561234ff")
-	}
-	sendMessage(c, wsshell.MessageTypeSpawnShell, "", "user-id-unit-tests-7f00f6723467-561234ff")
-	time.Sleep(4 * time.Second)
-	for {
 		time.Sleep(4 * time.Second)
+		for {
+			time.Sleep(4 * time.Second)
+		}
 	}
 }
 
 //maxUserSessions controls how many sessions user can have.
 func TestMenderShellSessionLimitPerUser(t *testing.T) {
-	session.MaxUserSessions = 2
 	currentUser, err := user.Current()
 	if err != nil {
 		t.Errorf("cant get current user: %s", err.Error())
@@ -321,7 +339,7 @@ func TestMenderShellSessionLimitPerUser(t *testing.T) {
 	}
 
 	t.Log("starting mock httpd with websockets")
-	s := httptest.NewServer(http.HandlerFunc(newShellMulti))
+	s := httptest.NewServer(newShellMulti(2))
 	defer s.Close()
 
 	u := "ws" + strings.TrimPrefix(s.URL, "http")
@@ -336,15 +354,19 @@ func TestMenderShellSessionLimitPerUser(t *testing.T) {
 	d := NewDaemon(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
-			User:         currentUser.Name,
+			MaxSessions:  16,
+			User:         currentUser.Username,
 			Terminal: config.TerminalConfig{
 				Width:  24,
 				Height: 80,
 			},
 		},
 	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 2
+	})
 
-	for i := 0; i < session.MaxUserSessions; i++ {
+	for i := 0; i < d.sessions.Settings().MaxUserSessions; i++ {
 		message, err := d.readMessage(ws)
 		assert.NoError(t, err)
 		assert.NotNil(t, message)
@@ -375,7 +397,7 @@ func TestMenderShellStopDaemon(t *testing.T) {
 	d := NewDaemon(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
-			User:         currentUser.Name,
+			User:         currentUser.Username,
 			Terminal: config.TerminalConfig{
 				Width:  24,
 				Height: 80,
@@ -384,9 +406,11 @@ func TestMenderShellStopDaemon(t *testing.T) {
 	})
 
 	assert.True(t, !d.shouldStop())
+	assert.Equal(t, connection.StateDisconnected, d.ConnectionState())
 	d.PrintStatus()
 	d.StopDaemon()
 	assert.True(t, d.shouldStop())
+	assert.Equal(t, connection.StateShuttingDown, d.ConnectionState())
 }
 
 func oneMsgMainServerLoop(w http.ResponseWriter, r *http.Request) {
@@ -406,153 +430,1824 @@ func oneMsgMainServerLoop(w http.ResponseWriter, r *http.Request) {
 				"status": wsshell.NormalMessage,
 			},
 		},
-		Body: []byte("hello ws"),
+		Body: []byte("hello ws"),
+	}
+
+	data, err := msgpack.Marshal(m)
+	c.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	c.WriteMessage(websocket.BinaryMessage, data)
+
+	for {
+		time.Sleep(1 * time.Second)
+	}
+}
+
+func TestMenderShellReadMessage(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         currentUser.Username,
+			Terminal: config.TerminalConfig{
+				Width:  24,
+				Height: 80,
+			},
+		},
+	})
+
+	t.Log("starting mock httpd with websockets")
+	s := httptest.NewServer(http.HandlerFunc(oneMsgMainServerLoop))
+	defer s.Close()
+
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	urlString, err := url.Parse(u)
+	assert.NoError(t, err)
+	assert.NotNil(t, urlString)
+
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 526, 16*time.Second, true, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, ws)
+
+	time.Sleep(2 * time.Second)
+	m, err := d.readMessage(ws)
+	assert.NoError(t, err)
+	assert.NotNil(t, m)
+	assert.Equal(t, m.Data, []byte("hello ws"))
+	time.Sleep(2 * time.Second)
+
+	ws.Close()
+	m, err = d.readMessage(ws)
+	assert.Error(t, err)
+	assert.Nil(t, m)
+}
+
+func TestMenderShellWsReconnect(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         currentUser.Username,
+			Terminal: config.TerminalConfig{
+				Width:  24,
+				Height: 80,
+			},
+		},
+	})
+
+	t.Log("starting mock httpd with websockets")
+	s := httptest.NewServer(http.HandlerFunc(oneMsgMainServerLoop))
+	defer s.Close()
+
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	urlString, err := url.Parse(u)
+	assert.NoError(t, err)
+	assert.NotNil(t, urlString)
+
+	ws, err := connection.NewConnection(*urlString, "token", time.Second, 526, time.Second, true, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, ws)
+
+	t.Log("attempting reconnect")
+	d.setServerUrl(u)
+	ws, err = d.wsReconnect("atoken")
+	assert.NotNil(t, ws)
+	assert.NoError(t, err)
+}
+
+func TestMenderShellWsReconnectDialer(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ServerURL: "http://mender.invalid",
+		},
+	})
+	d.reconnectBackoff.SetIntervals(time.Millisecond, time.Millisecond, 0)
+	dialer := connectiontest.NewDialer(http.HandlerFunc(oneMsgMainServerLoop))
+	defer dialer.Close()
+	d.SetDialer(dialer)
+
+	//the link comes back after two failed attempts
+	dialer.Fail(errors.New("link down"))
+	go func() {
+		for len(dialer.Addresses()) < 2 {
+			time.Sleep(time.Millisecond)
+		}
+		dialer.Fail(nil)
+	}()
+	ws, err := d.wsReconnect("atoken")
+	assert.NoError(t, err)
+	assert.NotNil(t, ws)
+	defer ws.Close()
+	addresses := dialer.Addresses()
+	assert.True(t, len(addresses) >= 3)
+	assert.Equal(t, "mender.invalid:80", addresses[0])
+	assert.Equal(t, uint(0), d.reconnectBreaker.Failures())
+}
+
+func TestMenderShellWsReconnectWindow(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ServerURL:       "http://127.0.0.1:1",
+			ReconnectWindow: 2,
+		},
+	})
+
+	maxReconnectAttempts := config.MaxReconnectAttempts
+	config.MaxReconnectAttempts = 128
+	defer func() {
+		config.MaxReconnectAttempts = maxReconnectAttempts
+	}()
+
+	start := time.Now()
+	ws, err := d.wsReconnect("atoken")
+	assert.Nil(t, ws)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < 8*time.Second)
+}
+
+func TestMenderShellWsReconnectShutdown(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ServerURL:            "http://127.0.0.1:1",
+			ReconnectIntervalMin: 60,
+			ReconnectIntervalMax: 60,
+		},
+	})
+	go func() {
+		time.Sleep(time.Second)
+		d.StopDaemon()
+	}()
+	start := time.Now()
+	ws, err := d.wsReconnect("atoken")
+	assert.Nil(t, ws)
+	assert.Equal(t, ErrShuttingDown, err)
+	assert.True(t, time.Since(start) < 4*time.Second)
+}
+
+func TestMenderShellWsReconnectCircuitBreaker(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ServerURL: "http://127.0.0.1:1",
+		},
+	})
+	d.reconnectBackoff.SetIntervals(time.Millisecond, time.Millisecond, 0)
+	d.reconnectBreaker.SetLimits(2, 200*time.Millisecond)
+
+	maxReconnectAttempts := config.MaxReconnectAttempts
+	config.MaxReconnectAttempts = 4
+	defer func() {
+		config.MaxReconnectAttempts = maxReconnectAttempts
+	}()
+
+	//the third and the fourth attempts wait for the cooldown
+	start := time.Now()
+	ws, err := d.wsReconnect("atoken")
+	assert.Nil(t, ws)
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+	assert.True(t, d.reconnectBreaker.Open())
+	assert.Equal(t, uint(4), d.reconnectBreaker.Failures())
+
+	buf := &bytes.Buffer{}
+	d.metrics.WriteTo(buf)
+	assert.Contains(t, buf.String(), "mender_shell_reconnect_circuit_open 1\n")
+	assert.Contains(t, buf.String(), "mender_shell_reconnect_circuit_opened_total 1\n")
+
+	//the probe reaching the server closes the breaker
+	s := httptest.NewServer(http.HandlerFunc(oneMsgMainServerLoop))
+	defer s.Close()
+	d.setServerUrl("ws" + strings.TrimPrefix(s.URL, "http"))
+	ws, err = d.wsReconnect("atoken")
+	assert.NotNil(t, ws)
+	assert.NoError(t, err)
+	assert.False(t, d.reconnectBreaker.Open())
+	assert.Equal(t, uint(0), d.reconnectBreaker.Failures())
+
+	buf.Reset()
+	d.metrics.WriteTo(buf)
+	assert.Contains(t, buf.String(), "mender_shell_reconnect_circuit_open 0\n")
+}
+
+var idleSessionMessages = make(chan *shell.MenderShellMessage, 64)
+
+func idleSessionServerLoop(w http.ResponseWriter, r *http.Request) {
+	var upgrader = websocket.Upgrader{}
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	for {
+		m, err := readMessage(c)
+		if err != nil {
+			return
+		}
+		idleSessionMessages <- m
+	}
+}
+
+func waitForIdleSessionMessage(messageType string, timeout time.Duration) *shell.MenderShellMessage {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case m := <-idleSessionMessages:
+			if m.Type == messageType {
+				return m
+			}
+		case <-deadline:
+			return nil
+		}
+	}
+}
+
+//the close code of a stop shell or spawn shell message
+func messageCloseCode(m *shell.MenderShellMessage) shell.CloseCode {
+	code, _ := propertyInt64(m.Properties, shell.PropertyCloseCode)
+	return shell.CloseCode(code)
+}
+
+//connects to a new test server running handler, with a short write timeout:
+//StopShell waits twice the write timeout; both are closed with the test
+func newTestConnection(t *testing.T, handler http.HandlerFunc) *connection.Connection {
+	s := httptest.NewServer(handler)
+	t.Cleanup(s.Close)
+	u, err := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+	assert.NoError(t, err)
+	ws, err := connection.NewConnection(*u, "token", time.Second, 526, 16*time.Second, true, "")
+	if err != nil {
+		t.Fatalf("can't connect to the test server: %s", err.Error())
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+//returns the current user, the shells of the tests run as, and its ids
+func currentShellUser(t *testing.T) (*user.User, uint32, uint32) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Fatalf("cant get current user: %s", err.Error())
+	}
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+	return currentUser, uint32(uid), uint32(gid)
+}
+
+func TestMenderShellTerminateIdleSessions(t *testing.T) {
+	currentUser, uid, gid := currentShellUser(t)
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:       "/bin/sh",
+			MaxSessions:        16,
+			User:               currentUser.Username,
+			IdleTimeoutSeconds: 2,
+		},
+	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 2
+	})
+	d.idleTimeoutGracePeriod = 2 * time.Second
+	d.setWebSock(ws)
+
+	userSession, err := d.sessions.NewMenderShellSession(d.writeMutex, ws, "user-id-unit-tests-idle-timeout",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = userSession.StartShell(userSession.GetId(), session.MenderShellTerminalSettings{
+		Uid:            uid,
+		Gid:            gid,
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         24,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	d.shellsSpawned++
+
+	d.terminateIdleSessions()
+	assert.False(t, userSession.IsIdleWarned())
+
+	time.Sleep(3 * time.Second)
+	d.terminateIdleSessions()
+	assert.True(t, userSession.IsIdleWarned())
+	assert.NotNil(t, d.sessions.MenderShellSessionGetById(userSession.GetId()))
+
+	//any input resets the idle timer and the warning
+	err = userSession.ShellCommand(&shell.MenderShellMessage{
+		Type:      wsshell.MessageTypeShellCommand,
+		SessionId: userSession.GetId(),
+		Data:      []byte("echo;\n"),
+	})
+	assert.NoError(t, err)
+	assert.False(t, userSession.IsIdleWarned())
+	d.terminateIdleSessions()
+	assert.False(t, userSession.IsIdleWarned())
+
+	time.Sleep(3 * time.Second)
+	d.terminateIdleSessions()
+	assert.True(t, userSession.IsIdleWarned())
+	time.Sleep(3 * time.Second)
+	d.terminateIdleSessions()
+	assert.Nil(t, d.sessions.MenderShellSessionGetById(userSession.GetId()))
+	assert.Equal(t, uint(0), d.shellsSpawned)
+
+	m := waitForIdleSessionMessage(wsshell.MessageTypeStopShell, 8*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, userSession.GetId(), m.SessionId)
+		assert.Equal(t, SessionTimedOutMessage, string(m.Data))
+		assert.Equal(t, shell.CloseIdleTimeout, messageCloseCode(m))
+	}
+}
+
+func TestMenderShellTerminateAbandonedSessions(t *testing.T) {
+	currentUser, uid, gid := currentShellUser(t)
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:               "/bin/sh",
+			MaxSessions:                16,
+			User:                       currentUser.Username,
+			InitialInputTimeoutSeconds: 2,
+		},
+	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 2
+	})
+	assert.Equal(t, 2*time.Second, d.liveConfig().initialInputTimeout)
+	d.setWebSock(ws)
+
+	startSession := func(userId string) *session.MenderShellSession {
+		userSession, err := d.sessions.NewMenderShellSession(d.writeMutex, ws, userId,
+			session.NoExpirationTimeout, session.NoExpirationTimeout)
+		assert.NoError(t, err)
+		err = userSession.StartShell(userSession.GetId(), session.MenderShellTerminalSettings{
+			Uid:            uid,
+			Gid:            gid,
+			Shell:          "/bin/sh",
+			TerminalString: "xterm-256color",
+			Height:         24,
+			Width:          80,
+		})
+		assert.NoError(t, err)
+		d.shellsSpawned++
+		return userSession
+	}
+	abandonedSession := startSession("user-id-unit-tests-abandoned")
+	defer d.sessions.MenderShellDeleteById(abandonedSession.GetId())
+	usedSession := startSession("user-id-unit-tests-used")
+	defer d.sessions.MenderShellDeleteById(usedSession.GetId())
+
+	d.terminateAbandonedSessions()
+	assert.NotNil(t, d.sessions.MenderShellSessionGetById(abandonedSession.GetId()))
+
+	//any input cancels the timeout
+	err := usedSession.ShellCommand(&shell.MenderShellMessage{
+		Type:      wsshell.MessageTypeShellCommand,
+		SessionId: usedSession.GetId(),
+		Data:      []byte("\n"),
+	})
+	assert.NoError(t, err)
+
+	time.Sleep(2500 * time.Millisecond)
+	d.terminateAbandonedSessions()
+	assert.Nil(t, d.sessions.MenderShellSessionGetById(abandonedSession.GetId()))
+	assert.NotNil(t, d.sessions.MenderShellSessionGetById(usedSession.GetId()))
+	assert.Equal(t, uint(1), d.shellsSpawned)
+
+	m := waitForIdleSessionMessage(wsshell.MessageTypeStopShell, 8*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, abandonedSession.GetId(), m.SessionId)
+		assert.Equal(t, SessionAbandonedMessage, string(m.Data))
+		assert.Equal(t, shell.CloseInitialInputTimeout, messageCloseCode(m))
+	}
+}
+
+func TestMenderShellTerminateLongSessions(t *testing.T) {
+	currentUser, uid, gid := currentShellUser(t)
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:              "/bin/sh",
+			MaxSessions:               16,
+			User:                      currentUser.Username,
+			MaxSessionDurationSeconds: 4,
+		},
+	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 2
+	})
+	d.maxDurationWarning = 2 * time.Second
+	d.setWebSock(ws)
+
+	userSession, err := d.sessions.NewMenderShellSession(d.writeMutex, ws, "user-id-unit-tests-max-duration",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = userSession.StartShell(userSession.GetId(), session.MenderShellTerminalSettings{
+		Uid:            uid,
+		Gid:            gid,
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         24,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	d.shellsSpawned++
+
+	d.terminateLongSessions()
+	assert.False(t, userSession.IsDurationWarned())
+
+	time.Sleep(2500 * time.Millisecond)
+	d.terminateLongSessions()
+	assert.True(t, userSession.IsDurationWarned())
+	assert.NotNil(t, d.sessions.MenderShellSessionGetById(userSession.GetId()))
+
+	//unlike the idle timeout, the input does not extend the session
+	err = userSession.ShellCommand(&shell.MenderShellMessage{
+		Type:      wsshell.MessageTypeShellCommand,
+		SessionId: userSession.GetId(),
+		Data:      []byte("echo;\n"),
+	})
+	assert.NoError(t, err)
+
+	time.Sleep(2 * time.Second)
+	d.terminateLongSessions()
+	assert.Nil(t, d.sessions.MenderShellSessionGetById(userSession.GetId()))
+	assert.Equal(t, uint(0), d.shellsSpawned)
+
+	m := waitForIdleSessionMessage(wsshell.MessageTypeStopShell, 8*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, userSession.GetId(), m.SessionId)
+		assert.Equal(t, SessionMaxDurationMessage, string(m.Data))
+		assert.Equal(t, shell.CloseMaxDuration, messageCloseCode(m))
+	}
+}
+
+func TestMenderShellCloseExitedShells(t *testing.T) {
+	currentUser, uid, gid := currentShellUser(t)
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	testCases := map[string]struct {
+		command   string
+		respawn   bool
+		status    wsshell.MenderShellMessageStatus
+		exitCode  int
+		signal    interface{}
+		respawned bool
+		closeCode shell.CloseCode
+	}{
+		"exit": {
+			command:   "exit 3\n",
+			status:    wsshell.NormalMessage,
+			exitCode:  3,
+			closeCode: shell.CloseNormalExit,
+		},
+		"exit, respawn enabled": {
+			command:   "exit\n",
+			respawn:   true,
+			status:    wsshell.NormalMessage,
+			exitCode:  0,
+			closeCode: shell.CloseNormalExit,
+		},
+		"crash": {
+			command:   "kill -SEGV $$\n",
+			status:    wsshell.ErrorMessage,
+			exitCode:  -1,
+			signal:    "segmentation fault",
+			closeCode: shell.CloseInternalError,
+		},
+		"crash, respawned": {
+			command:   "kill -SEGV $$\n",
+			respawn:   true,
+			status:    wsshell.ErrorMessage,
+			exitCode:  -1,
+			signal:    "segmentation fault",
+			respawned: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand: "/bin/sh",
+					MaxSessions:  16,
+					User:         currentUser.Username,
+					RespawnShell: tc.respawn,
+				},
+			})
+			d.setWebSock(ws)
+
+			userSession, err := d.sessions.NewMenderShellSession(d.writeMutex, ws, "user-id-unit-tests-shell-exit",
+				session.NoExpirationTimeout, session.NoExpirationTimeout)
+			assert.NoError(t, err)
+			defer d.sessions.MenderShellDeleteById(userSession.GetId())
+			err = userSession.StartShell(userSession.GetId(), session.MenderShellTerminalSettings{
+				Uid:            uid,
+				Gid:            gid,
+				Shell:          "/bin/sh",
+				TerminalString: "xterm-256color",
+				Height:         24,
+				Width:          80,
+			})
+			assert.NoError(t, err)
+			d.shellsSpawned++
+			pid := userSession.GetShellPid()
+
+			//a running shell is left alone
+			d.closeExitedShells()
+			assert.Equal(t, session.ActiveSession, userSession.GetStatus())
+
+			err = userSession.ShellCommand(&shell.MenderShellMessage{Data: []byte(tc.command)})
+			assert.NoError(t, err)
+			assert.Eventually(t, func() bool {
+				return userSession.ShellExited() != nil
+			}, 4*time.Second, 100*time.Millisecond)
+			d.closeExitedShells()
+
+			m := waitForIdleSessionMessage(shell.MessageTypeShellExit, 4*time.Second)
+			if assert.NotNil(t, m) {
+				assert.Equal(t, userSession.GetId(), m.SessionId)
+				assert.EqualValues(t, tc.status, m.Properties["status"])
+				assert.EqualValues(t, tc.exitCode, m.Properties[shell.PropertyExitCode])
+				assert.Equal(t, tc.signal, m.Properties[shell.PropertySignal])
+			}
+
+			if tc.respawned {
+				assert.Equal(t, session.ActiveSession, userSession.GetStatus())
+				assert.NotEqual(t, pid, userSession.GetShellPid())
+				assert.Equal(t, 1, userSession.GetRespawnCount())
+				assert.Equal(t, uint(1), d.shellsSpawned)
+				assert.Nil(t, userSession.ShellExited())
+				assert.NoError(t, userSession.StopShell())
+				return
+			}
+			assert.Equal(t, session.EmptySession, userSession.GetStatus())
+			assert.Nil(t, d.sessions.MenderShellSessionGetById(userSession.GetId()))
+			assert.Equal(t, uint(0), d.shellsSpawned)
+			m = waitForIdleSessionMessage(wsshell.MessageTypeStopShell, 4*time.Second)
+			if assert.NotNil(t, m) {
+				assert.Equal(t, userSession.GetId(), m.SessionId)
+				assert.EqualValues(t, tc.status, m.Properties["status"])
+				assert.Equal(t, tc.closeCode, messageCloseCode(m))
+			}
+		})
+	}
+}
+
+func TestMenderShellKillSession(t *testing.T) {
+	currentUser, uid, gid := currentShellUser(t)
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			MaxSessions:  16,
+			User:         currentUser.Username,
+		},
+	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 2
+	})
+	d.setWebSock(ws)
+
+	userSession, err := d.sessions.NewMenderShellSession(d.writeMutex, ws, "user-id-unit-tests-kill",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer d.sessions.MenderShellDeleteById(userSession.GetId())
+	assert.Equal(t, session.ErrSessionShellNotRunning, d.KillSession(userSession.GetId()))
+
+	err = userSession.StartShell(userSession.GetId(), session.MenderShellTerminalSettings{
+		Uid:            uid,
+		Gid:            gid,
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         24,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	d.shellsSpawned++
+
+	sessions := d.activeSessions()
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, userSession.GetId(), sessions[0].SessionID)
+		assert.Equal(t, "user-id-unit-tests-kill", sessions[0].UserID)
+		assert.Equal(t, userSession.GetStartedAt().Format(time.RFC3339), sessions[0].StartedAt)
+	}
+
+	assert.Equal(t, session.ErrSessionNotFound, d.KillSession("not-a-session-id"))
+	assert.NoError(t, d.KillSession(userSession.GetId()))
+	//the session is terminated by the main loop
+	assert.NotNil(t, d.sessions.MenderShellSessionGetById(userSession.GetId()))
+	d.killRequestedSessions()
+	assert.Nil(t, d.sessions.MenderShellSessionGetById(userSession.GetId()))
+	assert.Equal(t, uint(0), d.shellsSpawned)
+	assert.Empty(t, d.sessionsToKill())
+
+	//a session the message loop stopped in the meantime is left alone
+	d.shellsSpawned++
+	d.terminateSession(ws, userSession, SessionKilledMessage, shell.ClosePolicyDenied)
+	assert.Equal(t, uint(1), d.shellsSpawned)
+	d.shellsSpawned--
+
+	m := waitForIdleSessionMessage(wsshell.MessageTypeStopShell, 8*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, userSession.GetId(), m.SessionId)
+		assert.Equal(t, SessionKilledMessage, string(m.Data))
+		assert.Equal(t, shell.ClosePolicyDenied, messageCloseCode(m))
+	}
+}
+
+func TestMenderShellRevokeSessions(t *testing.T) {
+	currentUser, uid, gid := currentShellUser(t)
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	provider := &authmocks.TokenProvider{}
+	defer provider.AssertExpectations(t)
+	provider.On("Refresh").Return("", mender.ErrUnauthorized)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			MaxSessions:  16,
+			User:         currentUser.Username,
+		},
+	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 2
+	})
+	d.tokenProvider = provider
+	d.setWebSock(ws)
+
+	startSession := func(userId string) *session.MenderShellSession {
+		userSession, err := d.sessions.NewMenderShellSession(d.writeMutex, ws, userId,
+			session.NoExpirationTimeout, session.NoExpirationTimeout)
+		assert.NoError(t, err)
+		err = userSession.StartShell(userSession.GetId(), session.MenderShellTerminalSettings{
+			Uid:            uid,
+			Gid:            gid,
+			Shell:          "/bin/sh",
+			TerminalString: "xterm-256color",
+			Height:         24,
+			Width:          80,
+		})
+		assert.NoError(t, err)
+		d.shellsSpawned++
+		return userSession
+	}
+	revokedSession := startSession("user-id-unit-tests-revoked")
+	defer d.sessions.MenderShellDeleteById(revokedSession.GetId())
+	otherSession := startSession("user-id-unit-tests-other")
+	defer d.sessions.MenderShellDeleteById(otherSession.GetId())
+
+	//the server revokes the sessions of a user
+	err := d.routeMessage(ws, &shell.MenderShellMessage{
+		Type: shell.MessageTypeRevoke,
+		Data: []byte("user-id-unit-tests-revoked"),
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, d.sessions.MenderShellSessionGetById(revokedSession.GetId()))
+	assert.NotNil(t, d.sessions.MenderShellSessionGetById(otherSession.GetId()))
+	assert.Equal(t, uint(1), d.shellsSpawned)
+
+	m := waitForIdleSessionMessage(wsshell.MessageTypeStopShell, 8*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, revokedSession.GetId(), m.SessionId)
+		assert.Equal(t, SessionRevokedMessage, string(m.Data))
+		assert.Equal(t, shell.CloseRevoked, messageCloseCode(m))
+	}
+
+	//the device is not authorized anymore when refreshing the token
+	assert.Equal(t, "token", d.refreshJWTToken("token"))
+	assert.Nil(t, d.sessions.MenderShellSessionGetById(otherSession.GetId()))
+	assert.Equal(t, uint(0), d.shellsSpawned)
+}
+
+func TestMenderShellResumeSessions(t *testing.T) {
+	currentUser, uid, gid := currentShellUser(t)
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			MaxSessions:  16,
+			User:         currentUser.Username,
+		},
+	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 2
+	})
+	d.setWebSock(ws)
+
+	var sessions []*session.MenderShellSession
+	for i := 0; i < 2; i++ {
+		userSession, err := d.sessions.NewMenderShellSession(d.writeMutex, ws, "user-id-unit-tests-resume",
+			session.NoExpirationTimeout, session.NoExpirationTimeout)
+		assert.NoError(t, err)
+		err = userSession.StartShell(userSession.GetId(), session.MenderShellTerminalSettings{
+			Uid:            uid,
+			Gid:            gid,
+			Shell:          "/bin/sh",
+			TerminalString: "xterm-256color",
+			Height:         24,
+			Width:          80,
+		})
+		assert.NoError(t, err)
+		d.shellsSpawned++
+		sessions = append(sessions, userSession)
+	}
+	resumed, lost := sessions[0], sessions[1]
+
+	err := resumed.ShellCommand(&shell.MenderShellMessage{
+		Type:      wsshell.MessageTypeShellCommand,
+		SessionId: resumed.GetId(),
+		Data:      []byte("echo scrollback-$((40+2))\n"),
+	})
+	assert.NoError(t, err)
+	time.Sleep(time.Second)
+
+	err = d.routeMessage(ws, &shell.MenderShellMessage{
+		Type: shell.MessageTypeResumeSessions,
+		Properties: map[string]interface{}{
+			shell.PropertySessionIds: []interface{}{resumed.GetId(), "server-only-session"},
+		},
+	})
+	assert.NoError(t, err)
+
+	assert.NotNil(t, d.sessions.MenderShellSessionGetById(resumed.GetId()))
+	assert.Nil(t, d.sessions.MenderShellSessionGetById(lost.GetId()))
+	assert.Equal(t, uint(1), d.shellsSpawned)
+
+	m := waitForIdleSessionMessage(shell.MessageTypeSessionResumed, 8*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, resumed.GetId(), m.SessionId)
+		assert.Contains(t, string(m.Data), "scrollback-42")
+		assert.Equal(t, true, m.Properties[shell.PropertyReplay])
+	}
+	m = waitForIdleSessionMessage(wsshell.MessageTypeStopShell, 8*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, "server-only-session", m.SessionId)
+		assert.Equal(t, session.ErrSessionNotFound.Error(), string(m.Data))
+		assert.Equal(t, shell.CloseInternalError, messageCloseCode(m))
+	}
+	d.sessions.MenderSessionTerminateAll()
+}
+
+func TestMenderShellGracefulShutdown(t *testing.T) {
+	currentUser, uid, gid := currentShellUser(t)
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:               "/bin/sh",
+			MaxSessions:                16,
+			User:                       currentUser.Username,
+			ShutdownGracePeriodSeconds: 2,
+		},
+	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 2
+	})
+	d.setWebSock(ws)
+
+	userSession, err := d.sessions.NewMenderShellSession(d.writeMutex, ws, "user-id-unit-tests-shutdown",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = userSession.StartShell(userSession.GetId(), session.MenderShellTerminalSettings{
+		Uid:            uid,
+		Gid:            gid,
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         24,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	d.shellsSpawned++
+
+	d.StopDaemon()
+	d.gracefulShutdown()
+	//a second SIGTERM does not shut down again
+	d.StopDaemon()
+	d.gracefulShutdown()
+
+	assert.Nil(t, d.sessions.MenderShellSessionGetById(userSession.GetId()))
+	assert.Equal(t, uint(0), d.shellsSpawned)
+	assert.Equal(t, connection.StateShuttingDown, d.ConnectionState())
+
+	var output []byte
+	for {
+		m := waitForIdleSessionMessage(wsshell.MessageTypeShellCommand, 4*time.Second)
+		if !assert.NotNil(t, m) {
+			break
+		}
+		output = append(output, m.Data...)
+		if strings.Contains(string(output), SessionShutdownMessage) {
+			break
+		}
+	}
+	m := waitForIdleSessionMessage(wsshell.MessageTypeStopShell, 4*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, userSession.GetId(), m.SessionId)
+		assert.Equal(t, SessionShutdownMessage, string(m.Data))
+		assert.Equal(t, shell.CloseShutdown, messageCloseCode(m))
+	}
+	assert.Nil(t, waitForIdleSessionMessage(wsshell.MessageTypeStopShell, time.Second))
+}
+
+func TestRefreshJWTToken(t *testing.T) {
+	testCases := map[string]struct {
+		fetchToken string
+		fetchErr   error
+		getToken   string
+		getErr     error
+		token      string
+		refreshed  bool
+
+		unauthorized bool
+	}{
+		"ok, fetched": {
+			fetchToken: "fresh",
+			token:      "fresh",
+			refreshed:  true,
+		},
+		"ok, fetch failed, get": {
+			fetchErr: errors.New("fetch error"),
+			getToken: "current",
+			token:    "current",
+		},
+		"ok, fetch and get failed": {
+			fetchErr: errors.New("fetch error"),
+			getErr:   errors.New("get error"),
+			token:    "old",
+		},
+		"ok, unauthorized": {
+			fetchErr:     mender.ErrUnauthorized,
+			unauthorized: true,
+			token:        "old",
+		},
+		"ok, unauthorized, no token": {
+			unauthorized: true,
+			token:        "old",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			provider := &authmocks.TokenProvider{}
+			defer provider.AssertExpectations(t)
+			provider.On("Refresh").Return(tc.fetchToken, tc.fetchErr)
+			if tc.fetchErr != nil && !tc.unauthorized {
+				provider.On("Token").Return(tc.getToken, tc.getErr)
+			}
+
+			d := &MenderShellDaemon{tokenProvider: provider, metrics: metrics.NewMetrics(), sessions: session.NewRegistry(nil)}
+			assert.Equal(t, tc.token, d.refreshJWTToken("old"))
+
+			var output bytes.Buffer
+			d.metrics.WriteTo(&output)
+			if tc.refreshed {
+				assert.Contains(t, output.String(), "mender_shell_token_refreshes_total 1\n")
+			} else {
+				assert.Contains(t, output.String(), "mender_shell_token_refreshes_total 0\n")
+			}
+		})
+	}
+}
+
+func TestMenderShellMaxShellsLimit(t *testing.T) {
+	defer func(max uint) {
+		config.MaxShellsSpawned = max
+	}(config.MaxShellsSpawned)
+	config.MaxShellsSpawned = 2
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+
+	t.Log("starting mock httpd with websockets")
+	s := httptest.NewServer(newShellMulti(4))
+	defer s.Close()
+
+	u := "ws" + strings.TrimPrefix(s.URL, "http")
+	urlString, err := url.Parse(u)
+	assert.NoError(t, err)
+	assert.NotNil(t, urlString)
+
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 526, 16*time.Second, true, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, ws)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			MaxSessions:  16,
+			User:         currentUser.Username,
+			Terminal: config.TerminalConfig{
+				Width:  24,
+				Height: 80,
+			},
+		},
+	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 4
+	})
+
+	for i := 0; i < int(config.MaxShellsSpawned); i++ {
+		time.Sleep(time.Second)
+		message, err := d.readMessage(ws)
+		assert.NoError(t, err)
+		assert.NotNil(t, message)
+		t.Logf("read message: type, session_id, data %s, %s, %s", message.Type, message.SessionId, message.Data)
+		err = d.routeMessage(ws, message)
+		if err != nil {
+			t.Logf("route message error: %s", err.Error())
+		}
+		assert.NoError(t, err)
+	}
+
+	message, err := d.readMessage(ws)
+	t.Logf("read message: type, session_id, data %s, %s, %s", message.Type, message.SessionId, message.Data)
+	err = d.routeMessage(ws, message)
+	if err != nil {
+		t.Logf("route message error: %s", err.Error())
+	}
+	assert.Error(t, err)
+}
+
+func TestMenderShellMaxSessions(t *testing.T) {
+	currentUser, _, _ := currentShellUser(t)
+
+	ws := newTestConnection(t, newShellMulti(4))
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         currentUser.Username,
+		},
+	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 4
+	})
+	assert.Equal(t, config.DefaultMaxSessions, d.sessions.Settings().MaxSessions)
+
+	for i := 0; i < 2; i++ {
+		message, err := d.readMessage(ws)
+		assert.NoError(t, err)
+		assert.NotNil(t, message)
+		err = d.routeMessage(ws, message)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, uint(1), d.shellsSpawned)
+	assert.Equal(t, 1, d.sessions.MenderShellSessionGetActiveCount())
+	assert.Equal(t, 1, d.sessions.MenderShellSessionGetCount())
+
+	d.sessions.MenderSessionTerminateAll()
+}
+
+func TestMenderShellSpawnShellUnknownUser(t *testing.T) {
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			User:         "thisoneisnotknown",
+		},
+	})
+
+	err := d.routeMessage(ws, &shell.MenderShellMessage{
+		Type: wsshell.MessageTypeSpawnShell,
+		Data: []byte("user-id-unit-tests-unknown-user"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint(0), d.shellsSpawned)
+	assert.Equal(t, 0, d.sessions.MenderShellSessionGetCount())
+
+	m := waitForIdleSessionMessage(wsshell.MessageTypeSpawnShell, 8*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Contains(t, string(m.Data), "failed to start shell")
+		assert.Contains(t, string(m.Data), "thisoneisnotknown")
+		assert.Equal(t, shell.CloseInternalError, messageCloseCode(m))
+	}
+}
+
+func TestMenderShellSpawnShellPreSessionScriptFailed(t *testing.T) {
+	currentUser, _, _ := currentShellUser(t)
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:     "/bin/sh",
+			User:             currentUser.Username,
+			PreSessionScript: "/bin/false",
+		},
+	})
+
+	err := d.routeMessage(ws, &shell.MenderShellMessage{
+		Type: wsshell.MessageTypeSpawnShell,
+		Data: []byte("user-id-unit-tests-pre-session-script"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint(0), d.shellsSpawned)
+	assert.Equal(t, 0, d.sessions.MenderShellSessionGetCount())
+
+	m := waitForIdleSessionMessage(wsshell.MessageTypeSpawnShell, 8*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, "failed to start shell: pre-session script failed: exit status 1", string(m.Data))
+		assert.Equal(t, shell.ClosePolicyDenied, messageCloseCode(m))
+	}
+}
+
+func TestMenderShellSpawnShellNotAuthorized(t *testing.T) {
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand:        "/bin/sh",
+			AuthorizedUsers:     []string{"admin@example.com"},
+			AuthorizedUserClaim: "mender.user",
+		},
+	})
+	payload, _ := json.Marshal(map[string]interface{}{"sub": "device", "mender.user": "guest@example.com"})
+	d.setAuthenticatedUser("eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".")
+	assert.Equal(t, "guest@example.com", d.authenticatedUser)
+
+	err := d.routeMessage(ws, &shell.MenderShellMessage{
+		Type: wsshell.MessageTypeSpawnShell,
+		Data: []byte("user-id-unit-tests-not-authorized"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint(0), d.shellsSpawned)
+	assert.Equal(t, 0, d.sessions.MenderShellSessionGetCount())
+
+	m := waitForIdleSessionMessage(wsshell.MessageTypeSpawnShell, 8*time.Second)
+	if assert.NotNil(t, m) {
+		assert.Equal(t, "failed to start shell: "+ErrUserNotAuthorized.Error(), string(m.Data))
+		assert.Equal(t, shell.ClosePolicyDenied, messageCloseCode(m))
+	}
+}
+
+func TestMenderShellMultiplexedSessions(t *testing.T) {
+	currentUser, _, _ := currentShellUser(t)
+
+	ws := newTestConnection(t, idleSessionServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			MaxSessions:  2,
+			User:         currentUser.Username,
+		},
+	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 3
+	})
+	defer d.sessions.MenderSessionTerminateAll()
+	d.setWebSock(ws)
+
+	//the sessions share the connection, their messages tagged with the
+	//session id
+	var ids []string
+	for i := 0; i < 3; i++ {
+		err := d.routeMessage(ws, &shell.MenderShellMessage{
+			Type: wsshell.MessageTypeSpawnShell,
+			Data: []byte("user-id-unit-tests-multiplexed"),
+		})
+		assert.NoError(t, err)
+		m := waitForIdleSessionMessage(wsshell.MessageTypeSpawnShell, 8*time.Second)
+		if !assert.NotNil(t, m) {
+			return
+		}
+		if i < 2 {
+			assert.EqualValues(t, wsshell.NormalMessage, m.Properties["status"])
+			ids = append(ids, m.SessionId)
+			continue
+		}
+		//MaxSessions is enforced across the sessions of the connection
+		assert.EqualValues(t, wsshell.ErrorMessage, m.Properties["status"])
+		assert.Contains(t, string(m.Data), session.ErrSessionTooManySessions.Error())
+		assert.Equal(t, shell.ClosePolicyDenied, messageCloseCode(m))
+	}
+	if !assert.Len(t, ids, 2) || !assert.NotEqual(t, ids[0], ids[1]) {
+		return
+	}
+	assert.Equal(t, uint(2), d.shellsSpawned)
+
+	for i, id := range ids {
+		err := d.routeMessage(ws, &shell.MenderShellMessage{
+			Type:      wsshell.MessageTypeShellCommand,
+			SessionId: id,
+			Data:      []byte("echo output-of-session-" + strconv.Itoa(i) + "\n"),
+		})
+		assert.NoError(t, err)
+	}
+
+	output := map[string]string{}
+	deadline := time.After(8 * time.Second)
+	for !strings.Contains(output[ids[0]], "output-of-session-0") ||
+		!strings.Contains(output[ids[1]], "output-of-session-1") {
+		select {
+		case m := <-idleSessionMessages:
+			if m.Type == wsshell.MessageTypeShellCommand {
+				output[m.SessionId] += string(m.Data)
+			}
+		case <-deadline:
+			t.Fatalf("the sessions output is incomplete: %q", output)
+		}
+	}
+	assert.NotContains(t, output[ids[0]], "output-of-session-1")
+	assert.NotContains(t, output[ids[1]], "output-of-session-0")
+}
+
+func TestUserAuthorized(t *testing.T) {
+	testCases := map[string]struct {
+		authorizedUsers     []string
+		authorizedUserClaim string
+		authenticatedUser   string
+		userId              string
+		authorized          bool
+	}{
+		"no authorized users, anyone": {
+			userId:     "anyone",
+			authorized: true,
+		},
+		"authorized": {
+			authorizedUsers: []string{"admin-user-id", "ops-user-id"},
+			userId:          "ops-user-id",
+			authorized:      true,
+		},
+		"not authorized": {
+			authorizedUsers: []string{"admin-user-id"},
+			userId:          "guest-user-id",
+		},
+		"claim authorized": {
+			authorizedUsers:     []string{"admin@example.com", "ops@example.com"},
+			authorizedUserClaim: "mender.user",
+			authenticatedUser:   "ops@example.com",
+			userId:              "guest-user-id",
+			authorized:          true,
+		},
+		"claim not authorized": {
+			authorizedUsers:     []string{"admin@example.com"},
+			authorizedUserClaim: "mender.user",
+			authenticatedUser:   "guest@example.com",
+			userId:              "admin@example.com",
+		},
+		"claim missing from the token": {
+			authorizedUsers:     []string{"admin@example.com"},
+			authorizedUserClaim: "mender.user",
+			userId:              "admin@example.com",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := &MenderShellDaemon{
+				live:                &liveConfig{authorizedUsers: tc.authorizedUsers},
+				authorizedUserClaim: tc.authorizedUserClaim,
+				authenticatedUser:   tc.authenticatedUser,
+			}
+			assert.Equal(t, tc.authorized, d.liveConfig().userAuthorized(d.operator(tc.userId)))
+		})
+	}
+}
+
+func TestSetAuthenticatedUser(t *testing.T) {
+	payload, _ := json.Marshal(map[string]interface{}{"sub": "device-id", "mender.user": "ops@example.com"})
+	token := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + "."
+
+	//without a claim, the device id in the subject is not taken as the user
+	d := NewDaemon(&config.MenderShellConfig{})
+	d.setAuthenticatedUser(token)
+	assert.Equal(t, "", d.authenticatedUser)
+	assert.Equal(t, "device-id", d.deviceId)
+	assert.Equal(t, "user-id", d.operator("user-id"))
+
+	d = NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			AuthorizedUserClaim: "mender.user",
+		},
+	})
+	d.setAuthenticatedUser(token)
+	assert.Equal(t, "ops@example.com", d.authenticatedUser)
+	assert.Equal(t, "ops@example.com", d.operator("user-id"))
+}
+
+func TestNewDaemonPing(t *testing.T) {
+	testCases := map[string]struct {
+		interval         uint32
+		timeout          uint32
+		expectedInterval time.Duration
+		expectedTimeout  time.Duration
+	}{
+		"defaults": {
+			expectedInterval: config.DefaultPingInterval,
+			expectedTimeout:  config.DefaultPingTimeout,
+		},
+		"configured": {
+			interval:         30,
+			timeout:          5,
+			expectedInterval: 30 * time.Second,
+			expectedTimeout:  5 * time.Second,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					PingIntervalSeconds: tc.interval,
+					PingTimeoutSeconds:  tc.timeout,
+				},
+			})
+			assert.Equal(t, tc.expectedInterval, d.pingInterval)
+			assert.Equal(t, tc.expectedTimeout, d.pingTimeout)
+		})
+	}
+}
+
+func TestNewDaemonTimeouts(t *testing.T) {
+	testCases := map[string]struct {
+		connectTimeout                 uint32
+		writeTimeout                   uint32
+		authManagerWaitTimeout         uint32
+		expectedConnectTimeout         time.Duration
+		expectedWriteTimeout           time.Duration
+		expectedAuthManagerWaitTimeout time.Duration
+	}{
+		"defaults": {
+			expectedConnectTimeout:         config.DefaultConnectTimeout,
+			expectedWriteTimeout:           config.DefaultWriteTimeout,
+			expectedAuthManagerWaitTimeout: config.DefaultAuthManagerWaitTimeout,
+		},
+		"configured": {
+			connectTimeout:                 5,
+			writeTimeout:                   3,
+			authManagerWaitTimeout:         7,
+			expectedConnectTimeout:         5 * time.Second,
+			expectedWriteTimeout:           3 * time.Second,
+			expectedAuthManagerWaitTimeout: 7 * time.Second,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ConnectTimeoutSeconds:         tc.connectTimeout,
+					WriteTimeoutSeconds:           tc.writeTimeout,
+					AuthManagerWaitTimeoutSeconds: tc.authManagerWaitTimeout,
+				},
+			})
+			assert.Equal(t, tc.expectedConnectTimeout, d.connectTimeout)
+			assert.Equal(t, tc.expectedWriteTimeout, d.writeTimeout)
+			assert.Equal(t, tc.expectedAuthManagerWaitTimeout, d.authManagerWaitTimeout)
+		})
+	}
+}
+
+func TestWaitForAuthManager(t *testing.T) {
+	testCases := map[string]struct {
+		err error
+	}{
+		"available": {},
+		"timeout": {
+			err: context.DeadlineExceeded,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client := &authmocks.AuthClient{}
+			defer client.AssertExpectations(t)
+			client.On("WaitForAuthManager", mock.Anything).Return(func(ctx context.Context) error {
+				_, ok := ctx.Deadline()
+				assert.True(t, ok)
+				if tc.err != nil {
+					<-ctx.Done()
+					return ctx.Err()
+				}
+				return nil
+			})
+
+			d := &MenderShellDaemon{authManagerWaitTimeout: 10 * time.Millisecond}
+			d.waitForAuthManager(client)
+		})
+	}
+}
+
+//returns the websocket handshake request the daemon sends to the server,
+//with its connection options
+func handshakeRequest(t *testing.T, d *MenderShellDaemon) *http.Request {
+	requests := make(chan *http.Request, 1)
+	dialer := connectiontest.NewDialer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		upgrader := websocket.Upgrader{EnableCompression: true}
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		c.Close()
+	}))
+	defer dialer.Close()
+	d.SetDialer(dialer)
+
+	u := url.URL{Scheme: "ws", Host: "mender.invalid", Path: "/"}
+	ws, err := connection.NewConnection(u, "atoken", time.Second, 1024, time.Minute, false, "", d.connectionOptions()...)
+	if assert.NoError(t, err) {
+		ws.Close()
+	}
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("no handshake request")
+		return nil
+	}
+}
+
+func TestDeviceIdentity(t *testing.T) {
+	testCases := map[string]struct {
+		provider mender.TokenProvider
+		identity string
+	}{
+		"identity": {
+			provider: func() mender.TokenProvider {
+				client := &authmocks.AuthClient{}
+				client.On("GetDeviceIdentity").Return(map[string]string{"device_id": "device-1"}, nil)
+				return client
+			}(),
+			identity: `{"device_id":"device-1"}`,
+		},
+		"identity not available": {
+			provider: func() mender.TokenProvider {
+				client := &authmocks.AuthClient{}
+				client.On("GetDeviceIdentity").Return(nil, errors.New("no identity"))
+				return client
+			}(),
+		},
+		"no identity provider": {
+			provider: &authmocks.TokenProvider{},
+		},
 	}
 
-	data, err := msgpack.Marshal(m)
-	c.SetWriteDeadline(time.Now().Add(2 * time.Second))
-	c.WriteMessage(websocket.BinaryMessage, data)
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.identity, deviceIdentity(tc.provider))
 
-	for {
-		time.Sleep(1 * time.Second)
+			d := NewDaemon(&config.MenderShellConfig{})
+			d.deviceIdentity = deviceIdentity(tc.provider)
+			r := handshakeRequest(t, d)
+			assert.Equal(t, tc.identity, r.Header.Get(deviceconnect.DeviceIdentityHeader))
+		})
 	}
 }
 
-func TestMenderShellReadMessage(t *testing.T) {
-	currentUser, err := user.Current()
-	if err != nil {
-		t.Errorf("cant get current user: %s", err.Error())
-		return
+func TestNewDaemonCompression(t *testing.T) {
+	testCases := map[string]struct {
+		enable            bool
+		threshold         uint32
+		expectedThreshold int
+	}{
+		"defaults": {
+			expectedThreshold: config.DefaultCompressionThreshold,
+		},
+		"enabled": {
+			enable:            true,
+			threshold:         1024,
+			expectedThreshold: 1024,
+		},
 	}
 
-	d := NewDaemon(&config.MenderShellConfig{
-		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
-			ShellCommand: "/bin/sh",
-			User:         currentUser.Name,
-			Terminal: config.TerminalConfig{
-				Width:  24,
-				Height: 80,
-			},
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					EnableCompression:    tc.enable,
+					CompressionThreshold: tc.threshold,
+				},
+			})
+			assert.Equal(t, tc.enable, d.enableCompression)
+			assert.Equal(t, tc.expectedThreshold, d.compressionThreshold)
+			r := handshakeRequest(t, d)
+			assert.Equal(t, tc.enable, strings.Contains(r.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate"))
+		})
+	}
+}
+
+func TestNewDaemonTLS(t *testing.T) {
+	testCases := map[string]struct {
+		minVersion           string
+		cipherSuites         []string
+		expectedMinVersion   uint16
+		expectedCipherSuites []uint16
+	}{
+		"defaults": {
+			expectedMinVersion:   tls.VersionTLS12,
+			expectedCipherSuites: []uint16{},
 		},
-	})
+		"restricted": {
+			minVersion:           "1.3",
+			cipherSuites:         []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+			expectedMinVersion:   tls.VersionTLS13,
+			expectedCipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		},
+	}
 
-	t.Log("starting mock httpd with websockets")
-	s := httptest.NewServer(http.HandlerFunc(oneMsgMainServerLoop))
-	defer s.Close()
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					MinTLSVersion:   tc.minVersion,
+					TLSCipherSuites: tc.cipherSuites,
+				},
+			})
+			assert.Equal(t, tc.expectedMinVersion, d.minTLSVersion)
+			assert.Equal(t, tc.expectedCipherSuites, d.tlsCipherSuites)
+		})
+	}
+}
 
-	u := "ws" + strings.TrimPrefix(s.URL, "http")
-	urlString, err := url.Parse(u)
-	assert.NoError(t, err)
-	assert.NotNil(t, urlString)
+func TestNewDaemonTCPKeepAlive(t *testing.T) {
+	disabled := false
+	testCases := map[string]struct {
+		keepAlive        *bool
+		idle             uint32
+		interval         uint32
+		count            uint32
+		expectedIdle     time.Duration
+		expectedInterval time.Duration
+		expectedCount    int
+	}{
+		"defaults": {
+			expectedIdle:     config.DefaultTCPKeepAliveIdle,
+			expectedInterval: config.DefaultTCPKeepAliveInterval,
+			expectedCount:    config.DefaultTCPKeepAliveCount,
+		},
+		"custom": {
+			idle:             120,
+			interval:         15,
+			count:            5,
+			expectedIdle:     120 * time.Second,
+			expectedInterval: 15 * time.Second,
+			expectedCount:    5,
+		},
+		"disabled": {
+			keepAlive:        &disabled,
+			idle:             120,
+			expectedInterval: config.DefaultTCPKeepAliveInterval,
+			expectedCount:    config.DefaultTCPKeepAliveCount,
+		},
+	}
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 526, 16*time.Second, true, "")
-	assert.NoError(t, err)
-	assert.NotNil(t, ws)
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					TCPKeepAlive:                tc.keepAlive,
+					TCPKeepAliveIdleSeconds:     tc.idle,
+					TCPKeepAliveIntervalSeconds: tc.interval,
+					TCPKeepAliveCount:           tc.count,
+				},
+			})
+			assert.Equal(t, tc.expectedIdle, d.tcpKeepAliveIdle)
+			assert.Equal(t, tc.expectedInterval, d.tcpKeepAliveInterval)
+			assert.Equal(t, tc.expectedCount, d.tcpKeepAliveCount)
+		})
+	}
+}
 
-	time.Sleep(2 * time.Second)
-	m, err := d.readMessage(ws)
-	assert.NoError(t, err)
-	assert.NotNil(t, m)
-	assert.Equal(t, m.Data, []byte("hello ws"))
-	time.Sleep(2 * time.Second)
+func TestNewDaemonTokenPlacement(t *testing.T) {
+	testCases := map[string]struct {
+		placement         string
+		parameter         string
+		expectedParameter string
+	}{
+		"default": {},
+		"header": {
+			placement: "header",
+			parameter: "token",
+		},
+		"query": {
+			placement:         "query",
+			expectedParameter: "jwt",
+		},
+		"query, custom parameter": {
+			placement:         "query",
+			parameter:         "token",
+			expectedParameter: "token",
+		},
+	}
 
-	ws.Close()
-	m, err = d.readMessage(ws)
-	assert.Error(t, err)
-	assert.Nil(t, m)
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					TokenPlacement:      tc.placement,
+					TokenQueryParameter: tc.parameter,
+				},
+			})
+			assert.Equal(t, tc.expectedParameter, d.tokenQueryParameter)
+			r := handshakeRequest(t, d)
+			if tc.expectedParameter != "" {
+				assert.Equal(t, "atoken", r.URL.Query().Get(tc.expectedParameter))
+				assert.Empty(t, r.Header.Get("Authorization"))
+			} else {
+				assert.Empty(t, r.URL.RawQuery)
+				assert.Equal(t, "Bearer atoken", r.Header.Get("Authorization"))
+			}
+		})
+	}
 }
 
-func TestMenderShellWsReconnect(t *testing.T) {
-	currentUser, err := user.Current()
-	if err != nil {
-		t.Errorf("cant get current user: %s", err.Error())
-		return
+func TestNewDaemonOutputBuffering(t *testing.T) {
+	testCases := map[string]struct {
+		bufferBytes      uint32
+		flushInterval    uint32
+		queueLength      uint32
+		rawFraming       bool
+		sanitize         bool
+		expectedSize     int
+		expectedInterval time.Duration
+		expectedQueue    int
+		expectedUTF8Safe bool
+	}{
+		"defaults": {
+			expectedSize:     config.DefaultOutputBufferSize,
+			expectedInterval: config.DefaultOutputFlushInterval,
+			expectedQueue:    config.DefaultOutputQueueLength,
+			expectedUTF8Safe: true,
+		},
+		"configured": {
+			bufferBytes:      1,
+			flushInterval:    50,
+			queueLength:      4,
+			rawFraming:       true,
+			sanitize:         true,
+			expectedSize:     1,
+			expectedInterval: 50 * time.Millisecond,
+			expectedQueue:    4,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					OutputBufferBytes:               tc.bufferBytes,
+					OutputFlushIntervalMilliseconds: tc.flushInterval,
+					OutputQueueLength:               tc.queueLength,
+					RawOutputFraming:                tc.rawFraming,
+					SanitizeOutput:                  tc.sanitize,
+				},
+			})
+			assert.Equal(t, tc.expectedSize, d.sessions.Settings().OutputBufferSize)
+			assert.Equal(t, tc.expectedInterval, d.sessions.Settings().OutputFlushInterval)
+			assert.Equal(t, tc.expectedQueue, d.sessions.Settings().OutputQueueLength)
+			assert.Equal(t, tc.expectedUTF8Safe, d.sessions.Settings().UTF8SafeOutput)
+			assert.Equal(t, tc.sanitize, d.sessions.Settings().SanitizeOutput)
+		})
 	}
+}
 
+func TestNewDaemonInputLimits(t *testing.T) {
 	d := NewDaemon(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
-			ShellCommand: "/bin/sh",
-			User:         currentUser.Name,
-			Terminal: config.TerminalConfig{
-				Width:  24,
-				Height: 80,
-			},
+			MaxInputBytesPerSecond: 1024,
+			MaxInputMessageBytes:   4096,
 		},
 	})
+	assert.Equal(t, uint32(1024), d.sessions.Settings().MaxInputBytesPerSecond)
+	assert.Equal(t, 4096, d.sessions.Settings().MaxInputMessageSize)
 
-	t.Log("starting mock httpd with websockets")
-	s := httptest.NewServer(http.HandlerFunc(oneMsgMainServerLoop))
-	defer s.Close()
+	d = NewDaemon(&config.MenderShellConfig{})
+	assert.Equal(t, uint32(0), d.sessions.Settings().MaxInputBytesPerSecond)
+	assert.Equal(t, 0, d.sessions.Settings().MaxInputMessageSize)
+}
 
-	u := "ws" + strings.TrimPrefix(s.URL, "http")
-	urlString, err := url.Parse(u)
+func TestShellCommandLine(t *testing.T) {
+	executable, err := os.Executable()
 	assert.NoError(t, err)
-	assert.NotNil(t, urlString)
 
-	ws, err := connection.NewConnection(*urlString, "token", time.Second, 526, time.Second, true, "")
+	testCases := map[string]struct {
+		restrictedShell    bool
+		restrictedCommands []string
+		shell              string
+		args               []string
+	}{
+		"full shell": {
+			restrictedCommands: []string{"uptime"},
+			shell:              "/bin/sh",
+			args:               []string{"-l"},
+		},
+		"restricted shell": {
+			restrictedShell:    true,
+			restrictedCommands: []string{"uptime", "journalctl ..."},
+			shell:              executable,
+			args: []string{RestrictedShellCommandName,
+				"--allow", "uptime", "--allow", "journalctl ..."},
+		},
+		"restricted shell without commands": {
+			restrictedShell: true,
+			shell:           executable,
+			args:            []string{RestrictedShellCommandName},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand:       "/bin/sh",
+					ShellArguments:     []string{"-l"},
+					RestrictedShell:    tc.restrictedShell,
+					RestrictedCommands: tc.restrictedCommands,
+				},
+			})
+			shell, args, err := d.liveConfig().shellCommandLine()
+			assert.NoError(t, err)
+			assert.Equal(t, tc.shell, shell)
+			assert.Equal(t, tc.args, args)
+		})
+	}
+}
+
+func TestSessionNamespaces(t *testing.T) {
+	executable, err := os.Executable()
 	assert.NoError(t, err)
-	assert.NotNil(t, ws)
 
-	t.Log("attempting reconnect")
-	d.serverUrl = u
-	ws, err = d.wsReconnect("atoken")
-	assert.NotNil(t, ws)
+	assert.Nil(t, sessionNamespaces(nil, ""))
+	assert.Nil(t, sessionNamespaces([]string{"net"}, ""))
+
+	//the init command moves the shell to the cgroup before running it
+	assert.Equal(t, &shell.Namespaces{Init: []string{executable, NamespaceInitCommandName}, Cgroup: "/sys/fs/cgroup/shells"},
+		sessionNamespaces(nil, "/sys/fs/cgroup/shells"))
+
+	names := []string{shell.NamespacePID, shell.NamespaceMount}
+	flags, err := shell.NamespaceFlags(names)
 	assert.NoError(t, err)
+	if err := shell.CheckNamespaces(flags); err != nil {
+		//not supported, the shells start without them
+		assert.Nil(t, sessionNamespaces(names, ""))
+		return
+	}
+	assert.Equal(t, &shell.Namespaces{Flags: flags, Init: []string{executable, NamespaceInitCommandName}},
+		sessionNamespaces(names, ""))
 }
 
-func TestMenderShellMaxShellsLimit(t *testing.T) {
-	session.MaxUserSessions = 4
-	config.MaxShellsSpawned = 2
-	currentUser, err := user.Current()
-	if err != nil {
-		t.Errorf("cant get current user: %s", err.Error())
-		return
+func TestTerminalEnv(t *testing.T) {
+	configuredEnv := map[string]string{"EDITOR": "vi", "LANG": "C"}
+
+	testCases := map[string]struct {
+		properties map[string]interface{}
+		env        map[string]string
+		term       string
+		sessionEnv map[string]string
+	}{
+		"defaults": {
+			env:        configuredEnv,
+			term:       "xterm-256color",
+			sessionEnv: configuredEnv,
+		},
+		"term and locale": {
+			properties: map[string]interface{}{
+				shell.PropertyTerm:   "screen.xterm-256color",
+				shell.PropertyLocale: []interface{}{"LANG=sv_SE.UTF-8", "LC_TIME=C"},
+			},
+			env:        configuredEnv,
+			term:       "screen.xterm-256color",
+			sessionEnv: map[string]string{"EDITOR": "vi", "LANG": "sv_SE.UTF-8", "LC_TIME": "C"},
+		},
+		"term overrides the configured TERM": {
+			properties: map[string]interface{}{
+				shell.PropertyTerm: "vt100",
+			},
+			env:        map[string]string{"TERM": "xterm"},
+			term:       "vt100",
+			sessionEnv: map[string]string{},
+		},
+		"invalid term and locale": {
+			properties: map[string]interface{}{
+				shell.PropertyTerm:   "xterm\nLD_PRELOAD=/tmp/x.so",
+				shell.PropertyLocale: []interface{}{"LD_PRELOAD=/tmp/x.so", "LANG", "LC_ALL=C"},
+			},
+			env:        configuredEnv,
+			term:       "xterm-256color",
+			sessionEnv: map[string]string{"EDITOR": "vi", "LANG": "C", "LC_ALL": "C"},
+		},
+		"locale not a list": {
+			properties: map[string]interface{}{
+				shell.PropertyLocale: "LANG=sv_SE.UTF-8",
+			},
+			env:        configuredEnv,
+			term:       "xterm-256color",
+			sessionEnv: configuredEnv,
+		},
 	}
 
-	t.Log("starting mock httpd with websockets")
-	s := httptest.NewServer(http.HandlerFunc(newShellMulti))
-	defer s.Close()
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			term, sessionEnv := terminalEnv(tc.properties, "xterm-256color", tc.env)
+			assert.Equal(t, tc.term, term)
+			assert.Equal(t, tc.sessionEnv, sessionEnv)
+		})
+	}
+	//the configured environment is left alone
+	assert.Equal(t, map[string]string{"EDITOR": "vi", "LANG": "C"}, configuredEnv)
+}
 
-	u := "ws" + strings.TrimPrefix(s.URL, "http")
-	urlString, err := url.Parse(u)
-	assert.NoError(t, err)
-	assert.NotNil(t, urlString)
+func TestTerminalSize(t *testing.T) {
+	testCases := map[string]struct {
+		properties map[string]interface{}
+		height     uint16
+		width      uint16
+	}{
+		"ok": {
+			properties: map[string]interface{}{
+				shell.PropertyTerminalHeight: int8(50),
+				shell.PropertyTerminalWidth:  uint16(132),
+			},
+			height: 50,
+			width:  132,
+		},
+		"ok, int64": {
+			properties: map[string]interface{}{
+				shell.PropertyTerminalHeight: int64(50),
+				shell.PropertyTerminalWidth:  int64(132),
+			},
+			height: 50,
+			width:  132,
+		},
+		"defaults, no properties": {
+			height: 24,
+			width:  80,
+		},
+		"defaults, invalid values": {
+			properties: map[string]interface{}{
+				shell.PropertyTerminalHeight: "50",
+				shell.PropertyTerminalWidth:  int64(-1),
+			},
+			height: 24,
+			width:  80,
+		},
+		"defaults, out of range": {
+			properties: map[string]interface{}{
+				shell.PropertyTerminalHeight: uint64(1 << 16),
+				shell.PropertyTerminalWidth:  int64(0),
+			},
+			height: 24,
+			width:  80,
+		},
+	}
 
-	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 526, 16*time.Second, true, "")
-	assert.NoError(t, err)
-	assert.NotNil(t, ws)
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			height, width := terminalSize(tc.properties, 24, 80)
+			assert.Equal(t, tc.height, height)
+			assert.Equal(t, tc.width, width)
+		})
+	}
+}
 
+func TestRouteMessageResizeShell(t *testing.T) {
 	d := NewDaemon(&config.MenderShellConfig{
 		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
 			ShellCommand: "/bin/sh",
-			User:         currentUser.Name,
-			Terminal: config.TerminalConfig{
-				Width:  24,
-				Height: 80,
-			},
 		},
 	})
 
-	for i := 0; i < int(config.MaxShellsSpawned); i++ {
-		time.Sleep(time.Second)
-		message, err := d.readMessage(ws)
-		assert.NoError(t, err)
-		assert.NotNil(t, message)
-		t.Logf("read message: type, session_id, data %s, %s, %s", message.Type, message.SessionId, message.Data)
-		err = d.routeMessage(ws, message)
-		if err != nil {
-			t.Logf("route message error: %s", err.Error())
-		}
-		assert.NoError(t, err)
-	}
-
-	message, err := d.readMessage(ws)
-	t.Logf("read message: type, session_id, data %s, %s, %s", message.Type, message.SessionId, message.Data)
-	err = d.routeMessage(ws, message)
-	if err != nil {
-		t.Logf("route message error: %s", err.Error())
-	}
-	assert.Error(t, err)
+	err := d.routeMessage(nil, &shell.MenderShellMessage{
+		Type:      shell.MessageTypeResizeShell,
+		SessionId: "undefined-session-id",
+		Properties: map[string]interface{}{
+			shell.PropertyTerminalHeight: int64(50),
+			shell.PropertyTerminalWidth:  int64(132),
+		},
+	})
+	assert.Equal(t, session.ErrSessionNotFound, err)
 }
 
 func TestOutputStatus(t *testing.T) {
@@ -586,14 +2281,15 @@ func TestTimeToSweepSessions(t *testing.T) {
 	assert.False(t, d.timeToSweepSessions())
 
 	//if both expire timeout and idle expire timeout are not set it is never time to sweep
-	d.expireSessionsAfter = time.Duration(0)
-	d.expireSessionsAfterIdle = time.Duration(0)
+	d.setLiveConfig(&liveConfig{})
 	assert.False(t, d.timeToSweepSessions())
 
 	//on the other hand when both are set it maybe time to sweep
-	d.expireSessionsAfter = 32 * time.Second
-	d.expireSessionsAfterIdle = 8 * time.Second
-	lastExpiredSessionSweep = time.Now()
+	d.setLiveConfig(&liveConfig{
+		expireSessionsAfter:     32 * time.Second,
+		expireSessionsAfterIdle: 8 * time.Second,
+	})
+	d.lastSessionSweep = time.Now()
 	assert.False(t, d.timeToSweepSessions())
 
 	expiredSessionsSweepFrequency = 2 * time.Second
@@ -627,9 +2323,9 @@ func TestWaitForJWTToken(t *testing.T) {
 				t.Run(tc.name, func(t *testing.T) {
 					dbusAPI := &dbusmocks.DBusAPI{}
 					defer dbusAPI.AssertExpectations(t)
-					client := &authmocks.AuthClient{}
-					client.On("GetJWTToken").Return(tc.token, tc.err)
-					token, err := waitForJWTToken(client)
+					provider := &authmocks.TokenProvider{}
+					provider.On("Token").Return(tc.token, tc.err)
+					token, err := (&MenderShellDaemon{}).waitForJWTToken(provider)
 					if tc.err != nil {
 						assert.Error(t, err)
 					} else {
@@ -650,9 +2346,9 @@ func TestWaitForJWTToken(t *testing.T) {
 			t.Run(tc.name, func(t *testing.T) {
 				dbusAPI := &dbusmocks.DBusAPI{}
 				defer dbusAPI.AssertExpectations(t)
-				client := &authmocks.AuthClient{}
-				client.On("GetJWTToken").Return(tc.token, tc.err)
-				token, err := waitForJWTToken(client)
+				provider := &authmocks.TokenProvider{}
+				provider.On("Token").Return(tc.token, tc.err)
+				token, err := (&MenderShellDaemon{}).waitForJWTToken(provider)
 				if tc.err != nil {
 					assert.Error(t, err)
 				} else {
@@ -694,9 +2390,9 @@ func TestDeviceUnauth(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			dbusAPI := &dbusmocks.DBusAPI{}
 			defer dbusAPI.AssertExpectations(t)
-			client := &authmocks.AuthClient{}
-			client.On("GetJWTToken").Return(tc.token, tc.err)
-			rc := deviceUnauth(client)
+			provider := &authmocks.TokenProvider{}
+			provider.On("Token").Return(tc.token, tc.err)
+			rc := deviceUnauth(provider)
 			assert.Equal(t, tc.rc, rc)
 		})
 	}
@@ -758,7 +2454,7 @@ func TestMessageMainLoop(t *testing.T) {
 		done := make(chan bool)
 		go func() {
 			t.Run(tc.name, func(t *testing.T) {
-				d := &MenderShellDaemon{}
+				d := &MenderShellDaemon{sessions: session.NewRegistry(nil)}
 				d.stop = tc.shouldStop
 				d.printStatus = true
 				if tc.ws != nil {
@@ -790,7 +2486,7 @@ func TestMessageMainLoop(t *testing.T) {
 }
 
 func TestRun(t *testing.T) {
-	d := &MenderShellDaemon{}
+	d := &MenderShellDaemon{sessions: session.NewRegistry(nil)}
 	d.debug = true
 	to := 15 * time.Second
 	timeout := time.After(to)
@@ -807,3 +2503,211 @@ func TestRun(t *testing.T) {
 	case <-done:
 	}
 }
+
+func TestReloadConfig(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mender-shell-reload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	defer log.SetLevel(log.GetLevel())
+
+	configPath := path.Join(tdir, "mender-shell.conf")
+	err = ioutil.WriteFile(configPath, []byte(`{"ServerURL": "https://mender.io", "MaxSessions": 2, "IdleTimeoutSeconds": 60}`), 0600)
+	assert.NoError(t, err)
+	c, err := config.LoadConfig(configPath, "")
+	assert.NoError(t, err)
+	assert.NoError(t, c.Validate())
+	initial := c.Snapshot()
+
+	d := NewDaemon(c)
+	before := d.liveConfig()
+	assert.Equal(t, 60*time.Second, before.idleTimeout)
+	assert.Equal(t, 2, d.sessions.Settings().MaxSessions)
+	assert.Equal(t, "", d.shouldReloadConfig())
+
+	err = ioutil.WriteFile(configPath, []byte(`{"ServerURL": "https://mender.io", "MaxSessions": 4, "IdleTimeoutSeconds": 30, "LogLevel": "warning", "LogSecretKeys": ["apikey"]}`), 0600)
+	assert.NoError(t, err)
+	d.ReloadConfig(configPath)
+	reloadPath := d.shouldReloadConfig()
+	assert.Equal(t, configPath, reloadPath)
+	assert.Equal(t, "", d.shouldReloadConfig())
+	d.reloadConfig(reloadPath)
+	assert.Equal(t, 30*time.Second, d.liveConfig().idleTimeout)
+	//the snapshot read before the reload is not changed by it
+	assert.Equal(t, 60*time.Second, before.idleTimeout)
+	assert.Equal(t, uint32(2), initial.MaxSessions)
+	assert.Equal(t, uint32(4), c.MaxSessions)
+	assert.Equal(t, 4, d.sessions.Settings().MaxSessions)
+	assert.Equal(t, log.WarnLevel, log.GetLevel())
+	assert.Equal(t, "apikey=[REDACTED]", logging.Redact("apikey=0123456789"))
+
+	//an invalid configuration is not applied
+	err = ioutil.WriteFile(configPath, []byte(`{"ServerURL": "https://mender.io", "MaxSessions": 8, "ShellCommand": ""}`), 0600)
+	assert.NoError(t, err)
+	d.reloadConfig(configPath)
+	assert.Equal(t, 30*time.Second, d.liveConfig().idleTimeout)
+	assert.Equal(t, 4, d.sessions.Settings().MaxSessions)
+	assert.Equal(t, uint32(4), c.MaxSessions)
+	assert.Equal(t, "/bin/sh", d.liveConfig().shell)
+
+	logging.SetSecretKeys(nil)
+}
+
+var execCommandMessages = make(chan *ws.ProtoMsg, 64)
+
+func execCommandServerLoop(w http.ResponseWriter, r *http.Request) {
+	var upgrader = websocket.Upgrader{}
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg := &ws.ProtoMsg{}
+		if msgpack.Unmarshal(data, msg) == nil {
+			execCommandMessages <- msg
+		}
+	}
+}
+
+func TestRouteMessageExecCommand(t *testing.T) {
+	currentUser, _, _ := currentShellUser(t)
+
+	tdir, err := ioutil.TempDir("", "mender-shell-exec")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	command := path.Join(tdir, "command.sh")
+	err = ioutil.WriteFile(command, []byte("#!/bin/sh\necho out\necho err >&2\nexit 3\n"), 0700)
+	assert.NoError(t, err)
+
+	webSock := newTestConnection(t, execCommandServerLoop)
+
+	testCases := map[string]struct {
+		command  string
+		status   wsshell.MenderShellMessageStatus
+		stdout   string
+		stderr   string
+		exitCode interface{}
+	}{
+		"allowed": {
+			command:  command,
+			status:   wsshell.NormalMessage,
+			stdout:   "out\n",
+			stderr:   "err\n",
+			exitCode: 3,
+		},
+		"not allowed": {
+			command: "/bin/rm -rf " + tdir,
+			status:  wsshell.ErrorMessage,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ShellCommand:    "/bin/sh",
+					User:            currentUser.Username,
+					AllowedCommands: []string{command},
+				},
+			})
+			d.setWebSock(webSock)
+
+			err := d.routeMessage(webSock, &shell.MenderShellMessage{
+				Type:      shell.MessageTypeExecCommand,
+				SessionId: "exec-" + name,
+				Data:      []byte(tc.command),
+			})
+			assert.NoError(t, err)
+
+			output := map[string]string{}
+			timeout := time.After(8 * time.Second)
+			for {
+				select {
+				case m := <-execCommandMessages:
+					assert.Equal(t, "exec-"+name, m.Header.SessionID)
+					if m.Header.MsgType == shell.MessageTypeExecCommand {
+						stream, _ := m.Header.Properties[shell.PropertyStream].(string)
+						output[stream] += string(m.Body)
+						continue
+					}
+					assert.Equal(t, shell.MessageTypeExecExit, m.Header.MsgType)
+					assert.EqualValues(t, tc.status, m.Header.Properties["status"])
+					assert.Equal(t, tc.stdout, output[shell.StreamStdout])
+					assert.Equal(t, tc.stderr, output[shell.StreamStderr])
+					if tc.exitCode != nil {
+						assert.EqualValues(t, tc.exitCode, m.Header.Properties[shell.PropertyExitCode])
+					}
+				case <-timeout:
+					t.Fatal("the exec_exit message was not received")
+				}
+				break
+			}
+		})
+	}
+	_, err = os.Stat(tdir)
+	assert.NoError(t, err)
+}
+
+func TestFollowServerOfToken(t *testing.T) {
+	token := func(claims map[string]interface{}) string {
+		payload, _ := json.Marshal(claims)
+		return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + "."
+	}
+
+	testCases := map[string]struct {
+		follow    bool
+		token     string
+		serverURL string
+	}{
+		"disabled": {
+			token:     token(map[string]interface{}{"mender.server": "https://new.mender.io"}),
+			serverURL: "https://old.mender.io",
+		},
+		"no token": {
+			follow:    true,
+			serverURL: "https://old.mender.io",
+		},
+		"no server in the token": {
+			follow:    true,
+			token:     token(map[string]interface{}{"sub": "device"}),
+			serverURL: "https://old.mender.io",
+		},
+		"same server": {
+			follow:    true,
+			token:     token(map[string]interface{}{"mender.server": "https://old.mender.io/"}),
+			serverURL: "https://old.mender.io",
+		},
+		"migrated": {
+			follow:    true,
+			token:     token(map[string]interface{}{"mender.server": "https://new.mender.io", "iss": "Mender"}),
+			serverURL: "https://new.mender.io",
+		},
+		"issuer": {
+			follow:    true,
+			token:     token(map[string]interface{}{"iss": "https://new.mender.io/"}),
+			serverURL: "https://new.mender.io",
+		},
+		"not a server URL": {
+			follow:    true,
+			token:     token(map[string]interface{}{"iss": "Mender"}),
+			serverURL: "https://old.mender.io",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					ServerURL:         "https://old.mender.io",
+					FollowTokenServer: tc.follow,
+				},
+			})
+			d.followServerOfToken(tc.token)
+			assert.Equal(t, tc.serverURL, d.getServerUrl())
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	configuration "github.com/mendersoftware/mender-shell/config"
+)
+
+// DumpDiagnostics writes the stacks of the goroutines, the connection state,
+// the timings and the active sessions to the diagnostics directory, or to
+// the log; it runs in its own goroutine, so that it works with the main
+// loop stuck, and a dump requested while one is running is dropped
+func (d *MenderShellDaemon) DumpDiagnostics() {
+	if !atomic.CompareAndSwapInt32(&d.dumpingDiagnostics, 0, 1) {
+		log.Warn("a diagnostics dump is running already, not starting another one")
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&d.dumpingDiagnostics, 0)
+		d.dumpDiagnostics(time.Now())
+	}()
+}
+
+func (d *MenderShellDaemon) dumpDiagnostics(now time.Time) {
+	if d.diagnosticsDir == "" {
+		d.writeDiagnostics(logWriter{}, now)
+		return
+	}
+	name := filepath.Join(d.diagnosticsDir,
+		"mender-shell-diagnostics-"+now.Format("20060102-150405.000000000")+".txt")
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Errorf("failed to dump the diagnostics: %s", err.Error())
+		return
+	}
+	defer f.Close()
+	log.Infof("dumping the diagnostics to %s", name)
+	d.writeDiagnostics(f, now)
+}
+
+//writes the diagnostics a section at a time; it reads the daemon through its
+//getters and the sessions through the locked session registry, whose locks
+//are never held while blocking, so a stuck main loop does not stall the dump
+func (d *MenderShellDaemon) writeDiagnostics(w io.Writer, now time.Time) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "mender-shell daemon v%s diagnostics at %s\n",
+		configuration.VersionString(), now.Format(time.RFC3339Nano))
+	fmt.Fprintf(&b, "connection: %s %s%s\n", d.ConnectionState().String(), d.getServerUrl(), d.deviceConnectUrl)
+	stats := d.Stats()
+	fmt.Fprintf(&b, "last token fetch: %s at %s, error: %v\n",
+		stats.TokenFetch, formatTime(stats.TokenFetchedAt), stats.TokenFetchError)
+	fmt.Fprintf(&b, "last connect: %s at %s\n", stats.Connect, formatTime(stats.ConnectedAt))
+	fmt.Fprintf(&b, "ping round-trip times: %v\n", stats.PingRTTs)
+	w.Write(b.Bytes())
+
+	b.Reset()
+	b.WriteString("goroutines:\n")
+	pprof.Lookup("goroutine").WriteTo(&b, 2)
+	w.Write(b.Bytes())
+
+	b.Reset()
+	sessions := d.activeSessions()
+	fmt.Fprintf(&b, "active sessions: %d\n", len(sessions))
+	for _, s := range sessions {
+		fmt.Fprintf(&b, " %s %s %s\n", s.SessionID, s.UserID, s.StartedAt)
+	}
+	w.Write(b.Bytes())
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+//logs every write as an entry of its own
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	log.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/session"
+)
+
+func TestDumpDiagnostics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diagnostics")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			DiagnosticsDir: dir,
+		},
+	})
+	d.stats.pinged(time.Millisecond)
+	d.DumpDiagnostics()
+
+	var files []os.FileInfo
+	for i := 0; i < 50 && len(files) == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+		files, err = ioutil.ReadDir(dir)
+		assert.NoError(t, err)
+	}
+	if assert.Len(t, files, 1) {
+		assert.Equal(t, os.FileMode(0600), files[0].Mode().Perm())
+		for i := 0; i < 50 && atomic.LoadInt32(&d.dumpingDiagnostics) != 0; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, files[0].Name()))
+		assert.NoError(t, err)
+		assert.Contains(t, string(data), "connection: Disconnected")
+		assert.Contains(t, string(data), "ping round-trip times: [1ms]")
+		assert.Contains(t, string(data), "goroutines:\ngoroutine ")
+		assert.Contains(t, string(data), "TestDumpDiagnostics")
+		assert.Contains(t, string(data), "active sessions: 0")
+	}
+}
+
+func TestDumpDiagnosticsRunning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diagnostics")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			DiagnosticsDir: dir,
+		},
+	})
+	//a dump is running already
+	atomic.StoreInt32(&d.dumpingDiagnostics, 1)
+	d.DumpDiagnostics()
+	time.Sleep(200 * time.Millisecond)
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestDumpDiagnosticsLog(t *testing.T) {
+	defer log.SetOutput(log.StandardLogger().Out)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+
+	d := NewDaemon(&config.MenderShellConfig{})
+	d.dumpDiagnostics(time.Now())
+	assert.Contains(t, buf.String(), "connection: Disconnected")
+	assert.Contains(t, buf.String(), "goroutines:")
+	assert.Contains(t, buf.String(), "active sessions: 0")
+}
+
+func TestDumpDiagnosticsWhileSessionsChange(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ServerURL: "https://mender.io",
+		},
+	})
+	d.sessions.Configure(func(settings *session.Settings) {
+		settings.MaxUserSessions = 8
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			s, err := d.sessions.NewMenderShellSession(&sync.Mutex{}, nil, "user-id-diagnostics",
+				session.NoExpirationTimeout, session.NoExpirationTimeout)
+			if assert.NoError(t, err) {
+				d.sessions.MenderShellDeleteById(s.GetId())
+			}
+			d.setServerUrl(fmt.Sprintf("https://%d.mender.io", i))
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		var buf bytes.Buffer
+		d.writeDiagnostics(&buf, time.Now())
+		assert.Contains(t, buf.String(), "active sessions: ")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/filetransfer"
+	"github.com/mendersoftware/mender-shell/logging"
+	"github.com/mendersoftware/mender-shell/shell"
+)
+
+//starts the upload of a file, replacing the unfinished one of the session
+func (d *MenderShellDaemon) startUpload(webSock *connection.Connection, message *shell.MenderShellMessage, live *liveConfig) error {
+	logger := logging.FromContext(logging.WithSessionID(context.Background(), message.SessionId))
+	d.uploadsMutex.Lock()
+	defer d.uploadsMutex.Unlock()
+	if d.uploads == nil {
+		d.uploads = map[string]*filetransfer.Upload{}
+	}
+	if upload, ok := d.uploads[message.SessionId]; ok {
+		logger.Warnf("aborting the unfinished upload to %s", upload.Path())
+		upload.Abort()
+		delete(d.uploads, message.SessionId)
+	}
+
+	path, _ := message.Properties[filetransfer.PropertyPath].(string)
+	checksum, _ := message.Properties[filetransfer.PropertyChecksum].(string)
+	size, ok := propertyInt64(message.Properties, filetransfer.PropertySize)
+	if !ok {
+		size = -1
+	}
+	mode, _ := propertyInt64(message.Properties, filetransfer.PropertyMode)
+
+	upload, err := filetransfer.NewUpload(path, size, checksum, os.FileMode(mode), live.uploadPaths, live.maxFileSize)
+	if err != nil {
+		logger.Errorf("failed to start the upload to %s: %s", path, err.Error())
+		return d.uploadDone(webSock, message.SessionId, "", err)
+	}
+	logger.Infof("uploading %d bytes to %s", size, upload.Path())
+	d.uploads[message.SessionId] = upload
+
+	//an empty file is complete right away
+	if upload.Complete() {
+		return d.finishUpload(webSock, message.SessionId, upload)
+	}
+	return d.uploadAck(webSock, message.SessionId, 0)
+}
+
+//writes the next chunk of the upload, finishing it with the last one
+func (d *MenderShellDaemon) uploadChunk(webSock *connection.Connection, message *shell.MenderShellMessage) error {
+	logger := logging.FromContext(logging.WithSessionID(context.Background(), message.SessionId))
+	d.uploadsMutex.Lock()
+	defer d.uploadsMutex.Unlock()
+	upload, ok := d.uploads[message.SessionId]
+	if !ok {
+		logger.Errorf("received a chunk without an upload")
+		return d.uploadDone(webSock, message.SessionId, "", filetransfer.ErrUploadNotStarted)
+	}
+
+	if int64(len(message.Data)) > d.uploadChunkSize {
+		upload.Abort()
+		err := fmt.Errorf("%w: %d bytes, the limit is %d", filetransfer.ErrChunkTooLarge, len(message.Data), d.uploadChunkSize)
+		logger.Errorf("failed to upload %s: %s", upload.Path(), err.Error())
+		delete(d.uploads, message.SessionId)
+		return d.uploadDone(webSock, message.SessionId, "", err)
+	}
+	received, err := upload.Write(message.Data)
+	if err != nil {
+		logger.Errorf("failed to upload %s: %s", upload.Path(), err.Error())
+		delete(d.uploads, message.SessionId)
+		return d.uploadDone(webSock, message.SessionId, "", err)
+	}
+	if upload.Complete() {
+		return d.finishUpload(webSock, message.SessionId, upload)
+	}
+	return d.uploadAck(webSock, message.SessionId, received)
+}
+
+//the caller holds d.uploadsMutex
+func (d *MenderShellDaemon) finishUpload(webSock *connection.Connection, sessionId string, upload *filetransfer.Upload) error {
+	logger := logging.FromContext(logging.WithSessionID(context.Background(), sessionId))
+	delete(d.uploads, sessionId)
+	checksum, err := upload.Finish()
+	if err != nil {
+		logger.Errorf("failed to upload %s: %s", upload.Path(), err.Error())
+	} else {
+		logger.Infof("uploaded %s", upload.Path())
+	}
+	return d.uploadDone(webSock, sessionId, checksum, err)
+}
+
+func (d *MenderShellDaemon) uploadAck(webSock *connection.Connection, sessionId string, received int64) error {
+	return d.responseMessage(webSock, &shell.MenderShellMessage{
+		Type:       filetransfer.MessageTypeUploadAck,
+		Status:     wsshell.NormalMessage,
+		SessionId:  sessionId,
+		Properties: map[string]interface{}{filetransfer.PropertyReceived: received},
+	})
+}
+
+func (d *MenderShellDaemon) uploadDone(webSock *connection.Connection, sessionId string, checksum string, err error) error {
+	done := &shell.MenderShellMessage{
+		Type:       filetransfer.MessageTypeUploadDone,
+		Status:     wsshell.NormalMessage,
+		SessionId:  sessionId,
+		Properties: map[string]interface{}{filetransfer.PropertyChecksum: checksum},
+	}
+	if err != nil {
+		done.Status = wsshell.ErrorMessage
+		done.Data = []byte("upload failed: " + err.Error())
+	}
+	return d.responseMessage(webSock, done)
+}
+
+//aborts all the unfinished uploads, removing their temporary files
+func (d *MenderShellDaemon) abortUploads() {
+	d.uploadsMutex.Lock()
+	defer d.uploadsMutex.Unlock()
+	for sessionId, upload := range d.uploads {
+		upload.Abort()
+		delete(d.uploads, sessionId)
+	}
+}
+
+//sends the file in chunks over the current websocket, streaming it so that
+//the large files are not kept in memory
+func (d *MenderShellDaemon) downloadFile(sessionId string, path string, live *liveConfig) {
+	ctx := logging.WithSessionID(context.Background(), sessionId)
+	logger := logging.FromContext(ctx)
+
+	download, err := filetransfer.OpenDownload(path, live.downloadPaths, live.maxFileSize)
+	if err != nil {
+		logger.Errorf("failed to download %s: %s", path, err.Error())
+		d.downloadDone(ctx, sessionId, "", err)
+		return
+	}
+	defer download.Close()
+	logger.Infof("downloading %d bytes from %s", download.Size(), download.Path())
+
+	err = d.sendMessage(&shell.MenderShellMessage{
+		Type:      filetransfer.MessageTypeDownloadStart,
+		Status:    wsshell.NormalMessage,
+		SessionId: sessionId,
+		Properties: map[string]interface{}{
+			filetransfer.PropertyPath: download.Path(),
+			filetransfer.PropertySize: download.Size(),
+			filetransfer.PropertyMode: uint32(download.Mode()),
+		},
+	})
+	if err != nil {
+		logger.Errorf("failed to download %s: %s", path, err.Error())
+		return
+	}
+
+	chunk := make([]byte, filetransfer.DownloadChunkSize)
+	for {
+		n, rErr := io.ReadFull(download, chunk)
+		if n > 0 {
+			err = d.sendMessage(&shell.MenderShellMessage{
+				Type:      filetransfer.MessageTypeDownloadChunk,
+				Status:    wsshell.NormalMessage,
+				SessionId: sessionId,
+				Data:      chunk[:n],
+			})
+			if err != nil {
+				logger.Errorf("failed to download %s: %s", path, err.Error())
+				return
+			}
+		}
+		if rErr == io.EOF || rErr == io.ErrUnexpectedEOF {
+			break
+		} else if rErr != nil {
+			logger.Errorf("failed to download %s: %s", path, rErr.Error())
+			d.downloadDone(ctx, sessionId, download.Checksum(), rErr)
+			return
+		}
+	}
+	logger.Infof("downloaded %s", download.Path())
+	d.downloadDone(ctx, sessionId, download.Checksum(), nil)
+}
+
+func (d *MenderShellDaemon) downloadDone(ctx context.Context, sessionId string, checksum string, err error) {
+	done := &shell.MenderShellMessage{
+		Type:       filetransfer.MessageTypeDownloadDone,
+		Status:     wsshell.NormalMessage,
+		SessionId:  sessionId,
+		Properties: map[string]interface{}{filetransfer.PropertyChecksum: checksum},
+	}
+	if err != nil {
+		done.Status = wsshell.ErrorMessage
+		done.Data = []byte("download failed: " + err.Error())
+	}
+	if wErr := d.sendMessage(done); wErr != nil {
+		logging.FromContext(ctx).Errorf("failed to send the download result: %s", wErr.Error())
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	"github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/filetransfer"
+	"github.com/mendersoftware/mender-shell/shell"
+)
+
+var fileTransferMessages = make(chan *ws.ProtoMsg, 64)
+
+func fileTransferServerLoop(w http.ResponseWriter, r *http.Request) {
+	var upgrader = websocket.Upgrader{}
+	c, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	for {
+		_, data, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg := &ws.ProtoMsg{}
+		if msgpack.Unmarshal(data, msg) == nil {
+			fileTransferMessages <- msg
+		}
+	}
+}
+
+func waitForFileTransferMessage(t *testing.T) *ws.ProtoMsg {
+	select {
+	case m := <-fileTransferMessages:
+		return m
+	case <-time.After(4 * time.Second):
+		t.Fatal("no file transfer message received")
+	}
+	return nil
+}
+
+func TestUploadFile(t *testing.T) {
+	content := []byte("#!/bin/sh\necho uploaded\n")
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	webSock := newTestConnection(t, fileTransferServerLoop)
+
+	testCases := map[string]struct {
+		path      func(dir string) string
+		checksum  string
+		chunkSize int64
+		chunks    [][]byte
+		acks      []int64
+		err       bool
+	}{
+		"ok": {
+			path:     func(dir string) string { return path.Join(dir, "script.sh") },
+			checksum: checksum,
+			chunks:   [][]byte{content[:8], content[8:]},
+			acks:     []int64{0, 8},
+		},
+		"checksum mismatch": {
+			path:     func(dir string) string { return path.Join(dir, "script.sh") },
+			checksum: strings.Repeat("0", 64),
+			chunks:   [][]byte{content},
+			acks:     []int64{0},
+			err:      true,
+		},
+		"chunk too large": {
+			path:      func(dir string) string { return path.Join(dir, "script.sh") },
+			checksum:  checksum,
+			chunkSize: 8,
+			chunks:    [][]byte{content[:8], content[8:]},
+			acks:      []int64{0, 8},
+			err:       true,
+		},
+		"path not allowed": {
+			path:     func(dir string) string { return "/etc/script.sh" },
+			checksum: checksum,
+			err:      true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mender-shell-upload")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					FileTransfer: config.FileTransferConfig{
+						UploadPaths: []string{dir},
+						ChunkSize:   tc.chunkSize,
+					},
+				},
+			})
+			sessionId := "upload-" + name
+
+			err = d.routeMessage(webSock, &shell.MenderShellMessage{
+				Type:      filetransfer.MessageTypeUploadStart,
+				SessionId: sessionId,
+				Properties: map[string]interface{}{
+					filetransfer.PropertyPath:     tc.path(dir),
+					filetransfer.PropertySize:     len(content),
+					filetransfer.PropertyChecksum: tc.checksum,
+					filetransfer.PropertyMode:     0750,
+				},
+			})
+			assert.NoError(t, err)
+
+			for i, chunk := range tc.chunks {
+				m := waitForFileTransferMessage(t)
+				assert.Equal(t, filetransfer.MessageTypeUploadAck, m.Header.MsgType)
+				assert.EqualValues(t, tc.acks[i], m.Header.Properties[filetransfer.PropertyReceived])
+				err = d.routeMessage(webSock, &shell.MenderShellMessage{
+					Type:      filetransfer.MessageTypeUploadChunk,
+					SessionId: sessionId,
+					Data:      chunk,
+				})
+				assert.NoError(t, err)
+			}
+
+			m := waitForFileTransferMessage(t)
+			assert.Equal(t, filetransfer.MessageTypeUploadDone, m.Header.MsgType)
+			assert.Equal(t, sessionId, m.Header.SessionID)
+			files, _ := ioutil.ReadDir(dir)
+			if tc.err {
+				assert.EqualValues(t, wsshell.ErrorMessage, m.Header.Properties["status"])
+				assert.Len(t, files, 0)
+				return
+			}
+			assert.EqualValues(t, wsshell.NormalMessage, m.Header.Properties["status"])
+			assert.Equal(t, checksum, m.Header.Properties[filetransfer.PropertyChecksum])
+			if assert.Len(t, files, 1) {
+				assert.Equal(t, os.FileMode(0750), files[0].Mode().Perm())
+			}
+			data, err := ioutil.ReadFile(tc.path(dir))
+			assert.NoError(t, err)
+			assert.Equal(t, content, data)
+		})
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	testCases := map[string]struct {
+		config config.MenderShellConfigFromFile
+		limit  int64
+	}{
+		"default": {
+			limit: config.DefaultMaxMessageSize,
+		},
+		"configured": {
+			config: config.MenderShellConfigFromFile{
+				MaxMessageBytes: 4096,
+			},
+			limit: 4096,
+		},
+		"uploads enabled": {
+			config: config.MenderShellConfigFromFile{
+				MaxMessageBytes: 4096,
+				FileTransfer: config.FileTransferConfig{
+					UploadPaths: []string{"/tmp"},
+					ChunkSize:   16384,
+				},
+			},
+			limit: 16384 + messageHeaderSize,
+		},
+		"uploads enabled, small chunks": {
+			config: config.MenderShellConfigFromFile{
+				MaxMessageBytes: 65536,
+				FileTransfer: config.FileTransferConfig{
+					UploadPaths: []string{"/tmp"},
+					ChunkSize:   1024,
+				},
+			},
+			limit: 65536,
+		},
+		"uploads disabled": {
+			config: config.MenderShellConfigFromFile{
+				MaxMessageBytes: 4096,
+				FileTransfer: config.FileTransferConfig{
+					ChunkSize: 16384,
+				},
+			},
+			limit: 4096,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := NewDaemon(&config.MenderShellConfig{MenderShellConfigFromFile: tc.config})
+			assert.Equal(t, tc.limit, d.readLimit())
+		})
+	}
+}
+
+func TestUploadChunkNotStarted(t *testing.T) {
+	webSock := newTestConnection(t, fileTransferServerLoop)
+
+	d := &MenderShellDaemon{}
+	err := d.routeMessage(webSock, &shell.MenderShellMessage{
+		Type:      filetransfer.MessageTypeUploadChunk,
+		SessionId: "upload-not-started",
+		Data:      []byte("data"),
+	})
+	assert.NoError(t, err)
+	m := waitForFileTransferMessage(t)
+	assert.Equal(t, filetransfer.MessageTypeUploadDone, m.Header.MsgType)
+	assert.EqualValues(t, wsshell.ErrorMessage, m.Header.Properties["status"])
+	assert.Equal(t, "upload failed: "+filetransfer.ErrUploadNotStarted.Error(), string(m.Body))
+}
+
+func TestFileTransferShellDisabled(t *testing.T) {
+	content := []byte("uploaded with the shell disabled\n")
+	sum := sha256.Sum256(content)
+
+	webSock := newTestConnection(t, fileTransferServerLoop)
+
+	dir, err := ioutil.TempDir("", "mender-shell-upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	enableShell := false
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			EnableShell:  &enableShell,
+			ShellCommand: "/bin/sh",
+			FileTransfer: config.FileTransferConfig{
+				UploadPaths: []string{dir},
+			},
+		},
+	})
+
+	//the shell is denied by policy
+	err = d.routeMessage(webSock, &shell.MenderShellMessage{
+		Type:      wsshell.MessageTypeSpawnShell,
+		SessionId: "shell-disabled",
+		Data:      []byte("user-id-unit-tests"),
+	})
+	assert.NoError(t, err)
+	m := waitForFileTransferMessage(t)
+	assert.Equal(t, wsshell.MessageTypeSpawnShell, m.Header.MsgType)
+	assert.EqualValues(t, wsshell.ErrorMessage, m.Header.Properties["status"])
+	assert.EqualValues(t, shell.ClosePolicyDenied, m.Header.Properties[shell.PropertyCloseCode])
+	assert.Equal(t, "failed to start shell: "+ErrShellDisabled.Error(), string(m.Body))
+	assert.Equal(t, uint(0), d.shellsSpawned)
+
+	//the file transfer is still served
+	err = d.routeMessage(webSock, &shell.MenderShellMessage{
+		Type:      filetransfer.MessageTypeUploadStart,
+		SessionId: "upload-shell-disabled",
+		Properties: map[string]interface{}{
+			filetransfer.PropertyPath:     path.Join(dir, "file.txt"),
+			filetransfer.PropertySize:     len(content),
+			filetransfer.PropertyChecksum: hex.EncodeToString(sum[:]),
+		},
+	})
+	assert.NoError(t, err)
+	m = waitForFileTransferMessage(t)
+	assert.Equal(t, filetransfer.MessageTypeUploadAck, m.Header.MsgType)
+	err = d.routeMessage(webSock, &shell.MenderShellMessage{
+		Type:      filetransfer.MessageTypeUploadChunk,
+		SessionId: "upload-shell-disabled",
+		Data:      content,
+	})
+	assert.NoError(t, err)
+	m = waitForFileTransferMessage(t)
+	assert.Equal(t, filetransfer.MessageTypeUploadDone, m.Header.MsgType)
+	assert.EqualValues(t, wsshell.NormalMessage, m.Header.Properties["status"])
+	data, err := ioutil.ReadFile(path.Join(dir, "file.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+}
+
+func TestDownloadFile(t *testing.T) {
+	content := []byte(strings.Repeat("mender-shell download\n", 512))
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	webSock := newTestConnection(t, fileTransferServerLoop)
+
+	testCases := map[string]struct {
+		path func(dir string) string
+		err  bool
+	}{
+		"ok": {
+			path: func(dir string) string { return path.Join(dir, "data.log") },
+		},
+		"path not allowed": {
+			path: func(dir string) string { return "/etc/passwd" },
+			err:  true,
+		},
+		"not found": {
+			path: func(dir string) string { return path.Join(dir, "missing.log") },
+			err:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mender-shell-download")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+			assert.NoError(t, ioutil.WriteFile(path.Join(dir, "data.log"), content, 0640))
+
+			d := NewDaemon(&config.MenderShellConfig{
+				MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+					FileTransfer: config.FileTransferConfig{
+						MaxFileSize:   1024 * 1024,
+						DownloadPaths: []string{dir},
+					},
+				},
+			})
+			d.setWebSock(webSock)
+			sessionId := "download-" + name
+
+			err = d.routeMessage(webSock, &shell.MenderShellMessage{
+				Type:       filetransfer.MessageTypeDownloadRequest,
+				SessionId:  sessionId,
+				Properties: map[string]interface{}{filetransfer.PropertyPath: tc.path(dir)},
+			})
+			assert.NoError(t, err)
+
+			m := waitForFileTransferMessage(t)
+			if tc.err {
+				assert.Equal(t, filetransfer.MessageTypeDownloadDone, m.Header.MsgType)
+				assert.EqualValues(t, wsshell.ErrorMessage, m.Header.Properties["status"])
+				assert.True(t, strings.HasPrefix(string(m.Body), "download failed: "))
+				return
+			}
+			assert.Equal(t, filetransfer.MessageTypeDownloadStart, m.Header.MsgType)
+			assert.Equal(t, sessionId, m.Header.SessionID)
+			assert.EqualValues(t, len(content), m.Header.Properties[filetransfer.PropertySize])
+			assert.EqualValues(t, 0640, m.Header.Properties[filetransfer.PropertyMode])
+
+			var data []byte
+			for {
+				m = waitForFileTransferMessage(t)
+				if m.Header.MsgType != filetransfer.MessageTypeDownloadChunk {
+					break
+				}
+				assert.True(t, len(m.Body) <= filetransfer.DownloadChunkSize)
+				data = append(data, m.Body...)
+			}
+			assert.Equal(t, filetransfer.MessageTypeDownloadDone, m.Header.MsgType)
+			assert.EqualValues(t, wsshell.NormalMessage, m.Header.Properties["status"])
+			assert.Equal(t, checksum, m.Header.Properties[filetransfer.PropertyChecksum])
+			assert.Equal(t, content, data)
+		})
+	}
+}
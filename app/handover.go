@@ -0,0 +1,152 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	configuration "github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/handover"
+	"github.com/mendersoftware/mender-shell/session"
+	"github.com/mendersoftware/mender-shell/shell"
+	"github.com/mendersoftware/mender-shell/systemd"
+)
+
+// SessionHandoverMessage is the reason the connection is closed with when
+// the sessions are handed over to a new process
+const SessionHandoverMessage = "mender-shell is restarting"
+
+var errHandoverFilesMismatch = errors.New("the sessions and the terminals handed over do not match")
+
+// Handover makes the daemon start its binary again, e.g.: once it was
+// updated, and hand the running sessions over to the new process, if
+// EnableHandover is set; the sessions which can't be handed over are closed
+// as on a shutdown. The daemon stops once the new process took over
+func (d *MenderShellDaemon) Handover() {
+	d.handoverMutex.Lock()
+	defer d.handoverMutex.Unlock()
+	d.handoverRequested = true
+}
+
+func (d *MenderShellDaemon) shouldHandover() bool {
+	d.handoverMutex.Lock()
+	defer d.handoverMutex.Unlock()
+	requested := d.handoverRequested
+	d.handoverRequested = false
+	return requested
+}
+
+//starts the binary again and hands the sessions over to the new process,
+//then stops the daemon; if the new process does not start, the daemon goes
+//on as if nothing happened
+func (d *MenderShellDaemon) handOver() {
+	live := d.liveConfig()
+	path, err := os.Executable()
+	if err != nil {
+		log.Errorf("handover: failed to find the mender-shell binary: %s", err.Error())
+		return
+	}
+	//the new process pings the watchdog once it is the main process
+	process, conn, err := handover.StartProcess(path, os.Args[1:], "WATCHDOG_PID")
+	if err != nil {
+		log.Errorf("handover: failed to start %s: %s", path, err.Error())
+		return
+	}
+	defer conn.Close()
+	defer process.Release()
+	log.Infof("handover: started %s, pid %d", path, process.Pid)
+
+	states, files := []session.HandoverState{}, []*os.File{}
+	if live.enableHandover {
+		states, files = d.sessions.MenderSessionPrepareHandover()
+	} else {
+		log.Info("handover: disabled, closing the sessions")
+		d.gracefulShutdown()
+	}
+	err = handover.Send(conn, states, files)
+	if err == nil {
+		err = handover.WaitAck(conn, configuration.HandoverTimeout)
+	}
+	if err != nil {
+		log.Errorf("handover: failed to hand the sessions over: %s", err.Error())
+		d.gracefulShutdown()
+		d.StopDaemon()
+		return
+	}
+
+	//the shells are left to the new process, and the server is told the
+	//sessions will be resumed
+	d.shutdownOnce.Do(func() {
+		d.shellsMutex.Lock()
+		count := d.sessions.MenderSessionReleaseHandedOver()
+		log.Infof("handover: handed %d sessions over to pid %d", count, process.Pid)
+		d.shellsSpawned = 0
+		d.shellsMutex.Unlock()
+		if webSock := d.getWebSock(); webSock != nil {
+			if err := webSock.CloseWithCode(int(shell.CloseHandover), SessionHandoverMessage); err != nil {
+				log.Debugf("failed to close the websocket: %s", err.Error())
+			}
+		}
+	})
+	d.StopDaemon()
+}
+
+//takes the sessions over from the process which started this one, if it
+//did with handover.StartProcess, and waits for it to exit, so that it is
+//disconnected from the server before this process connects
+func (d *MenderShellDaemon) adoptSessions() {
+	conn, err := handover.Inherited()
+	if err != nil {
+		log.Errorf("handover: %s", err.Error())
+		return
+	}
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	notifySystemd(systemd.MainPID(os.Getpid()))
+
+	states := []session.HandoverState{}
+	files, err := handover.Receive(conn, &states)
+	if err == nil && len(files) != len(states) {
+		err = errHandoverFilesMismatch
+	}
+	if err != nil {
+		log.Errorf("handover: failed to take the sessions over: %s", err.Error())
+		for _, f := range files {
+			f.Close()
+		}
+		return
+	}
+	for i, state := range states {
+		_, err := d.sessions.AdoptSession(d.writeMutex, nil, state, files[i])
+		if err != nil {
+			log.Errorf("handover: failed to take session %s over: %s", state.ID, err.Error())
+			files[i].Close()
+			continue
+		}
+		d.shellsSpawned++
+	}
+	if err := handover.Ack(conn); err != nil {
+		log.Errorf("handover: failed to acknowledge the handover: %s", err.Error())
+		return
+	}
+	log.Infof("handover: took %d sessions over", d.sessions.MenderShellSessionGetCount())
+	if err := handover.WaitClosed(conn, configuration.HandoverTimeout); err != nil {
+		log.Warnf("handover: the previous process did not exit: %s", err.Error())
+	}
+}
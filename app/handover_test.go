@@ -0,0 +1,121 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/handover"
+	"github.com/mendersoftware/mender-shell/procps"
+	"github.com/mendersoftware/mender-shell/session"
+)
+
+func TestHandoverRequested(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{})
+	assert.False(t, d.shouldHandover())
+	d.Handover()
+	assert.True(t, d.shouldHandover())
+	assert.False(t, d.shouldHandover())
+}
+
+//returns the end of a socket pair to send the handover over, the other one
+//inherited as if this process was started with handover.StartProcess
+func inheritHandover(t *testing.T) *net.UnixConn {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	assert.NoError(t, err)
+	os.Setenv(handover.EnvFD, strconv.Itoa(fds[1]))
+	f := os.NewFile(uintptr(fds[0]), "handover")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	assert.NoError(t, err)
+	return conn.(*net.UnixConn)
+}
+
+func TestAdoptSessions(t *testing.T) {
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	//a session of the previous process
+	previous := session.NewRegistry(nil)
+	s, err := previous.NewMenderShellSession(nil, nil, "user-id-unit-tests-handover",
+		session.NoExpirationTimeout, session.NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = s.StartShell(s.GetId(), session.MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         24,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	states, files := previous.MenderSessionPrepareHandover()
+	fd, err := syscall.Dup(int(files[0].Fd()))
+	assert.NoError(t, err)
+	pseudoTTY := os.NewFile(uintptr(fd), "pty")
+	defer pseudoTTY.Close()
+	assert.Equal(t, 1, previous.MenderSessionReleaseHandedOver())
+
+	conn := inheritHandover(t)
+	acked := make(chan error, 1)
+	go func() {
+		err := handover.Send(conn, states, []*os.File{pseudoTTY})
+		if err == nil {
+			err = handover.WaitAck(conn, time.Second)
+		}
+		acked <- err
+		time.Sleep(100 * time.Millisecond)
+		conn.Close()
+	}()
+
+	d := NewDaemon(&config.MenderShellConfig{})
+	d.adoptSessions()
+	assert.NoError(t, <-acked)
+	assert.Empty(t, os.Getenv(handover.EnvFD))
+	assert.Equal(t, uint(1), d.shellsSpawned)
+
+	adopted := d.sessions.MenderShellSessionGetById(s.GetId())
+	if assert.NotNil(t, adopted) {
+		assert.Equal(t, session.ActiveSession, adopted.GetStatus())
+		assert.Equal(t, s.GetShellPid(), adopted.GetShellPid())
+	}
+	d.sessions.MenderSessionShutdownAll(time.Second)
+	assert.False(t, procps.ProcessExists(s.GetShellPid()))
+}
+
+func TestAdoptSessionsNotHandedOver(t *testing.T) {
+	os.Unsetenv(handover.EnvFD)
+	d := NewDaemon(&config.MenderShellConfig{})
+	d.adoptSessions()
+	assert.Equal(t, 0, d.sessions.MenderShellSessionGetCount())
+
+	//the previous process failing before sending the sessions
+	conn := inheritHandover(t)
+	conn.Close()
+	d.adoptSessions()
+	assert.Equal(t, 0, d.sessions.MenderShellSessionGetCount())
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+
+	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/session"
+)
+
+// ErrDeviceNotAuthorized is the disconnection error when the device lost
+// its authorization
+var ErrDeviceNotAuthorized = errors.New("the device is not authorized")
+
+// LifecycleObserver is told about the connection to the server and the
+// sessions, see SetLifecycleObserver; it is called from the goroutines of
+// the daemon, which wait for it to return
+type LifecycleObserver interface {
+	// Connected is called when the connection to the server is made, and
+	// again after every reconnection
+	Connected()
+	// Disconnected is called when the connection to the server is lost, or
+	// closed; err tells why, ErrShuttingDown when the daemon stops
+	Disconnected(err error)
+	// SessionOpened is called when the shell of a session started
+	SessionOpened(sessionId string, userId string)
+	// SessionClosed is called when the shell of a session is closed, with
+	// the reason, e.g.: SessionTimedOutMessage
+	SessionClosed(sessionId string, userId string, reason string)
+}
+
+// SetLifecycleObserver sets the observer of the connection and the
+// sessions; it has to be called before Run
+func (d *MenderShellDaemon) SetLifecycleObserver(observer LifecycleObserver) {
+	d.lifecycleObserver = observer
+}
+
+//keeps why the connection is lost, for the transition out of the connected
+//state to report it
+func (d *MenderShellDaemon) setDisconnectError(err error) {
+	d.disconnectErrorMutex.Lock()
+	defer d.disconnectErrorMutex.Unlock()
+	d.disconnectError = err
+}
+
+func (d *MenderShellDaemon) takeDisconnectError() error {
+	d.disconnectErrorMutex.Lock()
+	defer d.disconnectErrorMutex.Unlock()
+	err := d.disconnectError
+	d.disconnectError = nil
+	return err
+}
+
+//tells the observer about the connection made and lost
+func (d *MenderShellDaemon) observeTransition(t connection.Transition) {
+	if d.lifecycleObserver == nil {
+		return
+	}
+	if t.To == connection.StateConnected {
+		d.takeDisconnectError()
+		d.lifecycleObserver.Connected()
+	} else if t.From == connection.StateConnected {
+		err := d.takeDisconnectError()
+		if err == nil && t.To == connection.StateShuttingDown {
+			err = ErrShuttingDown
+		}
+		d.lifecycleObserver.Disconnected(err)
+	}
+}
+
+// observerNotifier passes the sessions opened and closed to the observer,
+// with the reason the session closed
+type observerNotifier struct {
+	observer LifecycleObserver
+	sessions *session.Registry
+}
+
+func (n *observerNotifier) SessionOpened(sessionId string, userId string) {
+	n.observer.SessionOpened(sessionId, userId)
+}
+
+func (n *observerNotifier) SessionClosed(sessionId string, userId string) {
+	reason := session.SessionStoppedReason
+	if s := n.sessions.MenderShellSessionGetById(sessionId); s != nil {
+		reason = s.CloseReason()
+	}
+	n.observer.SessionClosed(sessionId, userId, reason)
+}
+
+// sessionNotifiers passes the sessions opened and closed to all of the
+// notifiers, in order
+type sessionNotifiers []session.SessionNotifier
+
+func (n sessionNotifiers) SessionOpened(sessionId string, userId string) {
+	for _, notifier := range n {
+		notifier.SessionOpened(sessionId, userId)
+	}
+}
+
+func (n sessionNotifiers) SessionClosed(sessionId string, userId string) {
+	for _, notifier := range n {
+		notifier.SessionClosed(sessionId, userId)
+	}
+}
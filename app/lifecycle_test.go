@@ -0,0 +1,89 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/session"
+)
+
+type recordingObserver struct {
+	events []string
+}
+
+func (o *recordingObserver) Connected() {
+	o.events = append(o.events, "connected")
+}
+
+func (o *recordingObserver) Disconnected(err error) {
+	o.events = append(o.events, fmt.Sprintf("disconnected: %v", err))
+}
+
+func (o *recordingObserver) SessionOpened(sessionId string, userId string) {
+	o.events = append(o.events, "opened "+sessionId)
+}
+
+func (o *recordingObserver) SessionClosed(sessionId string, userId string, reason string) {
+	o.events = append(o.events, "closed "+sessionId+": "+reason)
+}
+
+func TestObserveTransition(t *testing.T) {
+	observer := &recordingObserver{}
+	d := NewDaemon(&config.MenderShellConfig{})
+	d.SetLifecycleObserver(observer)
+
+	d.setConnectionState(connection.StateAuthenticating)
+	d.setConnectionState(connection.StateConnected)
+	d.setDisconnectError(errors.New("connection reset"))
+	d.setConnectionState(connection.StateReconnecting)
+	d.setConnectionState(connection.StateConnected)
+	d.setDisconnectError(ErrDeviceNotAuthorized)
+	d.setConnectionState(connection.StateAuthenticating)
+	d.setConnectionState(connection.StateConnected)
+	d.StopDaemon()
+
+	assert.Equal(t, []string{
+		"connected",
+		"disconnected: connection reset",
+		"connected",
+		"disconnected: " + ErrDeviceNotAuthorized.Error(),
+		"connected",
+		"disconnected: " + ErrShuttingDown.Error(),
+	}, observer.events)
+}
+
+func TestObserverNotifier(t *testing.T) {
+	observer := &recordingObserver{}
+	sessions := session.NewRegistry(nil)
+	notifiers := sessionNotifiers{
+		&observerNotifier{observer: observer, sessions: sessions},
+		&observerNotifier{observer: observer, sessions: sessions},
+	}
+	notifiers.SessionOpened("session-id", "user-id")
+	//the session is gone already
+	notifiers.SessionClosed("session-id", "user-id")
+	assert.Equal(t, []string{
+		"opened session-id",
+		"opened session-id",
+		"closed session-id: the shell was stopped",
+		"closed session-id: the shell was stopped",
+	}, observer.events)
+}
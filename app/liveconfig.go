@@ -0,0 +1,121 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"time"
+
+	configuration "github.com/mendersoftware/mender-shell/config"
+)
+
+//the options which a reload of the configuration can change; a snapshot is
+//never modified, the reload replaces it as a whole, so the messages and the
+//sweeps read it once and see a consistent set of options
+type liveConfig struct {
+	logLevel                string
+	logFormat               string
+	logSecretKeys           []string
+	logSink                 string
+	logSyslogFacility       string
+	username                string
+	sessionWorkingDir       string
+	shell                   string
+	shellArguments          []string
+	sessionEnv              map[string]string
+	inheritEnv              bool
+	respawnShell            bool
+	enableHandover          bool
+	restrictedShell         bool
+	restrictedCommands      []string
+	allowedCommands         []string
+	maxFileSize             int64
+	uploadPaths             []string
+	downloadPaths           []string
+	portForwardTargets      []string
+	shellEnabled            bool
+	banner                  string
+	authorizedUsers         []string
+	messagePolicy           configuration.MessagePolicyConfig
+	expireSessionsAfter     time.Duration
+	expireSessionsAfterIdle time.Duration
+	terminalWidth           uint16
+	terminalHeight          uint16
+	reconnectWindow         time.Duration
+	idleTimeout             time.Duration
+	initialInputTimeout     time.Duration
+	maxSessionDuration      time.Duration
+	shutdownGracePeriod     time.Duration
+}
+
+func newLiveConfig(config *configuration.MenderShellConfig) *liveConfig {
+	live := &liveConfig{
+		logLevel:                config.LogLevel,
+		logFormat:               config.LogFormat,
+		logSecretKeys:           config.LogSecretKeys,
+		logSink:                 config.LogSink,
+		logSyslogFacility:       config.LogSyslogFacility,
+		username:                config.User,
+		sessionWorkingDir:       config.SessionWorkingDir,
+		shell:                   config.ShellCommand,
+		shellArguments:          config.ShellArguments,
+		sessionEnv:              config.SessionEnv,
+		inheritEnv:              config.InheritEnv,
+		respawnShell:            config.RespawnShell,
+		enableHandover:          config.EnableHandover,
+		restrictedShell:         config.RestrictedShell,
+		restrictedCommands:      config.RestrictedCommands,
+		allowedCommands:         config.AllowedCommands,
+		maxFileSize:             config.FileTransfer.MaxFileSize,
+		uploadPaths:             config.FileTransfer.UploadPaths,
+		downloadPaths:           config.FileTransfer.DownloadPaths,
+		portForwardTargets:      config.PortForwardTargets,
+		shellEnabled:            config.ShellEnabled(),
+		banner:                  config.SessionBanner,
+		authorizedUsers:         config.AuthorizedUsers,
+		messagePolicy:           config.MessagePolicy,
+		expireSessionsAfter:     time.Second * time.Duration(config.Sessions.ExpireAfter),
+		expireSessionsAfterIdle: time.Second * time.Duration(config.Sessions.ExpireAfterIdle),
+		terminalWidth:           config.Terminal.Width,
+		terminalHeight:          config.Terminal.Height,
+		reconnectWindow:         time.Second * time.Duration(config.ReconnectWindow),
+		idleTimeout:             time.Second * time.Duration(config.IdleTimeoutSeconds),
+		initialInputTimeout:     time.Second * time.Duration(config.InitialInputTimeoutSeconds),
+		maxSessionDuration:      time.Second * time.Duration(config.MaxSessionDurationSeconds),
+		shutdownGracePeriod:     time.Second * time.Duration(config.ShutdownGracePeriodSeconds),
+	}
+	if live.maxFileSize <= 0 {
+		live.maxFileSize = configuration.DefaultMaxFileSize
+	}
+	if live.shutdownGracePeriod == 0 {
+		live.shutdownGracePeriod = configuration.DefaultShutdownGracePeriod
+	}
+	return live
+}
+
+//returns the current snapshot of the live options, the zero options if the
+//daemon was not created from a configuration
+func (d *MenderShellDaemon) liveConfig() *liveConfig {
+	d.liveMutex.RLock()
+	defer d.liveMutex.RUnlock()
+	if d.live == nil {
+		return &liveConfig{}
+	}
+	return d.live
+}
+
+func (d *MenderShellDaemon) setLiveConfig(live *liveConfig) {
+	d.liveMutex.Lock()
+	defer d.liveMutex.Unlock()
+	d.live = live
+}
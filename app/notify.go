@@ -0,0 +1,66 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/systemd"
+)
+
+//sends the state to systemd, if mender-shell runs as a Type=notify service
+func notifySystemd(state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		log.Warnf("failed to notify systemd of %s: %s", state, err.Error())
+	}
+}
+
+//reports the connection state as the service status, and the service as
+//ready once it connected to the server for the first time
+func (d *MenderShellDaemon) notifyConnectionState(state connection.State) {
+	notifySystemd(systemd.Status("connection state: " + state.String()))
+	if state == connection.StateConnected {
+		d.readyOnce.Do(func() {
+			notifySystemd(systemd.Ready)
+		})
+	}
+}
+
+//enables the systemd watchdog pings, if the watchdog is enabled for the
+//service
+func (d *MenderShellDaemon) setupWatchdog() {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		log.Warnf("the systemd watchdog is disabled: %s", err.Error())
+		return
+	}
+	if interval > 0 {
+		log.Infof("pinging the systemd watchdog every %s", interval/2)
+	}
+	d.watchdogInterval = interval
+}
+
+//pings the systemd watchdog, twice per watchdog interval; it is called from
+//the main loop, so the pings stop if the main loop gets stuck and systemd
+//restarts mender-shell
+func (d *MenderShellDaemon) pingWatchdog() {
+	if d.watchdogInterval == 0 || time.Since(d.lastWatchdogPing) < d.watchdogInterval/2 {
+		return
+	}
+	d.lastWatchdogPing = time.Now()
+	notifySystemd(systemd.Watchdog)
+}
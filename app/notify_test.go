@@ -0,0 +1,102 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/connection"
+)
+
+//listens on a notification socket set in NOTIFY_SOCKET, returning the
+//function reading the notifications received so far
+func listenNotifySocket(t *testing.T, dir string) (func() []string, func()) {
+	socketPath := path.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	assert.NoError(t, err)
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+
+	read := func() []string {
+		var notifications []string
+		buf := make([]byte, 256)
+		for {
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, err := conn.Read(buf)
+			if err != nil {
+				return notifications
+			}
+			notifications = append(notifications, string(buf[:n]))
+		}
+	}
+	return read, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+	}
+}
+
+func TestMenderShellNotifySystemd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-notify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	read, stop := listenNotifySocket(t, dir)
+	defer stop()
+
+	d := NewDaemon(&config.MenderShellConfig{})
+	d.setConnectionState(connection.StateAuthenticating)
+	assert.Equal(t, []string{"STATUS=connection state: Authenticating"}, read())
+
+	d.setConnectionState(connection.StateConnected)
+	assert.Equal(t, []string{"STATUS=connection state: Connected", "READY=1"}, read())
+
+	//the service is ready once, the reconnects only update the status
+	d.setConnectionState(connection.StateReconnecting)
+	d.setConnectionState(connection.StateConnected)
+	assert.Equal(t, []string{"STATUS=connection state: Reconnecting", "STATUS=connection state: Connected"}, read())
+
+	d.gracefulShutdown()
+	assert.Contains(t, read(), "STOPPING=1")
+}
+
+func TestMenderShellPingWatchdog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-notify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	read, stop := listenNotifySocket(t, dir)
+	defer stop()
+
+	d := &MenderShellDaemon{}
+	d.setupWatchdog()
+	d.pingWatchdog()
+	assert.Empty(t, read())
+
+	os.Setenv("WATCHDOG_USEC", "400000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	d.setupWatchdog()
+	assert.Equal(t, 400*time.Millisecond, d.watchdogInterval)
+	d.pingWatchdog()
+	d.pingWatchdog()
+	assert.Equal(t, []string{"WATCHDOG=1"}, read())
+
+	time.Sleep(200 * time.Millisecond)
+	d.pingWatchdog()
+	assert.Equal(t, []string{"WATCHDOG=1"}, read())
+}
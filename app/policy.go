@@ -0,0 +1,175 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	configuration "github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/filetransfer"
+	"github.com/mendersoftware/mender-shell/logging"
+	"github.com/mendersoftware/mender-shell/portforward"
+	"github.com/mendersoftware/mender-shell/shell"
+)
+
+var (
+	ErrPolicyDenied = errors.New("denied by policy")
+)
+
+//the destination of each message type the policy applies to: the messages
+//starting a shell, a command, a file transfer or a port forwarding; the
+//messages following them belong to an operation already authorized
+var policyDestinations = map[string]func(message *shell.MenderShellMessage) string{
+	wsshell.MessageTypeSpawnShell: func(message *shell.MenderShellMessage) string {
+		return ""
+	},
+	shell.MessageTypeExecCommand: func(message *shell.MenderShellMessage) string {
+		return string(message.Data)
+	},
+	filetransfer.MessageTypeUploadStart: func(message *shell.MenderShellMessage) string {
+		path, _ := message.Properties[filetransfer.PropertyPath].(string)
+		return path
+	},
+	filetransfer.MessageTypeDownloadRequest: func(message *shell.MenderShellMessage) string {
+		path, _ := message.Properties[filetransfer.PropertyPath].(string)
+		return path
+	},
+	portforward.MessageTypePortForwardOpen: func(message *shell.MenderShellMessage) string {
+		target, _ := message.Properties[portforward.PropertyTarget].(string)
+		return target
+	},
+}
+
+//returns nil if the policy allows the message of the given type, to the
+//destination, from the token carrying the claims; ErrPolicyDenied, with
+//the reason, otherwise
+func authorizeMessage(policy configuration.MessagePolicyConfig, messageType string,
+	destination string, claims map[string]interface{}) error {
+	named := false
+	var reason string
+	for _, rule := range policy.Rules {
+		if !stringIn(messageType, rule.MessageTypes) {
+			continue
+		}
+		named = true
+		if !destinationAllowed(destination, rule.Destinations) {
+			reason = fmt.Sprintf("destination %q not allowed", destination)
+			continue
+		}
+		if claim, ok := claimsAllowed(claims, rule.Claims); !ok {
+			reason = fmt.Sprintf("claim %s not allowed", claim)
+			continue
+		}
+		return nil
+	}
+	if !named {
+		if policy.DefaultDeny {
+			return fmt.Errorf("%w: no rule allows %s", ErrPolicyDenied, messageType)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrPolicyDenied, reason)
+}
+
+func stringIn(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func destinationAllowed(destination string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	if destination == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, destination); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//returns the first claim of the rule the token does not match, if any
+func claimsAllowed(claims map[string]interface{}, allowed map[string][]string) (string, bool) {
+	for claim, values := range allowed {
+		if !claimAllowed(claims[claim], values) {
+			return claim, false
+		}
+	}
+	return "", true
+}
+
+func claimAllowed(value interface{}, allowed []string) bool {
+	switch value := value.(type) {
+	case nil:
+		return false
+	case string:
+		return stringIn(value, allowed)
+	case []interface{}:
+		for _, v := range value {
+			if claimAllowed(v, allowed) {
+				return true
+			}
+		}
+		return false
+	default:
+		return stringIn(fmt.Sprint(value), allowed)
+	}
+}
+
+//rejects the messages the policy denies, answering with an error message
+//of the same type, or closing the shell; returns false if the message was
+//rejected
+func (d *MenderShellDaemon) messageAuthorized(webSock *connection.Connection, message *shell.MenderShellMessage,
+	policy configuration.MessagePolicyConfig) bool {
+	destinationOf, ok := policyDestinations[message.Type]
+	if !ok {
+		return true
+	}
+	destination := destinationOf(message)
+	err := authorizeMessage(policy, message.Type, destination, d.authenticatedClaims)
+	if err == nil {
+		return true
+	}
+	logger := logging.FromContext(logging.WithSessionID(context.Background(), message.SessionId))
+	logger.WithField(logging.EventField, logging.EventPolicyDenied).
+		Warnf("rejecting the %s message to %q of the authenticated user %q: %s",
+			message.Type, destination, d.authenticatedUser, err.Error())
+	if webSock == nil {
+		return false
+	}
+	if message.Type == wsshell.MessageTypeSpawnShell {
+		d.spawnShellFailed(webSock, message.SessionId, err, shell.ClosePolicyDenied)
+		return false
+	}
+	d.responseMessage(webSock, &shell.MenderShellMessage{
+		Type:      message.Type,
+		Status:    wsshell.ErrorMessage,
+		SessionId: message.SessionId,
+		Data:      []byte(err.Error()),
+	})
+	return false
+}
@@ -0,0 +1,259 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	"github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/filetransfer"
+	"github.com/mendersoftware/mender-shell/portforward"
+	"github.com/mendersoftware/mender-shell/shell"
+)
+
+func TestAuthorizeMessage(t *testing.T) {
+	policy := config.MessagePolicyConfig{
+		Rules: []config.PolicyRule{
+			{
+				MessageTypes: []string{wsshell.MessageTypeSpawnShell, shell.MessageTypeExecCommand},
+				Claims: map[string][]string{
+					"mender.user": {"admin", "operator"},
+				},
+			},
+			{
+				MessageTypes: []string{filetransfer.MessageTypeUploadStart},
+				Destinations: []string{"/data/*"},
+				Claims: map[string][]string{
+					"roles": {"uploader"},
+				},
+			},
+			{
+				MessageTypes: []string{filetransfer.MessageTypeUploadStart},
+				Destinations: []string{"/etc/*"},
+				Claims: map[string][]string{
+					"mender.user": {"admin"},
+				},
+			},
+			{
+				MessageTypes: []string{portforward.MessageTypePortForwardOpen},
+				Destinations: []string{"127.0.0.1:*"},
+			},
+		},
+	}
+	defaultDeny := policy
+	defaultDeny.DefaultDeny = true
+
+	admin := map[string]interface{}{
+		"mender.user": "admin",
+	}
+	operator := map[string]interface{}{
+		"mender.user": "operator",
+		"roles":       []interface{}{"viewer", "uploader"},
+	}
+	viewer := map[string]interface{}{
+		"mender.user": "viewer",
+		"roles":       []interface{}{"viewer"},
+	}
+
+	testCases := map[string]struct {
+		policy      config.MessagePolicyConfig
+		messageType string
+		destination string
+		claims      map[string]interface{}
+		err         string
+	}{
+		"shell, admin": {
+			policy:      policy,
+			messageType: wsshell.MessageTypeSpawnShell,
+			claims:      admin,
+		},
+		"shell, operator": {
+			policy:      policy,
+			messageType: wsshell.MessageTypeSpawnShell,
+			claims:      operator,
+		},
+		"shell, viewer": {
+			policy:      policy,
+			messageType: wsshell.MessageTypeSpawnShell,
+			claims:      viewer,
+			err:         "denied by policy: claim mender.user not allowed",
+		},
+		"shell, no claims": {
+			policy:      policy,
+			messageType: wsshell.MessageTypeSpawnShell,
+			err:         "denied by policy: claim mender.user not allowed",
+		},
+		"exec, viewer": {
+			policy:      policy,
+			messageType: shell.MessageTypeExecCommand,
+			destination: "uptime",
+			claims:      viewer,
+			err:         "denied by policy: claim mender.user not allowed",
+		},
+		"upload, operator to data": {
+			policy:      policy,
+			messageType: filetransfer.MessageTypeUploadStart,
+			destination: "/data/file",
+			claims:      operator,
+		},
+		"upload, operator to etc": {
+			policy:      policy,
+			messageType: filetransfer.MessageTypeUploadStart,
+			destination: "/etc/passwd",
+			claims:      operator,
+			err:         "denied by policy: claim mender.user not allowed",
+		},
+		"upload, admin to etc": {
+			policy:      policy,
+			messageType: filetransfer.MessageTypeUploadStart,
+			destination: "/etc/passwd",
+			claims:      admin,
+		},
+		"upload, admin to data": {
+			policy:      policy,
+			messageType: filetransfer.MessageTypeUploadStart,
+			destination: "/data/file",
+			claims:      admin,
+			err:         "denied by policy: destination \"/data/file\" not allowed",
+		},
+		"upload, viewer to data": {
+			policy:      policy,
+			messageType: filetransfer.MessageTypeUploadStart,
+			destination: "/data/file",
+			claims:      viewer,
+			err:         "denied by policy: destination \"/data/file\" not allowed",
+		},
+		"upload, operator to a subdirectory": {
+			policy:      policy,
+			messageType: filetransfer.MessageTypeUploadStart,
+			destination: "/data/dir/file",
+			claims:      operator,
+			err:         "denied by policy: destination \"/data/dir/file\" not allowed",
+		},
+		"port forward, local": {
+			policy:      policy,
+			messageType: portforward.MessageTypePortForwardOpen,
+			destination: "127.0.0.1:8080",
+			claims:      viewer,
+		},
+		"port forward, remote": {
+			policy:      policy,
+			messageType: portforward.MessageTypePortForwardOpen,
+			destination: "10.0.0.1:22",
+			claims:      admin,
+			err:         "denied by policy: destination \"10.0.0.1:22\" not allowed",
+		},
+		"download, no rule": {
+			policy:      policy,
+			messageType: filetransfer.MessageTypeDownloadRequest,
+			destination: "/etc/passwd",
+			claims:      viewer,
+		},
+		"download, no rule, default deny": {
+			policy:      defaultDeny,
+			messageType: filetransfer.MessageTypeDownloadRequest,
+			destination: "/etc/passwd",
+			claims:      admin,
+			err:         "denied by policy: no rule allows download_request",
+		},
+		"shell, admin, default deny": {
+			policy:      defaultDeny,
+			messageType: wsshell.MessageTypeSpawnShell,
+			claims:      admin,
+		},
+		"no policy": {
+			messageType: wsshell.MessageTypeSpawnShell,
+		},
+		"numeric claim": {
+			policy: config.MessagePolicyConfig{
+				Rules: []config.PolicyRule{{
+					MessageTypes: []string{shell.MessageTypeExecCommand},
+					Claims: map[string][]string{
+						"level": {"3"},
+					},
+				}},
+			},
+			messageType: shell.MessageTypeExecCommand,
+			claims: map[string]interface{}{
+				"level": float64(3),
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := authorizeMessage(tc.policy, tc.messageType, tc.destination, tc.claims)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				assert.True(t, errors.Is(err, ErrPolicyDenied))
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRouteMessagePolicyDenied(t *testing.T) {
+	webSock := newTestConnection(t, fileTransferServerLoop)
+
+	d := NewDaemon(&config.MenderShellConfig{
+		MenderShellConfigFromFile: config.MenderShellConfigFromFile{
+			ShellCommand: "/bin/sh",
+			MessagePolicy: config.MessagePolicyConfig{
+				DefaultDeny: true,
+				Rules: []config.PolicyRule{{
+					MessageTypes: []string{wsshell.MessageTypeSpawnShell},
+					Claims: map[string][]string{
+						"mender.user": {"admin"},
+					},
+				}},
+			},
+		},
+	})
+	payload, _ := json.Marshal(map[string]interface{}{"sub": "device", "mender.user": "viewer"})
+	d.setAuthenticatedUser("eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".")
+
+	err := d.routeMessage(webSock, &shell.MenderShellMessage{
+		Type:      wsshell.MessageTypeSpawnShell,
+		SessionId: "policy-denied",
+		Data:      []byte("user-id-unit-tests"),
+	})
+	assert.NoError(t, err)
+	m := waitForFileTransferMessage(t)
+	assert.Equal(t, wsshell.MessageTypeSpawnShell, m.Header.MsgType)
+	assert.EqualValues(t, wsshell.ErrorMessage, m.Header.Properties["status"])
+	assert.EqualValues(t, shell.ClosePolicyDenied, m.Header.Properties[shell.PropertyCloseCode])
+	assert.Equal(t, "failed to start shell: denied by policy: claim mender.user not allowed", string(m.Body))
+	assert.Equal(t, uint(0), d.shellsSpawned)
+
+	err = d.routeMessage(webSock, &shell.MenderShellMessage{
+		Type:      filetransfer.MessageTypeDownloadRequest,
+		SessionId: "policy-denied-download",
+		Properties: map[string]interface{}{
+			filetransfer.PropertyPath: "/etc/passwd",
+		},
+	})
+	assert.NoError(t, err)
+	m = waitForFileTransferMessage(t)
+	assert.Equal(t, filetransfer.MessageTypeDownloadRequest, m.Header.MsgType)
+	assert.EqualValues(t, wsshell.ErrorMessage, m.Header.Properties["status"])
+	assert.Equal(t, "denied by policy: no rule allows download_request", string(m.Body))
+}
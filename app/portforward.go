@@ -0,0 +1,163 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"context"
+
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	"github.com/mendersoftware/mender-shell/logging"
+	"github.com/mendersoftware/mender-shell/portforward"
+	"github.com/mendersoftware/mender-shell/shell"
+)
+
+//connects to the target and bridges it with the session over the websocket,
+//replacing the forwarded connection the session already has; it runs in the
+//background, as connecting may take up to portforward.DialTimeout
+func (d *MenderShellDaemon) openPortForward(sessionId string, target string, allowlist []string) {
+	logger := logging.FromContext(logging.WithSessionID(context.Background(), sessionId))
+	d.closePortForward(sessionId)
+
+	reply := &shell.MenderShellMessage{
+		Type:       portforward.MessageTypePortForwardOpen,
+		Status:     wsshell.NormalMessage,
+		SessionId:  sessionId,
+		Properties: map[string]interface{}{portforward.PropertyTarget: target},
+	}
+	forward, err := portforward.Open(target, allowlist, portforward.DialTimeout)
+	if err != nil {
+		logger.Errorf("failed to forward the connection to %q: %s", target, err.Error())
+		reply.Status = wsshell.ErrorMessage
+		reply.Data = []byte("port forwarding failed: " + err.Error())
+		d.sendMessage(reply)
+		return
+	}
+
+	d.portForwardsMutex.Lock()
+	if d.portForwards == nil {
+		d.portForwards = map[string]*portforward.Forward{}
+	}
+	d.portForwards[sessionId] = forward
+	d.portForwardsMutex.Unlock()
+
+	logger.Infof("forwarding the connection to %s", target)
+	if err := d.sendMessage(reply); err != nil {
+		logger.Errorf("failed to forward the connection to %s: %s", target, err.Error())
+		d.removePortForward(sessionId, forward)
+		return
+	}
+	d.pipePortForward(sessionId, forward)
+}
+
+//sends what the target writes to the session, until either side closes
+func (d *MenderShellDaemon) pipePortForward(sessionId string, forward *portforward.Forward) {
+	logger := logging.FromContext(logging.WithSessionID(context.Background(), sessionId))
+	data := make([]byte, portforward.ChunkSize)
+	for {
+		n, err := forward.Read(data)
+		if n > 0 {
+			wErr := d.sendMessage(&shell.MenderShellMessage{
+				Type:      portforward.MessageTypePortForwardData,
+				Status:    wsshell.NormalMessage,
+				SessionId: sessionId,
+				Data:      data[:n],
+			})
+			if wErr != nil {
+				logger.Errorf("failed to forward the data from %s: %s", forward.Target(), wErr.Error())
+				d.removePortForward(sessionId, forward)
+				return
+			}
+		}
+		if err != nil {
+			//closed by the server, which needs no notification
+			if !d.removePortForward(sessionId, forward) {
+				return
+			}
+			logger.Infof("the connection to %s was closed", forward.Target())
+			d.sendMessage(&shell.MenderShellMessage{
+				Type:      portforward.MessageTypePortForwardClose,
+				Status:    wsshell.NormalMessage,
+				SessionId: sessionId,
+			})
+			return
+		}
+	}
+}
+
+//writes the data sent by the server to the target of the session
+func (d *MenderShellDaemon) portForwardData(message *shell.MenderShellMessage) error {
+	logger := logging.FromContext(logging.WithSessionID(context.Background(), message.SessionId))
+	d.portForwardsMutex.Lock()
+	forward, ok := d.portForwards[message.SessionId]
+	d.portForwardsMutex.Unlock()
+	if !ok {
+		logger.Errorf("received data without a forwarded connection")
+		return d.sendMessage(&shell.MenderShellMessage{
+			Type:      portforward.MessageTypePortForwardClose,
+			Status:    wsshell.ErrorMessage,
+			SessionId: message.SessionId,
+			Data:      []byte("port forwarding failed: no forwarded connection"),
+		})
+	}
+
+	_, err := forward.Write(message.Data)
+	if err != nil {
+		logger.Errorf("failed to forward the data to %s: %s", forward.Target(), err.Error())
+		if d.removePortForward(message.SessionId, forward) {
+			return d.sendMessage(&shell.MenderShellMessage{
+				Type:      portforward.MessageTypePortForwardClose,
+				Status:    wsshell.ErrorMessage,
+				SessionId: message.SessionId,
+				Data:      []byte("port forwarding failed: " + err.Error()),
+			})
+		}
+	}
+	return nil
+}
+
+//removes and closes the forwarded connection, if it is still the one of the
+//session; returns false if it was already removed
+func (d *MenderShellDaemon) removePortForward(sessionId string, forward *portforward.Forward) bool {
+	d.portForwardsMutex.Lock()
+	defer d.portForwardsMutex.Unlock()
+	forward.Close()
+	if d.portForwards[sessionId] != forward {
+		return false
+	}
+	delete(d.portForwards, sessionId)
+	return true
+}
+
+//closes the forwarded connection of the session, if any
+func (d *MenderShellDaemon) closePortForward(sessionId string) {
+	d.portForwardsMutex.Lock()
+	defer d.portForwardsMutex.Unlock()
+	if forward, ok := d.portForwards[sessionId]; ok {
+		logging.FromContext(logging.WithSessionID(context.Background(), sessionId)).
+			Infof("closing the connection to %s", forward.Target())
+		forward.Close()
+		delete(d.portForwards, sessionId)
+	}
+}
+
+//closes all the forwarded connections
+func (d *MenderShellDaemon) closePortForwards() {
+	d.portForwardsMutex.Lock()
+	defer d.portForwardsMutex.Unlock()
+	for sessionId, forward := range d.portForwards {
+		forward.Close()
+		delete(d.portForwards, sessionId)
+	}
+}
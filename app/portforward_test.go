@@ -0,0 +1,123 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
+
+	"github.com/mendersoftware/mender-shell/portforward"
+	"github.com/mendersoftware/mender-shell/shell"
+)
+
+func TestPortForward(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	target := listener.Addr().String()
+
+	webSock := newTestConnection(t, fileTransferServerLoop)
+
+	d := &MenderShellDaemon{live: &liveConfig{portForwardTargets: []string{target}}}
+	d.setWebSock(webSock)
+	sessionId := "port-forward"
+
+	err = d.routeMessage(webSock, &shell.MenderShellMessage{
+		Type:       portforward.MessageTypePortForwardOpen,
+		SessionId:  sessionId,
+		Properties: map[string]interface{}{portforward.PropertyTarget: target},
+	})
+	assert.NoError(t, err)
+	m := waitForFileTransferMessage(t)
+	assert.Equal(t, portforward.MessageTypePortForwardOpen, m.Header.MsgType)
+	assert.EqualValues(t, wsshell.NormalMessage, m.Header.Properties["status"])
+
+	err = d.routeMessage(webSock, &shell.MenderShellMessage{
+		Type:      portforward.MessageTypePortForwardData,
+		SessionId: sessionId,
+		Data:      []byte("GET / HTTP/1.0\r\n\r\n"),
+	})
+	assert.NoError(t, err)
+	var data []byte
+	for len(data) < len("GET / HTTP/1.0\r\n\r\n") {
+		m = waitForFileTransferMessage(t)
+		assert.Equal(t, portforward.MessageTypePortForwardData, m.Header.MsgType)
+		data = append(data, m.Body...)
+	}
+	assert.Equal(t, "GET / HTTP/1.0\r\n\r\n", string(data))
+
+	err = d.routeMessage(webSock, &shell.MenderShellMessage{
+		Type:      portforward.MessageTypePortForwardClose,
+		SessionId: sessionId,
+	})
+	assert.NoError(t, err)
+	d.portForwardsMutex.Lock()
+	assert.Len(t, d.portForwards, 0)
+	d.portForwardsMutex.Unlock()
+}
+
+func TestPortForwardFailed(t *testing.T) {
+	//a port nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	refused := listener.Addr().String()
+	listener.Close()
+
+	webSock := newTestConnection(t, fileTransferServerLoop)
+
+	testCases := map[string]struct {
+		target string
+		err    string
+	}{
+		"connection refused": {
+			target: refused,
+			err:    "connection refused",
+		},
+		"not allowed": {
+			target: "127.0.0.1:22",
+			err:    portforward.ErrTargetNotAllowed.Error(),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := &MenderShellDaemon{live: &liveConfig{portForwardTargets: []string{refused}}}
+			d.setWebSock(webSock)
+
+			err = d.routeMessage(webSock, &shell.MenderShellMessage{
+				Type:       portforward.MessageTypePortForwardOpen,
+				SessionId:  "port-forward-" + name,
+				Properties: map[string]interface{}{portforward.PropertyTarget: tc.target},
+			})
+			assert.NoError(t, err)
+			m := waitForFileTransferMessage(t)
+			assert.Equal(t, portforward.MessageTypePortForwardOpen, m.Header.MsgType)
+			assert.EqualValues(t, wsshell.ErrorMessage, m.Header.Properties["status"])
+			assert.Contains(t, string(m.Body), tc.err)
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// pingHistoryLength is how many ping round-trip times Stats keeps
+const pingHistoryLength = 16
+
+// Stats is a snapshot of the recent timings of the daemon, e.g.: to tell
+// why a device is slow; the zero values mean there was no such event yet
+type Stats struct {
+	// how long the last JWT token fetch from the Authentication Manager
+	// took, when it ended, and its error, nil if it succeeded
+	TokenFetch      time.Duration
+	TokenFetchedAt  time.Time
+	TokenFetchError error
+	// how long the last websocket connection to the server took to be set
+	// up, including the TLS and the websocket handshakes, and when it was
+	Connect     time.Duration
+	ConnectedAt time.Time
+	// round-trip times of the last websocket pings, the oldest first
+	PingRTTs []time.Duration
+}
+
+//collects the timings of the daemon; it is fed from several goroutines
+type stats struct {
+	mutex    sync.Mutex
+	snapshot Stats
+}
+
+func (s *stats) tokenFetched(duration time.Duration, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.snapshot.TokenFetch = duration
+	s.snapshot.TokenFetchedAt = time.Now()
+	s.snapshot.TokenFetchError = err
+}
+
+func (s *stats) connected(duration time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.snapshot.Connect = duration
+	s.snapshot.ConnectedAt = time.Now()
+}
+
+func (s *stats) pinged(rtt time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.snapshot.PingRTTs) < pingHistoryLength {
+		s.snapshot.PingRTTs = append(s.snapshot.PingRTTs, rtt)
+		return
+	}
+	copy(s.snapshot.PingRTTs, s.snapshot.PingRTTs[1:])
+	s.snapshot.PingRTTs[pingHistoryLength-1] = rtt
+}
+
+// Stats returns a snapshot of the recent timings of the daemon: the last
+// JWT token fetch, the last connection to the server, and the last pings;
+// it can be called at any time, from any goroutine
+func (d *MenderShellDaemon) Stats() Stats {
+	d.stats.mutex.Lock()
+	defer d.stats.mutex.Unlock()
+	snapshot := d.stats.snapshot
+	snapshot.PingRTTs = append([]time.Duration(nil), d.stats.snapshot.PingRTTs...)
+	return snapshot
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package app
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-shell/config"
+)
+
+func TestStats(t *testing.T) {
+	d := NewDaemon(&config.MenderShellConfig{})
+	assert.Equal(t, Stats{}, d.Stats())
+
+	d.stats.tokenFetched(2*time.Second, errors.New("timeout"))
+	d.stats.tokenFetched(time.Second, nil)
+	d.stats.connected(300 * time.Millisecond)
+	for i := 1; i <= pingHistoryLength+2; i++ {
+		d.stats.pinged(time.Duration(i) * time.Millisecond)
+	}
+
+	stats := d.Stats()
+	assert.Equal(t, time.Second, stats.TokenFetch)
+	assert.NoError(t, stats.TokenFetchError)
+	assert.False(t, stats.TokenFetchedAt.IsZero())
+	assert.Equal(t, 300*time.Millisecond, stats.Connect)
+	assert.False(t, stats.ConnectedAt.IsZero())
+	if assert.Len(t, stats.PingRTTs, pingHistoryLength) {
+		assert.Equal(t, 3*time.Millisecond, stats.PingRTTs[0])
+		assert.Equal(t, time.Duration(pingHistoryLength+2)*time.Millisecond, stats.PingRTTs[pingHistoryLength-1])
+	}
+
+	//the snapshot is not changed by the next pings
+	d.stats.pinged(time.Minute)
+	assert.Equal(t, 3*time.Millisecond, stats.PingRTTs[0])
+}
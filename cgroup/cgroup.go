@@ -0,0 +1,76 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package cgroup
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+const (
+	//lists the processes of the cgroup, a process is moved in by writing
+	//its pid to it
+	procsFile = "cgroup.procs"
+	//statfs(2) type of the cgroup v2 filesystem
+	cgroup2SuperMagic = 0x63677270
+)
+
+var ErrNotCgroup = errors.New("not a cgroup v2 directory")
+
+//tells if the directory is on the cgroup v2 filesystem
+var onCgroup2 = func(dir string) bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return false
+	}
+	return stat.Type == cgroup2SuperMagic
+}
+
+// Check tells if the processes can be moved to the cgroup v2 at dir: it has
+// to exist, and its cgroup.procs has to be writable by this process
+func Check(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() || !onCgroup2(dir) {
+		return fmt.Errorf("%s: %w", dir, ErrNotCgroup)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, procsFile), os.O_WRONLY|os.O_APPEND, 0)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: %w", dir, ErrNotCgroup)
+	} else if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// AddProcess moves the process to the cgroup v2 at dir; the children it
+// starts from then on are in the cgroup too
+func AddProcess(dir string, pid int) error {
+	f, err := os.OpenFile(filepath.Join(dir, procsFile), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	//the kernel takes one pid per write
+	_, err = f.Write([]byte(strconv.Itoa(pid) + "\n"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,96 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package cgroup
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//makes a fake cgroupfs in a temporary directory
+func fakeCgroup(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, procsFile), nil, 0644))
+	onCgroup2 = func(dir string) bool { return true }
+	return dir, func() {
+		os.RemoveAll(dir)
+		onCgroup2 = func(dir string) bool { return false }
+	}
+}
+
+func TestCheck(t *testing.T) {
+	testCases := map[string]struct {
+		prepare func(dir string) string
+		err     error
+	}{
+		"ok": {
+			prepare: func(dir string) string { return dir },
+		},
+		"missing": {
+			prepare: func(dir string) string { return path.Join(dir, "missing") },
+			err:     os.ErrNotExist,
+		},
+		"not a directory": {
+			prepare: func(dir string) string { return path.Join(dir, procsFile) },
+			err:     ErrNotCgroup,
+		},
+		"no cgroup.procs": {
+			prepare: func(dir string) string {
+				os.Remove(path.Join(dir, procsFile))
+				return dir
+			},
+			err: ErrNotCgroup,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir, cleanup := fakeCgroup(t)
+			defer cleanup()
+			err := Check(tc.prepare(dir))
+			if tc.err != nil {
+				assert.True(t, errors.Is(err, tc.err), err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestCheckNotCgroup2(t *testing.T) {
+	dir, cleanup := fakeCgroup(t)
+	defer cleanup()
+	onCgroup2 = func(dir string) bool { return false }
+	assert.True(t, errors.Is(Check(dir), ErrNotCgroup))
+}
+
+func TestAddProcess(t *testing.T) {
+	dir, cleanup := fakeCgroup(t)
+	defer cleanup()
+
+	assert.NoError(t, AddProcess(dir, 1234))
+	assert.NoError(t, AddProcess(dir, 5678))
+	data, err := ioutil.ReadFile(path.Join(dir, procsFile))
+	assert.NoError(t, err)
+	assert.Equal(t, "1234\n5678\n", string(data))
+
+	err = AddProcess(path.Join(dir, "missing"), 1234)
+	assert.True(t, os.IsNotExist(err))
+}
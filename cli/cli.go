@@ -14,8 +14,11 @@
 package cli
 
 import (
+	"os"
+
 	"github.com/urfave/cli/v2"
 
+	"github.com/mendersoftware/mender-shell/app"
 	"github.com/mendersoftware/mender-shell/config"
 )
 
@@ -26,12 +29,63 @@ func SetupCLI(args []string) error {
 		Name:        "mender-shell",
 		Usage:       "manage and start the Mender shell.",
 		Version:     config.ShowVersion(),
+		Action:      runOptions.handleValidateOption,
 		Commands: []*cli.Command{
 			{
 				Name:   "daemon",
 				Usage:  "Start the client as a background service.",
 				Action: runOptions.handleCLIOptions,
 			},
+			{
+				Name:   "check",
+				Usage:  "Check the connection to the Authentication Manager and to the server, and exit.",
+				Action: runOptions.handleCLIOptions,
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:        "timeout",
+						Usage:       "Give up on each step of the check after `DURATION`.",
+						Value:       app.DefaultCheckTimeout,
+						Destination: &runOptions.checkTimeout,
+					},
+				},
+			},
+			{
+				Name:   "show-config",
+				Usage:  "Print the configuration as loaded from the files and the environment, the secrets redacted, and exit.",
+				Action: runOptions.handleCLIOptions,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "format",
+						Usage:       "Print the configuration as `FORMAT`: text, one name=value per line, or json.",
+						Value:       showConfigFormatText,
+						Destination: &runOptions.showConfigFormat,
+					},
+					&cli.BoolFlag{
+						Name:        "show-secrets",
+						Usage:       "Print the secrets too, for local debugging only.",
+						Destination: &runOptions.showSecrets,
+					},
+				},
+			},
+			{
+				Name:   app.RestrictedShellCommandName,
+				Usage:  "Run the restricted shell, allowing only the given commands; started by the daemon in the sessions.",
+				Hidden: true,
+				Action: handleRestrictedShell,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{
+						Name:  "allow",
+						Usage: "Allow the `COMMAND` line, with argument patterns; can be given more than once.",
+					},
+				},
+			},
+			{
+				Name:            app.NamespaceInitCommandName,
+				Usage:           "Set the namespaces of a session up and run its shell in them; started by the daemon in the sessions.",
+				Hidden:          true,
+				SkipFlagParsing: true,
+				Action:          handleNamespaceInit,
+			},
 			{
 				Name:   "version",
 				Usage:  "Show the version and runtime information of the binary build",
@@ -53,12 +107,24 @@ func SetupCLI(args []string) error {
 				Value:       config.DefaultFallbackConfFile,
 				Destination: &runOptions.fallbackConfig,
 			},
+			&cli.BoolFlag{
+				Name:        "validate",
+				Usage:       "Validate the configuration, print all the problems found and exit.",
+				Destination: &runOptions.validate,
+			},
 		},
 	}
 
 	return app.Run(args)
 }
 
+func (runOptions *runOptionsType) handleValidateOption(ctx *cli.Context) error {
+	if !runOptions.validate {
+		return cli.ShowAppHelp(ctx)
+	}
+	return runOptions.handleCLIOptions(ctx)
+}
+
 func (runOptions *runOptionsType) handleCLIOptions(ctx *cli.Context) error {
 	// Handle config flags
 	config, err := config.LoadConfig(runOptions.config, runOptions.fallbackConfig)
@@ -66,6 +132,10 @@ func (runOptions *runOptionsType) handleCLIOptions(ctx *cli.Context) error {
 		return err
 	}
 
+	if runOptions.validate {
+		return validateConfig(os.Stdout, config)
+	}
+
 	err = config.Validate()
 	if err != nil {
 		return err
@@ -73,11 +143,15 @@ func (runOptions *runOptionsType) handleCLIOptions(ctx *cli.Context) error {
 
 	switch ctx.Command.Name {
 	case "daemon":
+		return runDaemon(config, runOptions.config)
+	case "check":
 		d, err := initDaemon(config)
 		if err != nil {
 			return err
 		}
-		return runDaemon(d)
+		return d.Check(os.Stdout, runOptions.checkTimeout)
+	case "show-config":
+		return showConfig(os.Stdout, os.Stderr, config, runOptions.showConfigFormat, runOptions.showSecrets)
 	default:
 		cli.ShowAppHelpAndExit(ctx, 1)
 	}
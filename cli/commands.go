@@ -14,17 +14,92 @@
 package cli
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/urfave/cli/v2"
+
+	"github.com/mendersoftware/mender-shell/agent"
 	"github.com/mendersoftware/mender-shell/app"
 	"github.com/mendersoftware/mender-shell/config"
+	"github.com/mendersoftware/mender-shell/logging"
+	"github.com/mendersoftware/mender-shell/shell"
 )
 
 type runOptionsType struct {
 	config         string
 	fallbackConfig string
+	checkTimeout   time.Duration
+	validate       bool
+	//the show-config format, and whether it prints the secrets
+	showConfigFormat string
+	showSecrets      bool
+}
+
+const (
+	showConfigFormatText = "text"
+	showConfigFormatJSON = "json"
+)
+
+var (
+	errUnknownShowConfigFormat = errors.New("unknown configuration format, it must be text or json")
+)
+
+//prints all the problems found in the configuration, one per line
+func validateConfig(out io.Writer, c *config.MenderShellConfig) error {
+	err := c.Validate()
+	if err == nil {
+		fmt.Fprintln(out, "the configuration is valid")
+		return nil
+	}
+	errs, ok := err.(config.ValidationErrors)
+	if !ok {
+		return err
+	}
+	for _, err := range errs {
+		fmt.Fprintln(out, err.Error())
+	}
+	return fmt.Errorf("the configuration is not valid: %d problem(s) found", len(errs))
+}
+
+//prints the configuration as loaded and validated, redacting the secrets
+//like the daemon does in its log lines, unless showSecrets is set
+func showConfig(out io.Writer, errOut io.Writer, c *config.MenderShellConfig, format string, showSecrets bool) error {
+	if format != showConfigFormatText && format != showConfigFormatJSON {
+		return errUnknownShowConfigFormat
+	}
+	if showSecrets {
+		fmt.Fprintln(errOut, "WARNING: the secrets are shown, don't share this output")
+	} else {
+		logging.SetSecretKeys(c.LogSecretKeys)
+	}
+	settings, err := c.Settings(showSecrets)
+	if err != nil {
+		return err
+	}
+
+	if format == showConfigFormatJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(settings)
+	}
+	lines, err := config.SettingLines(settings)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Fprintln(out, line)
+	}
+	return nil
 }
 
 func initDaemon(config *config.MenderShellConfig) (*app.MenderShellDaemon, error) {
@@ -32,23 +107,87 @@ func initDaemon(config *config.MenderShellConfig) (*app.MenderShellDaemon, error
 	return daemon, nil
 }
 
-func runDaemon(d *app.MenderShellDaemon) error {
+func runDaemon(config *config.MenderShellConfig, configFile string) error {
+	d := agent.New(config, nil)
+	d.ConfigureLogging()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	// Handle user forcing update check.
 	go func() {
 		c := make(chan os.Signal, 2)
 		signal.Notify(c, syscall.SIGTERM)
 		signal.Notify(c, syscall.SIGUSR1)
+		signal.Notify(c, syscall.SIGHUP)
+		signal.Notify(c, syscall.SIGUSR2)
 		defer signal.Stop(c)
 
 		for {
 			s := <-c // Block until a signal is received.
 			switch s {
 			case syscall.SIGTERM:
-				d.StopDaemon()
+				cancel()
 			case syscall.SIGUSR1:
-				d.PrintStatus()
+				d.DumpDiagnostics()
+			case syscall.SIGHUP:
+				d.ReloadConfig(configFile)
+			case syscall.SIGUSR2:
+				d.Handover()
+			}
+		}
+	}()
+	return d.Run(ctx)
+}
+
+//runs in the terminal of a session, in place of the shell, so the terminal
+//echoes and edits the command lines; the commands run on the same terminal
+func handleNamespaceInit(ctx *cli.Context) error {
+	//on success, the shell replaces mender-shell
+	return shell.RunNamespaceInit(ctx.Args().Slice())
+}
+
+func handleRestrictedShell(ctx *cli.Context) error {
+	//Ctrl-C interrupts the running command, not the restricted shell;
+	//catching the signals instead of ignoring them, the commands get the
+	//default handlers
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTSTP)
+	defer signal.Stop(c)
+
+	var running *os.Process
+	runningMutex := &sync.Mutex{}
+	go func() {
+		for s := range c {
+			//there is no job control: a command stopped by Ctrl-Z is
+			//continued, or the restricted shell would wait for it forever
+			runningMutex.Lock()
+			if s == syscall.SIGTSTP && running != nil {
+				_ = running.Signal(syscall.SIGCONT)
 			}
+			runningMutex.Unlock()
 		}
 	}()
-	return d.Run()
+
+	return shell.RunRestrictedShell(os.Stdin, os.Stdout, ctx.StringSlice("allow"),
+		func(args []string) error {
+			cmd := exec.Command(args[0], args[1:]...)
+			cmd.Stdin = os.Stdin
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			err := cmd.Start()
+			if err != nil {
+				return err
+			}
+			runningMutex.Lock()
+			running = cmd.Process
+			runningMutex.Unlock()
+			err = cmd.Wait()
+			runningMutex.Lock()
+			running = nil
+			runningMutex.Unlock()
+			if _, ok := err.(*exec.ExitError); ok {
+				//the command reported its own failure
+				return nil
+			}
+			return err
+		})
 }
@@ -15,6 +15,7 @@
 package dbus
 
 import (
+	"context"
 	"errors"
 	"time"
 	"unsafe"
@@ -34,14 +35,47 @@ type DBusCallResponse interface {
 	GetBoolean() bool
 }
 
+// DBusCallResponseDetail is implemented by the responses which can carry,
+// after the main return value, a string with details about the result
+type DBusCallResponseDetail interface {
+	// GetDetail returns the detail string stored in the response object,
+	// or an empty string if there is none
+	GetDetail() string
+}
+
+// DBusCallResponseType is implemented by the responses which can tell the
+// DBus type signature of the value they store, e.g.: (s) or (bs)
+type DBusCallResponseType interface {
+	// Type returns the type signature of the value stored in the response
+	Type() string
+}
+
+// StringTuples is the value of a method returning an array of tuples of
+// Width strings, e.g.: a(sss) when Width is 3
+type StringTuples struct {
+	Width  int
+	Tuples [][]string
+}
+
+// MethodCallCallback handles a call of a method of an exported object, with
+// the string arguments of the call; the returned value can be nil, a string,
+// a boolean or StringTuples
+type MethodCallCallback func(objectPath string, interfaceName string, methodName string, args []string) (interface{}, error)
+
 // DBusAPI is the interface which describes a DBus API
 type DBusAPI interface {
 	// BusGet synchronously connects to the message bus specified by bus_type
 	BusGet(uint) (Handle, error)
 	// BusProxyNew creates a proxy for accessing an interface over DBus
 	BusProxyNew(Handle, string, string, string) (Handle, error)
-	// BusProxyCall synchronously invokes a method method on a proxy
+	// BusProxyCall synchronously invokes a method method on a proxy,
+	// the timeout is given in seconds
 	BusProxyCall(Handle, string, interface{}, int) (DBusCallResponse, error)
+	// BusProxyGetNameOwner returns the unique name of the owner of the
+	// name the proxy is for, or "" if the name is not owned
+	BusProxyGetNameOwner(Handle) string
+	// ObjectUnref releases a reference to a connection or proxy object
+	ObjectUnref(Handle)
 	// MainLoopNew creates a new GMainLoop structure
 	MainLoopNew() MainLoop
 	// MainLoopRun runs a main loop until MainLoopQuit() is called
@@ -52,6 +86,29 @@ type DBusAPI interface {
 	HandleSignal(signalName string)
 	// WaitForSignal waits for a DBus signal
 	WaitForSignal(signalName string, timeout time.Duration) error
+	// WaitForSignalContext waits for a DBus signal until ctx is done
+	WaitForSignalContext(ctx context.Context, signalName string) error
+	// BusOwnNameConnection acquires the well-known name on the message bus
+	// connection, returning the id to release it with
+	BusOwnNameConnection(Handle, string) (uint, error)
+	// BusUnownName releases the name acquired with BusOwnNameConnection
+	BusUnownName(uint)
+	// BusRegisterInterface exports an object at the path, implementing the
+	// interface described by the introspection XML; returns the id to
+	// unregister it with
+	BusRegisterInterface(Handle, string, string) (uint, error)
+	// BusUnregisterInterface unexports the object registered with
+	// BusRegisterInterface
+	BusUnregisterInterface(Handle, uint) bool
+	// RegisterMethodCallCallback sets the callback handling the calls of
+	// the method of the interface exported at the path
+	RegisterMethodCallCallback(path string, interfaceName string, method string, callback MethodCallCallback)
+	// UnregisterMethodCallCallback removes the callback set with
+	// RegisterMethodCallCallback
+	UnregisterMethodCallCallback(path string, interfaceName string, method string)
+	// EmitSignal emits the signal of the interface exported at the path,
+	// with the strings as arguments; an empty destination broadcasts it
+	EmitSignal(conn Handle, destination string, path string, interfaceName string, signalName string, params []string) error
 }
 
 // GetDBusAPI returns the global DBusAPI object
@@ -21,7 +21,10 @@ package dbus
 // #include "dbus_libgio.go.h"
 import "C"
 import (
+	"context"
 	"runtime"
+	"strings"
+	"sync"
 	"time"
 	"unsafe"
 
@@ -30,6 +33,9 @@ import (
 
 type dbusAPILibGio struct {
 	signals map[string]chan interface{}
+	// the method calls are handled in the main loop thread
+	methodCallCallbacksMutex sync.Mutex
+	methodCallCallbacks      map[string]MethodCallCallback
 }
 
 // constants for GDBusProxyFlags
@@ -42,6 +48,12 @@ const (
 	GDbusProxyFlagsDoNotAutoStartAtConstruction = (1 << 4)
 )
 
+// names of the errors returned to the method callers
+const (
+	DBusErrorFailed        = "org.freedesktop.DBus.Error.Failed"
+	DBusErrorUnknownMethod = "org.freedesktop.DBus.Error.UnknownMethod"
+)
+
 // constants for GDBusCallFlags
 const (
 	GDBusCallFlagsNone                          = 0
@@ -82,21 +94,54 @@ func (d *dbusAPILibGio) BusProxyNew(conn Handle, name string, objectPath string,
 	return Handle(proxy), nil
 }
 
-// BusProxyCall synchronously invokes a method method on a proxy
+// BusProxyCall synchronously invokes a method method on a proxy; params
+// can be nil or a string, passed as the only argument of the method
 // https://developer.gnome.org/gio/stable/GDBusProxy.html#g-dbus-proxy-call-sync
 func (d *dbusAPILibGio) BusProxyCall(proxy Handle, methodName string, params interface{}, timeout int) (DBusCallResponse, error) {
 	var gerror *C.GError
 	gproxy := C.to_gdbusproxy(unsafe.Pointer(proxy))
 	cmethodName := C.CString(methodName)
 	defer C.free(unsafe.Pointer(cmethodName))
+	var gparams *C.GVariant
+	switch p := params.(type) {
+	case nil:
+	case string:
+		cparam := C.CString(p)
+		defer C.free(unsafe.Pointer(cparam))
+		gparams = C.g_variant_from_string((*C.gchar)(cparam))
+	default:
+		return nil, errors.Errorf("unsupported parameters type %T", params)
+	}
 	flags := C.GDBusCallFlags(GDBusCallFlagsNone)
-	result := C.g_dbus_proxy_call_sync(gproxy, cmethodName, nil, flags, C.gint(timeout), nil, &gerror)
+	timeoutMsec := C.gint(timeout * 1000)
+	result := C.g_dbus_proxy_call_sync(gproxy, cmethodName, gparams, flags, timeoutMsec, nil, &gerror)
 	if Handle(gerror) != nil {
 		return nil, ErrorFromNative(Handle(gerror))
 	}
 	return NewDBusCallResponse(unsafe.Pointer(result)), nil
 }
 
+// BusProxyGetNameOwner returns the unique name of the owner of the name the
+// proxy is for, or "" if the name is not owned
+// https://developer.gnome.org/gio/stable/GDBusProxy.html#g-dbus-proxy-get-name-owner
+func (d *dbusAPILibGio) BusProxyGetNameOwner(proxy Handle) string {
+	gproxy := C.to_gdbusproxy(unsafe.Pointer(proxy))
+	owner := C.g_dbus_proxy_get_name_owner(gproxy)
+	if owner == nil {
+		return ""
+	}
+	defer C.g_free(C.gpointer(unsafe.Pointer(owner)))
+	return goString(owner)
+}
+
+// ObjectUnref releases a reference to a connection or proxy object
+// https://developer.gnome.org/gobject/stable/gobject-The-Base-Object-Type.html#g-object-unref
+func (d *dbusAPILibGio) ObjectUnref(object Handle) {
+	if object != nil {
+		C.g_object_unref(C.gpointer(object))
+	}
+}
+
 // MainLoopNew creates a new GMainLoop structure
 // https://developer.gnome.org/glib/stable/glib-The-Main-Event-Loop.html#g-main-loop-new
 func (d *dbusAPILibGio) MainLoopNew() MainLoop {
@@ -125,7 +170,7 @@ func (d *dbusAPILibGio) MainLoopQuit(loop MainLoop) {
 func (d *dbusAPILibGio) getChannelForSignal(signalName string) chan interface{} {
 	channel, ok := d.signals[signalName]
 	if !ok {
-		channel := make(chan interface{}, 1)
+		channel = make(chan interface{}, 1)
 		d.signals[signalName] = channel
 	}
 	return channel
@@ -151,16 +196,243 @@ func (d *dbusAPILibGio) HandleSignal(signalName string) {
 
 // WaitForSignal waits for a DBus signal
 func (d *dbusAPILibGio) WaitForSignal(signalName string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := d.WaitForSignalContext(ctx, signalName)
+	if err == context.DeadlineExceeded {
+		return errors.New("timeout waiting for signal " + signalName)
+	}
+	return err
+}
+
+// WaitForSignalContext waits for a DBus signal until ctx is done
+func (d *dbusAPILibGio) WaitForSignalContext(ctx context.Context, signalName string) error {
 	channel := d.getChannelForSignal(signalName)
 	select {
 	case <-channel:
-		break
-	case <-time.After(timeout):
-		return errors.New("timeout waiting for signal " + signalName)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// BusOwnNameConnection acquires the name on the message bus connection
+// https://developer.gnome.org/gio/stable/gio-Owning-Bus-Names.html#g-bus-own-name-on-connection
+func (d *dbusAPILibGio) BusOwnNameConnection(conn Handle, name string) (uint, error) {
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	gid := C.own_name_on_connection(gconn, (*C.gchar)(cname))
+	if gid == 0 {
+		return 0, errors.New("unable to own the name " + name)
+	}
+	return uint(gid), nil
+}
+
+// BusUnownName releases the name acquired with BusOwnNameConnection
+// https://developer.gnome.org/gio/stable/gio-Owning-Bus-Names.html#g-bus-unown-name
+func (d *dbusAPILibGio) BusUnownName(gid uint) {
+	C.g_bus_unown_name(C.guint(gid))
+}
+
+// BusRegisterInterface exports an object at the path, implementing the
+// first interface described by the introspection XML
+// https://developer.gnome.org/gio/stable/GDBusConnection.html#g-dbus-connection-register-object
+func (d *dbusAPILibGio) BusRegisterInterface(conn Handle, path string, interfaceXML string) (uint, error) {
+	var gerror *C.GError
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	cinterfaceXML := C.CString(interfaceXML)
+	defer C.free(unsafe.Pointer(cinterfaceXML))
+	nodeInfo := C.g_dbus_node_info_new_for_xml((*C.gchar)(cinterfaceXML), &gerror)
+	if Handle(gerror) != nil {
+		return 0, ErrorFromNative(Handle(gerror))
+	}
+	//the registration holds its own reference to the interface info
+	defer C.g_dbus_node_info_unref(nodeInfo)
+	interfaceInfo := C.first_interface_info(nodeInfo)
+	if interfaceInfo == nil {
+		return 0, errors.New("no interface in the introspection XML")
+	}
+
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	gid := C.register_object(gconn, (*C.gchar)(cpath), interfaceInfo, &gerror)
+	if Handle(gerror) != nil {
+		return 0, ErrorFromNative(Handle(gerror))
+	} else if gid == 0 {
+		return 0, errors.New("unable to register the object at " + path)
+	}
+	return uint(gid), nil
+}
+
+// BusUnregisterInterface unexports the object registered with BusRegisterInterface
+// https://developer.gnome.org/gio/stable/GDBusConnection.html#g-dbus-connection-unregister-object
+func (d *dbusAPILibGio) BusUnregisterInterface(conn Handle, gid uint) bool {
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	return goBool(C.g_dbus_connection_unregister_object(gconn, C.guint(gid)))
+}
+
+func methodCallKey(path string, interfaceName string, method string) string {
+	return path + "/" + interfaceName + "." + method
+}
+
+// RegisterMethodCallCallback sets the callback handling the calls of the
+// method of the interface exported at the path
+func (d *dbusAPILibGio) RegisterMethodCallCallback(path string, interfaceName string, method string, callback MethodCallCallback) {
+	d.methodCallCallbacksMutex.Lock()
+	defer d.methodCallCallbacksMutex.Unlock()
+	d.methodCallCallbacks[methodCallKey(path, interfaceName, method)] = callback
+}
+
+// UnregisterMethodCallCallback removes the callback set with RegisterMethodCallCallback
+func (d *dbusAPILibGio) UnregisterMethodCallCallback(path string, interfaceName string, method string) {
+	d.methodCallCallbacksMutex.Lock()
+	defer d.methodCallCallbacksMutex.Unlock()
+	delete(d.methodCallCallbacks, methodCallKey(path, interfaceName, method))
+}
+
+func (d *dbusAPILibGio) getMethodCallCallback(path string, interfaceName string, method string) (MethodCallCallback, bool) {
+	d.methodCallCallbacksMutex.Lock()
+	defer d.methodCallCallbacksMutex.Unlock()
+	callback, ok := d.methodCallCallbacks[methodCallKey(path, interfaceName, method)]
+	return callback, ok
+}
+
+// EmitSignal emits the signal of the interface exported at the path, with
+// the strings as arguments
+// https://developer.gnome.org/gio/stable/GDBusConnection.html#g-dbus-connection-emit-signal
+func (d *dbusAPILibGio) EmitSignal(conn Handle, destination string, path string, interfaceName string, signalName string, params []string) error {
+	var gerror *C.GError
+	gconn := C.to_gdbusconnection(unsafe.Pointer(conn))
+	var cdestination *C.char
+	if destination != "" {
+		cdestination = C.CString(destination)
+		defer C.free(unsafe.Pointer(cdestination))
+	}
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	cinterfaceName := C.CString(interfaceName)
+	defer C.free(unsafe.Pointer(cinterfaceName))
+	csignalName := C.CString(signalName)
+	defer C.free(unsafe.Pointer(csignalName))
+
+	builder := C.g_variant_builder_new_tuple()
+	defer C.g_variant_builder_unref(builder)
+	for _, param := range params {
+		cparam := C.CString(param)
+		C.g_variant_builder_add_string(builder, (*C.gchar)(cparam))
+		C.free(unsafe.Pointer(cparam))
+	}
+	gparams := C.g_variant_builder_end(builder)
+
+	C.g_dbus_connection_emit_signal(gconn, (*C.gchar)(cdestination), (*C.gchar)(cpath),
+		(*C.gchar)(cinterfaceName), (*C.gchar)(csignalName), gparams, &gerror)
+	if Handle(gerror) != nil {
+		return ErrorFromNative(Handle(gerror))
 	}
 	return nil
 }
 
+//export handle_method_call_callback
+func handle_method_call_callback(conn *C.GDBusConnection, sender *C.gchar, objectPath *C.gchar, interfaceName *C.gchar, methodName *C.gchar, parameters *C.GVariant, invocation *C.GDBusMethodInvocation, userData C.gpointer) {
+	goObjectPath := goString(objectPath)
+	goInterfaceName := goString(interfaceName)
+	goMethodName := goString(methodName)
+
+	var callback MethodCallCallback
+	api, _ := GetDBusAPI()
+	if d, ok := api.(*dbusAPILibGio); ok {
+		callback, _ = d.getMethodCallCallback(goObjectPath, goInterfaceName, goMethodName)
+	}
+	if callback == nil {
+		returnMethodCallError(invocation, DBusErrorUnknownMethod, "unknown method "+goInterfaceName+"."+goMethodName)
+		return
+	}
+
+	result, err := callback(goObjectPath, goInterfaceName, goMethodName, stringsFromGVariant(parameters))
+	if err != nil {
+		returnMethodCallError(invocation, DBusErrorFailed, err.Error())
+		return
+	}
+	var gresult *C.GVariant
+	switch r := result.(type) {
+	case nil:
+	case string:
+		cresult := C.CString(r)
+		defer C.free(unsafe.Pointer(cresult))
+		gresult = C.g_variant_from_string((*C.gchar)(cresult))
+	case bool:
+		gresult = C.g_variant_from_boolean(C.gboolean(boolToInt(r)))
+	case StringTuples:
+		gresult = gvariantFromStringTuples(r)
+	default:
+		returnMethodCallError(invocation, DBusErrorFailed, "unsupported return value type")
+		return
+	}
+	C.g_dbus_method_invocation_return_value(invocation, gresult)
+}
+
+//returns a GVariant tuple holding the array of the string tuples, e.g.:
+//(a(sss)); the tuples shorter than the width are padded with empty strings
+func gvariantFromStringTuples(value StringTuples) *C.GVariant {
+	tupleType := C.CString("(" + strings.Repeat("s", value.Width) + ")")
+	defer C.free(unsafe.Pointer(tupleType))
+	arrayType := C.CString("a(" + strings.Repeat("s", value.Width) + ")")
+	defer C.free(unsafe.Pointer(arrayType))
+
+	builder := C.g_variant_builder_new_tuple()
+	defer C.g_variant_builder_unref(builder)
+	C.g_variant_builder_open_type(builder, (*C.gchar)(arrayType))
+	for _, tuple := range value.Tuples {
+		C.g_variant_builder_open_type(builder, (*C.gchar)(tupleType))
+		for i := 0; i < value.Width; i++ {
+			str := ""
+			if i < len(tuple) {
+				str = tuple[i]
+			}
+			cstr := C.CString(str)
+			C.g_variant_builder_add_string(builder, (*C.gchar)(cstr))
+			C.free(unsafe.Pointer(cstr))
+		}
+		C.g_variant_builder_close(builder)
+	}
+	C.g_variant_builder_close(builder)
+	return C.g_variant_builder_end(builder)
+}
+
+//returns the strings in the GVariant tuple, skipping the other children
+func stringsFromGVariant(value *C.GVariant) []string {
+	if value == nil {
+		return nil
+	}
+	var strs []string
+	n := C.g_variant_n_children(value)
+	for i := C.gsize(0); i < n; i++ {
+		str := C.string_child_from_g_variant(value, i)
+		if str == nil {
+			continue
+		}
+		strs = append(strs, goString(str))
+		C.g_free(C.gpointer(unsafe.Pointer(str)))
+	}
+	return strs
+}
+
+func returnMethodCallError(invocation *C.GDBusMethodInvocation, name string, message string) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	cmessage := C.CString(message)
+	defer C.free(unsafe.Pointer(cmessage))
+	C.g_dbus_method_invocation_return_dbus_error(invocation, (*C.gchar)(cname), (*C.gchar)(cmessage))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 //export handle_on_signal_callback
 func handle_on_signal_callback(proxy *C.GDBusProxy, senderName *C.gchar, signalName *C.gchar, params *C.GVariant, userData C.gpointer) {
 	goSignalName := C.GoString(signalName)
@@ -170,7 +442,8 @@ func handle_on_signal_callback(proxy *C.GDBusProxy, senderName *C.gchar, signalN
 
 func newDBusAPILibGio() *dbusAPILibGio {
 	return &dbusAPILibGio{
-		signals: make(map[string]chan interface{}),
+		signals:             make(map[string]chan interface{}),
+		methodCallCallbacks: make(map[string]MethodCallCallback),
 	}
 }
 
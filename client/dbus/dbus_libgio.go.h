@@ -22,11 +22,17 @@ static GVariant *to_gvariant(void *ptr)
     return (GVariant *)ptr;
 }
 
+// creates a new GVariant tuple holding a string
+static GVariant *g_variant_from_string(gchar *str)
+{
+    return g_variant_new("(s)", str);
+}
+
 // creates a new string from a GVariant
 static gchar *string_from_g_variant(GVariant *value)
 {
     gchar *str;
-    g_variant_get(value, "(s)", &str);
+    g_variant_get_child(value, 0, "s", &str);
     return str;
 }
 
@@ -34,10 +40,21 @@ static gchar *string_from_g_variant(GVariant *value)
 static gboolean boolean_from_g_variant(GVariant *value)
 {
     gboolean b;
-    g_variant_get(value, "(b)", &b);
+    g_variant_get_child(value, 0, "b", &b);
     return b;
 }
 
+// creates a new string from the second element of a (bs) GVariant
+static gchar *detail_from_g_variant(GVariant *value)
+{
+    gchar *str = NULL;
+    if (g_variant_is_of_type(value, G_VARIANT_TYPE("(bs)")))
+    {
+        g_variant_get_child(value, 1, "s", &str);
+    }
+    return str;
+}
+
 // exported by golang, see dbus_libgio.go
 void handle_on_signal_callback(
     GDBusProxy *proxy,
@@ -63,3 +80,105 @@ static void g_signal_connect_on_proxy(GDBusProxy *proxy)
 {
     g_signal_connect(proxy, "g-signal", G_CALLBACK(on_signal), NULL);
 }
+
+// creates a new GVariant tuple holding a boolean
+static GVariant *g_variant_from_boolean(gboolean b)
+{
+    return g_variant_new("(b)", b);
+}
+
+// creates a new builder of a GVariant tuple
+static GVariantBuilder *g_variant_builder_new_tuple(void)
+{
+    return g_variant_builder_new(G_VARIANT_TYPE_TUPLE);
+}
+
+// adds a string to a GVariant builder
+static void g_variant_builder_add_string(GVariantBuilder *builder, gchar *str)
+{
+    g_variant_builder_add(builder, "s", str);
+}
+
+// opens a container of the given type, e.g.: a(sss), in a GVariant builder
+static void g_variant_builder_open_type(GVariantBuilder *builder, gchar *type)
+{
+    g_variant_builder_open(builder, G_VARIANT_TYPE(type));
+}
+
+// creates a new string from the child of a GVariant tuple, NULL if the child
+// is not a string
+static gchar *string_child_from_g_variant(GVariant *value, gsize index)
+{
+    gchar *str = NULL;
+    GVariant *child = g_variant_get_child_value(value, index);
+    if (g_variant_is_of_type(child, G_VARIANT_TYPE_STRING))
+    {
+        str = g_variant_dup_string(child, NULL);
+    }
+    g_variant_unref(child);
+    return str;
+}
+
+// returns the first interface described by a node info, if any
+static GDBusInterfaceInfo *first_interface_info(GDBusNodeInfo *node_info)
+{
+    if (node_info->interfaces == NULL)
+    {
+        return NULL;
+    }
+    return node_info->interfaces[0];
+}
+
+// exported by golang, see dbus_libgio.go
+void handle_method_call_callback(
+    GDBusConnection *connection,
+    gchar *sender,
+    gchar *object_path,
+    gchar *interface_name,
+    gchar *method_name,
+    GVariant *parameters,
+    GDBusMethodInvocation *invocation,
+    gpointer user_data);
+
+// callback of the method calls of the registered objects
+static void on_method_call(
+    GDBusConnection *connection,
+    const gchar *sender,
+    const gchar *object_path,
+    const gchar *interface_name,
+    const gchar *method_name,
+    GVariant *parameters,
+    GDBusMethodInvocation *invocation,
+    gpointer user_data)
+{
+    handle_method_call_callback(
+        connection, (gchar *)sender, (gchar *)object_path,
+        (gchar *)interface_name, (gchar *)method_name,
+        parameters, invocation, user_data);
+}
+
+static const GDBusInterfaceVTable interface_vtable = {
+    on_method_call,
+    NULL,
+    NULL,
+};
+
+// registers an object at the path, its method calls are handled by
+// handle_method_call_callback
+static guint register_object(
+    GDBusConnection *connection,
+    gchar *object_path,
+    GDBusInterfaceInfo *interface_info,
+    GError **error)
+{
+    return g_dbus_connection_register_object(
+        connection, object_path, interface_info, &interface_vtable,
+        NULL, NULL, error);
+}
+
+// acquires the name on the connection, without any callback
+static guint own_name_on_connection(GDBusConnection *connection, gchar *name)
+{
+    return g_bus_own_name_on_connection(
+        connection, name, G_BUS_NAME_OWNER_FLAGS_NONE, NULL, NULL, NULL, NULL);
+}
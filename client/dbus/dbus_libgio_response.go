@@ -43,3 +43,17 @@ func (r *dbusCallResponseLibgio) GetBoolean() bool {
 	val := C.boolean_from_g_variant(C.to_gvariant(r.ptr))
 	return goBool(val)
 }
+
+// Type returns the type signature of the value stored in the response
+func (r *dbusCallResponseLibgio) Type() string {
+	return goString(C.g_variant_get_type_string(C.to_gvariant(r.ptr)))
+}
+
+func (r *dbusCallResponseLibgio) GetDetail() string {
+	str := C.detail_from_g_variant(C.to_gvariant(r.ptr))
+	if str == nil {
+		return ""
+	}
+	defer C.g_free(C.gpointer(unsafe.Pointer(str)))
+	return goString(str)
+}
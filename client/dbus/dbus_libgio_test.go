@@ -15,6 +15,7 @@
 package dbus
 
 import (
+	"context"
 	"os"
 	"testing"
 	"time"
@@ -149,6 +150,22 @@ func TestWaitForSignal(t *testing.T) {
 	libgio.DrainSignal(signalName)
 }
 
+func TestWaitForSignalContext(t *testing.T) {
+	const signalName = "test-context"
+
+	// received signal
+	libgio.DrainSignal(signalName)
+	go libgio.HandleSignal(signalName)
+	err := libgio.WaitForSignalContext(context.Background(), signalName)
+	assert.NoError(t, err)
+
+	// canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = libgio.WaitForSignalContext(ctx, signalName)
+	assert.Equal(t, context.Canceled, err)
+}
+
 func TestMenderclient(t *testing.T) {
 	// we do not run this test, as we cannot depend on having the Mender client
 	// running at unit test execution time. Still, we leave it here for debugging
@@ -0,0 +1,235 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package dbustest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/mender-shell/client/dbus"
+)
+
+// RecordedCall is a call to the dbus.DBusAPI recorded by RecordingAPI
+type RecordedCall struct {
+	// Method is the name of the dbus.DBusAPI method called
+	Method string
+	// Args are the arguments of the call
+	Args []interface{}
+}
+
+// RecordingAPI is a dbus.DBusAPI test helper which records, in order, the calls
+// it receives before forwarding them to the wrapped dbus.DBusAPI, if any
+type RecordingAPI struct {
+	api   dbus.DBusAPI
+	mutex sync.Mutex
+	calls []RecordedCall
+}
+
+// NewRecordingAPI returns a new RecordingAPI wrapping api; when api is nil
+// the calls are only recorded and zero values are returned
+func NewRecordingAPI(api dbus.DBusAPI) *RecordingAPI {
+	return &RecordingAPI{
+		api: api,
+	}
+}
+
+func (r *RecordingAPI) record(method string, args ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.calls = append(r.calls, RecordedCall{Method: method, Args: args})
+}
+
+// Calls returns the recorded calls, in order
+func (r *RecordingAPI) Calls() []RecordedCall {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	calls := make([]RecordedCall, len(r.calls))
+	copy(calls, r.calls)
+	return calls
+}
+
+// Methods returns the names of the methods called, in order
+func (r *RecordingAPI) Methods() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	methods := make([]string, len(r.calls))
+	for i, call := range r.calls {
+		methods[i] = call.Method
+	}
+	return methods
+}
+
+// Reset clears the recorded calls
+func (r *RecordingAPI) Reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.calls = nil
+}
+
+// BusGet synchronously connects to the message bus specified by bus_type
+func (r *RecordingAPI) BusGet(busType uint) (dbus.Handle, error) {
+	r.record("BusGet", busType)
+	if r.api == nil {
+		return dbus.Handle(nil), nil
+	}
+	return r.api.BusGet(busType)
+}
+
+// BusProxyNew creates a proxy for accessing an interface over DBus
+func (r *RecordingAPI) BusProxyNew(conn dbus.Handle, name string, objectPath string, interfaceName string) (dbus.Handle, error) {
+	r.record("BusProxyNew", conn, name, objectPath, interfaceName)
+	if r.api == nil {
+		return dbus.Handle(nil), nil
+	}
+	return r.api.BusProxyNew(conn, name, objectPath, interfaceName)
+}
+
+// BusProxyCall synchronously invokes a method method on a proxy
+func (r *RecordingAPI) BusProxyCall(proxy dbus.Handle, methodName string, params interface{}, timeout int) (dbus.DBusCallResponse, error) {
+	r.record("BusProxyCall", proxy, methodName, params, timeout)
+	if r.api == nil {
+		return nil, nil
+	}
+	return r.api.BusProxyCall(proxy, methodName, params, timeout)
+}
+
+// BusProxyGetNameOwner returns the owner of the name the proxy is for
+func (r *RecordingAPI) BusProxyGetNameOwner(proxy dbus.Handle) string {
+	r.record("BusProxyGetNameOwner", proxy)
+	if r.api == nil {
+		return ""
+	}
+	return r.api.BusProxyGetNameOwner(proxy)
+}
+
+// ObjectUnref releases a reference to a connection or proxy object
+func (r *RecordingAPI) ObjectUnref(object dbus.Handle) {
+	r.record("ObjectUnref", object)
+	if r.api != nil {
+		r.api.ObjectUnref(object)
+	}
+}
+
+// MainLoopNew creates a new GMainLoop structure
+func (r *RecordingAPI) MainLoopNew() dbus.MainLoop {
+	r.record("MainLoopNew")
+	if r.api == nil {
+		return dbus.MainLoop(nil)
+	}
+	return r.api.MainLoopNew()
+}
+
+// MainLoopRun runs a main loop until MainLoopQuit() is called
+func (r *RecordingAPI) MainLoopRun(loop dbus.MainLoop) {
+	r.record("MainLoopRun", loop)
+	if r.api != nil {
+		r.api.MainLoopRun(loop)
+	}
+}
+
+// MainLoopQuit stops a main loop from running
+func (r *RecordingAPI) MainLoopQuit(loop dbus.MainLoop) {
+	r.record("MainLoopQuit", loop)
+	if r.api != nil {
+		r.api.MainLoopQuit(loop)
+	}
+}
+
+// HandleSignal handles a DBus signal
+func (r *RecordingAPI) HandleSignal(signalName string) {
+	r.record("HandleSignal", signalName)
+	if r.api != nil {
+		r.api.HandleSignal(signalName)
+	}
+}
+
+// WaitForSignal waits for a DBus signal
+func (r *RecordingAPI) WaitForSignal(signalName string, timeout time.Duration) error {
+	r.record("WaitForSignal", signalName, timeout)
+	if r.api == nil {
+		return nil
+	}
+	return r.api.WaitForSignal(signalName, timeout)
+}
+
+// WaitForSignalContext waits for a DBus signal until ctx is done
+func (r *RecordingAPI) WaitForSignalContext(ctx context.Context, signalName string) error {
+	r.record("WaitForSignalContext", ctx, signalName)
+	if r.api == nil {
+		return nil
+	}
+	return r.api.WaitForSignalContext(ctx, signalName)
+}
+
+// BusOwnNameConnection acquires the name on the message bus connection
+func (r *RecordingAPI) BusOwnNameConnection(conn dbus.Handle, name string) (uint, error) {
+	r.record("BusOwnNameConnection", conn, name)
+	if r.api == nil {
+		return 0, nil
+	}
+	return r.api.BusOwnNameConnection(conn, name)
+}
+
+// BusUnownName releases the name acquired with BusOwnNameConnection
+func (r *RecordingAPI) BusUnownName(gid uint) {
+	r.record("BusUnownName", gid)
+	if r.api != nil {
+		r.api.BusUnownName(gid)
+	}
+}
+
+// BusRegisterInterface exports an object at the path
+func (r *RecordingAPI) BusRegisterInterface(conn dbus.Handle, path string, interfaceXML string) (uint, error) {
+	r.record("BusRegisterInterface", conn, path, interfaceXML)
+	if r.api == nil {
+		return 0, nil
+	}
+	return r.api.BusRegisterInterface(conn, path, interfaceXML)
+}
+
+// BusUnregisterInterface unexports the object registered with BusRegisterInterface
+func (r *RecordingAPI) BusUnregisterInterface(conn dbus.Handle, gid uint) bool {
+	r.record("BusUnregisterInterface", conn, gid)
+	if r.api == nil {
+		return false
+	}
+	return r.api.BusUnregisterInterface(conn, gid)
+}
+
+// RegisterMethodCallCallback sets the callback handling the calls of the method
+func (r *RecordingAPI) RegisterMethodCallCallback(path string, interfaceName string, method string, callback dbus.MethodCallCallback) {
+	r.record("RegisterMethodCallCallback", path, interfaceName, method)
+	if r.api != nil {
+		r.api.RegisterMethodCallCallback(path, interfaceName, method, callback)
+	}
+}
+
+// UnregisterMethodCallCallback removes the callback set with RegisterMethodCallCallback
+func (r *RecordingAPI) UnregisterMethodCallCallback(path string, interfaceName string, method string) {
+	r.record("UnregisterMethodCallCallback", path, interfaceName, method)
+	if r.api != nil {
+		r.api.UnregisterMethodCallCallback(path, interfaceName, method)
+	}
+}
+
+// EmitSignal emits the signal of the interface exported at the path
+func (r *RecordingAPI) EmitSignal(conn dbus.Handle, destination string, path string, interfaceName string, signalName string, params []string) error {
+	r.record("EmitSignal", conn, destination, path, interfaceName, signalName, params)
+	if r.api == nil {
+		return nil
+	}
+	return r.api.EmitSignal(conn, destination, path, interfaceName, signalName, params)
+}
@@ -17,6 +17,8 @@
 package mocks
 
 import (
+	context "context"
+
 	dbus "github.com/mendersoftware/mender-shell/client/dbus"
 	mock "github.com/stretchr/testify/mock"
 
@@ -49,6 +51,27 @@ func (_m *DBusAPI) BusGet(_a0 uint) (dbus.Handle, error) {
 	return r0, r1
 }
 
+// BusOwnNameConnection provides a mock function with given fields: _a0, _a1
+func (_m *DBusAPI) BusOwnNameConnection(_a0 dbus.Handle, _a1 string) (uint, error) {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 uint
+	if rf, ok := ret.Get(0).(func(dbus.Handle, string) uint); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(uint)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(dbus.Handle, string) error); ok {
+		r1 = rf(_a0, _a1)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // BusProxyCall provides a mock function with given fields: _a0, _a1, _a2, _a3
 func (_m *DBusAPI) BusProxyCall(_a0 dbus.Handle, _a1 string, _a2 interface{}, _a3 int) (dbus.DBusCallResponse, error) {
 	ret := _m.Called(_a0, _a1, _a2, _a3)
@@ -93,6 +116,74 @@ func (_m *DBusAPI) BusProxyNew(_a0 dbus.Handle, _a1 string, _a2 string, _a3 stri
 	return r0, r1
 }
 
+// BusProxyGetNameOwner provides a mock function with given fields: _a0
+func (_m *DBusAPI) BusProxyGetNameOwner(_a0 dbus.Handle) string {
+	ret := _m.Called(_a0)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(dbus.Handle) string); ok {
+		r0 = rf(_a0)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
+
+// BusRegisterInterface provides a mock function with given fields: _a0, _a1, _a2
+func (_m *DBusAPI) BusRegisterInterface(_a0 dbus.Handle, _a1 string, _a2 string) (uint, error) {
+	ret := _m.Called(_a0, _a1, _a2)
+
+	var r0 uint
+	if rf, ok := ret.Get(0).(func(dbus.Handle, string, string) uint); ok {
+		r0 = rf(_a0, _a1, _a2)
+	} else {
+		r0 = ret.Get(0).(uint)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(dbus.Handle, string, string) error); ok {
+		r1 = rf(_a0, _a1, _a2)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// BusUnownName provides a mock function with given fields: _a0
+func (_m *DBusAPI) BusUnownName(_a0 uint) {
+	_m.Called(_a0)
+}
+
+// BusUnregisterInterface provides a mock function with given fields: _a0, _a1
+func (_m *DBusAPI) BusUnregisterInterface(_a0 dbus.Handle, _a1 uint) bool {
+	ret := _m.Called(_a0, _a1)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(dbus.Handle, uint) bool); ok {
+		r0 = rf(_a0, _a1)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	return r0
+}
+
+// EmitSignal provides a mock function with given fields: conn, destination, path, interfaceName, signalName, params
+func (_m *DBusAPI) EmitSignal(conn dbus.Handle, destination string, path string, interfaceName string, signalName string, params []string) error {
+	ret := _m.Called(conn, destination, path, interfaceName, signalName, params)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(dbus.Handle, string, string, string, string, []string) error); ok {
+		r0 = rf(conn, destination, path, interfaceName, signalName, params)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // HandleSignal provides a mock function with given fields: signalName
 func (_m *DBusAPI) HandleSignal(signalName string) {
 	_m.Called(signalName)
@@ -122,6 +213,21 @@ func (_m *DBusAPI) MainLoopRun(_a0 dbus.MainLoop) {
 	_m.Called(_a0)
 }
 
+// ObjectUnref provides a mock function with given fields: _a0
+func (_m *DBusAPI) ObjectUnref(_a0 dbus.Handle) {
+	_m.Called(_a0)
+}
+
+// RegisterMethodCallCallback provides a mock function with given fields: path, interfaceName, method, callback
+func (_m *DBusAPI) RegisterMethodCallCallback(path string, interfaceName string, method string, callback dbus.MethodCallCallback) {
+	_m.Called(path, interfaceName, method, callback)
+}
+
+// UnregisterMethodCallCallback provides a mock function with given fields: path, interfaceName, method
+func (_m *DBusAPI) UnregisterMethodCallCallback(path string, interfaceName string, method string) {
+	_m.Called(path, interfaceName, method)
+}
+
 // WaitForSignal provides a mock function with given fields: signalName, timeout
 func (_m *DBusAPI) WaitForSignal(signalName string, timeout time.Duration) error {
 	ret := _m.Called(signalName, timeout)
@@ -135,3 +241,17 @@ func (_m *DBusAPI) WaitForSignal(signalName string, timeout time.Duration) error
 
 	return r0
 }
+
+// WaitForSignalContext provides a mock function with given fields: ctx, signalName
+func (_m *DBusAPI) WaitForSignalContext(ctx context.Context, signalName string) error {
+	ret := _m.Called(ctx, signalName)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context, string) error); ok {
+		r0 = rf(ctx, signalName)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
@@ -15,9 +15,19 @@
 package mender
 
 import (
+	"context"
+	"crypto"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
+	log "github.com/sirupsen/logrus"
+
 	"github.com/mendersoftware/mender-shell/client/dbus"
 )
 
@@ -28,37 +38,198 @@ const (
 	DBusInterfaceName                    = "io.mender.Authentication1"
 	DBusMethodNameGetJwtToken            = "GetJwtToken"
 	DBusMethodNameFetchJwtToken          = "FetchJwtToken"
+	DBusMethodNameGetIdentity            = "GetIdentity"
 	DBusSignalNameValidJwtTokenAvailable = "ValidJwtTokenAvailable"
 	DBusMethodTimeoutInSeconds           = 5
+	// DefaultTransientErrorRetries is how many times GetJWTToken retries
+	// a call failing with a transient DBus error
+	DefaultTransientErrorRetries = 2
 )
 
-var timeout = 10 * time.Second
+const timeout = 10 * time.Second
+
+var tokenRefreshRetryInterval = time.Second
+var authManagerPollInterval = 500 * time.Millisecond
+var fetchRetryMaxTotalWait = 5 * time.Minute
+
+// the wait before the first retry of a call failing with a transient DBus
+// error, doubled before every following one
+var transientErrorRetryBackoff = 100 * time.Millisecond
 var errFetchTokenFailed = errors.New("FetchJwtToken failed")
 
+// fetchTokenDeclinedError is returned when the Authentication Manager
+// declines to schedule the fetching of a new token, giving a reason
+type fetchTokenDeclinedError struct {
+	detail string
+}
+
+func (e *fetchTokenDeclinedError) Error() string {
+	return fmt.Sprintf("FetchJwtToken scheduling was declined: %s", e.detail)
+}
+
+func (e *fetchTokenDeclinedError) Is(target error) bool {
+	return target == errFetchTokenFailed
+}
+
+// ErrAuthClientDisconnected is returned when calling a method after Disconnect()
+var ErrAuthClientDisconnected = errors.New("the auth client is disconnected")
+
+// ErrDBusDisconnected is returned when the connection to the message bus
+// was lost; the caller can recover calling Reconnect()
+var ErrDBusDisconnected = errors.New("DBus connection lost")
+
+// ErrUnexpectedDBusType is returned when the Authentication Manager answers
+// with a value of another DBus type than expected, which would read as an
+// empty token or a declined fetch
+var ErrUnexpectedDBusType = errors.New("unexpected DBus type")
+
+// messages of the errors reported when the message bus connection is lost
+var dbusDisconnectedErrorMessages = []string{
+	"The connection is closed",
+	"org.freedesktop.DBus.Error.Disconnected",
+}
+
+// messages of the errors reported when the Authentication Manager was too
+// busy to answer in time, which are worth retrying; not the failures like
+// an unknown method or no token available
+var dbusTransientErrorMessages = []string{
+	"org.freedesktop.DBus.Error.NoReply",
+	"org.freedesktop.DBus.Error.Timeout",
+	"org.freedesktop.DBus.Error.TimedOut",
+	"Timeout was reached",
+}
+
 // AuthClient is the interface for the Mender Authentication Manager clilents
 type AuthClient interface {
+	TokenProvider
+	DeviceIdentityProvider
 	// Connect to the Mender client interface
 	Connect(objectName, objectPath, interfaceName string) error
+	// ConnectWithBus connects to the Mender client interface on the given message bus
+	ConnectWithBus(busType uint, objectName, objectPath, interfaceName string) error
+	// Reconnect to the Mender client interface given in the last Connect call
+	Reconnect() error
+	// Disconnect releases the connection to the Mender client interface
+	Disconnect() error
 	// GetJWTToken returns a device JWT token
 	GetJWTToken() (string, error)
+	// GetCachedOrFreshJWTToken returns a device JWT token, falling back to
+	// the last valid token if the Authentication Manager is unavailable
+	GetCachedOrFreshJWTToken() (string, error)
 	// FetchJWTToken schedules the fetching of a new device JWT token
 	FetchJWTToken() (bool, error)
+	// FetchJWTTokenForServer schedules the fetching of a new device JWT token
+	// for the given server
+	FetchJWTTokenForServer(serverURL string) (bool, error)
 	// WaitForValidJWTTokenAvailable synchronously waits for the ValidJwtTokenAvailable signal
 	WaitForValidJWTTokenAvailable() error
+	// WaitForValidJWTTokenAvailableContext synchronously waits for the
+	// ValidJwtTokenAvailable signal until ctx is done
+	WaitForValidJWTTokenAvailableContext(ctx context.Context) error
+	// WaitForAuthManager synchronously waits for the Authentication Manager
+	// to own its name on the message bus until ctx is done
+	WaitForAuthManager(ctx context.Context) error
 	// FetchAndGetJWTToken fetches a new JWT token and returns it
 	FetchAndGetJWTToken() (string, error)
+	// FetchAndGetJWTTokenWithRetry fetches a new JWT token and returns it,
+	// retrying with exponential backoff on failures
+	FetchAndGetJWTTokenWithRetry(ctx context.Context, attempts int, initialBackoff time.Duration) (string, error)
+	// GetServerURL returns the server URL the device JWT token was issued for
+	GetServerURL() (string, error)
+	// SetVerificationKey sets the public key used to verify the JWT tokens
+	SetVerificationKey(key crypto.PublicKey)
+	// StartTokenRefresh refreshes the JWT token leeway before it expires
+	// and emits the new tokens on the returned channel
+	StartTokenRefresh(ctx context.Context, leeway time.Duration) <-chan string
 }
 
 // AuthClientDBUS is the implementation of the client for the Mender
 // Authentication Manager which communicates using DBUS
 type AuthClientDBUS struct {
-	dbusAPI          dbus.DBusAPI
+	dbusAPI dbus.DBusAPI
+	// guards the connection below: the token refresh goroutine calls the
+	// methods while the main loop disconnects and reconnects
+	connMutex        sync.RWMutex
 	dbusConnection   dbus.Handle
 	authManagerProxy dbus.Handle
+	disconnected     bool
+	busType          uint
+	objectName       string
+	objectPath       string
+	interfaceName    string
+	// last successfully retrieved token and its expiration time
+	cacheMutex     sync.Mutex
+	cachedToken    string
+	cachedTokenExp time.Time
+	// public key to verify the JWT token signatures with, if set
+	verificationKey crypto.PublicKey
+	// MethodTimeout is the timeout for the DBus method calls,
+	// DBusMethodTimeoutInSeconds is used if not set
+	MethodTimeout time.Duration
+	// TransientErrorRetries is how many times GetJWTToken retries a call
+	// failing with a transient DBus error, e.g.: no reply, with a short
+	// backoff; the other errors are returned right away
+	TransientErrorRetries int
+	// OnTokenRefreshed, if set, is called after every successful
+	// FetchAndGetJWTToken; it runs in its own goroutine, so it can
+	// be called concurrently
+	OnTokenRefreshed func(token string, fetchedAt time.Time)
+	// OnTokenFetched, if set, is called after every FetchAndGetJWTToken,
+	// successful or not, with how long it took; it runs in the goroutine
+	// of the caller, so it has to return quickly
+	OnTokenFetched func(duration time.Duration, err error)
+	// RefreshJitter is the fraction of the leeway, between 0 and 1, over
+	// which StartTokenRefresh spreads the refreshes: the tokens issued at
+	// the same time are not all refreshed at once
+	RefreshJitter float64
+	//seeded per device, or the devices would all draw the same jitter
+	randomMutex sync.Mutex
+	random      *rand.Rand
+}
+
+// AuthClientOption is an option for NewAuthClient
+type AuthClientOption func(*AuthClientDBUS)
+
+// WithMethodTimeout sets the timeout for the DBus method calls
+func WithMethodTimeout(methodTimeout time.Duration) AuthClientOption {
+	return func(a *AuthClientDBUS) {
+		a.MethodTimeout = methodTimeout
+	}
+}
+
+// WithTransientErrorRetries sets how many times GetJWTToken retries a call
+// failing with a transient DBus error; 0 disables the retries
+func WithTransientErrorRetries(retries int) AuthClientOption {
+	return func(a *AuthClientDBUS) {
+		a.TransientErrorRetries = retries
+	}
+}
+
+// WithOnTokenRefreshed sets the callback called when a new JWT token is fetched
+func WithOnTokenRefreshed(onTokenRefreshed func(token string, fetchedAt time.Time)) AuthClientOption {
+	return func(a *AuthClientDBUS) {
+		a.OnTokenRefreshed = onTokenRefreshed
+	}
+}
+
+// WithOnTokenFetched sets the callback called with the duration of every
+// JWT token fetch
+func WithOnTokenFetched(onTokenFetched func(duration time.Duration, err error)) AuthClientOption {
+	return func(a *AuthClientDBUS) {
+		a.OnTokenFetched = onTokenFetched
+	}
+}
+
+// WithRefreshJitter sets the fraction of the leeway, between 0 and 1, over
+// which StartTokenRefresh spreads the refreshes
+func WithRefreshJitter(fraction float64) AuthClientOption {
+	return func(a *AuthClientDBUS) {
+		a.RefreshJitter = fraction
+	}
 }
 
 // NewAuthClient returns a new AuthClient
-func NewAuthClient(dbusAPI dbus.DBusAPI) (AuthClient, error) {
+func NewAuthClient(dbusAPI dbus.DBusAPI, opts ...AuthClientOption) (AuthClient, error) {
 	if dbusAPI == nil {
 		var err error
 		dbusAPI, err = dbus.GetDBusAPI()
@@ -66,14 +237,33 @@ func NewAuthClient(dbusAPI dbus.DBusAPI) (AuthClient, error) {
 			return nil, err
 		}
 	}
-	return &AuthClientDBUS{
-		dbusAPI: dbusAPI,
-	}, nil
+	client := &AuthClientDBUS{
+		dbusAPI:               dbusAPI,
+		TransientErrorRetries: DefaultTransientErrorRetries,
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client, nil
+}
+
+// methodTimeoutInSeconds returns the timeout for the DBus method calls
+func (a *AuthClientDBUS) methodTimeoutInSeconds() int {
+	if a.MethodTimeout <= 0 {
+		return DBusMethodTimeoutInSeconds
+	}
+	return int(math.Ceil(a.MethodTimeout.Seconds()))
 }
 
-// Connect to the Mender client interface
+// Connect to the Mender client interface on the system bus
 func (a *AuthClientDBUS) Connect(objectName, objectPath, interfaceName string) error {
-	dbusConnection, err := a.dbusAPI.BusGet(dbus.GBusTypeSystem)
+	return a.ConnectWithBus(dbus.GBusTypeSystem, objectName, objectPath, interfaceName)
+}
+
+// ConnectWithBus connects to the Mender client interface on the given
+// message bus, dbus.GBusTypeSystem or dbus.GBusTypeSession
+func (a *AuthClientDBUS) ConnectWithBus(busType uint, objectName, objectPath, interfaceName string) error {
+	dbusConnection, err := a.dbusAPI.BusGet(busType)
 	if err != nil {
 		return err
 	}
@@ -81,36 +271,255 @@ func (a *AuthClientDBUS) Connect(objectName, objectPath, interfaceName string) e
 	if err != nil {
 		return err
 	}
+	a.connMutex.Lock()
+	defer a.connMutex.Unlock()
 	a.dbusConnection = dbusConnection
 	a.authManagerProxy = authManagerProxy
+	a.disconnected = false
+	a.busType = busType
+	a.objectName = objectName
+	a.objectPath = objectPath
+	a.interfaceName = interfaceName
 	return nil
 }
 
-// GetJWTToken returns a device JWT token
+// Reconnect to the Mender client interface given in the last Connect call
+func (a *AuthClientDBUS) Reconnect() error {
+	a.connMutex.RLock()
+	busType, objectName, objectPath, interfaceName := a.busType, a.objectName, a.objectPath, a.interfaceName
+	a.connMutex.RUnlock()
+	if objectName == "" {
+		return errors.New("Reconnect called before Connect")
+	}
+	return a.ConnectWithBus(busType, objectName, objectPath, interfaceName)
+}
+
+// Disconnect releases the proxy and the connection to the message bus; the
+// method calls fail with ErrAuthClientDisconnected until the next Connect
+func (a *AuthClientDBUS) Disconnect() error {
+	a.connMutex.Lock()
+	defer a.connMutex.Unlock()
+	if a.disconnected {
+		return nil
+	}
+	if a.authManagerProxy != nil {
+		a.dbusAPI.ObjectUnref(a.authManagerProxy)
+	}
+	if a.dbusConnection != nil {
+		a.dbusAPI.ObjectUnref(a.dbusConnection)
+	}
+	a.authManagerProxy = nil
+	a.dbusConnection = nil
+	a.disconnected = true
+	return nil
+}
+
+// proxy returns the proxy of the Authentication Manager, or
+// ErrAuthClientDisconnected after Disconnect
+func (a *AuthClientDBUS) proxy() (dbus.Handle, error) {
+	a.connMutex.RLock()
+	defer a.connMutex.RUnlock()
+	if a.disconnected {
+		return nil, ErrAuthClientDisconnected
+	}
+	return a.authManagerProxy, nil
+}
+
+// wrapDBusError wraps the errors caused by a lost message bus
+// connection in ErrDBusDisconnected
+func wrapDBusError(err error) error {
+	for _, message := range dbusDisconnectedErrorMessages {
+		if strings.Contains(err.Error(), message) {
+			return fmt.Errorf("%w: %s", ErrDBusDisconnected, err.Error())
+		}
+	}
+	return err
+}
+
+// isTransientDBusError tells if the call failed because the other end was
+// momentarily too busy to answer
+func isTransientDBusError(err error) bool {
+	for _, message := range dbusTransientErrorMessages {
+		if strings.Contains(err.Error(), message) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetJWTToken returns a device JWT token; the calls failing with a transient
+// DBus error are retried up to TransientErrorRetries times
 func (a *AuthClientDBUS) GetJWTToken() (string, error) {
-	response, err := a.dbusAPI.BusProxyCall(a.authManagerProxy, DBusMethodNameGetJwtToken, nil, DBusMethodTimeoutInSeconds)
+	proxy, err := a.proxy()
 	if err != nil {
 		return "", err
 	}
-	return response.GetString(), nil
+	response, err := a.dbusAPI.BusProxyCall(proxy, DBusMethodNameGetJwtToken, nil, a.methodTimeoutInSeconds())
+	backoff := transientErrorRetryBackoff
+	for retry := 1; err != nil && retry <= a.TransientErrorRetries && isTransientDBusError(err); retry++ {
+		log.Debugf("GetJwtToken failed with a transient error (%s), retry %d of %d in %s",
+			err.Error(), retry, a.TransientErrorRetries, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		response, err = a.dbusAPI.BusProxyCall(proxy, DBusMethodNameGetJwtToken, nil, a.methodTimeoutInSeconds())
+	}
+	if err != nil {
+		return "", wrapDBusError(err)
+	}
+	if err := checkResponseType(DBusMethodNameGetJwtToken, response, "s"); err != nil {
+		return "", err
+	}
+	token := response.GetString()
+	if a.verificationKey != nil && token != "" {
+		if err := verifyJWTTokenSignature(token, a.verificationKey); err != nil {
+			log.Errorf("the JWT token failed the signature verification: %s", err.Error())
+			return "", ErrTokenSignatureInvalid
+		}
+	}
+	a.cacheToken(token)
+	return token, nil
+}
+
+// SetVerificationKey sets the public key used to verify the JWT tokens
+// returned by GetJWTToken; RSA (RS256) and ECDSA (ES256) keys are supported
+func (a *AuthClientDBUS) SetVerificationKey(key crypto.PublicKey) {
+	a.verificationKey = key
+}
+
+// GetCachedOrFreshJWTToken returns a device JWT token; if the Authentication
+// Manager can't be reached, it returns the last retrieved token, as long as
+// it has not expired yet
+func (a *AuthClientDBUS) GetCachedOrFreshJWTToken() (string, error) {
+	token, err := a.GetJWTToken()
+	if err == nil {
+		return token, nil
+	}
+	if cachedToken := a.getCachedToken(); cachedToken != "" {
+		log.Debugf("failed to get the JWT token (%s), using the cached one", err.Error())
+		return cachedToken, nil
+	}
+	return "", err
+}
+
+func (a *AuthClientDBUS) cacheToken(token string) {
+	a.cacheMutex.Lock()
+	defer a.cacheMutex.Unlock()
+	a.cachedToken = ""
+	a.cachedTokenExp = time.Time{}
+	if exp, err := getJWTTokenExpiration(token); err == nil {
+		a.cachedToken = token
+		a.cachedTokenExp = exp
+	}
+}
+
+func (a *AuthClientDBUS) getCachedToken() string {
+	a.cacheMutex.Lock()
+	defer a.cacheMutex.Unlock()
+	if a.cachedToken != "" && !time.Now().Before(a.cachedTokenExp) {
+		a.cachedToken = ""
+		a.cachedTokenExp = time.Time{}
+	}
+	return a.cachedToken
 }
 
 // FetchJWTToken schedules the fetching of a new device JWT token
 func (a *AuthClientDBUS) FetchJWTToken() (bool, error) {
-	response, err := a.dbusAPI.BusProxyCall(a.authManagerProxy, DBusMethodNameFetchJwtToken, nil, DBusMethodTimeoutInSeconds)
+	return a.FetchJWTTokenForServer("")
+}
+
+// FetchJWTTokenForServer schedules the fetching of a new device JWT token for
+// the given server; if serverURL is empty, the method is called without
+// arguments, as expected by the Mender clients supporting only one server
+func (a *AuthClientDBUS) FetchJWTTokenForServer(serverURL string) (bool, error) {
+	proxy, err := a.proxy()
 	if err != nil {
 		return false, err
 	}
-	return response.GetBoolean(), nil
+	var params interface{}
+	if serverURL != "" {
+		params = serverURL
+	}
+	response, err := a.dbusAPI.BusProxyCall(proxy, DBusMethodNameFetchJwtToken, params, a.methodTimeoutInSeconds())
+	if err != nil {
+		return false, wrapDBusError(err)
+	}
+	if err := checkResponseType(DBusMethodNameFetchJwtToken, response, "b"); err != nil {
+		return false, err
+	}
+	fetch := response.GetBoolean()
+	if !fetch {
+		if r, ok := response.(dbus.DBusCallResponseDetail); ok && r.GetDetail() != "" {
+			return false, &fetchTokenDeclinedError{detail: r.GetDetail()}
+		}
+		log.Debug("FetchJwtToken scheduling was declined, no reason given")
+	}
+	return fetch, nil
+}
+
+//checks the first value of the response is of the given DBus type, if the
+//response tells its type; the values following it are ignored
+func checkResponseType(method string, response dbus.DBusCallResponse, expected string) error {
+	r, ok := response.(dbus.DBusCallResponseType)
+	if !ok {
+		return nil
+	}
+	signature := r.Type()
+	if !strings.HasPrefix(signature, "("+expected) {
+		return fmt.Errorf("%w: %s returned %s, expected (%s)", ErrUnexpectedDBusType, method, signature, expected)
+	}
+	return nil
 }
 
 // WaitForValidJWTTokenAvailable synchronously waits for the ValidJwtTokenAvailable signal
 func (a *AuthClientDBUS) WaitForValidJWTTokenAvailable() error {
-	return a.dbusAPI.WaitForSignal(DBusSignalNameValidJwtTokenAvailable, timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return a.WaitForValidJWTTokenAvailableContext(ctx)
+}
+
+// WaitForValidJWTTokenAvailableContext synchronously waits for the
+// ValidJwtTokenAvailable signal; it returns ctx.Err() if ctx is done first
+func (a *AuthClientDBUS) WaitForValidJWTTokenAvailableContext(ctx context.Context) error {
+	return a.dbusAPI.WaitForSignalContext(ctx, DBusSignalNameValidJwtTokenAvailable)
+}
+
+// WaitForAuthManager synchronously waits for the Authentication Manager to
+// own its name on the message bus, polling the owner of the name; before,
+// the proxy is created fine but the method calls fail. It returns ctx.Err()
+// if ctx is done first
+func (a *AuthClientDBUS) WaitForAuthManager(ctx context.Context) error {
+	ticker := time.NewTicker(authManagerPollInterval)
+	defer ticker.Stop()
+	for {
+		proxy, err := a.proxy()
+		if err != nil {
+			return err
+		}
+		if a.dbusAPI.BusProxyGetNameOwner(proxy) != "" {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
 // FetchAndGetJWTToken fetches a new JWT token and returns it
 func (a *AuthClientDBUS) FetchAndGetJWTToken() (string, error) {
+	start := time.Now()
+	token, err := a.fetchAndGetJWTToken()
+	if a.OnTokenFetched != nil {
+		a.OnTokenFetched(time.Since(start), err)
+	}
+	if err == nil && a.OnTokenRefreshed != nil {
+		go a.OnTokenRefreshed(token, time.Now())
+	}
+	return token, err
+}
+
+func (a *AuthClientDBUS) fetchAndGetJWTToken() (string, error) {
 	fetch, err := a.FetchJWTToken()
 	if err != nil {
 		return "", err
@@ -123,3 +532,151 @@ func (a *AuthClientDBUS) FetchAndGetJWTToken() (string, error) {
 	}
 	return a.GetJWTToken()
 }
+
+// Token returns the device JWT token, see GetJWTToken
+func (a *AuthClientDBUS) Token() (string, error) {
+	return a.GetJWTToken()
+}
+
+// Refresh fetches a new JWT token and returns it, see FetchAndGetJWTToken
+func (a *AuthClientDBUS) Refresh() (string, error) {
+	return a.FetchAndGetJWTToken()
+}
+
+// FetchAndGetJWTTokenWithRetry fetches a new JWT token and returns it; on
+// failure, it retries up to attempts times doubling the backoff between the
+// attempts, without exceeding fetchRetryMaxTotalWait in total. It returns the
+// last error if all the attempts fail, or the context error if ctx is done.
+func (a *AuthClientDBUS) FetchAndGetJWTTokenWithRetry(ctx context.Context, attempts int, initialBackoff time.Duration) (string, error) {
+	var waited time.Duration
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		token, err := a.FetchAndGetJWTToken()
+		if err == nil {
+			return token, nil
+		} else if errors.Is(err, errFetchTokenFailed) {
+			log.Infof("fetch of the JWT token not accepted (attempt %d/%d): %s", attempt, attempts, err.Error())
+		} else {
+			log.Warnf("failed to fetch the JWT token (attempt %d/%d): %s", attempt, attempts, err.Error())
+		}
+		if attempt >= attempts || waited+backoff > fetchRetryMaxTotalWait {
+			return "", err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+		waited += backoff
+		backoff *= 2
+	}
+}
+
+// GetServerURL returns the server URL the device JWT token was issued for;
+// ErrNoServerInToken is returned if the token does not carry one
+func (a *AuthClientDBUS) GetServerURL() (string, error) {
+	token, err := a.GetJWTToken()
+	if err != nil {
+		return "", err
+	}
+	return GetJWTTokenServerURL(token)
+}
+
+// GetDeviceIdentity returns the device identity the Authentication Manager
+// returns with GetIdentity, as a JSON object of the identity attributes;
+// without the method, the identity is the device id of the JWT token
+func (a *AuthClientDBUS) GetDeviceIdentity() (map[string]string, error) {
+	proxy, err := a.proxy()
+	if err != nil {
+		return nil, err
+	}
+	response, err := a.dbusAPI.BusProxyCall(proxy, DBusMethodNameGetIdentity, nil, a.methodTimeoutInSeconds())
+	if err == nil {
+		err = checkResponseType(DBusMethodNameGetIdentity, response, "s")
+	}
+	if err == nil {
+		identity := map[string]string{}
+		if err = json.Unmarshal([]byte(response.GetString()), &identity); err == nil {
+			return identity, nil
+		}
+	}
+	log.Debugf("can't get the device identity with %s (%s), using the JWT token", DBusMethodNameGetIdentity, err.Error())
+	token, err := a.GetJWTToken()
+	if err != nil {
+		return nil, err
+	}
+	return getJWTTokenIdentity(token)
+}
+
+// StartTokenRefresh starts a goroutine which fetches a new JWT token leeway
+// before the current one expires, and emits it on the returned channel.
+// If the token has no exp claim, it falls back to waiting for the
+// ValidJwtTokenAvailable signal. The channel is closed when ctx is done.
+func (a *AuthClientDBUS) StartTokenRefresh(ctx context.Context, leeway time.Duration) <-chan string {
+	tokens := make(chan string, 1)
+	go func() {
+		defer close(tokens)
+		for {
+			token, err := a.waitForTokenRefresh(ctx, leeway)
+			if ctx.Err() != nil {
+				return
+			} else if err != nil {
+				log.Errorf("failed to refresh the JWT token: %s", err.Error())
+				select {
+				case <-time.After(tokenRefreshRetryInterval):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case tokens <- token:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return tokens
+}
+
+//returns the delay before refreshing the token expiring at exp: leeway
+//before exp, plus a random part of RefreshJitter*leeway; as the jitter stays
+//below the leeway, the token is still refreshed before it expires
+func (a *AuthClientDBUS) tokenRefreshDelay(exp time.Time, leeway time.Duration) time.Duration {
+	delay := time.Until(exp.Add(-leeway))
+	jitter := a.RefreshJitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	maxJitter := int64(float64(leeway) * jitter)
+	if maxJitter <= 0 {
+		return delay
+	}
+	a.randomMutex.Lock()
+	defer a.randomMutex.Unlock()
+	if a.random == nil {
+		a.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return delay + time.Duration(a.random.Int63n(maxJitter))
+}
+
+func (a *AuthClientDBUS) waitForTokenRefresh(ctx context.Context, leeway time.Duration) (string, error) {
+	token, err := a.GetJWTToken()
+	if err != nil {
+		return "", err
+	}
+	exp, err := getJWTTokenExpiration(token)
+	if err != nil {
+		log.Debugf("can't schedule the JWT token refresh (%s), waiting for signal", err.Error())
+		if err := a.WaitForValidJWTTokenAvailableContext(ctx); err != nil {
+			return "", err
+		}
+		return a.GetJWTToken()
+	}
+	select {
+	case <-time.After(a.tokenRefreshDelay(exp, leeway)):
+		return a.FetchAndGetJWTToken()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
@@ -15,12 +15,20 @@
 package mender
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"errors"
+	"math"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 
 	"github.com/mendersoftware/mender-shell/client/dbus"
+	"github.com/mendersoftware/mender-shell/client/dbus/dbustest"
 	dbus_mocks "github.com/mendersoftware/mender-shell/client/dbus/mocks"
 )
 
@@ -141,6 +149,12 @@ func TestAuthClientGetJWTToken(t *testing.T) {
 				assert.Equal(t, value, JWTTokenValue)
 				assert.NoError(t, err)
 			}
+
+			//the token provider gets the same token
+			var provider TokenProvider = client
+			token, tokenErr := provider.Token()
+			assert.Equal(t, value, token)
+			assert.Equal(t, err, tokenErr)
 		})
 	}
 }
@@ -211,9 +225,9 @@ func TestAuthClientWaitForValidJWTTokenAvailable(t *testing.T) {
 			dbusAPI := &dbus_mocks.DBusAPI{}
 			defer dbusAPI.AssertExpectations(t)
 
-			dbusAPI.On("WaitForSignal",
+			dbusAPI.On("WaitForSignalContext",
+				mock.Anything,
 				DBusSignalNameValidJwtTokenAvailable,
-				timeout,
 			).Return(tc.err)
 
 			client, err := NewAuthClient(dbusAPI)
@@ -285,9 +299,9 @@ func TestFetchAndGetJWTToken(t *testing.T) {
 			).Return(response, tc.fetchErr)
 
 			if tc.fetchErr == nil && tc.fetch == true {
-				dbusAPI.On("WaitForSignal",
+				dbusAPI.On("WaitForSignalContext",
+					mock.Anything,
 					DBusSignalNameValidJwtTokenAvailable,
-					timeout,
 				).Return(tc.waitErr)
 			}
 
@@ -321,3 +335,1141 @@ func TestFetchAndGetJWTToken(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenRefreshDelay(t *testing.T) {
+	testCases := map[string]struct {
+		jitter   float64
+		minDelay time.Duration
+		maxDelay time.Duration
+		spread   bool
+	}{
+		"no jitter": {
+			minDelay: 50 * time.Minute,
+			maxDelay: 50 * time.Minute,
+		},
+		"half the leeway": {
+			jitter:   0.5,
+			minDelay: 50 * time.Minute,
+			maxDelay: 55 * time.Minute,
+			spread:   true,
+		},
+		"whole leeway": {
+			jitter:   1,
+			minDelay: 50 * time.Minute,
+			maxDelay: time.Hour,
+			spread:   true,
+		},
+		"above one": {
+			jitter:   3,
+			minDelay: 50 * time.Minute,
+			maxDelay: time.Hour,
+			spread:   true,
+		},
+		"negative": {
+			jitter:   -1,
+			minDelay: 50 * time.Minute,
+			maxDelay: 50 * time.Minute,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client := &AuthClientDBUS{RefreshJitter: tc.jitter}
+			exp := time.Now().Add(time.Hour)
+			shortest, longest := time.Duration(math.MaxInt64), time.Duration(0)
+			for i := 0; i < 1000; i++ {
+				delay := client.tokenRefreshDelay(exp, 10*time.Minute)
+				//time.Until runs after exp was set
+				assert.True(t, delay > tc.minDelay-time.Second, "delay %s below %s", delay, tc.minDelay)
+				assert.True(t, delay <= tc.maxDelay, "delay %s above %s", delay, tc.maxDelay)
+				//refreshed before the token expires, even with the max jitter
+				assert.True(t, delay < time.Until(exp))
+				if delay < shortest {
+					shortest = delay
+				}
+				if delay > longest {
+					longest = delay
+				}
+			}
+			//the draws cover most of the jitter range
+			if tc.spread {
+				assert.True(t, longest-shortest > (tc.maxDelay-tc.minDelay)/2)
+			} else {
+				assert.True(t, longest-shortest < time.Second)
+			}
+		})
+	}
+}
+
+func TestStartTokenRefresh(t *testing.T) {
+	expiringToken := makeJWTToken(map[string]interface{}{
+		"exp": time.Now().Add(2 * time.Second).Unix(),
+	})
+	noExpToken := makeJWTToken(map[string]interface{}{"sub": "device"})
+
+	testCases := map[string]struct {
+		token   string
+		fetch   bool
+		waitErr error
+	}{
+		"ok, refresh before exp": {
+			token: expiringToken,
+			fetch: true,
+		},
+		"ok, no exp, wait for signal": {
+			token: noExpToken,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			response := &dbus_mocks.DBusCallResponse{}
+			response.On("GetString").Return(tc.token)
+			response.On("GetBoolean").Return(true)
+
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			dbusAPI.On("BusProxyCall",
+				dbus.Handle(nil),
+				DBusMethodNameGetJwtToken,
+				nil,
+				DBusMethodTimeoutInSeconds,
+			).Return(response, nil)
+			if tc.fetch {
+				dbusAPI.On("BusProxyCall",
+					dbus.Handle(nil),
+					DBusMethodNameFetchJwtToken,
+					nil,
+					DBusMethodTimeoutInSeconds,
+				).Return(response, nil)
+			}
+			dbusAPI.On("WaitForSignalContext",
+				mock.Anything,
+				DBusSignalNameValidJwtTokenAvailable,
+			).Return(nil)
+
+			client, err := NewAuthClient(dbusAPI)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			tokens := client.StartTokenRefresh(ctx, time.Second)
+			select {
+			case token := <-tokens:
+				assert.Equal(t, tc.token, token)
+			case <-time.After(5 * time.Second):
+				assert.Fail(t, "timeout waiting for the refreshed token")
+			}
+			cancel()
+			for range tokens {
+			}
+			if tc.fetch {
+				dbusAPI.AssertCalled(t, "BusProxyCall",
+					dbus.Handle(nil),
+					DBusMethodNameFetchJwtToken,
+					nil,
+					DBusMethodTimeoutInSeconds,
+				)
+			}
+		})
+	}
+}
+
+func TestAuthClientMethodTimeout(t *testing.T) {
+	testCases := map[string]struct {
+		methodTimeout time.Duration
+		timeout       int
+	}{
+		"default": {
+			timeout: DBusMethodTimeoutInSeconds,
+		},
+		"custom": {
+			methodTimeout: 30 * time.Second,
+			timeout:       30,
+		},
+		"custom, rounded up": {
+			methodTimeout: 1500 * time.Millisecond,
+			timeout:       2,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			response := &dbus_mocks.DBusCallResponse{}
+			defer response.AssertExpectations(t)
+			response.On("GetString").Return("token")
+			response.On("GetBoolean").Return(true)
+
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			dbusAPI.On("BusProxyCall",
+				dbus.Handle(nil),
+				DBusMethodNameGetJwtToken,
+				nil,
+				tc.timeout,
+			).Return(response, nil)
+			dbusAPI.On("BusProxyCall",
+				dbus.Handle(nil),
+				DBusMethodNameFetchJwtToken,
+				nil,
+				tc.timeout,
+			).Return(response, nil)
+
+			client, err := NewAuthClient(dbusAPI, WithMethodTimeout(tc.methodTimeout))
+			assert.NoError(t, err)
+
+			_, err = client.GetJWTToken()
+			assert.NoError(t, err)
+			_, err = client.FetchJWTToken()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestFetchAndGetJWTTokenWithRetry(t *testing.T) {
+	testCases := map[string]struct {
+		attempts  int
+		fetches   []bool
+		fetchErrs []error
+		cancel    bool
+		res       string
+		resErr    error
+	}{
+		"ok, first attempt": {
+			attempts: 3,
+			fetches:  []bool{true},
+			res:      "token",
+		},
+		"ok, after fetch false and transport error": {
+			attempts:  3,
+			fetches:   []bool{false, false, true},
+			fetchErrs: []error{nil, errors.New("dbus error"), nil},
+			res:       "token",
+		},
+		"ko, attempts exhausted": {
+			attempts: 2,
+			fetches:  []bool{false, false},
+			resErr:   errFetchTokenFailed,
+		},
+		"ko, context canceled": {
+			attempts: 3,
+			fetches:  []bool{false},
+			cancel:   true,
+			resErr:   context.Canceled,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			for i, fetch := range tc.fetches {
+				var fetchErr error
+				if i < len(tc.fetchErrs) {
+					fetchErr = tc.fetchErrs[i]
+				}
+				response := &dbus_mocks.DBusCallResponse{}
+				if fetchErr == nil {
+					response.On("GetBoolean").Return(fetch).Once()
+				}
+				dbusAPI.On("BusProxyCall",
+					dbus.Handle(nil),
+					DBusMethodNameFetchJwtToken,
+					nil,
+					DBusMethodTimeoutInSeconds,
+				).Return(response, fetchErr).Once()
+			}
+			if tc.res != "" {
+				dbusAPI.On("WaitForSignalContext",
+					mock.Anything,
+					DBusSignalNameValidJwtTokenAvailable,
+				).Return(nil)
+
+				response := &dbus_mocks.DBusCallResponse{}
+				response.On("GetString").Return(tc.res)
+				dbusAPI.On("BusProxyCall",
+					dbus.Handle(nil),
+					DBusMethodNameGetJwtToken,
+					nil,
+					DBusMethodTimeoutInSeconds,
+				).Return(response, nil)
+			}
+
+			client, err := NewAuthClient(dbusAPI)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				cancel()
+			}
+			res, err := client.FetchAndGetJWTTokenWithRetry(ctx, tc.attempts, time.Millisecond)
+			assert.Equal(t, tc.res, res)
+			assert.Equal(t, tc.resErr, err)
+		})
+	}
+}
+
+func TestAuthClientGetJWTTokenTransientErrors(t *testing.T) {
+	defer func(backoff time.Duration) {
+		transientErrorRetryBackoff = backoff
+	}(transientErrorRetryBackoff)
+	transientErrorRetryBackoff = time.Millisecond
+
+	noReply := errors.New("GDBus.Error:org.freedesktop.DBus.Error.NoReply: Did not receive a reply")
+	timeout := errors.New("Timeout was reached")
+	testCases := map[string]struct {
+		retries []AuthClientOption
+		errs    []error
+		succeed bool
+		calls   int
+	}{
+		"no reply, then the token": {
+			errs:    []error{noReply},
+			succeed: true,
+			calls:   2,
+		},
+		"timeouts, then the token": {
+			errs:    []error{timeout, noReply},
+			succeed: true,
+			calls:   3,
+		},
+		"no reply every time": {
+			errs:  []error{noReply, noReply, noReply},
+			calls: 3,
+		},
+		"more retries": {
+			retries: []AuthClientOption{WithTransientErrorRetries(4)},
+			errs:    []error{noReply, noReply, noReply, noReply},
+			succeed: true,
+			calls:   5,
+		},
+		"retries disabled": {
+			retries: []AuthClientOption{WithTransientErrorRetries(0)},
+			errs:    []error{noReply},
+			calls:   1,
+		},
+		"not transient": {
+			errs:  []error{errors.New("GDBus.Error:org.freedesktop.DBus.Error.UnknownMethod: No such method")},
+			calls: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+			for _, err := range tc.errs {
+				dbusAPI.On("BusProxyCall",
+					dbus.Handle(nil),
+					DBusMethodNameGetJwtToken,
+					nil,
+					DBusMethodTimeoutInSeconds,
+				).Return(nil, err).Once()
+			}
+			if tc.succeed {
+				response := &dbus_mocks.DBusCallResponse{}
+				defer response.AssertExpectations(t)
+				response.On("GetString").Return("token")
+				dbusAPI.On("BusProxyCall",
+					dbus.Handle(nil),
+					DBusMethodNameGetJwtToken,
+					nil,
+					DBusMethodTimeoutInSeconds,
+				).Return(response, nil).Once()
+			}
+
+			client, err := NewAuthClient(dbusAPI, tc.retries...)
+			assert.NoError(t, err)
+
+			token, err := client.GetJWTToken()
+			if tc.succeed {
+				assert.NoError(t, err)
+				assert.Equal(t, "token", token)
+			} else {
+				assert.Error(t, err)
+			}
+			dbusAPI.AssertNumberOfCalls(t, "BusProxyCall", tc.calls)
+		})
+	}
+}
+
+func TestAuthClientGetDeviceIdentity(t *testing.T) {
+	testCases := map[string]struct {
+		identityResponse string
+		identityErr      error
+		token            string
+		tokenErr         error
+		identity         map[string]string
+		err              bool
+	}{
+		"GetIdentity": {
+			identityResponse: `{"device_id":"device-1","mac":"00:11:22:33:44:55"}`,
+			identity:         map[string]string{"device_id": "device-1", "mac": "00:11:22:33:44:55"},
+		},
+		"no GetIdentity, the JWT token subject": {
+			identityErr: errors.New("GDBus.Error:org.freedesktop.DBus.Error.UnknownMethod: No such method"),
+			token:       makeJWTToken(map[string]interface{}{"sub": "device-1"}),
+			identity:    map[string]string{IdentityDeviceID: "device-1"},
+		},
+		"GetIdentity not a JSON object, the JWT token subject": {
+			identityResponse: "device-1",
+			token:            makeJWTToken(map[string]interface{}{"sub": "device-1"}),
+			identity:         map[string]string{IdentityDeviceID: "device-1"},
+		},
+		"no GetIdentity, no subject": {
+			identityErr: errors.New("GDBus.Error:org.freedesktop.DBus.Error.UnknownMethod: No such method"),
+			token:       makeJWTToken(map[string]interface{}{"iss": "Mender"}),
+			err:         true,
+		},
+		"no GetIdentity, no token": {
+			identityErr: errors.New("GDBus.Error:org.freedesktop.DBus.Error.UnknownMethod: No such method"),
+			tokenErr:    errors.New("GDBus.Error:org.freedesktop.DBus.Error.AccessDenied: denied"),
+			err:         true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			identityResponse := &dbus_mocks.DBusCallResponse{}
+			defer identityResponse.AssertExpectations(t)
+			if tc.identityErr == nil {
+				identityResponse.On("GetString").Return(tc.identityResponse)
+			}
+			dbusAPI.On("BusProxyCall",
+				dbus.Handle(nil),
+				DBusMethodNameGetIdentity,
+				nil,
+				DBusMethodTimeoutInSeconds,
+			).Return(identityResponse, tc.identityErr)
+
+			//the JWT token is asked only without the identity
+			if tc.token != "" || tc.tokenErr != nil {
+				tokenResponse := &dbus_mocks.DBusCallResponse{}
+				defer tokenResponse.AssertExpectations(t)
+				if tc.tokenErr == nil {
+					tokenResponse.On("GetString").Return(tc.token)
+				}
+				dbusAPI.On("BusProxyCall",
+					dbus.Handle(nil),
+					DBusMethodNameGetJwtToken,
+					nil,
+					DBusMethodTimeoutInSeconds,
+				).Return(tokenResponse, tc.tokenErr)
+			}
+
+			client, err := NewAuthClient(dbusAPI)
+			assert.NoError(t, err)
+
+			identity, err := client.GetDeviceIdentity()
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.identity, identity)
+		})
+	}
+}
+
+func TestAuthClientDBusDisconnected(t *testing.T) {
+	testCases := map[string]struct {
+		busProxyCallError error
+		disconnected      bool
+	}{
+		"disconnected": {
+			busProxyCallError: errors.New("The connection is closed"),
+			disconnected:      true,
+		},
+		"no reply": {
+			busProxyCallError: errors.New("GDBus.Error:org.freedesktop.DBus.Error.NoReply: no reply"),
+		},
+		"other error": {
+			busProxyCallError: errors.New("error"),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			dbusAPI.On("BusProxyCall",
+				dbus.Handle(nil),
+				DBusMethodNameGetJwtToken,
+				nil,
+				DBusMethodTimeoutInSeconds,
+			).Return(nil, tc.busProxyCallError)
+
+			client, err := NewAuthClient(dbusAPI)
+			assert.NoError(t, err)
+
+			_, err = client.GetJWTToken()
+			assert.Error(t, err)
+			assert.Equal(t, tc.disconnected, errors.Is(err, ErrDBusDisconnected))
+		})
+	}
+}
+
+func TestAuthClientReconnect(t *testing.T) {
+	dbusAPI := &dbus_mocks.DBusAPI{}
+	defer dbusAPI.AssertExpectations(t)
+
+	client, err := NewAuthClient(dbusAPI)
+	assert.NoError(t, err)
+
+	err = client.Reconnect()
+	assert.Error(t, err)
+
+	dbusAPI.On("BusGet",
+		uint(dbus.GBusTypeSystem),
+	).Return(dbus.Handle(nil), nil).Twice()
+	dbusAPI.On("BusProxyNew",
+		dbus.Handle(nil),
+		DBusObjectName,
+		DBusObjectPath,
+		DBusInterfaceName,
+	).Return(dbus.Handle(nil), nil).Twice()
+
+	err = client.Connect(DBusObjectName, DBusObjectPath, DBusInterfaceName)
+	assert.NoError(t, err)
+
+	err = client.Reconnect()
+	assert.NoError(t, err)
+}
+
+func TestAuthClientDisconnectWhileCalling(t *testing.T) {
+	dbusAPI := &dbus_mocks.DBusAPI{}
+
+	dbusAPI.On("BusGet",
+		uint(dbus.GBusTypeSystem),
+	).Return(dbus.Handle(nil), nil)
+	dbusAPI.On("BusProxyNew",
+		dbus.Handle(nil),
+		DBusObjectName,
+		DBusObjectPath,
+		DBusInterfaceName,
+	).Return(dbus.Handle(nil), nil)
+	dbusAPI.On("BusProxyCall",
+		dbus.Handle(nil),
+		DBusMethodNameGetJwtToken,
+		nil,
+		DBusMethodTimeoutInSeconds,
+	).Return(nil, errors.New("error"))
+
+	client, err := NewAuthClient(dbusAPI)
+	assert.NoError(t, err)
+	err = client.Connect(DBusObjectName, DBusObjectPath, DBusInterfaceName)
+	assert.NoError(t, err)
+
+	//the token refresh calls the methods while the main loop reconnects
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			assert.NoError(t, client.Disconnect())
+			assert.NoError(t, client.Reconnect())
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		_, err := client.GetJWTToken()
+		assert.Error(t, err)
+	}
+}
+
+func TestAuthClientWaitForValidJWTTokenAvailableContext(t *testing.T) {
+	dbusAPI := &dbus_mocks.DBusAPI{}
+	defer dbusAPI.AssertExpectations(t)
+
+	dbusAPI.On("WaitForSignalContext",
+		mock.Anything,
+		DBusSignalNameValidJwtTokenAvailable,
+	).Return(func(ctx context.Context, signalName string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	client, err := NewAuthClient(dbusAPI)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = client.WaitForValidJWTTokenAvailableContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestAuthClientWaitForAuthManager(t *testing.T) {
+	defer func(interval time.Duration) {
+		authManagerPollInterval = interval
+	}(authManagerPollInterval)
+	authManagerPollInterval = time.Millisecond
+
+	testCases := map[string]struct {
+		notOwnedPolls int
+		timeout       time.Duration
+		err           error
+	}{
+		"owned": {
+			timeout: time.Second,
+		},
+		"owned after some polls": {
+			notOwnedPolls: 3,
+			timeout:       time.Second,
+		},
+		"timeout": {
+			notOwnedPolls: -1,
+			timeout:       20 * time.Millisecond,
+			err:           context.DeadlineExceeded,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			if tc.notOwnedPolls < 0 {
+				dbusAPI.On("BusProxyGetNameOwner", mock.Anything).Return("")
+			} else {
+				if tc.notOwnedPolls > 0 {
+					dbusAPI.On("BusProxyGetNameOwner", mock.Anything).Return("").Times(tc.notOwnedPolls)
+				}
+				dbusAPI.On("BusProxyGetNameOwner", mock.Anything).Return(":1.42").Once()
+			}
+
+			client, err := NewAuthClient(dbusAPI)
+			assert.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), tc.timeout)
+			defer cancel()
+			err = client.WaitForAuthManager(ctx)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+}
+
+func TestAuthClientConnectWithBus(t *testing.T) {
+	testCases := map[string]struct {
+		busType uint
+	}{
+		"system bus": {
+			busType: dbus.GBusTypeSystem,
+		},
+		"session bus": {
+			busType: dbus.GBusTypeSession,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			dbusAPI.On("BusGet",
+				tc.busType,
+			).Return(dbus.Handle(nil), nil).Twice()
+			dbusAPI.On("BusProxyNew",
+				dbus.Handle(nil),
+				DBusObjectName,
+				DBusObjectPath,
+				DBusInterfaceName,
+			).Return(dbus.Handle(nil), nil).Twice()
+
+			client, err := NewAuthClient(dbusAPI)
+			assert.NoError(t, err)
+
+			err = client.ConnectWithBus(tc.busType, DBusObjectName, DBusObjectPath, DBusInterfaceName)
+			assert.NoError(t, err)
+
+			// reconnect uses the same bus
+			err = client.Reconnect()
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestGetCachedOrFreshJWTToken(t *testing.T) {
+	validToken := makeJWTToken(map[string]interface{}{
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	expiredToken := makeJWTToken(map[string]interface{}{
+		"exp": time.Now().Add(-time.Hour).Unix(),
+	})
+
+	testCases := map[string]struct {
+		cachedToken string
+		res         string
+		resErr      bool
+	}{
+		"ok, cached token": {
+			cachedToken: validToken,
+			res:         validToken,
+		},
+		"ko, cached token expired": {
+			cachedToken: expiredToken,
+			resErr:      true,
+		},
+		"ko, no cached token": {
+			resErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			if tc.cachedToken != "" {
+				response := &dbus_mocks.DBusCallResponse{}
+				response.On("GetString").Return(tc.cachedToken)
+				dbusAPI.On("BusProxyCall",
+					dbus.Handle(nil),
+					DBusMethodNameGetJwtToken,
+					nil,
+					DBusMethodTimeoutInSeconds,
+				).Return(response, nil).Once()
+			}
+			dbusAPI.On("BusProxyCall",
+				dbus.Handle(nil),
+				DBusMethodNameGetJwtToken,
+				nil,
+				DBusMethodTimeoutInSeconds,
+			).Return(nil, errors.New("The name is not activatable"))
+
+			client, err := NewAuthClient(dbusAPI)
+			assert.NoError(t, err)
+
+			if tc.cachedToken != "" {
+				token, err := client.GetCachedOrFreshJWTToken()
+				assert.NoError(t, err)
+				assert.Equal(t, tc.cachedToken, token)
+			}
+
+			// the GetJWTToken calls fail from now on
+			_, err = client.GetJWTToken()
+			assert.Error(t, err)
+
+			res, err := client.GetCachedOrFreshJWTToken()
+			assert.Equal(t, tc.res, res)
+			if tc.resErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestFetchAndGetJWTTokenOnTokenRefreshed(t *testing.T) {
+	response := &dbus_mocks.DBusCallResponse{}
+	defer response.AssertExpectations(t)
+	response.On("GetBoolean").Return(true)
+	response.On("GetString").Return("token")
+
+	dbusAPI := &dbus_mocks.DBusAPI{}
+	defer dbusAPI.AssertExpectations(t)
+
+	dbusAPI.On("BusProxyCall",
+		dbus.Handle(nil),
+		DBusMethodNameFetchJwtToken,
+		nil,
+		DBusMethodTimeoutInSeconds,
+	).Return(response, nil)
+	dbusAPI.On("WaitForSignalContext",
+		mock.Anything,
+		DBusSignalNameValidJwtTokenAvailable,
+	).Return(nil)
+	dbusAPI.On("BusProxyCall",
+		dbus.Handle(nil),
+		DBusMethodNameGetJwtToken,
+		nil,
+		DBusMethodTimeoutInSeconds,
+	).Return(response, nil)
+
+	refreshed := make(chan string, 1)
+	client, err := NewAuthClient(dbusAPI, WithOnTokenRefreshed(func(token string, fetchedAt time.Time) {
+		assert.False(t, fetchedAt.IsZero())
+		refreshed <- token
+	}))
+	assert.NoError(t, err)
+
+	res, err := client.FetchAndGetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token", res)
+
+	select {
+	case token := <-refreshed:
+		assert.Equal(t, "token", token)
+	case <-time.After(time.Second):
+		assert.Fail(t, "OnTokenRefreshed not called")
+	}
+}
+
+func TestFetchAndGetJWTTokenOnTokenFetched(t *testing.T) {
+	response := &dbus_mocks.DBusCallResponse{}
+	defer response.AssertExpectations(t)
+	response.On("GetBoolean").Return(true)
+	response.On("GetString").Return("token")
+
+	dbusAPI := &dbus_mocks.DBusAPI{}
+	defer dbusAPI.AssertExpectations(t)
+
+	dbusAPI.On("BusProxyCall",
+		dbus.Handle(nil),
+		DBusMethodNameFetchJwtToken,
+		nil,
+		DBusMethodTimeoutInSeconds,
+	).Return(response, nil)
+	dbusAPI.On("WaitForSignalContext",
+		mock.Anything,
+		DBusSignalNameValidJwtTokenAvailable,
+	).Return(func(ctx context.Context, name string) error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}).Once()
+	dbusAPI.On("WaitForSignalContext",
+		mock.Anything,
+		DBusSignalNameValidJwtTokenAvailable,
+	).Return(errors.New("timeout")).Once()
+	dbusAPI.On("BusProxyCall",
+		dbus.Handle(nil),
+		DBusMethodNameGetJwtToken,
+		nil,
+		DBusMethodTimeoutInSeconds,
+	).Return(response, nil)
+
+	var durations []time.Duration
+	var errs []error
+	client, err := NewAuthClient(dbusAPI, WithOnTokenFetched(func(duration time.Duration, err error) {
+		durations = append(durations, duration)
+		errs = append(errs, err)
+	}))
+	assert.NoError(t, err)
+
+	_, err = client.FetchAndGetJWTToken()
+	assert.NoError(t, err)
+	_, err = client.FetchAndGetJWTToken()
+	assert.Error(t, err)
+
+	if assert.Len(t, durations, 2) {
+		assert.True(t, durations[0] >= 10*time.Millisecond)
+		assert.NoError(t, errs[0])
+		assert.EqualError(t, errs[1], "timeout")
+	}
+}
+
+func TestAuthClientGetJWTTokenVerificationKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	response := &dbus_mocks.DBusCallResponse{}
+	response.On("GetString").Return(makeJWTToken(map[string]interface{}{"sub": "device"}))
+
+	dbusAPI := &dbus_mocks.DBusAPI{}
+	dbusAPI.On("BusProxyCall",
+		dbus.Handle(nil),
+		DBusMethodNameGetJwtToken,
+		nil,
+		DBusMethodTimeoutInSeconds,
+	).Return(response, nil)
+
+	client, err := NewAuthClient(dbusAPI)
+	assert.NoError(t, err)
+
+	// no key set, no verification
+	_, err = client.GetJWTToken()
+	assert.NoError(t, err)
+
+	client.SetVerificationKey(key.Public())
+	_, err = client.GetJWTToken()
+	assert.Equal(t, ErrTokenSignatureInvalid, err)
+}
+
+func TestAuthClientCallSequence(t *testing.T) {
+	response := &dbus_mocks.DBusCallResponse{}
+	response.On("GetBoolean").Return(true)
+	response.On("GetString").Return("token")
+
+	dbusAPI := &dbus_mocks.DBusAPI{}
+	dbusAPI.On("BusGet", uint(dbus.GBusTypeSystem)).Return(dbus.Handle(nil), nil)
+	dbusAPI.On("BusProxyNew",
+		dbus.Handle(nil),
+		DBusObjectName,
+		DBusObjectPath,
+		DBusInterfaceName,
+	).Return(dbus.Handle(nil), nil)
+	dbusAPI.On("BusProxyCall",
+		dbus.Handle(nil),
+		mock.AnythingOfType("string"),
+		nil,
+		DBusMethodTimeoutInSeconds,
+	).Return(response, nil)
+	dbusAPI.On("WaitForSignalContext",
+		mock.Anything,
+		DBusSignalNameValidJwtTokenAvailable,
+	).Return(nil)
+
+	recordingAPI := dbustest.NewRecordingAPI(dbusAPI)
+	client, err := NewAuthClient(recordingAPI)
+	assert.NoError(t, err)
+
+	err = client.Connect(DBusObjectName, DBusObjectPath, DBusInterfaceName)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"BusGet", "BusProxyNew"}, recordingAPI.Methods())
+
+	recordingAPI.Reset()
+	_, err = client.FetchAndGetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"BusProxyCall",
+		"WaitForSignalContext",
+		"BusProxyCall",
+	}, recordingAPI.Methods())
+
+	calls := recordingAPI.Calls()
+	assert.Equal(t, DBusMethodNameFetchJwtToken, calls[0].Args[1])
+	assert.Equal(t, DBusMethodNameGetJwtToken, calls[2].Args[1])
+}
+
+func TestAuthClientFetchJWTTokenForServer(t *testing.T) {
+	testCases := map[string]struct {
+		serverURL string
+		params    interface{}
+	}{
+		"with server": {
+			serverURL: "https://hosted.mender.io",
+			params:    "https://hosted.mender.io",
+		},
+		"without server": {
+			params: nil,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			response := &dbus_mocks.DBusCallResponse{}
+			defer response.AssertExpectations(t)
+			response.On("GetBoolean").Return(true)
+
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			dbusAPI.On("BusProxyCall",
+				dbus.Handle(nil),
+				DBusMethodNameFetchJwtToken,
+				tc.params,
+				DBusMethodTimeoutInSeconds,
+			).Return(response, nil)
+
+			client, err := NewAuthClient(dbusAPI)
+			assert.NoError(t, err)
+
+			value, err := client.FetchJWTTokenForServer(tc.serverURL)
+			assert.NoError(t, err)
+			assert.True(t, value)
+		})
+	}
+}
+
+func TestAuthClientDisconnect(t *testing.T) {
+	var conn, proxy int
+	connHandle := dbus.Handle(unsafe.Pointer(&conn))
+	proxyHandle := dbus.Handle(unsafe.Pointer(&proxy))
+
+	dbusAPI := &dbus_mocks.DBusAPI{}
+	defer dbusAPI.AssertExpectations(t)
+
+	dbusAPI.On("BusGet", uint(dbus.GBusTypeSystem)).Return(connHandle, nil)
+	dbusAPI.On("BusProxyNew",
+		connHandle,
+		DBusObjectName,
+		DBusObjectPath,
+		DBusInterfaceName,
+	).Return(proxyHandle, nil)
+	dbusAPI.On("ObjectUnref", proxyHandle).Once()
+	dbusAPI.On("ObjectUnref", connHandle).Once()
+
+	client, err := NewAuthClient(dbusAPI)
+	assert.NoError(t, err)
+
+	err = client.Connect(DBusObjectName, DBusObjectPath, DBusInterfaceName)
+	assert.NoError(t, err)
+
+	err = client.Disconnect()
+	assert.NoError(t, err)
+
+	// safe to call twice
+	err = client.Disconnect()
+	assert.NoError(t, err)
+
+	_, err = client.GetJWTToken()
+	assert.Equal(t, ErrAuthClientDisconnected, err)
+	_, err = client.FetchJWTToken()
+	assert.Equal(t, ErrAuthClientDisconnected, err)
+}
+
+type callResponseWithDetail struct {
+	dbus_mocks.DBusCallResponse
+	detail string
+}
+
+func (r *callResponseWithDetail) GetDetail() string {
+	return r.detail
+}
+
+func TestAuthClientFetchJWTTokenDeclined(t *testing.T) {
+	testCases := map[string]struct {
+		detail string
+		err    string
+	}{
+		"with detail": {
+			detail: "device not authorized yet",
+			err:    "FetchJwtToken scheduling was declined: device not authorized yet",
+		},
+		"without detail": {},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			response := &callResponseWithDetail{detail: tc.detail}
+			response.On("GetBoolean").Return(false)
+
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			dbusAPI.On("BusProxyCall",
+				dbus.Handle(nil),
+				DBusMethodNameFetchJwtToken,
+				nil,
+				DBusMethodTimeoutInSeconds,
+			).Return(response, nil)
+
+			client, err := NewAuthClient(dbusAPI)
+			assert.NoError(t, err)
+
+			fetch, err := client.FetchJWTToken()
+			assert.False(t, fetch)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				assert.True(t, errors.Is(err, errFetchTokenFailed))
+			} else {
+				assert.NoError(t, err)
+			}
+
+			_, err = client.FetchAndGetJWTToken()
+			assert.True(t, errors.Is(err, errFetchTokenFailed))
+		})
+	}
+}
+
+type callResponseWithType struct {
+	dbus_mocks.DBusCallResponse
+	signature string
+}
+
+func (r *callResponseWithType) Type() string {
+	return r.signature
+}
+
+func TestAuthClientUnexpectedDBusType(t *testing.T) {
+	testCases := map[string]struct {
+		method    string
+		signature string
+		call      func(client AuthClient) error
+		err       string
+	}{
+		"token": {
+			method:    DBusMethodNameGetJwtToken,
+			signature: "(s)",
+			call: func(client AuthClient) error {
+				_, err := client.GetJWTToken()
+				return err
+			},
+		},
+		"token with the server URL": {
+			method:    DBusMethodNameGetJwtToken,
+			signature: "(ss)",
+			call: func(client AuthClient) error {
+				_, err := client.GetJWTToken()
+				return err
+			},
+		},
+		"token, wrong type": {
+			method:    DBusMethodNameGetJwtToken,
+			signature: "(b)",
+			call: func(client AuthClient) error {
+				_, err := client.GetJWTToken()
+				return err
+			},
+			err: "unexpected DBus type: GetJwtToken returned (b), expected (s)",
+		},
+		"fetch": {
+			method:    DBusMethodNameFetchJwtToken,
+			signature: "(b)",
+			call: func(client AuthClient) error {
+				_, err := client.FetchJWTToken()
+				return err
+			},
+		},
+		"fetch, wrong type": {
+			method:    DBusMethodNameFetchJwtToken,
+			signature: "(s)",
+			call: func(client AuthClient) error {
+				_, err := client.FetchJWTToken()
+				return err
+			},
+			err: "unexpected DBus type: FetchJwtToken returned (s), expected (b)",
+		},
+		"fetch, no value": {
+			method:    DBusMethodNameFetchJwtToken,
+			signature: "()",
+			call: func(client AuthClient) error {
+				_, err := client.FetchJWTToken()
+				return err
+			},
+			err: "unexpected DBus type: FetchJwtToken returned (), expected (b)",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			response := &callResponseWithType{signature: tc.signature}
+			if tc.err == "" {
+				response.On("GetString").Return("value")
+				response.On("GetBoolean").Return(true)
+			}
+
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			dbusAPI.On("BusProxyCall",
+				dbus.Handle(nil),
+				tc.method,
+				nil,
+				DBusMethodTimeoutInSeconds,
+			).Return(response, nil)
+
+			client, err := NewAuthClient(dbusAPI)
+			assert.NoError(t, err)
+
+			err = tc.call(client)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				assert.True(t, errors.Is(err, ErrUnexpectedDBusType))
+				//the values of the wrong type are not read
+				response.AssertNotCalled(t, "GetString")
+				response.AssertNotCalled(t, "GetBoolean")
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
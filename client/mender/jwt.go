@@ -0,0 +1,201 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mender
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	jwtAlgorithmRS256    = "RS256"
+	jwtAlgorithmES256    = "ES256"
+	jwtClaimExpiration   = "exp"
+	jwtClaimIssuer       = "iss"
+	jwtClaimMenderServer = "mender.server"
+	jwtClaimSubject      = "sub"
+)
+
+var (
+	// ErrNoServerInToken is returned when the JWT token carries no server URL
+	ErrNoServerInToken = errors.New("no server URL in the JWT token")
+	// ErrTokenSignatureInvalid is returned when the JWT token signature
+	// can't be verified against the verification key
+	ErrTokenSignatureInvalid = errors.New("invalid JWT token signature")
+	// ErrNoSubjectInToken is returned when the JWT token carries no subject
+	ErrNoSubjectInToken = errors.New("no sub claim in the JWT token")
+	// ErrNoClaimInToken is returned when the JWT token does not carry the
+	// requested claim as a string
+	ErrNoClaimInToken = errors.New("claim not in the JWT token")
+
+	errMalformedJWTToken = errors.New("malformed JWT token")
+	errNoExpInJWTToken   = errors.New("JWT token has no exp claim")
+)
+
+// decodeJWTClaims decodes the payload of a JWT token, the signature
+// is not verified
+func decodeJWTClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedJWTToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, errMalformedJWTToken
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errMalformedJWTToken
+	}
+	return claims, nil
+}
+
+// getJWTTokenExpiration returns the expiration time of a JWT token
+func getJWTTokenExpiration(token string) (time.Time, error) {
+	claims, err := decodeJWTClaims(token)
+	if err != nil {
+		return time.Time{}, err
+	}
+	exp, ok := claims[jwtClaimExpiration].(float64)
+	if !ok {
+		return time.Time{}, errNoExpInJWTToken
+	}
+	return time.Unix(int64(exp), 0), nil
+}
+
+// GetJWTTokenServerURL returns the server URL the JWT token was issued for,
+// taken from the mender.server claim or, if absent, the iss claim
+func GetJWTTokenServerURL(token string) (string, error) {
+	claims, err := decodeJWTClaims(token)
+	if err != nil {
+		return "", err
+	}
+	for _, claim := range []string{jwtClaimMenderServer, jwtClaimIssuer} {
+		if serverURL, ok := claims[claim].(string); ok && serverURL != "" {
+			return serverURL, nil
+		}
+	}
+	return "", ErrNoServerInToken
+}
+
+// GetJWTTokenSubject returns the subject (sub claim) of the JWT token, the
+// signature is not verified
+func GetJWTTokenSubject(token string) (string, error) {
+	subject, err := GetJWTTokenClaim(token, jwtClaimSubject)
+	if err == ErrNoClaimInToken {
+		return "", ErrNoSubjectInToken
+	}
+	return subject, err
+}
+
+// getJWTTokenIdentity returns the device identity carried by the JWT token:
+// its subject, which is the Mender device id, as IdentityDeviceID
+func getJWTTokenIdentity(token string) (map[string]string, error) {
+	deviceID, err := GetJWTTokenSubject(token)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{IdentityDeviceID: deviceID}, nil
+}
+
+// GetJWTTokenClaims returns all the claims of the JWT token, as decoded from
+// JSON; the signature is not verified
+func GetJWTTokenClaims(token string) (map[string]interface{}, error) {
+	return decodeJWTClaims(token)
+}
+
+// GetJWTTokenClaim returns the value of the string claim of the JWT token,
+// e.g.: "sub" or "mender.user"; the signature is not verified
+func GetJWTTokenClaim(token string, claim string) (string, error) {
+	claims, err := decodeJWTClaims(token)
+	if err != nil {
+		return "", err
+	}
+	if value, ok := claims[claim].(string); ok && value != "" {
+		return value, nil
+	}
+	return "", ErrNoClaimInToken
+}
+
+// verifyJWTTokenSignature verifies the signature of a RS256 or ES256
+// JWT token against the given public key
+func verifyJWTTokenSignature(token string, key crypto.PublicKey) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrTokenSignatureInvalid
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return ErrTokenSignatureInvalid
+	}
+	header := struct {
+		Alg string `json:"alg"`
+	}{}
+	if err := json.Unmarshal(headerData, &header); err != nil {
+		return ErrTokenSignatureInvalid
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[2], "="))
+	if err != nil {
+		return ErrTokenSignatureInvalid
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != jwtAlgorithmRS256 {
+			return ErrTokenSignatureInvalid
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature) != nil {
+			return ErrTokenSignatureInvalid
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != jwtAlgorithmES256 || len(signature) != 64 {
+			return ErrTokenSignatureInvalid
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, hash[:], r, s) {
+			return ErrTokenSignatureInvalid
+		}
+	default:
+		return errors.New("unsupported JWT verification key type")
+	}
+	return nil
+}
+
+// LoadVerificationKey loads a PEM encoded public key used to verify
+// the JWT token signatures
+func LoadVerificationKey(path string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in " + path)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
@@ -0,0 +1,242 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mender
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeJWTToken(claims map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+func TestGetJWTTokenExpiration(t *testing.T) {
+	testCases := map[string]struct {
+		token string
+		exp   time.Time
+		err   error
+	}{
+		"ok": {
+			token: makeJWTToken(map[string]interface{}{"exp": 1600000000}),
+			exp:   time.Unix(1600000000, 0),
+		},
+		"ko, no exp": {
+			token: makeJWTToken(map[string]interface{}{"sub": "device"}),
+			err:   errNoExpInJWTToken,
+		},
+		"ko, malformed": {
+			token: "not-a-token",
+			err:   errMalformedJWTToken,
+		},
+		"ko, bad payload": {
+			token: "header.!!!.signature",
+			err:   errMalformedJWTToken,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			exp, err := getJWTTokenExpiration(tc.token)
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.exp, exp)
+		})
+	}
+}
+
+func TestGetJWTTokenServerURL(t *testing.T) {
+	testCases := map[string]struct {
+		token     string
+		serverURL string
+		err       error
+	}{
+		"ok, mender.server": {
+			token: makeJWTToken(map[string]interface{}{
+				"iss":           "Mender",
+				"mender.server": "https://hosted.mender.io",
+			}),
+			serverURL: "https://hosted.mender.io",
+		},
+		"ok, iss": {
+			token:     makeJWTToken(map[string]interface{}{"iss": "https://docker.mender.io"}),
+			serverURL: "https://docker.mender.io",
+		},
+		"ko, no server": {
+			token: makeJWTToken(map[string]interface{}{"sub": "device"}),
+			err:   ErrNoServerInToken,
+		},
+		"ko, malformed": {
+			token: "not-a-token",
+			err:   errMalformedJWTToken,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			serverURL, err := GetJWTTokenServerURL(tc.token)
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.serverURL, serverURL)
+		})
+	}
+}
+
+func TestGetJWTTokenSubject(t *testing.T) {
+	testCases := map[string]struct {
+		token   string
+		subject string
+		err     error
+	}{
+		"ok": {
+			token:   makeJWTToken(map[string]interface{}{"sub": "1b9c1a2e-7f63-4b0e-9f8a-3d5e8c2b1a70"}),
+			subject: "1b9c1a2e-7f63-4b0e-9f8a-3d5e8c2b1a70",
+		},
+		"ko, no subject": {
+			token: makeJWTToken(map[string]interface{}{"iss": "Mender"}),
+			err:   ErrNoSubjectInToken,
+		},
+		"ko, malformed": {
+			token: "not-a-token",
+			err:   errMalformedJWTToken,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			subject, err := GetJWTTokenSubject(tc.token)
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.subject, subject)
+		})
+	}
+}
+
+func TestGetJWTTokenClaim(t *testing.T) {
+	testCases := map[string]struct {
+		token string
+		claim string
+		value string
+		err   error
+	}{
+		"ok": {
+			token: makeJWTToken(map[string]interface{}{"sub": "device", "mender.user": "operator@example.com"}),
+			claim: "mender.user",
+			value: "operator@example.com",
+		},
+		"ko, no claim": {
+			token: makeJWTToken(map[string]interface{}{"sub": "device"}),
+			claim: "mender.user",
+			err:   ErrNoClaimInToken,
+		},
+		"ko, not a string": {
+			token: makeJWTToken(map[string]interface{}{"mender.user": 42}),
+			claim: "mender.user",
+			err:   ErrNoClaimInToken,
+		},
+		"ko, malformed": {
+			token: "not-a-token",
+			claim: "sub",
+			err:   errMalformedJWTToken,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			value, err := GetJWTTokenClaim(tc.token, tc.claim)
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.value, value)
+		})
+	}
+}
+
+func signJWTToken(t *testing.T, alg string, claims map[string]interface{}, key crypto.Signer) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `","typ":"JWT"}`))
+	payload, _ := json.Marshal(claims)
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		assert.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, hash[:])
+		assert.NoError(t, err)
+		signature = make([]byte, 64)
+		rb, sb := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rb):32], rb)
+		copy(signature[64-len(sb):], sb)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyJWTTokenSignature(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	claims := map[string]interface{}{"sub": "device"}
+	testCases := map[string]struct {
+		token string
+		key   crypto.PublicKey
+		err   error
+	}{
+		"ok, RS256": {
+			token: signJWTToken(t, jwtAlgorithmRS256, claims, rsaKey),
+			key:   rsaKey.Public(),
+		},
+		"ok, ES256": {
+			token: signJWTToken(t, jwtAlgorithmES256, claims, ecKey),
+			key:   ecKey.Public(),
+		},
+		"ko, RS256 wrong key": {
+			token: signJWTToken(t, jwtAlgorithmRS256, claims, otherRSAKey),
+			key:   rsaKey.Public(),
+			err:   ErrTokenSignatureInvalid,
+		},
+		"ko, algorithm mismatch": {
+			token: signJWTToken(t, jwtAlgorithmES256, claims, ecKey),
+			key:   rsaKey.Public(),
+			err:   ErrTokenSignatureInvalid,
+		},
+		"ko, unsigned": {
+			token: makeJWTToken(claims),
+			key:   ecKey.Public(),
+			err:   ErrTokenSignatureInvalid,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := verifyJWTTokenSignature(tc.token, tc.key)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+}
@@ -16,7 +16,15 @@
 
 package mocks
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	context "context"
+
+	crypto "crypto"
+
+	mock "github.com/stretchr/testify/mock"
+
+	time "time"
+)
 
 // AuthClient is an autogenerated mock type for the AuthClient type
 type AuthClient struct {
@@ -37,6 +45,34 @@ func (_m *AuthClient) Connect(objectName string, objectPath string, interfaceNam
 	return r0
 }
 
+// ConnectWithBus provides a mock function with given fields: busType, objectName, objectPath, interfaceName
+func (_m *AuthClient) ConnectWithBus(busType uint, objectName string, objectPath string, interfaceName string) error {
+	ret := _m.Called(busType, objectName, objectPath, interfaceName)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(uint, string, string, string) error); ok {
+		r0 = rf(busType, objectName, objectPath, interfaceName)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Disconnect provides a mock function with given fields:
+func (_m *AuthClient) Disconnect() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // FetchAndGetJWTToken provides a mock function with given fields:
 func (_m *AuthClient) FetchAndGetJWTToken() (string, error) {
 	ret := _m.Called()
@@ -58,6 +94,27 @@ func (_m *AuthClient) FetchAndGetJWTToken() (string, error) {
 	return r0, r1
 }
 
+// FetchAndGetJWTTokenWithRetry provides a mock function with given fields: ctx, attempts, initialBackoff
+func (_m *AuthClient) FetchAndGetJWTTokenWithRetry(ctx context.Context, attempts int, initialBackoff time.Duration) (string, error) {
+	ret := _m.Called(ctx, attempts, initialBackoff)
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func(context.Context, int, time.Duration) string); ok {
+		r0 = rf(ctx, attempts, initialBackoff)
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, int, time.Duration) error); ok {
+		r1 = rf(ctx, attempts, initialBackoff)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // FetchJWTToken provides a mock function with given fields:
 func (_m *AuthClient) FetchJWTToken() (bool, error) {
 	ret := _m.Called()
@@ -79,6 +136,71 @@ func (_m *AuthClient) FetchJWTToken() (bool, error) {
 	return r0, r1
 }
 
+// FetchJWTTokenForServer provides a mock function with given fields: serverURL
+func (_m *AuthClient) FetchJWTTokenForServer(serverURL string) (bool, error) {
+	ret := _m.Called(serverURL)
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string) bool); ok {
+		r0 = rf(serverURL)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(string) error); ok {
+		r1 = rf(serverURL)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetCachedOrFreshJWTToken provides a mock function with given fields:
+func (_m *AuthClient) GetCachedOrFreshJWTToken() (string, error) {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// GetDeviceIdentity provides a mock function with given fields:
+func (_m *AuthClient) GetDeviceIdentity() (map[string]string, error) {
+	ret := _m.Called()
+
+	var r0 map[string]string
+	if rf, ok := ret.Get(0).(func() map[string]string); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]string)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // GetJWTToken provides a mock function with given fields:
 func (_m *AuthClient) GetJWTToken() (string, error) {
 	ret := _m.Called()
@@ -100,6 +222,118 @@ func (_m *AuthClient) GetJWTToken() (string, error) {
 	return r0, r1
 }
 
+// GetServerURL provides a mock function with given fields:
+func (_m *AuthClient) GetServerURL() (string, error) {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Reconnect provides a mock function with given fields:
+func (_m *AuthClient) Reconnect() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// Refresh provides a mock function with given fields:
+func (_m *AuthClient) Refresh() (string, error) {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// SetVerificationKey provides a mock function with given fields: key
+func (_m *AuthClient) SetVerificationKey(key crypto.PublicKey) {
+	_m.Called(key)
+}
+
+// StartTokenRefresh provides a mock function with given fields: ctx, leeway
+func (_m *AuthClient) StartTokenRefresh(ctx context.Context, leeway time.Duration) <-chan string {
+	ret := _m.Called(ctx, leeway)
+
+	var r0 <-chan string
+	if rf, ok := ret.Get(0).(func(context.Context, time.Duration) <-chan string); ok {
+		r0 = rf(ctx, leeway)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(<-chan string)
+		}
+	}
+
+	return r0
+}
+
+// Token provides a mock function with given fields:
+func (_m *AuthClient) Token() (string, error) {
+	ret := _m.Called()
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// WaitForAuthManager provides a mock function with given fields: ctx
+func (_m *AuthClient) WaitForAuthManager(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // WaitForValidJWTTokenAvailable provides a mock function with given fields:
 func (_m *AuthClient) WaitForValidJWTTokenAvailable() error {
 	ret := _m.Called()
@@ -113,3 +347,17 @@ func (_m *AuthClient) WaitForValidJWTTokenAvailable() error {
 
 	return r0
 }
+
+// WaitForValidJWTTokenAvailableContext provides a mock function with given fields: ctx
+func (_m *AuthClient) WaitForValidJWTTokenAvailableContext(ctx context.Context) error {
+	ret := _m.Called(ctx)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(context.Context) error); ok {
+		r0 = rf(ctx)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
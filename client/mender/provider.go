@@ -0,0 +1,46 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package mender
+
+import "errors"
+
+// ErrUnauthorized is returned by the TokenProvider Refresh when the server
+// rejected the device, e.g.: with a 401; unlike the transient errors,
+// retrying does not help
+var ErrUnauthorized = errors.New("the device is not authorized")
+
+// TokenProvider provides the device JWT tokens mender-shell authenticates
+// to the server with; the AuthClient implementations get them from the
+// Mender Authentication Manager, or from a static token, and others can
+// get them from anywhere else, e.g.: a secure element
+type TokenProvider interface {
+	// Token returns the current device JWT token; "" with no error if
+	// the device is not authorized
+	Token() (string, error)
+	// Refresh gets a new device JWT token and returns it; "" with no
+	// error, or ErrUnauthorized, if the device is not authorized
+	Refresh() (string, error)
+}
+
+// IdentityDeviceID is the device identity attribute holding the Mender
+// device id
+const IdentityDeviceID = "device_id"
+
+// DeviceIdentityProvider provides the identity of the device, which the
+// server can correlate the sessions with on top of the JWT token
+type DeviceIdentityProvider interface {
+	// GetDeviceIdentity returns the identity attributes of the device,
+	// with at least IdentityDeviceID
+	GetDeviceIdentity() (map[string]string, error)
+}
@@ -0,0 +1,260 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mender
+
+import (
+	"context"
+	"crypto"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AuthClientStatic is an implementation of the AuthClient which serves a
+// static JWT token, optionally reloaded from a file; it does not need the
+// Mender Authentication Manager, nor DBus
+type AuthClientStatic struct {
+	mutex            sync.Mutex
+	token            string
+	tokenFile        string
+	tokenFileModTime time.Time
+	// closed and replaced every time the token changes
+	tokenChanged    chan struct{}
+	stopWatcher     chan struct{}
+	verificationKey crypto.PublicKey
+}
+
+// NewStaticAuthClient returns a new AuthClient serving the given token
+func NewStaticAuthClient(token string) AuthClient {
+	return &AuthClientStatic{
+		token:        token,
+		tokenChanged: make(chan struct{}),
+	}
+}
+
+// NewStaticAuthClientFromFile returns a new AuthClient serving the token read
+// from tokenFile; if watchInterval is not zero, the file is checked for
+// changes at the given interval and the token reloaded, until Disconnect()
+func NewStaticAuthClientFromFile(tokenFile string, watchInterval time.Duration) (AuthClient, error) {
+	a := &AuthClientStatic{
+		tokenFile:    tokenFile,
+		tokenChanged: make(chan struct{}),
+	}
+	if err := a.reloadTokenFile(); err != nil {
+		return nil, err
+	}
+	if watchInterval > 0 {
+		a.stopWatcher = make(chan struct{})
+		go a.watchTokenFile(watchInterval, a.stopWatcher)
+	}
+	return a, nil
+}
+
+func (a *AuthClientStatic) reloadTokenFile() error {
+	info, err := os.Stat(a.tokenFile)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	modTime := a.tokenFileModTime
+	a.mutex.Unlock()
+	if info.ModTime().Equal(modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(a.tokenFile)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.tokenFileModTime = info.ModTime()
+	token := strings.TrimSpace(string(data))
+	if token != a.token {
+		a.token = token
+		close(a.tokenChanged)
+		a.tokenChanged = make(chan struct{})
+	}
+	return nil
+}
+
+func (a *AuthClientStatic) watchTokenFile(interval time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.reloadTokenFile(); err != nil {
+				log.Errorf("failed to reload the JWT token from %s: %s", a.tokenFile, err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Connect does nothing, there is nothing to connect to
+func (a *AuthClientStatic) Connect(objectName, objectPath, interfaceName string) error {
+	return nil
+}
+
+// ConnectWithBus does nothing, there is nothing to connect to
+func (a *AuthClientStatic) ConnectWithBus(busType uint, objectName, objectPath, interfaceName string) error {
+	return nil
+}
+
+// Reconnect does nothing, there is nothing to connect to
+func (a *AuthClientStatic) Reconnect() error {
+	return nil
+}
+
+// Disconnect stops the token file watcher, if any
+func (a *AuthClientStatic) Disconnect() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.stopWatcher != nil {
+		close(a.stopWatcher)
+		a.stopWatcher = nil
+	}
+	return nil
+}
+
+// GetJWTToken returns the static JWT token
+func (a *AuthClientStatic) GetJWTToken() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.verificationKey != nil && a.token != "" {
+		if err := verifyJWTTokenSignature(a.token, a.verificationKey); err != nil {
+			return "", ErrTokenSignatureInvalid
+		}
+	}
+	return a.token, nil
+}
+
+// GetCachedOrFreshJWTToken returns the static JWT token
+func (a *AuthClientStatic) GetCachedOrFreshJWTToken() (string, error) {
+	return a.GetJWTToken()
+}
+
+// FetchJWTToken reloads the token file, if any, and returns true
+func (a *AuthClientStatic) FetchJWTToken() (bool, error) {
+	return a.FetchJWTTokenForServer("")
+}
+
+// FetchJWTTokenForServer reloads the token file, if any, and returns true
+func (a *AuthClientStatic) FetchJWTTokenForServer(serverURL string) (bool, error) {
+	if a.tokenFile != "" {
+		if err := a.reloadTokenFile(); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// WaitForValidJWTTokenAvailable returns immediately
+func (a *AuthClientStatic) WaitForValidJWTTokenAvailable() error {
+	return nil
+}
+
+// WaitForValidJWTTokenAvailableContext returns immediately
+func (a *AuthClientStatic) WaitForValidJWTTokenAvailableContext(ctx context.Context) error {
+	return nil
+}
+
+// WaitForAuthManager returns immediately
+func (a *AuthClientStatic) WaitForAuthManager(ctx context.Context) error {
+	return nil
+}
+
+// FetchAndGetJWTToken reloads the token file, if any, and returns the token
+func (a *AuthClientStatic) FetchAndGetJWTToken() (string, error) {
+	if _, err := a.FetchJWTToken(); err != nil {
+		return "", err
+	}
+	return a.GetJWTToken()
+}
+
+// Token returns the token, see GetJWTToken
+func (a *AuthClientStatic) Token() (string, error) {
+	return a.GetJWTToken()
+}
+
+// Refresh reloads the token file, if any, and returns the token
+func (a *AuthClientStatic) Refresh() (string, error) {
+	return a.FetchAndGetJWTToken()
+}
+
+// FetchAndGetJWTTokenWithRetry reloads the token file, if any, and returns the token
+func (a *AuthClientStatic) FetchAndGetJWTTokenWithRetry(ctx context.Context, attempts int, initialBackoff time.Duration) (string, error) {
+	return a.FetchAndGetJWTToken()
+}
+
+// GetServerURL returns the server URL the static JWT token was issued for
+func (a *AuthClientStatic) GetServerURL() (string, error) {
+	token, err := a.GetJWTToken()
+	if err != nil {
+		return "", err
+	}
+	return GetJWTTokenServerURL(token)
+}
+
+// GetDeviceIdentity returns the device id of the static JWT token
+func (a *AuthClientStatic) GetDeviceIdentity() (map[string]string, error) {
+	token, err := a.GetJWTToken()
+	if err != nil {
+		return nil, err
+	}
+	return getJWTTokenIdentity(token)
+}
+
+// SetVerificationKey sets the public key used to verify the JWT token
+func (a *AuthClientStatic) SetVerificationKey(key crypto.PublicKey) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.verificationKey = key
+}
+
+// StartTokenRefresh emits the token on the returned channel every time it
+// is reloaded from the token file with a new value; leeway is ignored
+func (a *AuthClientStatic) StartTokenRefresh(ctx context.Context, leeway time.Duration) <-chan string {
+	tokens := make(chan string, 1)
+	go func() {
+		defer close(tokens)
+		for {
+			a.mutex.Lock()
+			tokenChanged := a.tokenChanged
+			a.mutex.Unlock()
+			select {
+			case <-tokenChanged:
+			case <-ctx.Done():
+				return
+			}
+			token, err := a.GetJWTToken()
+			if err != nil {
+				log.Errorf("failed to refresh the JWT token: %s", err.Error())
+				continue
+			}
+			select {
+			case tokens <- token:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return tokens
+}
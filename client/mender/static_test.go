@@ -0,0 +1,113 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mender
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaticAuthClient(t *testing.T) {
+	client := NewStaticAuthClient("token")
+
+	err := client.Connect(DBusObjectName, DBusObjectPath, DBusInterfaceName)
+	assert.NoError(t, err)
+
+	token, err := client.GetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token)
+
+	fetch, err := client.FetchJWTToken()
+	assert.NoError(t, err)
+	assert.True(t, fetch)
+
+	err = client.WaitForValidJWTTokenAvailable()
+	assert.NoError(t, err)
+
+	token, err = client.FetchAndGetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token)
+
+	identity, err := client.GetDeviceIdentity()
+	assert.Error(t, err)
+	assert.Nil(t, identity)
+
+	token, err = client.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token)
+
+	token, err = client.Refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, "token", token)
+
+	err = client.Disconnect()
+	assert.NoError(t, err)
+}
+
+func TestStaticAuthClientFromFile(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	tokenFile := path.Join(tdir, "token")
+	err = ioutil.WriteFile(tokenFile, []byte("token-1\n"), 0600)
+	assert.NoError(t, err)
+
+	_, err = NewStaticAuthClientFromFile(path.Join(tdir, "does-not-exist"), 0)
+	assert.Error(t, err)
+
+	client, err := NewStaticAuthClientFromFile(tokenFile, 10*time.Millisecond)
+	assert.NoError(t, err)
+	defer client.Disconnect()
+
+	token, err := client.GetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-1", token)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tokens := client.StartTokenRefresh(ctx, 0)
+
+	// make sure the modification time changes
+	modTime := time.Now().Add(time.Second)
+	err = ioutil.WriteFile(tokenFile, []byte("token-2\n"), 0600)
+	assert.NoError(t, err)
+	err = os.Chtimes(tokenFile, modTime, modTime)
+	assert.NoError(t, err)
+
+	select {
+	case token := <-tokens:
+		assert.Equal(t, "token-2", token)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "timeout waiting for the reloaded token")
+	}
+
+	token, err = client.GetJWTToken()
+	assert.NoError(t, err)
+	assert.Equal(t, "token-2", token)
+}
+
+func TestStaticAuthClientGetDeviceIdentity(t *testing.T) {
+	client := NewStaticAuthClient(makeJWTToken(map[string]interface{}{"sub": "device-1"}))
+	identity, err := client.GetDeviceIdentity()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{IdentityDeviceID: "device-1"}, identity)
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// EnvPrefix starts the names of the environment variables overriding the
+// configuration options
+const EnvPrefix = "MENDER_SHELL_"
+
+// EnvName returns the name of the environment variable overriding the option
+// at the path of field names: EnvPrefix followed by the field names, the
+// words split at the case changes, in upper case and joined by underscores,
+// e.g.: MENDER_SHELL_SERVER_URL for ServerURL, and
+// MENDER_SHELL_SESSIONS_MAX_PER_USER for Sessions.MaxPerUser
+func EnvName(fieldPath ...string) string {
+	var words []string
+	for _, field := range fieldPath {
+		words = append(words, splitWords(field)...)
+	}
+	return EnvPrefix + strings.ToUpper(strings.Join(words, "_"))
+}
+
+//splits the CamelCase name into its words, keeping the acronyms together,
+//e.g.: HTTPSClient is HTTPS and Client
+func splitWords(name string) []string {
+	runes := []rune(name)
+	var words []string
+	start := 0
+	for i := 1; i < len(runes); i++ {
+		if !unicode.IsUpper(runes[i]) {
+			continue
+		}
+		previousLower := !unicode.IsUpper(runes[i-1])
+		nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+		if previousLower || nextLower {
+			words = append(words, string(runes[start:i]))
+			start = i
+		}
+	}
+	return append(words, string(runes[start:]))
+}
+
+// applyEnv overrides the options of the configuration with the environment
+// variables named after them, found with lookup; a number is given in
+// decimal, a boolean as true or false, a list of strings separated by
+// commas, and the other lists and the maps in JSON, e.g.:
+// MENDER_SHELL_SESSION_ENV={"LANG":"C"}
+func applyEnv(config *MenderShellConfigFromFile, lookup func(string) (string, bool)) error {
+	return applyEnvToStruct(reflect.ValueOf(config).Elem(), nil, lookup)
+}
+
+func applyEnvToStruct(value reflect.Value, path []string, lookup func(string) (string, bool)) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fieldPath := append(append([]string{}, path...), field.Name)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnvToStruct(value.Field(i), fieldPath, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		name := EnvName(fieldPath...)
+		env, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setFromEnv(value.Field(i), env); err != nil {
+			return errors.Errorf("%s: %s", name, err.Error())
+		}
+		log.Infof("%s set from the %s environment variable", strings.Join(fieldPath, "."), name)
+	}
+	return nil
+}
+
+func setFromEnv(value reflect.Value, env string) error {
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(env)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(env)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(env, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(env, 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetUint(n)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() == reflect.String {
+			var items []string
+			for _, item := range strings.Split(env, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			value.Set(reflect.ValueOf(items).Convert(value.Type()))
+			return nil
+		}
+		fallthrough
+	default:
+		parsed := reflect.New(value.Type())
+		if err := json.Unmarshal([]byte(env), parsed.Interface()); err != nil {
+			return err
+		}
+		value.Set(parsed.Elem())
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-shell/client/https"
+)
+
+func TestEnvName(t *testing.T) {
+	testCases := map[string]struct {
+		fieldPath []string
+		name      string
+	}{
+		"one word": {
+			fieldPath: []string{"User"},
+			name:      "MENDER_SHELL_USER",
+		},
+		"words": {
+			fieldPath: []string{"MaxSessions"},
+			name:      "MENDER_SHELL_MAX_SESSIONS",
+		},
+		"trailing acronym": {
+			fieldPath: []string{"ServerURL"},
+			name:      "MENDER_SHELL_SERVER_URL",
+		},
+		"leading acronym": {
+			fieldPath: []string{"HTTPSClient", "Certificate"},
+			name:      "MENDER_SHELL_HTTPS_CLIENT_CERTIFICATE",
+		},
+		"nested": {
+			fieldPath: []string{"Sessions", "MaxPerUser"},
+			name:      "MENDER_SHELL_SESSIONS_MAX_PER_USER",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.name, EnvName(tc.fieldPath...))
+		})
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	testCases := map[string]struct {
+		env    map[string]string
+		config MenderShellConfigFromFile
+		err    string
+	}{
+		"none": {},
+		"scalars": {
+			env: map[string]string{
+				"MENDER_SHELL_SERVER_URL":                  "https://mender.io",
+				"MENDER_SHELL_SKIP_VERIFY":                 "true",
+				"MENDER_SHELL_MAX_SESSIONS":                "4",
+				"MENDER_SHELL_FILE_TRANSFER_MAX_FILE_SIZE": "1024",
+				"MENDER_SHELL_TERMINAL_WIDTH":              "132",
+			},
+			config: MenderShellConfigFromFile{
+				ServerURL:    "https://mender.io",
+				SkipVerify:   true,
+				MaxSessions:  4,
+				FileTransfer: FileTransferConfig{MaxFileSize: 1024},
+				Terminal:     TerminalConfig{Width: 132},
+			},
+		},
+		"lists and maps": {
+			env: map[string]string{
+				"MENDER_SHELL_AUTHORIZED_USERS": "admin@example.com, ops@example.com",
+				"MENDER_SHELL_SESSION_ENV":      `{"LANG":"C"}`,
+				"MENDER_SHELL_SERVERS":          `[{"ServerURL":"https://a.mender.io"}]`,
+			},
+			config: MenderShellConfigFromFile{
+				AuthorizedUsers: []string{"admin@example.com", "ops@example.com"},
+				SessionEnv:      map[string]string{"LANG": "C"},
+				Servers:         []https.MenderServer{{ServerURL: "https://a.mender.io"}},
+			},
+		},
+		"optional": {
+			env: map[string]string{"MENDER_SHELL_ENABLE_SHELL": "false"},
+			config: MenderShellConfigFromFile{
+				EnableShell: new(bool),
+			},
+		},
+		"not a number": {
+			env: map[string]string{"MENDER_SHELL_MAX_SESSIONS": "many"},
+			err: "MENDER_SHELL_MAX_SESSIONS: ",
+		},
+		"out of range": {
+			env: map[string]string{"MENDER_SHELL_TERMINAL_HEIGHT": "70000"},
+			err: "MENDER_SHELL_TERMINAL_HEIGHT: ",
+		},
+		"not JSON": {
+			env: map[string]string{"MENDER_SHELL_SESSION_ENV": "LANG=C"},
+			err: "MENDER_SHELL_SESSION_ENV: ",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			config := MenderShellConfigFromFile{}
+			err := applyEnv(&config, func(name string) (string, bool) {
+				value, ok := tc.env[name]
+				return value, ok
+			})
+			if tc.err != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tc.err)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.config, config)
+		})
+	}
+}
+
+func TestLoadConfigEnvPrecedence(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+
+	fallbackPath := path.Join(tdir, "fallback.conf")
+	err = ioutil.WriteFile(fallbackPath, []byte(`{
+		"ServerURL": "https://fallback.mender.io",
+		"User": "root",
+		"MaxSessions": 2,
+		"LogLevel": "debug"
+	}`), 0600)
+	assert.NoError(t, err)
+	mainPath := path.Join(tdir, "main.conf")
+	err = ioutil.WriteFile(mainPath, []byte(`{
+		"User": "nobody",
+		"MaxSessions": 3
+	}`), 0600)
+	assert.NoError(t, err)
+
+	os.Setenv("MENDER_SHELL_MAX_SESSIONS", "4")
+	defer os.Unsetenv("MENDER_SHELL_MAX_SESSIONS")
+
+	config, err := LoadConfig(mainPath, fallbackPath)
+	assert.NoError(t, err)
+	//the environment over the main file, over the fallback file, over the
+	//defaults
+	assert.Equal(t, uint32(4), config.MaxSessions)
+	assert.Equal(t, "nobody", config.User)
+	assert.Equal(t, "https://fallback.mender.io", config.ServerURL)
+	assert.Equal(t, DefaultShellCommand, config.ShellCommand)
+	//the merged configuration is validated as usual
+	assert.NoError(t, config.Validate())
+
+	os.Setenv("MENDER_SHELL_MAX_SESSIONS", "0x")
+	_, err = LoadConfig(mainPath, fallbackPath)
+	assert.Error(t, err)
+
+	os.Setenv("MENDER_SHELL_MAX_SESSIONS", "1")
+	os.Setenv("MENDER_SHELL_SESSIONS_MAX_PER_USER", "2")
+	defer os.Unsetenv("MENDER_SHELL_SESSIONS_MAX_PER_USER")
+	config, err = LoadConfig(mainPath, fallbackPath)
+	assert.NoError(t, err)
+	assert.Error(t, config.Validate())
+}
@@ -0,0 +1,53 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package config
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/mendersoftware/mender-shell/client/https"
+)
+
+// menderConfig is the part of the Mender client configuration file
+// naming the server, in the single or in the multi-server format
+type menderConfig struct {
+	ServerURL string
+	Servers   []https.MenderServer
+}
+
+// readMenderConfigServerURL returns the URL of the server the Mender client
+// connects to, from its configuration file: the first of Servers, which the
+// client tries first, or ServerURL
+func readMenderConfigServerURL(path string) (string, error) {
+	var config menderConfig
+	if err := readConfigFile(&config, path); err != nil {
+		return "", err
+	}
+
+	serverURL := config.ServerURL
+	if len(config.Servers) > 0 {
+		serverURL = config.Servers[0].ServerURL
+	}
+	if serverURL == "" {
+		return "", errors.New("no server URL in " + path)
+	}
+	u, err := url.Parse(serverURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", errors.New("the server URL " + serverURL + " in " + path + " is not valid")
+	}
+	return strings.TrimSuffix(serverURL, "/"), nil
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadMenderConfigServerURL(t *testing.T) {
+	testCases := map[string]struct {
+		config    string
+		serverURL string
+		err       string
+	}{
+		"single server": {
+			config:    `{"ServerURL": "https://hosted.mender.io/", "TenantToken": "tenant"}`,
+			serverURL: "https://hosted.mender.io",
+		},
+		"multiple servers": {
+			config: `{"Servers": [{"ServerURL": "https://eu.hosted.mender.io"},
+				{"ServerURL": "https://hosted.mender.io"}]}`,
+			serverURL: "https://eu.hosted.mender.io",
+		},
+		"no server": {
+			config: `{"TenantToken": "tenant"}`,
+			err:    "no server URL in ",
+		},
+		"invalid server": {
+			config: `{"ServerURL": "hosted.mender.io"}`,
+			err:    "the server URL hosted.mender.io in ",
+		},
+		"invalid file": {
+			config: `{"ServerURL": `,
+			err:    "Error parsing mender configuration file",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tdir, err := ioutil.TempDir("", "mendertest")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tdir)
+			file := path.Join(tdir, "mender.conf")
+			assert.NoError(t, ioutil.WriteFile(file, []byte(tc.config), 0600))
+
+			serverURL, err := readMenderConfigServerURL(file)
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.serverURL, serverURL)
+		})
+	}
+}
+
+func TestConfigurationServerFromMenderConfig(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	file := path.Join(tdir, "mender.conf")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`{"ServerURL": "https://hosted.mender.io"}`), 0600))
+
+	testCases := map[string]struct {
+		serverURL  string
+		fromMender bool
+		menderFile string
+		expected   string
+		err        string
+	}{
+		"not enabled": {
+			menderFile: file,
+		},
+		"enabled": {
+			fromMender: true,
+			menderFile: file,
+			expected:   "https://hosted.mender.io",
+		},
+		"own server URL first": {
+			serverURL:  "https://mender.example.com",
+			fromMender: true,
+			menderFile: file,
+			expected:   "https://mender.example.com",
+		},
+		"missing file": {
+			fromMender: true,
+			menderFile: path.Join(tdir, "missing.conf"),
+			err:        "ServerFromMenderConfig: ",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			config := NewMenderShellConfig()
+			config.ServerURL = tc.serverURL
+			config.ServerFromMenderConfig = tc.fromMender
+			config.MenderConfigFile = tc.menderFile
+			err := config.Validate()
+			if tc.err != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, config.ServerURL)
+			assert.Equal(t, tc.expected, config.Servers[0].ServerURL)
+		})
+	}
+}
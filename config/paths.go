@@ -34,10 +34,55 @@ var (
 
 	DefaultConfFile         = path.Join(GetConfDirPath(), "mender-shell.conf")
 	DefaultFallbackConfFile = path.Join(GetStateDirPath(), "mender-shell.conf")
+	DefaultMenderConfFile   = path.Join(GetConfDirPath(), "mender.conf")
 
 	MaxReconnectAttempts = 128
 	MessageWriteTimeout  = 2 * time.Second
 	MaxShellsSpawned     = uint(16)
+	DefaultMaxSessions   = 1
+
+	DefaultScrollbackSize = 64 * 1024
+
+	DefaultOutputBufferSize    = 4096
+	DefaultOutputFlushInterval = 10 * time.Millisecond
+	DefaultOutputQueueLength   = 16
+
+	MinInputBytesPerSecond = uint32(64)
+
+	DefaultReconnectStable = time.Minute
+
+	StaticTokenFileWatchInterval = 8 * time.Second
+
+	IdleTimeoutGracePeriod = 30 * time.Second
+
+	MaxSessionDurationWarning = time.Minute
+
+	DefaultShutdownGracePeriod = 5 * time.Second
+
+	HandoverTimeout = 10 * time.Second
+
+	DefaultAuthManagerWaitTimeout = 60 * time.Second
+
+	DefaultSessionScriptTimeout = 30 * time.Second
+
+	DefaultPingInterval = 60 * time.Second
+	DefaultPingTimeout  = 10 * time.Second
+
+	DefaultConnectTimeout = 30 * time.Second
+	DefaultWriteTimeout   = 10 * time.Second
+
+	DefaultTCPKeepAliveIdle     = 30 * time.Second
+	DefaultTCPKeepAliveInterval = 10 * time.Second
+	DefaultTCPKeepAliveCount    = 3
+
+	DefaultCompressionThreshold = 512
+
+	DefaultMaxFileSize = int64(64 * 1024 * 1024)
+
+	DefaultFileTransferChunkSize = int64(32 * 1024)
+
+	DefaultMaxMessageSize = int64(8192)
+	MinMaxMessageSize     = int64(1024)
 )
 
 // GetStateDirPath returns the default data store directory
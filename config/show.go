@@ -0,0 +1,103 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	"github.com/mendersoftware/mender-shell/logging"
+)
+
+// Settings returns the settings as they are loaded, keyed by their names in
+// the configuration file, the nested ones in maps; the secrets are redacted
+// like in the log lines unless showSecrets is set, e.g.: the
+// ClientKeyPassphrase, or the password of the Proxy URL
+func (c *MenderShellConfig) Settings(showSecrets bool) (map[string]interface{}, error) {
+	data, err := json.Marshal(c.MenderShellConfigFromFile)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	//the integers are kept as they are, not as floats
+	decoder.UseNumber()
+	settings := map[string]interface{}{}
+	if err := decoder.Decode(&settings); err != nil {
+		return nil, err
+	}
+	if !showSecrets {
+		redactSettings(settings)
+	}
+	return settings, nil
+}
+
+func redactSettings(settings map[string]interface{}) {
+	for name, value := range settings {
+		if s, ok := value.(string); ok && s != "" && logging.IsSecretKey(name) {
+			settings[name] = logging.Redacted
+			continue
+		}
+		settings[name] = redactValue(value)
+	}
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return logging.Redact(v)
+	case map[string]interface{}:
+		redactSettings(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return value
+}
+
+// SettingLines returns the settings as name=value lines sorted by name, the
+// nested ones named with their path, e.g.: Sessions.MaxPerUser=2; the
+// strings are written as they are, the other values in JSON
+func SettingLines(settings map[string]interface{}) ([]string, error) {
+	var lines []string
+	if err := appendSettingLines(&lines, "", settings); err != nil {
+		return nil, err
+	}
+	sort.Strings(lines)
+	return lines, nil
+}
+
+func appendSettingLines(lines *[]string, prefix string, settings map[string]interface{}) error {
+	for name, value := range settings {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if len(v) > 0 {
+				if err := appendSettingLines(lines, prefix+name+".", v); err != nil {
+					return err
+				}
+				continue
+			}
+		case string:
+			*lines = append(*lines, prefix+name+"="+v)
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		*lines = append(*lines, prefix+name+"="+string(data))
+	}
+	return nil
+}
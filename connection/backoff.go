@@ -0,0 +1,103 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBackoffMin is the cap of the first delay, if Min is not set
+	DefaultBackoffMin = time.Second
+	// DefaultBackoffMax is the max delay, if Max is not set
+	DefaultBackoffMax = time.Minute
+)
+
+// Backoff computes the delays between the reconnect attempts: exponential
+// backoff with full jitter, so that the devices losing the server at the same
+// time do not reconnect all at once. The zero value is ready to use.
+type Backoff struct {
+	mutex sync.Mutex
+	// Cap of the first delay
+	Min time.Duration
+	// Max delay
+	Max time.Duration
+	// After being connected for StableAfter the delays start again from
+	// Min; 0 resets them on every connection
+	StableAfter time.Duration
+	attempt     uint
+	connectedAt time.Time
+	//seeded per device, or the devices would all draw the same delays
+	random *rand.Rand
+}
+
+// SetIntervals changes the limits of the delays
+func (b *Backoff) SetIntervals(min time.Duration, max time.Duration, stableAfter time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.Min = min
+	b.Max = max
+	b.StableAfter = stableAfter
+}
+
+// Next returns the delay before the next attempt: a random duration between
+// 0 and Min*2^attempt, capped at Max
+func (b *Backoff) Next() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.connectedAt.IsZero() {
+		if time.Since(b.connectedAt) >= b.StableAfter {
+			b.attempt = 0
+		}
+		b.connectedAt = time.Time{}
+	}
+
+	min, max := b.Min, b.Max
+	if min <= 0 {
+		min = DefaultBackoffMin
+	}
+	if max <= 0 {
+		max = DefaultBackoffMax
+	}
+	if max < min {
+		max = min
+	}
+	ceiling := max
+	if b.attempt < 32 && min<<b.attempt < max && min<<b.attempt > 0 {
+		ceiling = min << b.attempt
+	}
+	b.attempt++
+	if b.random == nil {
+		b.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return time.Duration(b.random.Int63n(int64(ceiling) + 1))
+}
+
+// Connected records a successful connection; the delays start again from
+// Min once the connection has been stable for StableAfter
+func (b *Backoff) Connected() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.connectedAt = time.Now()
+}
+
+// Reset starts the delays again from Min
+func (b *Backoff) Reset() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.attempt = 0
+	b.connectedAt = time.Time{}
+}
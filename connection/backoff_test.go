@@ -0,0 +1,100 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffNext(t *testing.T) {
+	testCases := map[string]struct {
+		min      time.Duration
+		max      time.Duration
+		ceilings []time.Duration
+	}{
+		"exponential": {
+			min:      time.Second,
+			max:      time.Minute,
+			ceilings: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second},
+		},
+		"capped": {
+			min:      time.Second,
+			max:      3 * time.Second,
+			ceilings: []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		"defaults": {
+			ceilings: []time.Duration{DefaultBackoffMin, 2 * DefaultBackoffMin},
+		},
+		"max below min": {
+			min:      2 * time.Second,
+			max:      time.Second,
+			ceilings: []time.Duration{2 * time.Second, 2 * time.Second},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			b := &Backoff{Min: tc.min, Max: tc.max}
+			for _, ceiling := range tc.ceilings {
+				delay := b.Next()
+				assert.True(t, delay >= 0 && delay <= ceiling, "delay %s above %s", delay, ceiling)
+			}
+		})
+	}
+}
+
+func TestBackoffNoOverflow(t *testing.T) {
+	b := &Backoff{Min: time.Second, Max: time.Hour}
+	for i := 0; i < 100; i++ {
+		delay := b.Next()
+		assert.True(t, delay >= 0 && delay <= time.Hour)
+	}
+}
+
+func TestBackoffStable(t *testing.T) {
+	testCases := map[string]struct {
+		stableAfter time.Duration
+		reset       bool
+	}{
+		"stable": {
+			stableAfter: 0,
+			reset:       true,
+		},
+		"not stable yet": {
+			stableAfter: time.Hour,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			b := &Backoff{Min: time.Second, Max: time.Hour, StableAfter: tc.stableAfter}
+			for i := 0; i < 10; i++ {
+				b.Next()
+			}
+			b.Connected()
+			b.Next()
+			if tc.reset {
+				assert.EqualValues(t, 1, b.attempt)
+			} else {
+				assert.EqualValues(t, 11, b.attempt)
+			}
+
+			b.Reset()
+			assert.True(t, b.Next() <= time.Second)
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerThreshold is the number of consecutive failed attempts
+	// opening the circuit, if Threshold is not set
+	DefaultBreakerThreshold = 10
+	// DefaultBreakerCooldown is the delay between the probing attempts while
+	// the circuit is open, if Cooldown is not set
+	DefaultBreakerCooldown = 10 * time.Minute
+)
+
+// CircuitBreaker stops the hot reconnect loops against a server which keeps
+// failing: after Threshold consecutive failed attempts the circuit opens, and
+// the server is only probed every Cooldown until an attempt succeeds. The
+// zero value is ready to use.
+type CircuitBreaker struct {
+	mutex sync.Mutex
+	// Consecutive failed attempts opening the circuit
+	Threshold uint
+	// Delay between the attempts while the circuit is open
+	Cooldown time.Duration
+	failures uint
+	open     bool
+}
+
+// SetLimits changes the threshold and the cooldown of the breaker
+func (b *CircuitBreaker) SetLimits(threshold uint, cooldown time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.Threshold = threshold
+	b.Cooldown = cooldown
+}
+
+// Failed records a failed attempt; it returns true if the failure opened
+// the circuit
+func (b *CircuitBreaker) Failed() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	if b.open || b.failures < b.threshold() {
+		return false
+	}
+	b.open = true
+	return true
+}
+
+// Succeeded records a successful attempt, closing the circuit; it returns
+// true if the circuit was open
+func (b *CircuitBreaker) Succeeded() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	wasOpen := b.open
+	b.failures = 0
+	b.open = false
+	return wasOpen
+}
+
+// Open returns true if the circuit is open: the next attempt is a probe,
+// made after the cooldown
+func (b *CircuitBreaker) Open() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.open
+}
+
+// Failures returns the number of consecutive failed attempts
+func (b *CircuitBreaker) Failures() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.failures
+}
+
+// CooldownDelay returns the delay before probing the server while the
+// circuit is open
+func (b *CircuitBreaker) CooldownDelay() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.Cooldown <= 0 {
+		return DefaultBreakerCooldown
+	}
+	return b.Cooldown
+}
+
+func (b *CircuitBreaker) threshold() uint {
+	if b.Threshold == 0 {
+		return DefaultBreakerThreshold
+	}
+	return b.Threshold
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	testCases := map[string]struct {
+		threshold uint
+		cooldown  time.Duration
+		failures  uint
+		open      bool
+		delay     time.Duration
+	}{
+		"below the threshold": {
+			threshold: 3,
+			cooldown:  time.Minute,
+			failures:  2,
+			open:      false,
+			delay:     time.Minute,
+		},
+		"at the threshold": {
+			threshold: 3,
+			cooldown:  time.Minute,
+			failures:  3,
+			open:      true,
+			delay:     time.Minute,
+		},
+		"failed probes": {
+			threshold: 3,
+			cooldown:  time.Minute,
+			failures:  5,
+			open:      true,
+			delay:     time.Minute,
+		},
+		"defaults": {
+			failures: DefaultBreakerThreshold,
+			open:     true,
+			delay:    DefaultBreakerCooldown,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			b := &CircuitBreaker{}
+			b.SetLimits(tc.threshold, tc.cooldown)
+			opened := 0
+			for i := uint(0); i < tc.failures; i++ {
+				if b.Failed() {
+					opened++
+				}
+			}
+			assert.Equal(t, tc.open, b.Open())
+			if tc.open {
+				assert.Equal(t, 1, opened)
+			} else {
+				assert.Equal(t, 0, opened)
+			}
+			assert.Equal(t, tc.failures, b.Failures())
+			assert.Equal(t, tc.delay, b.CooldownDelay())
+
+			assert.Equal(t, tc.open, b.Succeeded())
+			assert.False(t, b.Open())
+			assert.Equal(t, uint(0), b.Failures())
+			assert.False(t, b.Succeeded())
+		})
+	}
+}
+
+func TestCircuitBreakerReopens(t *testing.T) {
+	b := &CircuitBreaker{Threshold: 2}
+	assert.False(t, b.Failed())
+	assert.True(t, b.Failed())
+	assert.True(t, b.Succeeded())
+
+	//a success resets the count of the consecutive failures
+	assert.False(t, b.Failed())
+	assert.False(t, b.Open())
+	assert.True(t, b.Failed())
+	assert.True(t, b.Open())
+}
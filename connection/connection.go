@@ -15,14 +15,20 @@
 package connection
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -30,18 +36,37 @@ import (
 	"github.com/vmihailenco/msgpack"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
+
+	"github.com/mendersoftware/mender-shell/logging"
 )
 
 const (
-	errMissingServerCertF = "IGNORING ERROR: The client server-certificate can not be " +
-		"loaded: (%s). The client will continue running, but may not be able to " +
-		"communicate with the server. If this is not your intention please add a valid " +
-		"server certificate"
 	errMissingCerts = "No trusted certificates. The client will continue running, but will " +
 		"not be able to communicate with the server. Either specify ServerCertificate in " +
 		"mender.conf, or make sure that CA certificates are installed on the system"
 )
 
+const (
+	// TokenInHeader sends the JWT token as the Authorization: Bearer header
+	// of the websocket handshake request
+	TokenInHeader = "header"
+	// TokenInQuery sends the JWT token as a query parameter of the
+	// websocket handshake request URL
+	TokenInQuery = "query"
+	// DefaultTokenQueryParameter is the query parameter the JWT token is
+	// sent as, with TokenInQuery, if not set
+	DefaultTokenQueryParameter = "jwt"
+)
+
+var (
+	// ErrNoValidCertificates is returned when the server certificate file
+	// holds no valid PEM certificate
+	ErrNoValidCertificates = errors.New("no valid certificates found")
+	// ErrMessageTooLarge is returned when the peer sent a message over the
+	// read limit; the connection is closed with the message too big code
+	ErrMessageTooLarge = errors.New("message too large")
+)
+
 type Connection struct {
 	writeMutex sync.Mutex
 	// the connection handler
@@ -52,84 +77,374 @@ type Connection struct {
 	maxMessageSize int64
 	// Time allowed to read the next pong message from the peer.
 	defaultPingWait time.Duration
+	// signals the pong messages received for the pings sent by StartPing
+	pong chan struct{}
+	// told the round-trip time of every ping, if set
+	pingObserver func(rtt time.Duration)
+	// closed when the connection is closed, it stops the pings
+	done      chan struct{}
+	closeOnce sync.Once
+	// the messages smaller than this are not compressed
+	compressionThreshold int
+	// shares the connection among the sessions, nil if disabled
+	flow *flowControl
 }
 
-func loadServerTrust(serverCertFilePath string) *x509.CertPool {
+// LoadServerTrust returns the CA certificates the server certificate is
+// verified with: the system ones, plus the ones in the PEM file at
+// serverCertFilePath, if set
+func LoadServerTrust(serverCertFilePath string) (*x509.CertPool, error) {
 	systemPool, err := x509.SystemCertPool()
 	if err != nil {
 		log.Warnf("Error when loading system certificates: %s", err.Error())
 	}
-
 	if systemPool == nil {
 		log.Warn("No system certificates found.")
 		systemPool = x509.NewCertPool()
 	}
 
-	if len(serverCertFilePath) < 1 {
-		log.Warnf(errMissingServerCertF, "no file provided")
-		return systemPool
+	if len(serverCertFilePath) > 0 {
+		certificates, err := loadCertificates(serverCertFilePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range certificates {
+			systemPool.AddCert(cert)
+		}
+	}
+
+	if len(systemPool.Subjects()) == 0 {
+		log.Error(errMissingCerts)
+	}
+	return systemPool, nil
+}
+
+// LoadPinnedServerTrust returns only the CA certificates in the PEM file at
+// serverCertFilePath, pinning the server to them: the system ones are not
+// trusted
+func LoadPinnedServerTrust(serverCertFilePath string) (*x509.CertPool, error) {
+	certificates, err := loadCertificates(serverCertFilePath)
+	if err != nil {
+		return nil, err
 	}
+	pool := x509.NewCertPool()
+	for _, cert := range certificates {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
 
-	log.Infof("loadServerTrust loading certificate from %s", serverCertFilePath)
-	// Read certificate file.
+//returns the valid certificates in the PEM file, an error if there is none
+func loadCertificates(serverCertFilePath string) ([]*x509.Certificate, error) {
+	log.Infof("LoadServerTrust loading certificate from %s", serverCertFilePath)
 	serverCertificate, err := ioutil.ReadFile(serverCertFilePath)
 	if err != nil {
-		// Ignore server certificate error  (See: MEN-2378)
-		log.Warnf(errMissingServerCertF, err.Error())
-	}
-
-	if len(serverCertificate) > 0 {
-		block, _ := pem.Decode(serverCertificate)
-		if block != nil {
-			cert, err := x509.ParseCertificate(block.Bytes)
-			if err == nil {
-				log.Infof("API Gateway certificate (in PEM format): \n%s", string(serverCertificate))
-				log.Infof("Issuer: %s, Valid from: %s, Valid to: %s",
-					cert.Issuer.Organization, cert.NotBefore, cert.NotAfter)
-			} else {
-				log.Warnf("Unparseable certificate '%s': %s", serverCertFilePath, err.Error())
+		return nil, errors.New("can't read the server certificate " + serverCertFilePath + ": " + err.Error())
+	}
+
+	certificates := []*x509.Certificate{}
+	for block, rest := pem.Decode(serverCertificate); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			log.Warnf("Unparseable certificate '%s': %s", serverCertFilePath, err.Error())
+			continue
+		}
+		log.Infof("Issuer: %s, Valid from: %s, Valid to: %s",
+			cert.Issuer.Organization, cert.NotBefore, cert.NotAfter)
+		certificates = append(certificates, cert)
+	}
+
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoValidCertificates, serverCertFilePath)
+	}
+	return certificates, nil
+}
+
+// Option configures the websocket dialer, or the handshake request, of a
+// new Connection
+type Option func(dialer *dialOptions) error
+
+// dialOptions is what the options set up the connection with: the
+// websocket dialer, the headers of the handshake request, the dialer of
+// the TCP connection, with the options set on its socket before it
+// connects, the SOCKS5 proxy, if any, and the query parameter the token is
+// sent as, empty to send it as the Authorization header
+type dialOptions struct {
+	*websocket.Dialer
+	header          http.Header
+	dialer          Dialer
+	netDialer       *happyEyeballsDialer
+	socketOptions   []func(fd int) error
+	socks5          *socks5Dialer
+	tokenQueryParam string
+}
+
+// WithProxy makes the connection go through the given HTTP proxy, with a
+// CONNECT tunnel authenticated with the proxy URL userinfo, if any; it takes
+// precedence over the HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables
+func WithProxy(proxyURL *url.URL) Option {
+	return func(dialer *dialOptions) error {
+		if proxyURL.Scheme != "http" {
+			return errors.New("unsupported proxy scheme: " + proxyURL.Scheme)
+		}
+		dialer.Proxy = http.ProxyURL(proxyURL)
+		return nil
+	}
+}
+
+// WithSOCKS5Proxy makes the connection go through the SOCKS5 proxy at the
+// socks5:// or socks5h:// URL, authenticated with its userinfo, if any; the
+// proxy resolves the host name of the server. It takes precedence over
+// WithProxy and the proxy environment variables
+func WithSOCKS5Proxy(proxyURL *url.URL) Option {
+	return func(dialer *dialOptions) error {
+		if proxyURL.Scheme != "socks5" && proxyURL.Scheme != "socks5h" {
+			return errors.New("unsupported proxy scheme: " + proxyURL.Scheme)
+		}
+		address := proxyURL.Host
+		if proxyURL.Port() == "" {
+			address = net.JoinHostPort(proxyURL.Hostname(), "1080")
+		}
+		dialer.socks5 = &socks5Dialer{proxyAddress: address}
+		if proxyURL.User != nil {
+			dialer.socks5.username = proxyURL.User.Username()
+			dialer.socks5.password, _ = proxyURL.User.Password()
+		}
+		return nil
+	}
+}
+
+// WithBind makes the connection originate from the given network interface,
+// and from the given local IP address; the OS chooses them if not set
+func WithBind(interfaceName string, address net.IP) Option {
+	return func(dialer *dialOptions) error {
+		netDialer := dialer.netDialer
+		if address != nil {
+			netDialer.LocalAddr = &net.TCPAddr{IP: address}
+		}
+		if interfaceName != "" {
+			if _, err := net.InterfaceByName(interfaceName); err != nil {
+				return fmt.Errorf("can't bind to the interface %s: %w", interfaceName, err)
 			}
+			dialer.socketOptions = append(dialer.socketOptions, func(fd int) error {
+				return syscall.SetsockoptString(fd, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, interfaceName)
+			})
 		}
+		return nil
+	}
+}
 
-		systemPool.AppendCertsFromPEM(serverCertificate)
+// WithDialer makes the connection go over the transport of the given
+// dialer, e.g.: a fake one in the tests, or a serial-tunneled link, instead
+// of a TCP connection; the proxies are not used then, while the TLS
+// handshake is still done for the wss:// URLs
+func WithDialer(d Dialer) Option {
+	return func(dialer *dialOptions) error {
+		dialer.dialer = d
+		return nil
 	}
+}
 
-	if len(systemPool.Subjects()) == 0 {
-		log.Error(errMissingCerts)
+// WithDialNetwork makes the connection use IPv4 only (NetworkTCP4), IPv6
+// only (NetworkTCP6), or both (NetworkTCP), racing the addresses of the two
+// families the happy eyeballs way
+func WithDialNetwork(network string) Option {
+	return func(dialer *dialOptions) error {
+		switch network {
+		case NetworkTCP, NetworkTCP4, NetworkTCP6:
+			dialer.netDialer.network = network
+			return nil
+		default:
+			return errors.New("unsupported network: " + network)
+		}
+	}
+}
+
+// LoadClientCertificate loads the client certificate and its key from the PEM
+// files; an encrypted key is decrypted with passphrase
+func LoadClientCertificate(certFilePath string, keyFilePath string, passphrase string) (tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFilePath)
+	if err != nil {
+		return tls.Certificate{}, errors.New("can't read the client certificate " + certFilePath + ": " + err.Error())
+	}
+	keyPEM, err := ioutil.ReadFile(keyFilePath)
+	if err != nil {
+		return tls.Certificate{}, errors.New("can't read the client key " + keyFilePath + ": " + err.Error())
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block != nil && x509.IsEncryptedPEMBlock(block) {
+		if passphrase == "" {
+			return tls.Certificate{}, errors.New("the client key " + keyFilePath + " is encrypted, but no passphrase is given")
+		}
+		der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+		if err != nil {
+			return tls.Certificate{}, errors.New("can't decrypt the client key " + keyFilePath + ": " + err.Error())
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("the client certificate %s and key %s are not a valid pair: %s",
+			certFilePath, keyFilePath, err.Error())
+	}
+	return cert, nil
+}
+
+// WithClientCertificate makes the connection authenticate with the client
+// certificate and key, loaded from the files on every new connection so
+// that the rotated certificates are picked up when reconnecting
+func WithClientCertificate(certFilePath string, keyFilePath string, passphrase string) Option {
+	return func(dialer *dialOptions) error {
+		cert, err := LoadClientCertificate(certFilePath, keyFilePath, passphrase)
+		if err != nil {
+			return err
+		}
+		dialer.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		return nil
+	}
+}
+
+// WithPinnedServerCertificate pins the server to the CA certificates in the
+// PEM file: the system ones are no longer trusted to verify it
+func WithPinnedServerCertificate(serverCertFilePath string) Option {
+	return func(dialer *dialOptions) error {
+		rootCAs, err := LoadPinnedServerTrust(serverCertFilePath)
+		if err != nil {
+			return err
+		}
+		dialer.TLSClientConfig.RootCAs = rootCAs
+		return nil
+	}
+}
+
+// WithConnectTimeout gives up on the connection if the dial, the TLS and the
+// websocket handshakes take longer than timeout, e.g.: with a server which
+// accepts the TCP connections and never answers
+func WithConnectTimeout(timeout time.Duration) Option {
+	return func(dialer *dialOptions) error {
+		dialer.HandshakeTimeout = timeout
+		return nil
+	}
+}
+
+// WithHeader sends the header with the websocket handshake request, e.g.:
+// to identify the device; the Authorization header can't be overridden
+func WithHeader(name string, value string) Option {
+	return func(dialer *dialOptions) error {
+		dialer.header.Set(name, value)
+		return nil
+	}
+}
+
+// WithTokenInQuery sends the JWT token as the given query parameter of the
+// handshake request URL, instead of the Authorization header, for the
+// servers which expect it there
+func WithTokenInQuery(parameter string) Option {
+	return func(dialer *dialOptions) error {
+		if parameter == "" {
+			return errors.New("the token query parameter can't be empty")
+		}
+		dialer.tokenQueryParam = parameter
+		return nil
+	}
+}
+
+// WithCompression negotiates the permessage-deflate extension with the
+// server; the server not supporting it leaves the messages uncompressed
+func WithCompression() Option {
+	return func(dialer *dialOptions) error {
+		dialer.EnableCompression = true
+		return nil
 	}
-	return systemPool
 }
 
-//Websocket connection routine. setup the ping-pong and connection settings
+//Websocket connection routine. setup the ping-pong and connection settings;
+//the proxy is taken from the environment, unless set with WithProxy
 func NewConnection(u url.URL,
 	token string,
 	writeWait time.Duration,
 	maxMessageSize int64,
 	defaultPingWait time.Duration,
 	skipVerify bool,
-	serverCertFilePath string) (*Connection, error) {
-	// skip verification of HTTPS certificate if skipVerify is set in the config file
-
-	websocket.DefaultDialer.TLSClientConfig = &tls.Config{
-		RootCAs:            loadServerTrust(serverCertFilePath),
-		InsecureSkipVerify: skipVerify,
+	serverCertFilePath string,
+	opts ...Option) (*Connection, error) {
+	rootCAs, err := LoadServerTrust(serverCertFilePath)
+	if err != nil {
+		return nil, err
 	}
 
-	var ws *websocket.Conn
 	dialer := *websocket.DefaultDialer
-
+	// skip verification of HTTPS certificate if skipVerify is set in the config file
+	dialer.TLSClientConfig = &tls.Config{
+		RootCAs:            rootCAs,
+		InsecureSkipVerify: skipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	dialer.Proxy = http.ProxyFromEnvironment
 	headers := http.Header{}
-	headers.Set("Authorization", "Bearer "+token)
-	ws, _, err := dialer.Dial(u.String(), headers)
+	options := &dialOptions{Dialer: &dialer, header: headers, netDialer: newHappyEyeballsDialer()}
+	for _, opt := range opts {
+		if err := opt(options); err != nil {
+			return nil, err
+		}
+	}
+	if len(options.socketOptions) > 0 {
+		options.netDialer.Control = func(network string, address string, c syscall.RawConn) error {
+			var optionErr error
+			err := c.Control(func(fd uintptr) {
+				for _, setOption := range options.socketOptions {
+					if optionErr = setOption(int(fd)); optionErr != nil {
+						return
+					}
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return optionErr
+		}
+	}
+	dialer.NetDialContext = options.netDialer.DialContext
+	if options.dialer != nil {
+		dialer.Proxy = nil
+		dialer.NetDialContext = options.dialer.DialContext
+	} else if options.socks5 != nil {
+		dialer.Proxy = nil
+		options.socks5.forward = options.netDialer.DialContext
+		dialer.NetDialContext = options.socks5.DialContext
+	}
+	if options.tokenQueryParam != "" {
+		query := u.Query()
+		query.Set(options.tokenQueryParam, token)
+		u.RawQuery = query.Encode()
+	} else {
+		headers.Set("Authorization", "Bearer "+token)
+	}
+	ws, response, err := dialer.Dial(u.String(), headers)
 	if err != nil {
 		return nil, err
 	}
+	if dialer.EnableCompression {
+		extensions := response.Header.Get("Sec-Websocket-Extensions")
+		if strings.Contains(extensions, "permessage-deflate") {
+			log.Debug("the websocket messages are compressed")
+		} else {
+			log.Info("the server does not support the websocket compression, the messages are not compressed")
+		}
+	}
 
 	c := &Connection{
 		connection:      ws,
 		writeWait:       writeWait,
 		maxMessageSize:  maxMessageSize,
 		defaultPingWait: defaultPingWait,
+		pong:            make(chan struct{}, 1),
+		done:            make(chan struct{}),
 	}
 	// ping-pong
 	ws.SetReadLimit(maxMessageSize)
@@ -139,37 +454,181 @@ func NewConnection(u url.URL,
 		ws.SetReadDeadline(time.Now().Add(time.Duration(pongWait) * time.Second))
 		c.writeMutex.Lock()
 		defer c.writeMutex.Unlock()
-		return ws.WriteControl(websocket.PongMessage, []byte{}, time.Now().Add(writeWait))
+		return c.writeFailed(context.Background(), ws.WriteControl(websocket.PongMessage, []byte{}, time.Now().Add(c.writeWait)))
 	})
 	return c, nil
 }
 
+// StartPing sends a ping to the peer every interval, closing the connection
+// if the pong does not arrive within timeout; the pongs are read along with
+// the messages, so ReadMessage has to be called for them to arrive
+func (c *Connection) StartPing(interval time.Duration, timeout time.Duration) {
+	c.connection.SetPongHandler(func(message string) error {
+		sentAt, err := strconv.ParseInt(message, 10, 64)
+		if err == nil {
+			rtt := time.Since(time.Unix(0, sentAt))
+			log.Debugf("websocket ping RTT: %s", rtt)
+			if c.pingObserver != nil {
+				c.pingObserver(rtt)
+			}
+		}
+		c.connection.SetReadDeadline(time.Now().Add(interval + timeout))
+		select {
+		case c.pong <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	go c.pingLoop(interval, timeout)
+}
+
+func (c *Connection) pingLoop(interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.done:
+			return
+		}
+
+		//drop a late pong of the previous ping
+		select {
+		case <-c.pong:
+		default:
+		}
+
+		err := c.writePing(time.Now())
+		if err != nil {
+			log.Errorf("failed to send the websocket ping: %s; closing the connection", err.Error())
+			c.Close()
+			return
+		}
+
+		select {
+		case <-c.pong:
+		case <-time.After(timeout):
+			log.Warnf("no websocket pong received within %s; closing the connection", timeout)
+			c.Close()
+			return
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Connection) writePing(sentAt time.Time) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.writeFailed(context.Background(), c.connection.WriteControl(websocket.PingMessage,
+		[]byte(strconv.FormatInt(sentAt.UnixNano(), 10)), time.Now().Add(c.writeWait)))
+}
+
+// writeFailed closes the connection if the write err stalled beyond the
+// write timeout, so that the reads fail too and the connection is replaced,
+// instead of every following write waiting for the wedged peer; it returns
+// err
+func (c *Connection) writeFailed(ctx context.Context, err error) error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		logging.FromContext(ctx).Warnf("the websocket write stalled for more than %s; closing the connection", c.writeWait)
+		c.Close()
+	}
+	return err
+}
+
+// SetPingObserver sets the function told the round-trip time of every ping
+// sent by StartPing; it is called from the goroutine reading the messages,
+// so it has to return quickly. It has to be called before StartPing
+func (c *Connection) SetPingObserver(observer func(rtt time.Duration)) {
+	c.pingObserver = observer
+}
+
+// SetFlowControl makes the sessions share the connection in turns of
+// window bytes, DefaultFlowControlWindow if 0: a session which sent its
+// window waits while the other ones have output to send, so a busy session
+// can't starve the others. The messages of no session, e.g.: the control
+// ones, and the ones without a body are never held back. It has to be
+// called before the messages are written
+func (c *Connection) SetFlowControl(window int) {
+	c.flow = newFlowControl(window)
+}
+
+// SetCompressionThreshold sets the size in bytes of the smallest message
+// compressed, if the compression was negotiated with WithCompression
+func (c *Connection) SetCompressionThreshold(threshold int) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.compressionThreshold = threshold
+}
+
+// SetWriteTimeout sets the time allowed to write a message to the peer; the
+// connection is closed if a write takes longer
+func (c *Connection) SetWriteTimeout(timeout time.Duration) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.writeWait = timeout
+}
+
+// SetReadLimit sets the max size in bytes of a message read from the peer;
+// on a bigger one the connection is closed with the message too big close
+// code, and ReadMessage fails with ErrMessageTooLarge. It has to be called
+// before the messages are read
+func (c *Connection) SetReadLimit(limit int64) {
+	c.maxMessageSize = limit
+	c.connection.SetReadLimit(limit)
+}
+
 func (c *Connection) GetWriteTimeout() time.Duration {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 	return c.writeWait
 }
 
 func (c *Connection) WriteMessage(m *ws.ProtoMsg) (err error) {
+	return c.WriteMessageContext(context.Background(), m)
+}
+
+// WriteMessageContext writes the message like WriteMessage, logging the
+// failure, the stalled write and the wait for the turn of the session with
+// the logger of ctx, e.g.: with the session id attached
+func (c *Connection) WriteMessageContext(ctx context.Context, m *ws.ProtoMsg) (err error) {
 	data, err := msgpack.Marshal(m)
 	if err != nil {
 		return err
 	}
+	if c.flow != nil && m.Header.SessionID != "" && len(m.Body) > 0 {
+		if waited := c.flow.Acquire(m.Header.SessionID, len(data)); waited > 0 {
+			logging.FromContext(ctx).Debugf("the %s message waited %s for its turn, the other sessions were sending",
+				m.Header.MsgType, waited)
+		}
+		defer c.flow.Release(m.Header.SessionID)
+	}
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
+	//the small messages would not get any smaller
+	c.connection.EnableWriteCompression(len(data) >= c.compressionThreshold)
 	c.connection.SetWriteDeadline(time.Now().Add(c.writeWait))
-	return c.connection.WriteMessage(websocket.BinaryMessage, data)
+	err = c.writeFailed(ctx, c.connection.WriteMessage(websocket.BinaryMessage, data))
+	if err != nil {
+		logging.FromContext(ctx).Debugf("failed to write the %s message: %s", m.Header.MsgType, err.Error())
+	}
+	return err
 }
 
 // keeping those for debugging and internal use
 func (c *Connection) writeMessageRaw(data []byte) (err error) {
 	c.writeMutex.Lock()
 	defer c.writeMutex.Unlock()
+	c.connection.EnableWriteCompression(len(data) >= c.compressionThreshold)
 	c.connection.SetWriteDeadline(time.Now().Add(c.writeWait))
-	return c.connection.WriteMessage(websocket.BinaryMessage, data)
+	return c.writeFailed(context.Background(), c.connection.WriteMessage(websocket.BinaryMessage, data))
 }
 
 func (c *Connection) ReadMessage() (*ws.ProtoMsg, error) {
 	_, data, err := c.connection.ReadMessage()
-	if err != nil {
+	if err == websocket.ErrReadLimit {
+		return nil, fmt.Errorf("%w: over the limit of %d bytes", ErrMessageTooLarge, c.maxMessageSize)
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -191,6 +650,28 @@ func (c *Connection) readMessageRaw() ([]byte, error) {
 	return data, nil
 }
 
+// CloseNormally tells the peer the connection is closing, with the normal
+// closure code and the given reason, then closes it
+func (c *Connection) CloseNormally(reason string) error {
+	return c.CloseWithCode(websocket.CloseNormalClosure, reason)
+}
+
+// CloseWithCode tells the peer the connection is closing, with the given
+// close code and reason, then closes it
+func (c *Connection) CloseWithCode(code int, reason string) error {
+	c.writeMutex.Lock()
+	err := c.connection.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(c.writeWait))
+	c.writeMutex.Unlock()
+	if closeErr := c.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 func (c *Connection) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
 	return c.connection.Close()
 }
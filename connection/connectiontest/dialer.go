@@ -0,0 +1,185 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package connectiontest provides a fake connection.Dialer for the tests:
+// the websocket connections go to an in-process handler, without any
+// networking
+package connectiontest
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// ErrClosed is returned when dialing after Close
+var ErrClosed = errors.New("the fake dialer is closed")
+
+// Dialer connects to its handler, serving the websocket handshake, over a
+// Unix socket pair, buffered as a TCP connection would be, unlike a
+// net.Pipe; whatever the address dialed. The dials can be made
+// to fail, and the connections dropped, e.g.: to test the reconnects
+type Dialer struct {
+	server    *http.Server
+	listener  *pairListener
+	mutex     sync.Mutex
+	err       error
+	addresses []string
+	conns     []net.Conn
+}
+
+// NewDialer returns a Dialer serving the connections with handler; Close
+// stops it
+func NewDialer(handler http.Handler) *Dialer {
+	d := &Dialer{
+		server:   &http.Server{Handler: handler},
+		listener: newPairListener(),
+	}
+	go d.server.Serve(d.listener)
+	return d
+}
+
+// DialContext returns the client end of a new connection to the handler,
+// or the error set with Fail
+func (d *Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.addresses = append(d.addresses, address)
+	if d.err != nil {
+		return nil, d.err
+	}
+	client, server, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.listener.push(ctx, server); err != nil {
+		client.Close()
+		server.Close()
+		return nil, err
+	}
+	d.conns = append(d.conns, client)
+	return client, nil
+}
+
+// Fail makes the next dials fail with err, or succeed again if nil
+func (d *Dialer) Fail(err error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.err = err
+}
+
+// Addresses returns the addresses dialed so far, the failed dials included
+func (d *Dialer) Addresses() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return append([]string{}, d.addresses...)
+}
+
+// Drop closes the connections made so far, as a network failure would
+func (d *Dialer) Drop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, conn := range d.conns {
+		conn.Close()
+	}
+	d.conns = nil
+}
+
+// Close drops the connections, and stops serving new ones
+func (d *Dialer) Close() {
+	d.Drop()
+	d.server.Close()
+}
+
+//returns the two connected ends of a new Unix socket pair
+func socketPair() (net.Conn, net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conns[i], err = net.FileConn(f)
+		f.Close()
+		if err != nil {
+			if i == 1 {
+				conns[0].Close()
+			} else {
+				syscall.Close(fds[1])
+			}
+			return nil, nil, err
+		}
+	}
+	return conns[0], conns[1], nil
+}
+
+// pairListener hands the server ends of the socket pairs to the http.Server
+type pairListener struct {
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPairListener() *pairListener {
+	return &pairListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+func (l *pairListener) push(ctx context.Context, conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.done:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *pairListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+func (l *pairListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *pairListener) Addr() net.Addr {
+	return pairAddr{}
+}
+
+type pairAddr struct{}
+
+func (pairAddr) Network() string {
+	return "socketpair"
+}
+
+func (pairAddr) String() string {
+	return "socketpair"
+}
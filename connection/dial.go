@@ -0,0 +1,182 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// the networks WithDialNetwork accepts: both IPv6 and IPv4, IPv4 only, or
+// IPv6 only
+const (
+	NetworkTCP  = "tcp"
+	NetworkTCP4 = "tcp4"
+	NetworkTCP6 = "tcp6"
+)
+
+// Dialer opens the transport the websocket connection to the server runs
+// on; by default, a TCP connection to the server, or to the proxy
+type Dialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// DefaultAttemptDelay is how long a connection attempt gets before the next
+// address is tried too, as recommended by RFC 8305
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+// resolver looks up the addresses of a host; net.DefaultResolver, or a fake
+// one in the tests
+type resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// happyEyeballsDialer dials the server the RFC 8305 way: the IPv6 and the
+// IPv4 addresses of the host are tried alternately, starting with an IPv6
+// one, a new attempt starting when the previous one fails or after
+// attemptDelay, whichever comes first, and the first connection made wins;
+// so an unreachable address family does not stall the connection
+type happyEyeballsDialer struct {
+	net.Dialer
+	// NetworkTCP, NetworkTCP4 or NetworkTCP6
+	network      string
+	attemptDelay time.Duration
+	resolver     resolver
+	// dials a single address, the net.Dialer if nil
+	dial func(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+func newHappyEyeballsDialer() *happyEyeballsDialer {
+	return &happyEyeballsDialer{
+		network:      NetworkTCP,
+		attemptDelay: DefaultAttemptDelay,
+		resolver:     net.DefaultResolver,
+	}
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// DialContext connects to the address, a host:port, racing its addresses;
+// the network is the one of the dialer, whatever is given
+func (d *happyEyeballsDialer) DialContext(ctx context.Context, _ string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no " + d.network + " address found for " + host)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult)
+	next, pending := 0, 0
+	attempt := func() {
+		ipAddress := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.dialAddress(ctx, ipAddress)
+			select {
+			case results <- dialResult{conn: conn, err: err}:
+			case <-ctx.Done():
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+
+	var firstErr error
+	attempt()
+	for {
+		var nextAttempt <-chan time.Time
+		if next < len(ips) {
+			nextAttempt = time.After(d.attemptDelay)
+		}
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if next < len(ips) {
+				attempt()
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		case <-nextAttempt:
+			attempt()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (d *happyEyeballsDialer) dialAddress(ctx context.Context, address string) (net.Conn, error) {
+	if d.dial != nil {
+		return d.dial(ctx, d.network, address)
+	}
+	return d.Dialer.DialContext(ctx, d.network, address)
+}
+
+//the addresses of the host in the network of the dialer, the IPv6 and the
+//IPv4 ones interleaved, starting with an IPv6 one
+func (d *happyEyeballsDialer) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	var addresses []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		addresses = []net.IP{ip}
+	} else {
+		ipAddrs, err := d.resolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ipAddr := range ipAddrs {
+			addresses = append(addresses, ipAddr.IP)
+		}
+	}
+
+	var ipv6, ipv4 []net.IP
+	for _, ip := range addresses {
+		if ip.To4() != nil {
+			if d.network != NetworkTCP6 {
+				ipv4 = append(ipv4, ip)
+			}
+		} else if d.network != NetworkTCP4 {
+			ipv6 = append(ipv6, ip)
+		}
+	}
+	ips := make([]net.IP, 0, len(ipv6)+len(ipv4))
+	for i := 0; i < len(ipv6) || i < len(ipv4); i++ {
+		if i < len(ipv6) {
+			ips = append(ips, ipv6[i])
+		}
+		if i < len(ipv4) {
+			ips = append(ips, ipv4[i])
+		}
+	}
+	return ips, nil
+}
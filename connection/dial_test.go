@@ -0,0 +1,204 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResolver resolves every host to its addresses, of both families
+type fakeResolver struct {
+	addresses []string
+}
+
+func (r *fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	var ipAddrs []net.IPAddr
+	for _, address := range r.addresses {
+		ipAddrs = append(ipAddrs, net.IPAddr{IP: net.ParseIP(address)})
+	}
+	return ipAddrs, nil
+}
+
+func TestHappyEyeballsDialerLookup(t *testing.T) {
+	resolver := &fakeResolver{addresses: []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "192.0.2.3", "2001:db8::2"}}
+	testCases := map[string]struct {
+		network string
+		host    string
+		ips     []string
+	}{
+		"both families, IPv6 first": {
+			network: NetworkTCP,
+			host:    "server.example",
+			ips:     []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"},
+		},
+		"IPv4 only": {
+			network: NetworkTCP4,
+			host:    "server.example",
+			ips:     []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		},
+		"IPv6 only": {
+			network: NetworkTCP6,
+			host:    "server.example",
+			ips:     []string{"2001:db8::1", "2001:db8::2"},
+		},
+		"IP address": {
+			network: NetworkTCP,
+			host:    "198.51.100.7",
+			ips:     []string{"198.51.100.7"},
+		},
+		"IP address of the other family": {
+			network: NetworkTCP6,
+			host:    "198.51.100.7",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := newHappyEyeballsDialer()
+			d.network = tc.network
+			d.resolver = resolver
+			ips, err := d.lookup(context.Background(), tc.host)
+			assert.NoError(t, err)
+			var addresses []string
+			for _, ip := range ips {
+				addresses = append(addresses, ip.String())
+			}
+			assert.Equal(t, tc.ips, addresses)
+		})
+	}
+}
+
+func TestHappyEyeballsDialer(t *testing.T) {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	errUnreachable := errors.New("network is unreachable")
+	testCases := map[string]struct {
+		network string
+		ipv6    func(ctx context.Context) error
+		err     error
+	}{
+		"IPv6 stalls": {
+			network: NetworkTCP,
+			ipv6: func(ctx context.Context) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+		},
+		"IPv6 unreachable": {
+			network: NetworkTCP,
+			ipv6: func(ctx context.Context) error {
+				return errUnreachable
+			},
+		},
+		"IPv6 only, unreachable": {
+			network: NetworkTCP6,
+			ipv6: func(ctx context.Context) error {
+				return errUnreachable
+			},
+			err: errUnreachable,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			d := newHappyEyeballsDialer()
+			d.network = tc.network
+			d.attemptDelay = 50 * time.Millisecond
+			d.resolver = &fakeResolver{addresses: []string{"127.0.0.1", "2001:db8::1"}}
+			d.dial = func(ctx context.Context, network string, address string) (net.Conn, error) {
+				if strings.HasPrefix(address, "[") {
+					return nil, tc.ipv6(ctx)
+				}
+				return (&net.Dialer{}).DialContext(ctx, network, address)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 4*time.Second)
+			defer cancel()
+			start := time.Now()
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort("server.example", port))
+			assert.Less(t, int64(time.Since(start)), int64(time.Second))
+			if tc.err != nil {
+				assert.Equal(t, tc.err, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, l.Addr().String(), conn.RemoteAddr().String())
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestNewConnectionDialNetwork(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(sleepyHandler))
+	defer s.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		network string
+		err     bool
+	}{
+		"both families": {
+			network: NetworkTCP,
+		},
+		"IPv4 only": {
+			network: NetworkTCP4,
+		},
+		"IPv6 only": {
+			network: NetworkTCP6,
+			err:     true,
+		},
+		"unsupported": {
+			network: "udp",
+			err:     true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewConnection(*u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "",
+				WithDialNetwork(tc.network))
+			if tc.err {
+				assert.Error(t, err)
+				assert.Nil(t, c)
+				return
+			}
+			assert.NoError(t, err)
+			c.Close()
+		})
+	}
+}
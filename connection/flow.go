@@ -0,0 +1,116 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultFlowControlWindow is the bytes a channel sends in its turn when
+// the flow control is enabled with a window of 0
+const DefaultFlowControlWindow = 16 * 1024
+
+// flowControl shares the connection among the channels, e.g.: the sessions,
+// in turns: every channel has a window of bytes to send per round, and once
+// it sent it, it waits while the other channels have something to send; a
+// new round starts, with the windows refilled, when none of them has. So a
+// busy channel is throttled to its fair share, and never starves the others
+type flowControl struct {
+	mutex    sync.Mutex
+	changed  *sync.Cond
+	window   int
+	channels map[string]*flowChannel
+}
+
+type flowChannel struct {
+	//bytes left to send in this round, down to one message below 0
+	credit int
+	//the writes given their turn, not done yet
+	pending int
+	//the writes waiting for their turn
+	blocked int
+}
+
+func newFlowControl(window int) *flowControl {
+	if window <= 0 {
+		window = DefaultFlowControlWindow
+	}
+	f := &flowControl{
+		window:   window,
+		channels: map[string]*flowChannel{},
+	}
+	f.changed = sync.NewCond(&f.mutex)
+	return f
+}
+
+// Acquire waits for the turn of the channel to send size bytes, and returns
+// how long it waited; Release has to be called once they are sent
+func (f *flowControl) Acquire(channel string, size int) (waited time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	ch := f.channels[channel]
+	if ch == nil {
+		ch = &flowChannel{credit: f.window}
+		f.channels[channel] = ch
+	}
+	for ch.credit <= 0 {
+		if !f.othersSending(channel) {
+			f.newRound(channel)
+			break
+		}
+		ch.blocked++
+		startedAt := time.Now()
+		f.changed.Wait()
+		waited += time.Since(startedAt)
+		ch.blocked--
+	}
+	ch.credit -= size
+	ch.pending++
+	return waited
+}
+
+// Release tells the write of the channel is done
+func (f *flowControl) Release(channel string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if ch := f.channels[channel]; ch != nil {
+		ch.pending--
+	}
+	f.changed.Broadcast()
+}
+
+//tells if a channel other than this one is sending, or waits to send with
+//its window not used up
+func (f *flowControl) othersSending(channel string) bool {
+	for name, ch := range f.channels {
+		if name != channel && (ch.pending > 0 || (ch.blocked > 0 && ch.credit > 0)) {
+			return true
+		}
+	}
+	return false
+}
+
+//refills the windows, forgetting the channels other than this one with
+//nothing to send, e.g.: the closed sessions
+func (f *flowControl) newRound(channel string) {
+	for name, ch := range f.channels {
+		if name != channel && ch.pending == 0 && ch.blocked == 0 {
+			delete(f.channels, name)
+		} else {
+			ch.credit = f.window
+		}
+	}
+	f.changed.Broadcast()
+}
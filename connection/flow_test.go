@@ -0,0 +1,151 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mendersoftware/go-lib-micro/ws"
+	"github.com/stretchr/testify/assert"
+)
+
+//acquires in the background, the returned channel is closed once acquired
+func acquire(f *flowControl, channel string, size int) <-chan struct{} {
+	acquired := make(chan struct{})
+	go func() {
+		f.Acquire(channel, size)
+		close(acquired)
+	}()
+	return acquired
+}
+
+func assertAcquired(t *testing.T, acquired <-chan struct{}, expected bool) {
+	select {
+	case <-acquired:
+		assert.True(t, expected, "acquired out of turn")
+	case <-time.After(100 * time.Millisecond):
+		assert.False(t, expected, "not acquired")
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	f := newFlowControl(10)
+
+	//the busy channel sends its window, and the other one gets its turn
+	f.Acquire("busy", 10)
+	assertAcquired(t, acquire(f, "interactive", 1), true)
+	f.Release("busy")
+	busy := acquire(f, "busy", 10)
+	assertAcquired(t, busy, false)
+
+	//and once it is done, the busy one goes on in a new round
+	f.Release("interactive")
+	assertAcquired(t, busy, true)
+	f.Release("busy")
+
+	//alone, the busy one is never held back
+	for i := 0; i < 5; i++ {
+		assertAcquired(t, acquire(f, "busy", 10), true)
+		f.Release("busy")
+	}
+	assert.Len(t, f.channels, 1)
+
+	//a channel gone idle is forgotten on the next round
+	assertAcquired(t, acquire(f, "idle", 1), true)
+	f.Release("idle")
+	assertAcquired(t, acquire(f, "busy", 10), true)
+	f.Release("busy")
+	assert.Len(t, f.channels, 1)
+}
+
+func TestFlowControlWindowDefault(t *testing.T) {
+	assert.Equal(t, DefaultFlowControlWindow, newFlowControl(0).window)
+}
+
+func TestConnection_FlowControl(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(readingHandler))
+	defer s.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+	assert.NoError(t, err)
+
+	c, err := NewConnection(*u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "")
+	assert.NoError(t, err)
+	defer c.Close()
+	const window = 4 * 1024
+	c.SetFlowControl(window)
+
+	message := func(sessionID string, size int) *ws.ProtoMsg {
+		return &ws.ProtoMsg{
+			Header: ws.ProtoHdr{Proto: ws.ProtoTypeShell, MsgType: "shell", SessionID: sessionID},
+			Body:   make([]byte, size),
+		}
+	}
+
+	//a few writers flood the connection for the same session, as the
+	//shell output and a file transfer would
+	var flooded int64
+	stop := make(chan struct{})
+	var flooders sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		flooders.Add(1)
+		go func() {
+			defer flooders.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if c.WriteMessage(message("flood", 1024)) != nil {
+					return
+				}
+				atomic.AddInt64(&flooded, 1)
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		flooders.Wait()
+	}()
+
+	//the keystroke echoes of the interactive session get through after a
+	//window of the flood, and the messages being written, at most; the
+	//median is taken, as the scheduler may pause the test goroutine
+	time.Sleep(50 * time.Millisecond)
+	var overtaken []int64
+	for i := 0; i < 21; i++ {
+		before := atomic.LoadInt64(&flooded)
+		start := time.Now()
+		assert.NoError(t, c.WriteMessage(message("interactive", 1)))
+		assert.True(t, time.Since(start) < time.Second)
+		overtaken = append(overtaken, atomic.LoadInt64(&flooded)-before)
+		time.Sleep(10 * time.Millisecond)
+	}
+	sort.Slice(overtaken, func(i, j int) bool { return overtaken[i] < overtaken[j] })
+	assert.LessOrEqual(t, overtaken[len(overtaken)/2], int64(window/1024+4))
+	assert.True(t, atomic.LoadInt64(&flooded) > 0)
+
+	//the control messages are never held back
+	start := time.Now()
+	assert.NoError(t, c.WriteMessage(&ws.ProtoMsg{Header: ws.ProtoHdr{Proto: ws.ProtoTypeShell, MsgType: "ping"}}))
+	assert.True(t, time.Since(start) < time.Second)
+}
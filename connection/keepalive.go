@@ -0,0 +1,54 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// WithTCPKeepAlive makes the OS probe the idle connection, after idle
+// without traffic, every interval, giving up on it after count unanswered
+// probes; unlike the websocket pings, the probes keep the mappings of the
+// NAT gateways which drop the idle connections sooner alive. The keepalive
+// is disabled if idle is 0
+func WithTCPKeepAlive(idle time.Duration, interval time.Duration, count int) Option {
+	return func(dialer *dialOptions) error {
+		//the net.Dialer keepalive would override the options below
+		dialer.netDialer.KeepAlive = -1
+		if idle == 0 {
+			return nil
+		}
+		if idle < time.Second || interval < time.Second || count < 1 {
+			return errors.New("the TCP keepalive idle time and interval must be at least 1s, " +
+				"and the count at least 1")
+		}
+		dialer.socketOptions = append(dialer.socketOptions, func(fd int) error {
+			if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+				return err
+			}
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE,
+				int(idle/time.Second)); err != nil {
+				return err
+			}
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL,
+				int(interval/time.Second)); err != nil {
+				return err
+			}
+			return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+		})
+		return nil
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//reads the integer socket option of the connection
+func getsockoptInt(t *testing.T, conn net.Conn, level int, option int) int {
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	assert.NoError(t, err)
+	var value int
+	var optionErr error
+	err = rawConn.Control(func(fd uintptr) {
+		value, optionErr = syscall.GetsockoptInt(int(fd), level, option)
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, optionErr)
+	return value
+}
+
+func TestWithTCPKeepAlive(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(sleepyHandler))
+	defer s.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		idle      time.Duration
+		interval  time.Duration
+		count     int
+		keepAlive int
+		err       string
+	}{
+		"enabled": {
+			idle:      45 * time.Second,
+			interval:  7 * time.Second,
+			count:     4,
+			keepAlive: 1,
+		},
+		"disabled": {},
+		"invalid interval": {
+			idle:     45 * time.Second,
+			interval: time.Millisecond,
+			count:    4,
+			err:      "the TCP keepalive idle time and interval must be at least 1s, and the count at least 1",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			c, err := NewConnection(*u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "",
+				WithBind("lo", nil), WithTCPKeepAlive(tc.idle, tc.interval, tc.count))
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			defer c.Close()
+
+			conn := c.connection.UnderlyingConn()
+			assert.Equal(t, tc.keepAlive, getsockoptInt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE))
+			if tc.keepAlive == 0 {
+				return
+			}
+			assert.Equal(t, 45, getsockoptInt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE))
+			assert.Equal(t, 7, getsockoptInt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL))
+			assert.Equal(t, 4, getsockoptInt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT))
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// the SOCKS protocol version 5 values, see RFC 1928 and RFC 1929
+const (
+	socks5Version          = 0x05
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+	socks5PasswordVersion  = 0x01
+	socks5Connect          = 0x01
+	socks5AddressIPv4      = 0x01
+	socks5AddressDomain    = 0x03
+	socks5AddressIPv6      = 0x04
+	socks5Succeeded        = 0x00
+)
+
+var socks5Replies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// socks5Dialer connects to the server through a SOCKS5 proxy, authenticated
+// with the username and the password, if any; the proxy is given the host
+// name of the server, and resolves it
+type socks5Dialer struct {
+	proxyAddress string
+	username     string
+	password     string
+	// dials the proxy
+	forward func(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// DialContext connects to the address, a host:port, through the proxy
+func (d *socks5Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	conn, err := d.forward(ctx, network, d.proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: can't connect to the proxy %s: %w", d.proxyAddress, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	if err := d.handshake(conn, address); err != nil {
+		conn.Close()
+		return nil, errors.New("socks5: " + err.Error())
+	}
+	return conn, nil
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return errors.New("invalid port: " + portString)
+	}
+
+	methods := []byte{socks5AuthNone}
+	if d.username != "" {
+		methods = append(methods, socks5AuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if err := d.authenticate(conn); err != nil {
+			return err
+		}
+	case socks5AuthNoAcceptable:
+		return errors.New("the proxy accepts none of the authentication methods")
+	default:
+		return fmt.Errorf("unexpected authentication method %d", reply[1])
+	}
+
+	request := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long: " + host)
+		}
+		request = append(request, socks5AddressDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5AddressIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5AddressIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	//version, reply, reserved, and the type of the bound address
+	reply = make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+	if reply[1] != socks5Succeeded {
+		message, ok := socks5Replies[reply[1]]
+		if !ok {
+			message = "unknown error " + strconv.Itoa(int(reply[1]))
+		}
+		return errors.New("the proxy failed to connect to " + address + ": " + message)
+	}
+	var boundLength int
+	switch reply[3] {
+	case socks5AddressIPv4:
+		boundLength = net.IPv4len
+	case socks5AddressIPv6:
+		boundLength = net.IPv6len
+	case socks5AddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		boundLength = int(length[0])
+	default:
+		return fmt.Errorf("unexpected address type %d", reply[3])
+	}
+	//the bound address and port are of no use
+	_, err = io.ReadFull(conn, make([]byte, boundLength+2))
+	return err
+}
+
+//the username and password authentication of RFC 1929
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	if len(d.username) > 255 || len(d.password) > 255 {
+		return errors.New("the username and the password must be at most 255 bytes long")
+	}
+	request := []byte{socks5PasswordVersion, byte(len(d.username))}
+	request = append(request, d.username...)
+	request = append(request, byte(len(d.password)))
+	request = append(request, d.password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("the proxy rejected the username and password")
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//socks5Request is what the fake SOCKS5 proxy was asked for
+type socks5Request struct {
+	method      byte
+	username    string
+	password    string
+	addressType byte
+	address     string
+}
+
+//fakeSOCKS5Proxy is a SOCKS5 proxy accepting the username and password
+//given, or no authentication if empty, and connecting every CONNECT request
+//to upstream, answering with reply
+func fakeSOCKS5Proxy(t *testing.T, username string, password string, reply byte, upstream string) (net.Listener, <-chan socks5Request) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	requests := make(chan socks5Request, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, username, password, reply, upstream, requests)
+		}
+	}()
+	return l, requests
+}
+
+func serveSOCKS5(conn net.Conn, username string, password string, reply byte, upstream string, requests chan<- socks5Request) {
+	defer conn.Close()
+	var request socks5Request
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != socks5Version {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	request.method = socks5AuthNoAcceptable
+	for _, method := range methods {
+		if (username == "" && method == socks5AuthNone) || (username != "" && method == socks5AuthPassword) {
+			request.method = method
+		}
+	}
+	conn.Write([]byte{socks5Version, request.method})
+	if request.method == socks5AuthNoAcceptable {
+		requests <- request
+		return
+	}
+	if request.method == socks5AuthPassword {
+		fields := make([][]byte, 2)
+		version := make([]byte, 1)
+		if _, err := io.ReadFull(conn, version); err != nil {
+			return
+		}
+		for i := range fields {
+			length := make([]byte, 1)
+			if _, err := io.ReadFull(conn, length); err != nil {
+				return
+			}
+			fields[i] = make([]byte, length[0])
+			if _, err := io.ReadFull(conn, fields[i]); err != nil {
+				return
+			}
+		}
+		request.username, request.password = string(fields[0]), string(fields[1])
+		if request.username != username || request.password != password {
+			conn.Write([]byte{socks5PasswordVersion, 1})
+			requests <- request
+			return
+		}
+		conn.Write([]byte{socks5PasswordVersion, 0})
+	}
+
+	connect := make([]byte, 4)
+	if _, err := io.ReadFull(conn, connect); err != nil || connect[1] != socks5Connect {
+		return
+	}
+	request.addressType = connect[3]
+	var host []byte
+	switch request.addressType {
+	case socks5AddressDomain:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		host = make([]byte, length[0])
+	case socks5AddressIPv4:
+		host = make([]byte, net.IPv4len)
+	default:
+		host = make([]byte, net.IPv6len)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, host)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return
+	}
+	if request.addressType == socks5AddressDomain {
+		request.address = string(host)
+	} else {
+		request.address = net.IP(host).String()
+	}
+	request.address = net.JoinHostPort(request.address, strconv.Itoa(int(port[0])<<8|int(port[1])))
+	requests <- request
+
+	conn.Write([]byte{socks5Version, reply, 0, socks5AddressIPv4, 127, 0, 0, 1, 0, 0})
+	if reply != socks5Succeeded {
+		return
+	}
+	target, err := net.Dial("tcp", upstream)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+func TestNewConnectionSOCKS5Proxy(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(helloHandler))
+	defer s.Close()
+	serverURL, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		username      string
+		password      string
+		userinfo      *url.Userinfo
+		host          string
+		reply         byte
+		addressType   byte
+		address       string
+		expectedError string
+	}{
+		"no authentication": {
+			host:        "mender.example.com",
+			addressType: socks5AddressDomain,
+			address:     "mender.example.com:443",
+		},
+		"authentication": {
+			username:    "user",
+			password:    "password",
+			userinfo:    url.UserPassword("user", "password"),
+			host:        "mender.example.com",
+			addressType: socks5AddressDomain,
+			address:     "mender.example.com:443",
+		},
+		"ip address": {
+			host:        "192.0.2.1",
+			addressType: socks5AddressIPv4,
+			address:     "192.0.2.1:443",
+		},
+		"wrong password": {
+			username:      "user",
+			password:      "password",
+			userinfo:      url.UserPassword("user", "wrong"),
+			host:          "mender.example.com",
+			expectedError: "socks5: the proxy rejected the username and password",
+		},
+		"authentication required": {
+			username:      "user",
+			password:      "password",
+			host:          "mender.example.com",
+			expectedError: "socks5: the proxy accepts none of the authentication methods",
+		},
+		"connection refused": {
+			host:          "mender.example.com",
+			reply:         0x05,
+			addressType:   socks5AddressDomain,
+			address:       "mender.example.com:443",
+			expectedError: "socks5: the proxy failed to connect to mender.example.com:443: connection refused",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			proxy, requests := fakeSOCKS5Proxy(t, tc.username, tc.password, tc.reply, serverURL.Host)
+			defer proxy.Close()
+			proxyURL := &url.URL{Scheme: "socks5", Host: proxy.Addr().String(), User: tc.userinfo}
+
+			//the host is not resolved locally, the proxy connects to
+			//the test server whatever it is asked for
+			u := url.URL{Scheme: "ws", Host: net.JoinHostPort(tc.host, "443"), Path: "/"}
+			c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "",
+				WithSOCKS5Proxy(proxyURL))
+
+			select {
+			case r := <-requests:
+				if tc.userinfo != nil {
+					assert.Equal(t, tc.userinfo.Username(), r.username)
+				}
+				assert.Equal(t, tc.addressType, r.addressType)
+				assert.Equal(t, tc.address, r.address)
+			case <-time.After(time.Second):
+				t.Fatal("the proxy got no request")
+			}
+
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				assert.Nil(t, c)
+				return
+			}
+			assert.NoError(t, err)
+			if !assert.NotNil(t, c) {
+				return
+			}
+			defer c.Close()
+			m, err := c.ReadMessage()
+			assert.NoError(t, err)
+			assert.Equal(t, helloMessage, string(m.Body))
+		})
+	}
+}
+
+func TestWithSOCKS5ProxyUnsupportedScheme(t *testing.T) {
+	u := url.URL{Scheme: "ws", Host: "localhost:1", Path: "/"}
+	proxyURL := &url.URL{Scheme: "http", Host: "localhost:3128"}
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "", WithSOCKS5Proxy(proxyURL))
+	assert.EqualError(t, err, "unsupported proxy scheme: http")
+	assert.Nil(t, c)
+}
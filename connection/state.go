@@ -0,0 +1,136 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// State is the state of the connection to the server
+type State int
+
+const (
+	// StateDisconnected is the initial state, and the one after giving up
+	// reconnecting
+	StateDisconnected State = iota
+	// StateAuthenticating is waiting for the JWT token to connect with
+	StateAuthenticating
+	// StateConnected has the websocket connected to the server
+	StateConnected
+	// StateReconnecting lost the websocket and is connecting it again
+	StateReconnecting
+	// StateShuttingDown is the final state, there is no way out of it
+	StateShuttingDown
+)
+
+var stateNames = map[State]string{
+	StateDisconnected:   "Disconnected",
+	StateAuthenticating: "Authenticating",
+	StateConnected:      "Connected",
+	StateReconnecting:   "Reconnecting",
+	StateShuttingDown:   "ShuttingDown",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return "State(" + strconv.Itoa(int(s)) + ")"
+}
+
+// the states each state can go to
+var stateTransitions = map[State][]State{
+	StateDisconnected:   {StateAuthenticating, StateReconnecting, StateShuttingDown},
+	StateAuthenticating: {StateConnected, StateReconnecting, StateDisconnected, StateShuttingDown},
+	StateConnected:      {StateReconnecting, StateAuthenticating, StateDisconnected, StateShuttingDown},
+	StateReconnecting:   {StateConnected, StateAuthenticating, StateDisconnected, StateShuttingDown},
+	StateShuttingDown:   {},
+}
+
+// ErrInvalidTransition is returned when the state can't go to the requested one
+var ErrInvalidTransition = errors.New("invalid connection state transition")
+
+// Transition is a change of the connection state
+type Transition struct {
+	From State
+	To   State
+}
+
+// StateMachine tracks the state of the connection to the server; the
+// transitions are serialized, and the subscribers are notified of them in
+// the order they happen
+type StateMachine struct {
+	mutex       sync.Mutex
+	state       State
+	notifyMutex sync.Mutex
+	subscribers []func(Transition)
+}
+
+// NewStateMachine returns a new StateMachine in the StateDisconnected state
+func NewStateMachine() *StateMachine {
+	return &StateMachine{
+		state: StateDisconnected,
+	}
+}
+
+// CurrentState returns the current state
+func (m *StateMachine) CurrentState() State {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.state
+}
+
+// Subscribe calls f on every transition; f runs in the goroutine of the
+// transition and must not call Transition itself
+func (m *StateMachine) Subscribe(f func(Transition)) {
+	m.notifyMutex.Lock()
+	defer m.notifyMutex.Unlock()
+	m.subscribers = append(m.subscribers, f)
+}
+
+// Transition goes to the given state, notifying the subscribers; going to
+// the current state does nothing
+func (m *StateMachine) Transition(to State) error {
+	m.mutex.Lock()
+	from := m.state
+	if from == to {
+		m.mutex.Unlock()
+		return nil
+	}
+	if !transitionAllowed(from, to) {
+		m.mutex.Unlock()
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, from, to)
+	}
+	m.state = to
+	//the notifications of the transitions keep their order
+	m.notifyMutex.Lock()
+	m.mutex.Unlock()
+	defer m.notifyMutex.Unlock()
+	for _, f := range m.subscribers {
+		f(Transition{From: from, To: to})
+	}
+	return nil
+}
+
+func transitionAllowed(from State, to State) bool {
+	for _, allowed := range stateTransitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
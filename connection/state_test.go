@@ -0,0 +1,133 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateMachineReconnectCycle(t *testing.T) {
+	m := NewStateMachine()
+	assert.Equal(t, StateDisconnected, m.CurrentState())
+
+	var transitions []Transition
+	m.Subscribe(func(tr Transition) {
+		//the state is readable from the subscribers
+		assert.Equal(t, tr.To, m.CurrentState())
+		transitions = append(transitions, tr)
+	})
+
+	for _, state := range []State{
+		StateAuthenticating,
+		StateConnected,
+		StateReconnecting,
+		StateReconnecting,
+		StateConnected,
+		StateShuttingDown,
+	} {
+		assert.NoError(t, m.Transition(state))
+		assert.Equal(t, state, m.CurrentState())
+	}
+	assert.Equal(t, []Transition{
+		{From: StateDisconnected, To: StateAuthenticating},
+		{From: StateAuthenticating, To: StateConnected},
+		{From: StateConnected, To: StateReconnecting},
+		{From: StateReconnecting, To: StateConnected},
+		{From: StateConnected, To: StateShuttingDown},
+	}, transitions)
+
+	err := m.Transition(StateConnected)
+	assert.True(t, errors.Is(err, ErrInvalidTransition))
+	assert.Equal(t, StateShuttingDown, m.CurrentState())
+	assert.Len(t, transitions, 5)
+}
+
+func TestStateMachineTransition(t *testing.T) {
+	testCases := map[string]struct {
+		from State
+		to   State
+		err  bool
+	}{
+		"disconnected to authenticating": {
+			from: StateDisconnected,
+			to:   StateAuthenticating,
+		},
+		"disconnected to connected": {
+			from: StateDisconnected,
+			to:   StateConnected,
+			err:  true,
+		},
+		"reconnecting to disconnected": {
+			from: StateReconnecting,
+			to:   StateDisconnected,
+		},
+		"shutting down to disconnected": {
+			from: StateShuttingDown,
+			to:   StateDisconnected,
+			err:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &StateMachine{state: tc.from}
+			err := m.Transition(tc.to)
+			if tc.err {
+				assert.True(t, errors.Is(err, ErrInvalidTransition))
+				assert.Equal(t, tc.from, m.CurrentState())
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.to, m.CurrentState())
+		})
+	}
+}
+
+func TestStateMachineConcurrentTransitions(t *testing.T) {
+	m := NewStateMachine()
+	assert.NoError(t, m.Transition(StateAuthenticating))
+
+	var last State
+	consistent := true
+	m.Subscribe(func(tr Transition) {
+		//every transition starts where the previous one ended
+		if last != StateDisconnected && tr.From != last {
+			consistent = false
+		}
+		last = tr.To
+	})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_ = m.Transition(StateConnected)
+				_ = m.Transition(StateReconnecting)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.True(t, consistent)
+}
+
+func TestStateString(t *testing.T) {
+	assert.Equal(t, "Reconnecting", StateReconnecting.String())
+	assert.Equal(t, "State(42)", State(42).String())
+}
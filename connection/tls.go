@@ -0,0 +1,82 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// DefaultMinTLSVersion is the oldest TLS version the connections accept
+// unless told otherwise
+const DefaultMinTLSVersion = "1.2"
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSVersion returns the TLS version named "1.0", "1.1", "1.2" or "1.3"
+func TLSVersion(name string) (uint16, error) {
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, errors.New("unsupported TLS version: " + name +
+			"; it must be one of 1.0, 1.1, 1.2 or 1.3")
+	}
+	return version, nil
+}
+
+// CipherSuites returns the IDs of the cipher suites named as in crypto/tls,
+// e.g.: TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256; the insecure ones and the
+// TLS 1.3 ones, which can't be chosen, are rejected
+func CipherSuites(names []string) ([]uint16, error) {
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		var suite *tls.CipherSuite
+		for _, s := range tls.CipherSuites() {
+			if s.Name == name {
+				suite = s
+				break
+			}
+		}
+		if suite == nil {
+			return nil, errors.New("unsupported cipher suite: " + name)
+		}
+		preTLS13 := false
+		for _, version := range suite.SupportedVersions {
+			if version != tls.VersionTLS13 {
+				preTLS13 = true
+			}
+		}
+		if !preTLS13 {
+			return nil, errors.New("the TLS 1.3 cipher suites can't be chosen: " + name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// WithTLS restricts the connection to the TLS versions from minVersion on
+// and, if not empty, to the cipher suites, which only apply up to TLS 1.2
+func WithTLS(minVersion uint16, cipherSuites []uint16) Option {
+	return func(dialer *dialOptions) error {
+		dialer.TLSClientConfig.MinVersion = minVersion
+		if len(cipherSuites) > 0 {
+			dialer.TLSClientConfig.CipherSuites = cipherSuites
+		}
+		return nil
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package connection
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTLSVersion(t *testing.T) {
+	testCases := map[string]struct {
+		name    string
+		version uint16
+		err     bool
+	}{
+		"1.2": {
+			name:    "1.2",
+			version: tls.VersionTLS12,
+		},
+		"1.3": {
+			name:    "1.3",
+			version: tls.VersionTLS13,
+		},
+		"unsupported": {
+			name: "1.4",
+			err:  true,
+		},
+		"ssl": {
+			name: "SSLv3",
+			err:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			version, err := TLSVersion(tc.name)
+			if tc.err {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.name)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.version, version)
+			}
+		})
+	}
+}
+
+func TestCipherSuites(t *testing.T) {
+	testCases := map[string]struct {
+		names []string
+		ids   []uint16
+		err   string
+	}{
+		"none": {
+			ids: []uint16{},
+		},
+		"ok": {
+			names: []string{
+				"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+				"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+			},
+			ids: []uint16{
+				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			},
+		},
+		"unknown": {
+			names: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_NULL"},
+			err:   "unsupported cipher suite: TLS_NULL",
+		},
+		"insecure": {
+			names: []string{"TLS_RSA_WITH_RC4_128_SHA"},
+			err:   "unsupported cipher suite: TLS_RSA_WITH_RC4_128_SHA",
+		},
+		"tls 1.3": {
+			names: []string{"TLS_AES_128_GCM_SHA256"},
+			err:   "the TLS 1.3 cipher suites can't be chosen: TLS_AES_128_GCM_SHA256",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			ids, err := CipherSuites(tc.names)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.ids, ids)
+			}
+		})
+	}
+}
+
+func TestWithTLS(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(sleepyHandler))
+	s.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	s.StartTLS()
+	defer s.Close()
+	serverURL, err := url.Parse(s.URL)
+	assert.NoError(t, err)
+	u := url.URL{Scheme: "wss", Host: serverURL.Host, Path: "/"}
+
+	c, err := NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "",
+		WithTLS(tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}))
+	assert.NoError(t, err)
+	if assert.NotNil(t, c) {
+		c.Close()
+	}
+
+	c, err = NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "",
+		WithTLS(tls.VersionTLS13, nil))
+	assert.Error(t, err)
+	assert.Nil(t, c)
+
+	c, err = NewConnection(u, "some-token", writeWait, maxMessageSize, defaultPingWait, true, "",
+		WithTLS(tls.VersionTLS12, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}))
+	assert.Error(t, err)
+	assert.Nil(t, c)
+}
@@ -0,0 +1,202 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package control
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SocketMode is the mode of the control socket: only its owner connects
+	SocketMode = 0600
+	// the answers end with a line starting with one of these
+	replyOK    = "OK"
+	replyError = "ERR"
+	// commands handled by the server itself
+	commandHelp = "help"
+	commandQuit = "quit"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrNotSocket      = errors.New("not a socket")
+)
+
+// Command answers a command of the control socket, writing its output to
+// out; the arguments are the words following the command name
+type Command func(out io.Writer, args []string) error
+
+// Server serves a tiny text protocol on a Unix domain socket, for debugging
+// the daemon on the device: a client writes one command per line, and gets
+// its output followed by a line with OK, or ERR and the error; quit closes
+// the connection, help lists the commands
+type Server struct {
+	path     string
+	commands map[string]Command
+	mutex    sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool
+	wg       sync.WaitGroup
+}
+
+// NewServer returns a new Server listening on path, answering the commands
+// by name
+func NewServer(path string, commands map[string]Command) *Server {
+	return &Server{
+		path:     path,
+		commands: commands,
+		conns:    make(map[net.Conn]bool),
+	}
+}
+
+// Start creates the socket, replacing the one left over by a previous run,
+// and serves the clients in the background
+func (s *Server) Start() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if info, err := os.Lstat(s.path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s: %w", s.path, ErrNotSocket)
+		}
+		if err := os.Remove(s.path); err != nil {
+			return err
+		}
+	}
+	//the socket is created in a private directory, so no one else can
+	//connect before the chmod, and moved in place once restricted
+	dir, err := ioutil.TempDir(filepath.Dir(s.path), ".control-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "socket")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	//the socket is removed from its final path by Stop
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(socket, SocketMode)
+	if err == nil {
+		err = os.Rename(socket, s.path)
+	}
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	s.listener = listener
+	s.wg.Add(1)
+	go s.serve(listener)
+	return nil
+}
+
+// Stop closes the socket and the client connections, and removes the socket
+func (s *Server) Stop() {
+	s.mutex.Lock()
+	if s.listener == nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.listener.Close()
+	s.listener = nil
+	os.Remove(s.path)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve(listener net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		if s.listener == nil {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mutex.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, conn)
+		s.mutex.Unlock()
+		conn.Close()
+	}()
+	log.Debug("control socket: client connected")
+	out := bufio.NewWriter(conn)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		words := strings.Fields(scanner.Text())
+		if len(words) == 0 {
+			continue
+		}
+		if words[0] == commandQuit {
+			return
+		}
+		err := s.run(out, words[0], words[1:])
+		if err != nil {
+			fmt.Fprintf(out, "%s %s\n", replyError, err.Error())
+		} else {
+			fmt.Fprintln(out, replyOK)
+		}
+		if out.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) run(out io.Writer, name string, args []string) error {
+	if name == commandHelp {
+		names := []string{commandHelp, commandQuit}
+		for name := range s.commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintln(out, name)
+		}
+		return nil
+	}
+	command, ok := s.commands[name]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownCommand, name)
+	}
+	log.Debugf("control socket: %s", name)
+	return command(out, args)
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package control
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//sends the command and returns the lines of the answer, up to the OK or
+//ERR line included
+func sendCommand(t *testing.T, conn net.Conn, reader *bufio.Reader, command string) []string {
+	_, err := fmt.Fprintln(conn, command)
+	assert.NoError(t, err)
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return lines
+		}
+		line = strings.TrimSuffix(line, "\n")
+		lines = append(lines, line)
+		if line == replyOK || strings.HasPrefix(line, replyError+" ") {
+			return lines
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := path.Join(dir, "control.sock")
+
+	var echoed []string
+	s := NewServer(socket, map[string]Command{
+		"echo": func(out io.Writer, args []string) error {
+			echoed = args
+			fmt.Fprintln(out, strings.Join(args, " "))
+			return nil
+		},
+		"fail": func(out io.Writer, args []string) error {
+			return errors.New("failed")
+		},
+	})
+	assert.NoError(t, s.Start())
+
+	info, err := os.Stat(socket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(SocketMode), info.Mode().Perm())
+	//the private directory the socket was created in is gone
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	conn, err := net.Dial("unix", socket)
+	assert.NoError(t, err)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	testCases := map[string]struct {
+		command string
+		answer  []string
+	}{
+		"command": {
+			command: "echo a  b",
+			answer:  []string{"a b", "OK"},
+		},
+		"error": {
+			command: "fail",
+			answer:  []string{"ERR failed"},
+		},
+		"unknown": {
+			command: "reboot now",
+			answer:  []string{"ERR unknown command: reboot"},
+		},
+		"help": {
+			command: "help",
+			answer:  []string{"echo", "fail", "help", "quit", "OK"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.answer, sendCommand(t, conn, reader, tc.command))
+		})
+	}
+	assert.Equal(t, []string{"a", "b"}, echoed)
+
+	_, err = fmt.Fprintln(conn, "quit")
+	assert.NoError(t, err)
+	_, err = reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err)
+
+	//the clients still connected are disconnected
+	other, err := net.Dial("unix", socket)
+	assert.NoError(t, err)
+	defer other.Close()
+	s.Stop()
+	_, err = bufio.NewReader(other).ReadString('\n')
+	assert.Error(t, err)
+	_, err = os.Stat(socket)
+	assert.True(t, os.IsNotExist(err))
+	s.Stop()
+}
+
+func TestServerStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	//left over by a previous run
+	socket := path.Join(dir, "control.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	s := NewServer(socket, nil)
+	assert.NoError(t, s.Start())
+	s.Stop()
+
+	//not a socket, not removed
+	file := path.Join(dir, "file")
+	assert.NoError(t, ioutil.WriteFile(file, []byte("data"), 0600))
+	s = NewServer(file, nil)
+	err = s.Start()
+	assert.True(t, errors.Is(err, ErrNotSocket))
+	_, err = os.Stat(file)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package dbusapi
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mendersoftware/mender-shell/client/dbus"
+)
+
+// DBus constants of the mender-shell sessions API
+const (
+	DBusObjectName                  = "io.mender.Shell"
+	DBusObjectPath                  = "/io/mender/Shell"
+	DBusInterfaceName               = "io.mender.Shell1"
+	DBusMethodNameGetActiveSessions = "GetActiveSessions"
+	DBusMethodNameListSessions      = "ListSessions"
+	DBusMethodNameKillSession       = "KillSession"
+	DBusSignalNameSessionOpened     = "SessionOpened"
+	DBusSignalNameSessionClosed     = "SessionClosed"
+)
+
+const interfaceXML = `<node>
+  <interface name="` + DBusInterfaceName + `">
+    <method name="` + DBusMethodNameGetActiveSessions + `">
+      <arg type="s" name="sessions" direction="out"/>
+    </method>
+    <method name="` + DBusMethodNameListSessions + `">
+      <arg type="a(sss)" name="sessions" direction="out"/>
+    </method>
+    <method name="` + DBusMethodNameKillSession + `">
+      <arg type="s" name="session_id" direction="in"/>
+    </method>
+    <signal name="` + DBusSignalNameSessionOpened + `">
+      <arg type="s" name="session_id"/>
+      <arg type="s" name="user_id"/>
+    </signal>
+    <signal name="` + DBusSignalNameSessionClosed + `">
+      <arg type="s" name="session_id"/>
+      <arg type="s" name="user_id"/>
+    </signal>
+  </interface>
+</node>`
+
+var (
+	ErrSessionIDMissing        = errors.New("missing session id")
+	ErrKillSessionNotSupported = errors.New("killing the sessions is not supported")
+)
+
+// Session is an active shell session; ListSessions returns them as an array
+// of (session id, user id, started at) tuples, GetActiveSessions, kept for
+// the existing clients, as a JSON array
+type Session struct {
+	SessionID string `json:"session_id"`
+	UserID    string `json:"user_id"`
+	//the time the session started at, in the RFC 3339 format
+	StartedAt string `json:"started_at,omitempty"`
+}
+
+// SessionsAPI exports the mender-shell sessions over DBus: it emits the
+// SessionOpened and SessionClosed signals, with the session and the user id,
+// lists the active sessions with the ListSessions method, and terminates one
+// by id with the KillSession method
+type SessionsAPI struct {
+	dbusAPI        dbus.DBusAPI
+	activeSessions func() []Session
+	killSession    func(sessionID string) error
+	mutex          sync.Mutex
+	dbusConnection dbus.Handle
+	objectID       uint
+	nameID         uint
+	started        bool
+}
+
+// NewSessionsAPI returns a new SessionsAPI, listing the active sessions
+// with activeSessions, and terminating them with killSession; the global
+// DBusAPI is used if dbusAPI is nil
+func NewSessionsAPI(dbusAPI dbus.DBusAPI, activeSessions func() []Session,
+	killSession func(sessionID string) error) (*SessionsAPI, error) {
+	if dbusAPI == nil {
+		var err error
+		dbusAPI, err = dbus.GetDBusAPI()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &SessionsAPI{
+		dbusAPI:        dbusAPI,
+		activeSessions: activeSessions,
+		killSession:    killSession,
+	}, nil
+}
+
+func (a *SessionsAPI) methodCallCallbacks() map[string]dbus.MethodCallCallback {
+	return map[string]dbus.MethodCallCallback{
+		DBusMethodNameGetActiveSessions: a.getActiveSessions,
+		DBusMethodNameListSessions:      a.listSessions,
+		DBusMethodNameKillSession:       a.killSessionCall,
+	}
+}
+
+// Start exports the sessions object on the message bus, dbus.GBusTypeSystem
+// or dbus.GBusTypeSession, and acquires the DBusObjectName
+func (a *SessionsAPI) Start(busType uint) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	dbusConnection, err := a.dbusAPI.BusGet(busType)
+	if err != nil {
+		return err
+	}
+	objectID, err := a.dbusAPI.BusRegisterInterface(dbusConnection, DBusObjectPath, interfaceXML)
+	if err != nil {
+		return err
+	}
+	for method, callback := range a.methodCallCallbacks() {
+		a.dbusAPI.RegisterMethodCallCallback(DBusObjectPath, DBusInterfaceName, method, callback)
+	}
+	nameID, err := a.dbusAPI.BusOwnNameConnection(dbusConnection, DBusObjectName)
+	if err != nil {
+		a.unregisterMethodCallCallbacks()
+		a.dbusAPI.BusUnregisterInterface(dbusConnection, objectID)
+		return err
+	}
+	a.dbusConnection = dbusConnection
+	a.objectID = objectID
+	a.nameID = nameID
+	a.started = true
+	return nil
+}
+
+// Stop releases the DBusObjectName and unexports the sessions object
+func (a *SessionsAPI) Stop() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.started {
+		return
+	}
+	a.dbusAPI.BusUnownName(a.nameID)
+	a.unregisterMethodCallCallbacks()
+	a.dbusAPI.BusUnregisterInterface(a.dbusConnection, a.objectID)
+	a.started = false
+}
+
+func (a *SessionsAPI) unregisterMethodCallCallbacks() {
+	for method := range a.methodCallCallbacks() {
+		a.dbusAPI.UnregisterMethodCallCallback(DBusObjectPath, DBusInterfaceName, method)
+	}
+}
+
+// SessionOpened emits the SessionOpened signal
+func (a *SessionsAPI) SessionOpened(sessionId string, userId string) {
+	a.emitSignal(DBusSignalNameSessionOpened, sessionId, userId)
+}
+
+// SessionClosed emits the SessionClosed signal
+func (a *SessionsAPI) SessionClosed(sessionId string, userId string) {
+	a.emitSignal(DBusSignalNameSessionClosed, sessionId, userId)
+}
+
+func (a *SessionsAPI) emitSignal(signalName string, sessionId string, userId string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.started {
+		return
+	}
+	err := a.dbusAPI.EmitSignal(a.dbusConnection, "", DBusObjectPath, DBusInterfaceName,
+		signalName, []string{sessionId, userId})
+	if err != nil {
+		log.Errorf("failed to emit the DBus signal %s for session %s: %s", signalName, sessionId, err.Error())
+	}
+}
+
+func (a *SessionsAPI) getActiveSessions(objectPath string, interfaceName string, methodName string, args []string) (interface{}, error) {
+	sessions := []Session{}
+	if a.activeSessions != nil {
+		sessions = append(sessions, a.activeSessions()...)
+	}
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (a *SessionsAPI) listSessions(objectPath string, interfaceName string, methodName string, args []string) (interface{}, error) {
+	sessions := dbus.StringTuples{Width: 3, Tuples: [][]string{}}
+	if a.activeSessions != nil {
+		for _, s := range a.activeSessions() {
+			sessions.Tuples = append(sessions.Tuples, []string{s.SessionID, s.UserID, s.StartedAt})
+		}
+	}
+	return sessions, nil
+}
+
+func (a *SessionsAPI) killSessionCall(objectPath string, interfaceName string, methodName string, args []string) (interface{}, error) {
+	if len(args) < 1 || args[0] == "" {
+		return nil, ErrSessionIDMissing
+	}
+	if a.killSession == nil {
+		return nil, ErrKillSessionNotSupported
+	}
+	log.Infof("killing session %s on the request over DBus", args[0])
+	if err := a.killSession(args[0]); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package dbusapi
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/mendersoftware/mender-shell/client/dbus"
+	dbus_mocks "github.com/mendersoftware/mender-shell/client/dbus/mocks"
+)
+
+var methods = []string{
+	DBusMethodNameGetActiveSessions,
+	DBusMethodNameListSessions,
+	DBusMethodNameKillSession,
+}
+
+func TestSessionsAPIStart(t *testing.T) {
+	testCases := map[string]struct {
+		busGetError   error
+		registerError error
+		ownNameError  error
+		err           bool
+	}{
+		"ok": {},
+		"error BusGet": {
+			busGetError: errors.New("error"),
+			err:         true,
+		},
+		"error BusRegisterInterface": {
+			registerError: errors.New("error"),
+			err:           true,
+		},
+		"error BusOwnNameConnection": {
+			ownNameError: errors.New("error"),
+			err:          true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dbusAPI := &dbus_mocks.DBusAPI{}
+			defer dbusAPI.AssertExpectations(t)
+
+			conn := dbus.Handle(nil)
+			dbusAPI.On("BusGet", uint(dbus.GBusTypeSystem)).Return(conn, tc.busGetError)
+			if tc.busGetError == nil {
+				dbusAPI.On("BusRegisterInterface", conn, DBusObjectPath, interfaceXML).
+					Return(uint(1), tc.registerError)
+			}
+			if tc.busGetError == nil && tc.registerError == nil {
+				for _, method := range methods {
+					dbusAPI.On("RegisterMethodCallCallback", DBusObjectPath, DBusInterfaceName,
+						method, mock.AnythingOfType("dbus.MethodCallCallback")).Return()
+					dbusAPI.On("UnregisterMethodCallCallback", DBusObjectPath, DBusInterfaceName,
+						method).Return()
+				}
+				dbusAPI.On("BusOwnNameConnection", conn, DBusObjectName).Return(uint(2), tc.ownNameError)
+				dbusAPI.On("BusUnregisterInterface", conn, uint(1)).Return(true)
+			}
+			if !tc.err {
+				dbusAPI.On("BusUnownName", uint(2)).Return()
+			}
+
+			api, err := NewSessionsAPI(dbusAPI, nil, nil)
+			assert.NoError(t, err)
+			err = api.Start(dbus.GBusTypeSystem)
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			api.Stop()
+		})
+	}
+}
+
+func TestSessionsAPISignals(t *testing.T) {
+	dbusAPI := &dbus_mocks.DBusAPI{}
+	defer dbusAPI.AssertExpectations(t)
+
+	api, err := NewSessionsAPI(dbusAPI, nil, nil)
+	assert.NoError(t, err)
+
+	//not started, nothing is emitted
+	api.SessionOpened("session-id", "user-id")
+
+	conn := dbus.Handle(nil)
+	dbusAPI.On("BusGet", uint(dbus.GBusTypeSystem)).Return(conn, nil)
+	dbusAPI.On("BusRegisterInterface", conn, DBusObjectPath, interfaceXML).Return(uint(1), nil)
+	for _, method := range methods {
+		dbusAPI.On("RegisterMethodCallCallback", DBusObjectPath, DBusInterfaceName,
+			method, mock.AnythingOfType("dbus.MethodCallCallback")).Return()
+	}
+	dbusAPI.On("BusOwnNameConnection", conn, DBusObjectName).Return(uint(2), nil)
+	assert.NoError(t, api.Start(dbus.GBusTypeSystem))
+
+	dbusAPI.On("EmitSignal", conn, "", DBusObjectPath, DBusInterfaceName,
+		DBusSignalNameSessionOpened, []string{"session-id", "user-id"}).Return(nil).Once()
+	api.SessionOpened("session-id", "user-id")
+	dbusAPI.On("EmitSignal", conn, "", DBusObjectPath, DBusInterfaceName,
+		DBusSignalNameSessionClosed, []string{"session-id", "user-id"}).Return(errors.New("error")).Once()
+	api.SessionClosed("session-id", "user-id")
+}
+
+func TestSessionsAPIGetActiveSessions(t *testing.T) {
+	testCases := map[string]struct {
+		sessions []Session
+		result   string
+	}{
+		"no sessions": {
+			result: "[]",
+		},
+		"sessions": {
+			sessions: []Session{
+				{SessionID: "session-1", UserID: "user-1"},
+				{SessionID: "session-2", UserID: "user-2"},
+			},
+			result: `[{"session_id":"session-1","user_id":"user-1"},` +
+				`{"session_id":"session-2","user_id":"user-2"}]`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			api, err := NewSessionsAPI(&dbus_mocks.DBusAPI{}, func() []Session {
+				return tc.sessions
+			}, nil)
+			assert.NoError(t, err)
+			result, err := api.getActiveSessions(DBusObjectPath, DBusInterfaceName,
+				DBusMethodNameGetActiveSessions, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.result, result)
+		})
+	}
+}
+
+func TestSessionsAPIListSessions(t *testing.T) {
+	api, err := NewSessionsAPI(&dbus_mocks.DBusAPI{}, func() []Session {
+		return []Session{
+			{SessionID: "session-1", UserID: "user-1", StartedAt: "2020-10-01T12:00:00Z"},
+		}
+	}, nil)
+	assert.NoError(t, err)
+	callback := api.methodCallCallbacks()[DBusMethodNameListSessions]
+	result, err := callback(DBusObjectPath, DBusInterfaceName, DBusMethodNameListSessions, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, dbus.StringTuples{
+		Width:  3,
+		Tuples: [][]string{{"session-1", "user-1", "2020-10-01T12:00:00Z"}},
+	}, result)
+
+	api, err = NewSessionsAPI(&dbus_mocks.DBusAPI{}, nil, nil)
+	assert.NoError(t, err)
+	result, err = api.listSessions(DBusObjectPath, DBusInterfaceName, DBusMethodNameListSessions, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, dbus.StringTuples{Width: 3, Tuples: [][]string{}}, result)
+}
+
+func TestSessionsAPIKillSession(t *testing.T) {
+	errNotFound := errors.New("session not found")
+	testCases := map[string]struct {
+		args        []string
+		unsupported bool
+		killed      string
+		err         error
+	}{
+		"killed": {
+			args:   []string{"session-1"},
+			killed: "session-1",
+		},
+		"not found": {
+			args:   []string{"session-2"},
+			killed: "session-2",
+			err:    errNotFound,
+		},
+		"missing session id": {
+			err: ErrSessionIDMissing,
+		},
+		"empty session id": {
+			args: []string{""},
+			err:  ErrSessionIDMissing,
+		},
+		"not supported": {
+			args:        []string{"session-1"},
+			unsupported: true,
+			err:         ErrKillSessionNotSupported,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			killed := ""
+			killSession := func(sessionID string) error {
+				killed = sessionID
+				return tc.err
+			}
+			if tc.unsupported {
+				killSession = nil
+			}
+			api, err := NewSessionsAPI(&dbus_mocks.DBusAPI{}, nil, killSession)
+			assert.NoError(t, err)
+			callback := api.methodCallCallbacks()[DBusMethodNameKillSession]
+			result, err := callback(DBusObjectPath, DBusInterfaceName, DBusMethodNameKillSession, tc.args)
+			assert.Nil(t, result)
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.killed, killed)
+		})
+	}
+}
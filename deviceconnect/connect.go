@@ -34,8 +34,12 @@ const (
 	wsProtocol    = "ws"
 )
 
+// DeviceIdentityHeader carries the device identity attributes, as a JSON
+// object, with the websocket handshake request
+const DeviceIdentityHeader = "X-Mender-Device-Identity"
+
 //Websocket connection routine. setup the ping-pong and connection settings
-func Connect(serverUrl string, connectUrl string, skipVerify bool, serverCertificate string, token string) (ws *connection.Connection, err error) {
+func Connect(serverUrl string, connectUrl string, skipVerify bool, serverCertificate string, token string, opts ...connection.Option) (ws *connection.Connection, err error) {
 	parsedUrl, err := url.Parse(serverUrl)
 	if err != nil {
 		return nil, err
@@ -43,7 +47,7 @@ func Connect(serverUrl string, connectUrl string, skipVerify bool, serverCertifi
 
 	scheme := getWebSocketScheme(parsedUrl.Scheme)
 	u := url.URL{Scheme: scheme, Host: parsedUrl.Host, Path: connectUrl}
-	ws, err = connection.NewConnection(u, token, writeWait, maxMessageSize, defaultPingWait, skipVerify, serverCertificate)
+	ws, err = connection.NewConnection(u, token, writeWait, maxMessageSize, defaultPingWait, skipVerify, serverCertificate, opts...)
 	return ws, err
 }
 
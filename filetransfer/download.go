@@ -0,0 +1,128 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package filetransfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	//requests the file in the PropertyPath property
+	MessageTypeDownloadRequest = "download_request"
+	//starts the download, with the PropertyPath, PropertySize and
+	//PropertyMode properties of the file
+	MessageTypeDownloadStart = "download_start"
+	//carries the next chunk of the file being downloaded
+	MessageTypeDownloadChunk = "download_chunk"
+	//ends the download, with the PropertyChecksum of the sent data; the
+	//status is an error and the data holds the reason if it failed
+	MessageTypeDownloadDone = "download_done"
+)
+
+//max bytes of the file sent in a single message
+const DownloadChunkSize = 4096
+
+var (
+	ErrNotRegularFile = errors.New("not a regular file")
+)
+
+// Download reads a file in chunks, computing its checksum on the way
+type Download struct {
+	path string
+	file *os.File
+	info os.FileInfo
+	hash hash.Hash
+	r    io.Reader
+}
+
+// OpenDownload opens the regular file at path for the download; the path,
+// with all its symlinks resolved, has to be inside one of the allowlist
+// directories and the file must not be larger than maxSize
+func OpenDownload(path string, allowlist []string, maxSize int64) (*Download, error) {
+	if !filepath.IsAbs(path) {
+		return nil, ErrPathNotAbsolute
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+	if !underAny(resolved, allowlist) {
+		return nil, ErrPathNotAllowed
+	}
+
+	file, err := os.Open(resolved)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, ErrNotRegularFile
+	}
+	if info.Size() > maxSize {
+		file.Close()
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrFileTooLarge, info.Size(), maxSize)
+	}
+
+	d := &Download{
+		path: resolved,
+		file: file,
+		info: info,
+		hash: sha256.New(),
+	}
+	d.r = io.TeeReader(io.LimitReader(file, info.Size()), d.hash)
+	return d, nil
+}
+
+// Path returns the path of the file, with the symlinks resolved
+func (d *Download) Path() string {
+	return d.path
+}
+
+// Size returns the size of the file when it was opened
+func (d *Download) Size() int64 {
+	return d.info.Size()
+}
+
+// Mode returns the permissions of the file
+func (d *Download) Mode() os.FileMode {
+	return d.info.Mode().Perm()
+}
+
+// Read reads the next chunk of the file; a file growing while it is read
+// is sent up to the size it had when it was opened
+func (d *Download) Read(p []byte) (int, error) {
+	return d.r.Read(p)
+}
+
+// Checksum returns the SHA256 hex checksum of the data read so far
+func (d *Download) Checksum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
+
+// Close closes the file
+func (d *Download) Close() error {
+	return d.file.Close()
+}
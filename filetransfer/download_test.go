@@ -0,0 +1,111 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package filetransfer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	allowed := path.Join(dir, "allowed")
+	other := path.Join(dir, "other")
+	assert.NoError(t, os.Mkdir(allowed, 0700))
+	assert.NoError(t, os.Mkdir(other, 0700))
+	content := []byte("ServerURL=https://mender.io\n")
+	assert.NoError(t, ioutil.WriteFile(path.Join(allowed, "file.conf"), content, 0640))
+	assert.NoError(t, ioutil.WriteFile(path.Join(other, "secret.conf"), content, 0600))
+	assert.NoError(t, os.Symlink(path.Join(allowed, "file.conf"), path.Join(allowed, "link.conf")))
+	assert.NoError(t, os.Symlink(path.Join(other, "secret.conf"), path.Join(allowed, "escape.conf")))
+
+	testCases := map[string]struct {
+		path    string
+		maxSize int64
+		err     error
+	}{
+		"ok": {
+			path:    path.Join(allowed, "file.conf"),
+			maxSize: 1024,
+		},
+		"symlink inside": {
+			path:    path.Join(allowed, "link.conf"),
+			maxSize: 1024,
+		},
+		"outside": {
+			path:    path.Join(other, "secret.conf"),
+			maxSize: 1024,
+			err:     ErrPathNotAllowed,
+		},
+		"symlink escaping": {
+			path:    path.Join(allowed, "escape.conf"),
+			maxSize: 1024,
+			err:     ErrPathNotAllowed,
+		},
+		"allowlist directory itself": {
+			path:    allowed,
+			maxSize: 1024,
+			err:     ErrPathNotAllowed,
+		},
+		"too large": {
+			path:    path.Join(allowed, "file.conf"),
+			maxSize: 10,
+			err:     ErrFileTooLarge,
+		},
+		"relative": {
+			path:    "file.conf",
+			maxSize: 1024,
+			err:     ErrPathNotAbsolute,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			download, err := OpenDownload(tc.path, []string{allowed}, tc.maxSize)
+			if tc.err != nil {
+				assert.True(t, errors.Is(err, tc.err), err)
+				assert.Nil(t, download)
+				return
+			}
+			assert.NoError(t, err)
+			defer download.Close()
+			assert.Equal(t, path.Join(allowed, "file.conf"), download.Path())
+			assert.Equal(t, int64(len(content)), download.Size())
+			assert.Equal(t, os.FileMode(0640), download.Mode())
+
+			data, err := ioutil.ReadAll(download)
+			assert.NoError(t, err)
+			assert.Equal(t, content, data)
+			assert.Equal(t, sha256Hex(content), download.Checksum())
+		})
+	}
+}
+
+func TestDownloadNotRegularFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-download")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, os.Mkdir(path.Join(dir, "subdir"), 0700))
+
+	download, err := OpenDownload(path.Join(dir, "subdir"), []string{dir}, 1024)
+	assert.Equal(t, ErrNotRegularFile, err)
+	assert.Nil(t, download)
+}
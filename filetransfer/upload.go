@@ -0,0 +1,207 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package filetransfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	//starts an upload, with the PropertyPath, PropertySize, PropertyChecksum
+	//and, optionally, PropertyMode properties
+	MessageTypeUploadStart = "upload_start"
+	//carries the next chunk of the file being uploaded
+	MessageTypeUploadChunk = "upload_chunk"
+	//acknowledges the chunk, with the bytes received so far in the
+	//PropertyReceived property
+	MessageTypeUploadAck = "upload_ack"
+	//ends the upload, with the computed PropertyChecksum; the status is
+	//an error and the data holds the reason if the upload failed
+	MessageTypeUploadDone = "upload_done"
+)
+
+const (
+	PropertyPath     = "path"
+	PropertySize     = "size"
+	PropertyChecksum = "checksum"
+	PropertyMode     = "mode"
+	PropertyReceived = "received"
+)
+
+//the mode of the uploaded files when not given
+const DefaultFileMode os.FileMode = 0600
+
+var (
+	ErrPathNotAbsolute  = errors.New("path is not absolute")
+	ErrPathNotAllowed   = errors.New("path is not allowed")
+	ErrFileTooLarge     = errors.New("file is too large")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	ErrSizeExceeded     = errors.New("received more bytes than the declared size")
+	ErrUploadIncomplete = errors.New("upload is incomplete")
+	ErrUploadNotStarted = errors.New("upload not started")
+	ErrChunkTooLarge    = errors.New("chunk is too large")
+)
+
+// AllowedPath returns the path with the symlinks of its directory resolved
+// if it is inside one of the allowlist directories, ErrPathNotAllowed
+// otherwise; the file itself may not exist
+func AllowedPath(path string, allowlist []string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", ErrPathNotAbsolute
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(filepath.Clean(path)))
+	if err != nil {
+		return "", err
+	}
+	resolved := filepath.Join(dir, filepath.Base(path))
+	if underAny(resolved, allowlist) {
+		return resolved, nil
+	}
+	return "", ErrPathNotAllowed
+}
+
+//underAny tells if path is inside one of the directories, resolving their
+//symlinks too
+func underAny(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			continue
+		}
+		if resolved == "/" || strings.HasPrefix(path, resolved+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Upload writes a file sent in chunks to a temporary file next to its
+// destination, which is renamed to the destination once the whole file
+// was received and its checksum verified
+type Upload struct {
+	path     string
+	size     int64
+	checksum string
+	mode     os.FileMode
+	received int64
+	file     *os.File
+	hash     hash.Hash
+}
+
+// NewUpload starts the upload of a file of the given size and SHA256 hex
+// checksum to path, which has to be inside one of the allowlist directories
+func NewUpload(path string,
+	size int64,
+	checksum string,
+	mode os.FileMode,
+	allowlist []string,
+	maxSize int64) (*Upload, error) {
+	if size < 0 || size > maxSize {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrFileTooLarge, size, maxSize)
+	}
+	path, err := AllowedPath(path, allowlist)
+	if err != nil {
+		return nil, err
+	}
+	if mode == 0 {
+		mode = DefaultFileMode
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(path), ".mender-shell-upload-")
+	if err != nil {
+		return nil, err
+	}
+	return &Upload{
+		path:     path,
+		size:     size,
+		checksum: strings.ToLower(checksum),
+		mode:     mode.Perm(),
+		file:     file,
+		hash:     sha256.New(),
+	}, nil
+}
+
+// Path returns the destination of the upload
+func (u *Upload) Path() string {
+	return u.path
+}
+
+// Write writes the next chunk, returning the bytes received so far; on
+// error the upload is aborted
+func (u *Upload) Write(chunk []byte) (received int64, err error) {
+	if u.received+int64(len(chunk)) > u.size {
+		u.Abort()
+		return u.received, ErrSizeExceeded
+	}
+	n, err := u.file.Write(chunk)
+	u.hash.Write(chunk[:n])
+	u.received += int64(n)
+	if err != nil {
+		u.Abort()
+		return u.received, err
+	}
+	return u.received, nil
+}
+
+// Complete tells if the whole file was received
+func (u *Upload) Complete() bool {
+	return u.received == u.size
+}
+
+// Finish verifies the checksum and moves the file to its destination,
+// returning the computed checksum; on error the upload is aborted
+func (u *Upload) Finish() (checksum string, err error) {
+	checksum = hex.EncodeToString(u.hash.Sum(nil))
+	if !u.Complete() {
+		u.Abort()
+		return checksum, ErrUploadIncomplete
+	}
+	if checksum != u.checksum {
+		u.Abort()
+		return checksum, ErrChecksumMismatch
+	}
+
+	err = u.file.Chmod(u.mode)
+	if err == nil {
+		err = u.file.Sync()
+	}
+	if cErr := u.file.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(u.file.Name(), u.path)
+	}
+	if err != nil {
+		os.Remove(u.file.Name())
+		return checksum, err
+	}
+	return checksum, nil
+}
+
+// Abort removes the temporary file
+func (u *Upload) Abort() {
+	u.file.Close()
+	os.Remove(u.file.Name())
+}
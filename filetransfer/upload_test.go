@@ -0,0 +1,179 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package filetransfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAllowedPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-upload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	allowed := path.Join(dir, "allowed")
+	other := path.Join(dir, "other")
+	assert.NoError(t, os.Mkdir(allowed, 0700))
+	assert.NoError(t, os.Mkdir(other, 0700))
+	assert.NoError(t, os.Symlink(other, path.Join(allowed, "escape")))
+
+	testCases := map[string]struct {
+		path string
+		err  error
+	}{
+		"allowed": {
+			path: path.Join(allowed, "file.conf"),
+		},
+		"outside": {
+			path: path.Join(other, "file.conf"),
+			err:  ErrPathNotAllowed,
+		},
+		"dot dot": {
+			path: allowed + "/../other/file.conf",
+			err:  ErrPathNotAllowed,
+		},
+		"symlink escaping": {
+			path: path.Join(allowed, "escape", "file.conf"),
+			err:  ErrPathNotAllowed,
+		},
+		"allowlist directory itself": {
+			path: allowed,
+			err:  ErrPathNotAllowed,
+		},
+		"relative": {
+			path: "file.conf",
+			err:  ErrPathNotAbsolute,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			resolved, err := AllowedPath(tc.path, []string{allowed})
+			if tc.err != nil {
+				assert.Equal(t, tc.err, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.path, resolved)
+		})
+	}
+}
+
+func TestUpload(t *testing.T) {
+	content := []byte("ServerURL=https://mender.io\n")
+
+	testCases := map[string]struct {
+		chunks   [][]byte
+		size     int64
+		checksum string
+		mode     os.FileMode
+		maxSize  int64
+		startErr error
+		err      error
+	}{
+		"ok": {
+			chunks:   [][]byte{content[:10], content[10:]},
+			size:     int64(len(content)),
+			checksum: sha256Hex(content),
+			mode:     0640,
+			maxSize:  1024,
+		},
+		"empty file": {
+			size:     0,
+			checksum: sha256Hex(nil),
+			maxSize:  1024,
+		},
+		"too large": {
+			size:     int64(len(content)),
+			maxSize:  10,
+			startErr: ErrFileTooLarge,
+		},
+		"checksum mismatch": {
+			chunks:   [][]byte{content},
+			size:     int64(len(content)),
+			checksum: sha256Hex([]byte("other")),
+			maxSize:  1024,
+			err:      ErrChecksumMismatch,
+		},
+		"size exceeded": {
+			chunks:   [][]byte{content, content},
+			size:     int64(len(content)),
+			checksum: sha256Hex(content),
+			maxSize:  1024,
+			err:      ErrSizeExceeded,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mender-shell-upload")
+			assert.NoError(t, err)
+			defer os.RemoveAll(dir)
+			dest := path.Join(dir, "file.conf")
+
+			upload, err := NewUpload(dest, tc.size, tc.checksum, tc.mode, []string{dir}, tc.maxSize)
+			if tc.startErr != nil {
+				assert.True(t, errors.Is(err, tc.startErr))
+				assert.Nil(t, upload)
+				return
+			}
+			assert.NoError(t, err)
+
+			for _, chunk := range tc.chunks {
+				_, err = upload.Write(chunk)
+				if err != nil {
+					break
+				}
+			}
+			if err == nil {
+				var checksum string
+				checksum, err = upload.Finish()
+				if err == nil {
+					assert.Equal(t, tc.checksum, checksum)
+				}
+			}
+
+			files, _ := ioutil.ReadDir(dir)
+			if tc.err != nil {
+				assert.Equal(t, tc.err, err)
+				//the temporary file is removed
+				assert.Len(t, files, 0)
+				return
+			}
+			assert.NoError(t, err)
+			if assert.Len(t, files, 1) {
+				mode := tc.mode
+				if mode == 0 {
+					mode = DefaultFileMode
+				}
+				assert.Equal(t, mode, files[0].Mode().Perm())
+			}
+			data, err := ioutil.ReadFile(dest)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.size, int64(len(data)))
+		})
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/mendersoftware/mender-shell
 
-go 1.14
+go 1.16
 
 replace github.com/urfave/cli/v2 => github.com/mendersoftware/cli/v2 v2.1.1-minimal
 
@@ -0,0 +1,260 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package handover passes the state of a running process, with its open
+// files, to the process replacing it, e.g.: after an update of the binary:
+// the old process starts the new one with one end of a Unix socket pair,
+// sends it the state as JSON and the files as SCM_RIGHTS, and waits for the
+// new process to acknowledge it took them over.
+package handover
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// EnvFD names the file descriptor of the handover socket in the
+	// environment of the new process
+	EnvFD = "MENDER_SHELL_HANDOVER_FD"
+	// MaxFiles is the max number of files passed in a handover, the limit
+	// of the kernel on the file descriptors of one message
+	MaxFiles = 253
+	// MaxStateSize is the max size of the JSON state
+	MaxStateSize = 16 * 1024 * 1024
+
+	//the file descriptor of the first of the ExtraFiles of a command
+	inheritedFD = 3
+	ack         = 'A'
+)
+
+var (
+	ErrTooManyFiles   = errors.New("too many files to hand over")
+	ErrStateTooLarge  = errors.New("handover state too large")
+	ErrNoAck          = errors.New("the new process did not acknowledge the handover")
+	ErrMissingFiles   = errors.New("files missing from the handover")
+	errNotUnixSocket  = errors.New("the handover file descriptor is not a Unix socket")
+	errTruncatedFiles = errors.New("the file descriptors of the handover were truncated")
+)
+
+// StartProcess starts the program with the arguments, passing it one end of
+// a new socket pair, named by EnvFD in its environment; the other end is
+// returned, to Send the state over. The environment variables named in
+// drop are not passed on.
+func StartProcess(path string, args []string, drop ...string) (*os.Process, *net.UnixConn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	local := os.NewFile(uintptr(fds[0]), "handover")
+	remote := os.NewFile(uintptr(fds[1]), "handover")
+	defer remote.Close()
+	conn, err := unixConn(local)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Env = []string{EnvFD + "=" + strconv.Itoa(inheritedFD)}
+	for _, env := range os.Environ() {
+		if !dropped(env, drop) && !dropped(env, []string{EnvFD}) {
+			cmd.Env = append(cmd.Env, env)
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return cmd.Process, conn, nil
+}
+
+func dropped(env string, names []string) bool {
+	for _, name := range names {
+		if len(env) > len(name) && env[:len(name)+1] == name+"=" {
+			return true
+		}
+	}
+	return false
+}
+
+// Inherited returns the handover socket the process was started with by
+// StartProcess, nil if it was not; EnvFD is removed from the environment,
+// so that the child processes don't see it
+func Inherited() (*net.UnixConn, error) {
+	value := os.Getenv(EnvFD)
+	if value == "" {
+		return nil, nil
+	}
+	os.Unsetenv(EnvFD)
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("invalid %s: %q", EnvFD, value)
+	}
+	syscall.CloseOnExec(fd)
+	return unixConn(os.NewFile(uintptr(fd), "handover"))
+}
+
+func unixConn(f *os.File) (*net.UnixConn, error) {
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, errNotUnixSocket
+	}
+	return unixConn, nil
+}
+
+// Send sends the state, encoded as JSON, and the files; the files stay open
+// in the sending process
+func Send(conn *net.UnixConn, state interface{}, files []*os.File) error {
+	if len(files) > MaxFiles {
+		return ErrTooManyFiles
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxStateSize {
+		return ErrStateTooLarge
+	}
+	//the header carries the sizes, and the files
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(files)))
+	binary.BigEndian.PutUint32(header[4:], uint32(len(data)))
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	var rights []byte
+	if len(fds) > 0 {
+		rights = syscall.UnixRights(fds...)
+	}
+	if _, _, err := conn.WriteMsgUnix(header, rights, nil); err != nil {
+		return err
+	}
+	_, err = conn.Write(data)
+	return err
+}
+
+// Receive receives the state sent with Send, decoding it into state, and
+// returns the files, in the order they were sent
+func Receive(conn *net.UnixConn, state interface{}) ([]*os.File, error) {
+	header := make([]byte, 8)
+	oob := make([]byte, syscall.CmsgSpace(MaxFiles*4))
+	n, oobn, flags, _, err := conn.ReadMsgUnix(header, oob)
+	if err != nil {
+		return nil, err
+	}
+	files, err := parseRights(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	closeFiles := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	if flags&syscall.MSG_CTRUNC != 0 {
+		closeFiles()
+		return nil, errTruncatedFiles
+	}
+	if _, err := io.ReadFull(conn, header[n:]); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	count := binary.BigEndian.Uint32(header)
+	size := binary.BigEndian.Uint32(header[4:])
+	if int(count) != len(files) {
+		closeFiles()
+		return nil, ErrMissingFiles
+	}
+	if size > MaxStateSize {
+		closeFiles()
+		return nil, ErrStateTooLarge
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		closeFiles()
+		return nil, err
+	}
+	return files, nil
+}
+
+func parseRights(oob []byte) ([]*os.File, error) {
+	messages, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var files []*os.File
+	for _, message := range messages {
+		fds, err := syscall.ParseUnixRights(&message)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "handover"))
+		}
+	}
+	return files, nil
+}
+
+// Ack tells the old process the new one took the state and the files over
+func Ack(conn *net.UnixConn) error {
+	_, err := conn.Write([]byte{ack})
+	return err
+}
+
+// WaitAck waits up to timeout for the new process to acknowledge the
+// handover
+func WaitAck(conn *net.UnixConn, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(conn, b); err != nil || b[0] != ack {
+		return ErrNoAck
+	}
+	return nil
+}
+
+// WaitClosed waits up to timeout for the old process to close its end of
+// the socket, i.e.: to exit
+func WaitClosed(conn *net.UnixConn, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	_, err := io.Copy(ioutil.Discard, conn)
+	return err
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package handover
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testState struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func socketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	assert.NoError(t, err)
+	a, err := unixConn(os.NewFile(uintptr(fds[0]), "a"))
+	assert.NoError(t, err)
+	b, err := unixConn(os.NewFile(uintptr(fds[1]), "b"))
+	assert.NoError(t, err)
+	return a, b
+}
+
+func TestSendReceive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handover")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testCases := map[string]struct {
+		files int
+	}{
+		"no files": {},
+		"one file": {
+			files: 1,
+		},
+		"many files": {
+			files: 32,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			sender, receiver := socketPair(t)
+			defer sender.Close()
+			defer receiver.Close()
+
+			files := []*os.File{}
+			for i := 0; i < tc.files; i++ {
+				name := path.Join(dir, strconv.Itoa(i))
+				assert.NoError(t, ioutil.WriteFile(name, []byte(strconv.Itoa(i)), 0600))
+				f, err := os.Open(name)
+				assert.NoError(t, err)
+				defer f.Close()
+				files = append(files, f)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- Send(sender, &testState{Name: name, Count: tc.files}, files)
+			}()
+			state := &testState{}
+			received, err := Receive(receiver, state)
+			assert.NoError(t, err)
+			assert.NoError(t, <-done)
+			assert.Equal(t, &testState{Name: name, Count: tc.files}, state)
+			assert.Len(t, received, tc.files)
+			for i, f := range received {
+				data, err := ioutil.ReadAll(f)
+				assert.NoError(t, err)
+				assert.Equal(t, strconv.Itoa(i), string(data))
+				f.Close()
+			}
+
+			go func() {
+				done <- Ack(receiver)
+			}()
+			assert.NoError(t, WaitAck(sender, time.Second))
+			assert.NoError(t, <-done)
+		})
+	}
+}
+
+func TestSendTooManyFiles(t *testing.T) {
+	sender, receiver := socketPair(t)
+	defer sender.Close()
+	defer receiver.Close()
+
+	files := make([]*os.File, MaxFiles+1)
+	err := Send(sender, &testState{}, files)
+	assert.Equal(t, ErrTooManyFiles, err)
+}
+
+func TestWaitAck(t *testing.T) {
+	sender, receiver := socketPair(t)
+	defer sender.Close()
+
+	err := WaitAck(sender, 100*time.Millisecond)
+	assert.Equal(t, ErrNoAck, err)
+
+	//the new process exiting without the ack
+	receiver.Close()
+	err = WaitAck(sender, time.Second)
+	assert.Equal(t, ErrNoAck, err)
+}
+
+func TestWaitClosed(t *testing.T) {
+	sender, receiver := socketPair(t)
+	defer receiver.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		sender.Close()
+	}()
+	assert.NoError(t, WaitClosed(receiver, time.Second))
+}
+
+func TestInherited(t *testing.T) {
+	os.Unsetenv(EnvFD)
+	conn, err := Inherited()
+	assert.NoError(t, err)
+	assert.Nil(t, conn)
+
+	os.Setenv(EnvFD, "invalid")
+	_, err = Inherited()
+	assert.Error(t, err)
+	assert.Empty(t, os.Getenv(EnvFD))
+
+	sender, receiver := socketPair(t)
+	defer sender.Close()
+	f, err := receiver.File()
+	assert.NoError(t, err)
+	fd, err := syscall.Dup(int(f.Fd()))
+	assert.NoError(t, err)
+	f.Close()
+	receiver.Close()
+	os.Setenv(EnvFD, strconv.Itoa(fd))
+	conn, err = Inherited()
+	assert.NoError(t, err)
+	assert.NotNil(t, conn)
+	defer conn.Close()
+	assert.Empty(t, os.Getenv(EnvFD))
+
+	go Send(sender, &testState{Name: "inherited"}, nil)
+	state := &testState{}
+	_, err = Receive(conn, state)
+	assert.NoError(t, err)
+	assert.Equal(t, "inherited", state.Name)
+}
+
+func TestDropped(t *testing.T) {
+	assert.True(t, dropped("WATCHDOG_PID=1", []string{"WATCHDOG_PID"}))
+	assert.False(t, dropped("WATCHDOG_PID_X=1", []string{"WATCHDOG_PID"}))
+	assert.False(t, dropped("WATCHDOG_PID", []string{"WATCHDOG_PID"}))
+	assert.False(t, dropped("PATH=/bin", nil))
+}
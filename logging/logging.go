@@ -0,0 +1,78 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package logging
+
+import (
+	"context"
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// FormatText is the default human readable log format
+	FormatText = "text"
+	// FormatJSON logs every line as a JSON object
+	FormatJSON = "json"
+	// SessionIDField is the field holding the id of the session the log
+	// line comes from
+	SessionIDField = "session_id"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown log format")
+)
+
+type contextKey int
+
+const sessionIDKey contextKey = 0
+
+// WithSessionID returns a copy of ctx carrying the session id, which is
+// attached to the log lines of the loggers returned by FromContext
+func WithSessionID(ctx context.Context, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionIDKey, sessionID)
+}
+
+// SessionIDFromContext returns the session id carried by ctx, if any
+func SessionIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	sessionID, _ := ctx.Value(sessionIDKey).(string)
+	return sessionID
+}
+
+// FromContext returns the logger for ctx, with the session_id field set if
+// ctx carries a session id
+func FromContext(ctx context.Context) *log.Entry {
+	entry := log.NewEntry(log.StandardLogger())
+	if sessionID := SessionIDFromContext(ctx); sessionID != "" {
+		entry = entry.WithField(SessionIDField, sessionID)
+	}
+	return entry
+}
+
+// SetFormat sets the format of the log lines, redacting the secrets from
+// them; text if format is empty
+func SetFormat(format string) error {
+	switch format {
+	case "", FormatText:
+		log.SetFormatter(&RedactingFormatter{&log.TextFormatter{}})
+	case FormatJSON:
+		log.SetFormatter(&RedactingFormatter{&log.JSONFormatter{}})
+	default:
+		return ErrUnknownFormat
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionIDFromContext(t *testing.T) {
+	assert.Equal(t, "", SessionIDFromContext(context.Background()))
+	assert.Equal(t, "", SessionIDFromContext(nil))
+	ctx := WithSessionID(context.Background(), "session-id-1")
+	assert.Equal(t, "session-id-1", SessionIDFromContext(ctx))
+}
+
+func TestFromContextJSON(t *testing.T) {
+	output := log.StandardLogger().Out
+	formatter := log.StandardLogger().Formatter
+	defer log.SetOutput(output)
+	defer log.SetFormatter(formatter)
+
+	testCases := map[string]struct {
+		ctx       context.Context
+		sessionID interface{}
+	}{
+		"with session id": {
+			ctx:       WithSessionID(context.Background(), "session-id-1"),
+			sessionID: "session-id-1",
+		},
+		"without session id": {
+			ctx: context.Background(),
+		},
+		"with empty session id": {
+			ctx: WithSessionID(context.Background(), ""),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			log.SetOutput(buf)
+			assert.NoError(t, SetFormat(FormatJSON))
+
+			FromContext(tc.ctx).Info("shell started")
+
+			line := map[string]interface{}{}
+			assert.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+			assert.Equal(t, "shell started", line["msg"])
+			assert.Equal(t, tc.sessionID, line[SessionIDField])
+		})
+	}
+}
+
+func TestSetFormat(t *testing.T) {
+	formatter := log.StandardLogger().Formatter
+	defer log.SetFormatter(formatter)
+
+	testCases := map[string]struct {
+		format    string
+		formatter log.Formatter
+		err       error
+	}{
+		"default": {
+			format:    "",
+			formatter: &log.TextFormatter{},
+		},
+		"text": {
+			format:    FormatText,
+			formatter: &log.TextFormatter{},
+		},
+		"json": {
+			format:    FormatJSON,
+			formatter: &log.JSONFormatter{},
+		},
+		"unknown": {
+			format: "xml",
+			err:    ErrUnknownFormat,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := SetFormat(tc.format)
+			if tc.err != nil {
+				assert.Equal(t, tc.err, err)
+				return
+			}
+			assert.NoError(t, err)
+			if assert.IsType(t, &RedactingFormatter{}, log.StandardLogger().Formatter) {
+				formatter := log.StandardLogger().Formatter.(*RedactingFormatter)
+				assert.IsType(t, tc.formatter, formatter.Formatter)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package logging
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Redacted replaces the secrets in the log lines
+const Redacted = "[REDACTED]"
+
+// DefaultSecretKeys are the names of the values always redacted from the
+// log lines, e.g.: ClientKeyPassphrase:"secret" or password=secret; the
+// names containing them match as well
+var DefaultSecretKeys = []string{"password", "passphrase", "secret"}
+
+var (
+	//the JWT header always starts with {" in base64url
+	jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]*\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	//the password in the userinfo of an URL, e.g.: a proxy one
+	userinfoPattern = regexp.MustCompile(`(://[^/\s:@]*:)[^/\s@]+@`)
+
+	secretsMutex   sync.RWMutex
+	secretKeys     []string
+	secretsPattern *regexp.Regexp
+)
+
+func init() {
+	SetSecretKeys(nil)
+}
+
+// SetSecretKeys sets the names of the values redacted from the log lines,
+// on top of the DefaultSecretKeys
+func SetSecretKeys(keys []string) {
+	var names []string
+	for _, key := range append(DefaultSecretKeys, keys...) {
+		if key != "" {
+			names = append(names, regexp.QuoteMeta(strings.ToLower(key)))
+		}
+	}
+	pattern := regexp.MustCompile(`(?i)(\w*(?:` + strings.Join(names, "|") + `)\w*"?\s*[:=]\s*"?)[^"\s,;&}]+`)
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+	secretKeys = names
+	secretsPattern = pattern
+}
+
+// IsSecretKey tells if the value named name is redacted, i.e.: if the name
+// contains one of the secret keys
+func IsSecretKey(name string) bool {
+	name = strings.ToLower(name)
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+	for _, key := range secretKeys {
+		if strings.Contains(name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redact replaces the JWT tokens, the passwords in the URLs and the values of
+// the secret keys in s with Redacted
+func Redact(s string) string {
+	secretsMutex.RLock()
+	pattern := secretsPattern
+	secretsMutex.RUnlock()
+	s = jwtPattern.ReplaceAllString(s, Redacted)
+	s = userinfoPattern.ReplaceAllString(s, "${1}"+Redacted+"@")
+	return pattern.ReplaceAllString(s, "${1}"+Redacted)
+}
+
+// RedactingFormatter redacts the secrets from the message and the fields of
+// the log lines before formatting them with Formatter; the log lines below
+// the log level are not formatted, so they cost nothing
+type RedactingFormatter struct {
+	log.Formatter
+}
+
+func (f *RedactingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = Redact(entry.Message)
+	if len(entry.Data) > 0 {
+		redacted.Data = make(log.Fields, len(entry.Data))
+		for name, value := range entry.Data {
+			if IsSecretKey(name) {
+				value = Redacted
+			} else if s, ok := value.(string); ok {
+				value = Redact(s)
+			}
+			redacted.Data[name] = value
+		}
+	}
+	return f.Formatter.Format(&redacted)
+}
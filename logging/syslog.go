@@ -0,0 +1,198 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package logging
+
+import (
+	"errors"
+	"log/syslog"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// SinkSyslog sends the events to syslog, on top of the log output
+	SinkSyslog = "syslog"
+	// DefaultSyslogFacility is the facility of the events sent to syslog
+	DefaultSyslogFacility = "daemon"
+	// EventField is the field marking the log lines sent to the sink,
+	// holding the kind of event
+	EventField = "event"
+	// syslogTag is the program name of the syslog messages
+	syslogTag = "mender-shell"
+)
+
+// The events sent to the sink, the values of EventField
+const (
+	EventSessionOpened   = "session_opened"
+	EventSessionClosed   = "session_closed"
+	EventAuthFailed      = "auth_failed"
+	EventPolicyDenied    = "policy_denied"
+	EventConnectionState = "connection_state"
+	EventSessionRevoked  = "session_revoked"
+	EventSessionCommand  = "session_command"
+)
+
+var (
+	ErrUnknownSink           = errors.New("unknown log sink")
+	ErrUnknownSyslogFacility = errors.New("unknown syslog facility")
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// ParseSyslogFacility returns the syslog facility with the given name,
+// e.g.: daemon or local0
+func ParseSyslogFacility(name string) (syslog.Priority, error) {
+	facility, ok := syslogFacilities[strings.ToLower(name)]
+	if !ok {
+		return 0, ErrUnknownSyslogFacility
+	}
+	return facility, nil
+}
+
+// syslogWriter writes a message to syslog with the given severity, it is
+// implemented by *syslog.Writer
+type syslogWriter interface {
+	Crit(m string) error
+	Err(m string) error
+	Warning(m string) error
+	Info(m string) error
+	Debug(m string) error
+	Close() error
+}
+
+var dialSyslog = func(facility syslog.Priority) (syslogWriter, error) {
+	return syslog.New(facility|syslog.LOG_INFO, syslogTag)
+}
+
+// SyslogHook sends the log lines with the EventField set to syslog,
+// formatted like the log output, e.g.: as JSON objects with the json
+// format, at the severity matching their level
+type SyslogHook struct {
+	mutex    sync.Mutex
+	writer   syslogWriter
+	sink     string
+	facility string
+}
+
+func (h *SyslogHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *SyslogHook) Fire(entry *log.Entry) error {
+	if _, ok := entry.Data[EventField]; !ok {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.writer == nil {
+		return nil
+	}
+	line, err := entry.Logger.Formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	message := strings.TrimSuffix(string(line), "\n")
+	//the event is in the log output anyway, a syslog failure is not
+	//reported on every event
+	switch entry.Level {
+	case log.PanicLevel, log.FatalLevel:
+		h.writer.Crit(message)
+	case log.ErrorLevel:
+		h.writer.Err(message)
+	case log.WarnLevel:
+		h.writer.Warning(message)
+	case log.InfoLevel:
+		h.writer.Info(message)
+	default:
+		h.writer.Debug(message)
+	}
+	return nil
+}
+
+// configure connects the hook to the sink, closing the previous one; it
+// does nothing if the sink and the facility did not change
+func (h *SyslogHook) configure(sink string, facility string) error {
+	if sink == SinkSyslog && facility == "" {
+		facility = DefaultSyslogFacility
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if sink == h.sink && facility == h.facility {
+		return nil
+	}
+	if h.writer != nil {
+		h.writer.Close()
+		h.writer = nil
+	}
+	h.sink = ""
+	h.facility = ""
+
+	switch sink {
+	case "":
+	case SinkSyslog:
+		priority, err := ParseSyslogFacility(facility)
+		if err != nil {
+			return err
+		}
+		writer, err := dialSyslog(priority)
+		if err != nil {
+			return err
+		}
+		h.writer = writer
+	default:
+		return ErrUnknownSink
+	}
+	h.sink = sink
+	h.facility = facility
+	return nil
+}
+
+var (
+	syslogHookOnce sync.Once
+	syslogHook     = &SyslogHook{}
+)
+
+// SetSink sends the events, the log lines with the EventField set, to the
+// sink on top of the log output: to syslog with the given facility, daemon
+// if empty, if sink is SinkSyslog, nowhere else if it is empty. On error,
+// e.g.: syslog is not available, the events only go to the log output
+func SetSink(sink string, facility string) error {
+	syslogHookOnce.Do(func() {
+		log.AddHook(syslogHook)
+	})
+	return syslogHook.configure(sink, facility)
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/syslog"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type syslogMessage struct {
+	severity string
+	message  string
+}
+
+type fakeSyslog struct {
+	messages []syslogMessage
+	closed   bool
+}
+
+func (f *fakeSyslog) write(severity string, m string) error {
+	f.messages = append(f.messages, syslogMessage{severity: severity, message: m})
+	return nil
+}
+
+func (f *fakeSyslog) Crit(m string) error    { return f.write("crit", m) }
+func (f *fakeSyslog) Err(m string) error     { return f.write("err", m) }
+func (f *fakeSyslog) Warning(m string) error { return f.write("warning", m) }
+func (f *fakeSyslog) Info(m string) error    { return f.write("info", m) }
+func (f *fakeSyslog) Debug(m string) error   { return f.write("debug", m) }
+
+func (f *fakeSyslog) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestParseSyslogFacility(t *testing.T) {
+	testCases := map[string]struct {
+		name     string
+		facility syslog.Priority
+		err      error
+	}{
+		"daemon": {
+			name:     "daemon",
+			facility: syslog.LOG_DAEMON,
+		},
+		"local": {
+			name:     "LOCAL7",
+			facility: syslog.LOG_LOCAL7,
+		},
+		"unknown": {
+			name: "local8",
+			err:  ErrUnknownSyslogFacility,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			facility, err := ParseSyslogFacility(tc.name)
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.facility, facility)
+		})
+	}
+}
+
+func TestSyslogHook(t *testing.T) {
+	writer := &fakeSyslog{}
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	logger.SetLevel(log.DebugLevel)
+	logger.SetFormatter(&RedactingFormatter{&log.JSONFormatter{}})
+	logger.AddHook(&SyslogHook{writer: writer})
+
+	logger.Info("not an event")
+	logger.WithField(EventField, EventConnectionState).Info("connection state: connecting -> connected")
+	logger.WithFields(log.Fields{
+		EventField:     EventAuthFailed,
+		SessionIDField: "session-id-1",
+	}).Warn("rejecting the shell, password=secret")
+	logger.WithField(EventField, EventSessionClosed).Error("failed")
+	logger.WithField(EventField, EventSessionOpened).Debug("opened")
+
+	if !assert.Len(t, writer.messages, 4) {
+		return
+	}
+	assert.Equal(t, "info", writer.messages[0].severity)
+	assert.Equal(t, "warning", writer.messages[1].severity)
+	assert.Equal(t, "err", writer.messages[2].severity)
+	assert.Equal(t, "debug", writer.messages[3].severity)
+
+	//the fields are kept, and the secrets redacted
+	line := map[string]interface{}{}
+	assert.NoError(t, json.Unmarshal([]byte(writer.messages[1].message), &line))
+	assert.Equal(t, EventAuthFailed, line[EventField])
+	assert.Equal(t, "session-id-1", line[SessionIDField])
+	assert.Equal(t, "rejecting the shell, password="+Redacted, line["msg"])
+	assert.NotContains(t, writer.messages[1].message, "\n")
+}
+
+func TestSetSink(t *testing.T) {
+	dial := dialSyslog
+	defer func() {
+		dialSyslog = dial
+		syslogHook.configure("", "")
+	}()
+
+	var writer *fakeSyslog
+	var dialed []syslog.Priority
+	var dialErr error
+	dialSyslog = func(facility syslog.Priority) (syslogWriter, error) {
+		dialed = append(dialed, facility)
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		writer = &fakeSyslog{}
+		return writer, nil
+	}
+
+	assert.NoError(t, SetSink("", ""))
+	assert.Empty(t, dialed)
+
+	assert.NoError(t, SetSink(SinkSyslog, ""))
+	assert.Equal(t, []syslog.Priority{syslog.LOG_DAEMON}, dialed)
+	first := writer
+	//not dialed again if nothing changed
+	assert.NoError(t, SetSink(SinkSyslog, DefaultSyslogFacility))
+	assert.Len(t, dialed, 1)
+
+	log.WithField(EventField, EventSessionOpened).Info("session opened")
+	assert.Len(t, first.messages, 1)
+
+	assert.NoError(t, SetSink(SinkSyslog, "local0"))
+	assert.Equal(t, []syslog.Priority{syslog.LOG_DAEMON, syslog.LOG_LOCAL0}, dialed)
+	assert.True(t, first.closed)
+
+	assert.Equal(t, ErrUnknownSink, SetSink("journal", ""))
+	assert.Equal(t, ErrUnknownSyslogFacility, SetSink(SinkSyslog, "local8"))
+
+	//syslog not available, the events only go to the log output
+	dialErr = errors.New("no syslog")
+	assert.Equal(t, dialErr, SetSink(SinkSyslog, "user"))
+	assert.NotPanics(t, func() {
+		log.WithField(EventField, EventSessionClosed).Info("session closed")
+	})
+
+	dialErr = nil
+	assert.NoError(t, SetSink(SinkSyslog, "user"))
+	assert.NoError(t, SetSink("", ""))
+	assert.True(t, writer.closed)
+}
@@ -17,12 +17,15 @@ import (
 	"os"
 
 	"github.com/mendersoftware/mender-shell/cli"
+	"github.com/mendersoftware/mender-shell/logging"
 	log "github.com/sirupsen/logrus"
 )
 
 func doMain() int {
-	log.SetFormatter(&log.TextFormatter{
-		FullTimestamp: true,
+	log.SetFormatter(&logging.RedactingFormatter{
+		Formatter: &log.TextFormatter{
+			FullTimestamp: true,
+		},
 	})
 	if err := cli.SetupCLI(os.Args); err != nil {
 		log.Errorln(err.Error())
@@ -14,7 +14,9 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -38,3 +40,93 @@ func TestMainRequiresConfig(t *testing.T) {
 	assert.Equal(t, 1, exitCode)
 	os.Args = args
 }
+
+func TestMainCheckRequiresConfig(t *testing.T) {
+	args := os.Args
+	os.Args = []string{"mender-shell", "check", "--timeout", "1s"}
+	exitCode := doMain()
+	assert.Equal(t, 1, exitCode)
+	os.Args = args
+}
+
+func TestMainValidate(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	validConfig := path.Join(tdir, "valid.conf")
+	err = ioutil.WriteFile(validConfig, []byte(`{"ServerURL": "https://mender.io"}`), 0600)
+	assert.NoError(t, err)
+	invalidConfig := path.Join(tdir, "invalid.conf")
+	err = ioutil.WriteFile(invalidConfig, []byte(`{"ShellCommand": "bash", "LogFormat": "xml"}`), 0600)
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		args     []string
+		exitCode int
+	}{
+		"valid": {
+			args: []string{"mender-shell", "--config", validConfig, "--validate"},
+		},
+		"invalid": {
+			args:     []string{"mender-shell", "--config", invalidConfig, "--validate"},
+			exitCode: 1,
+		},
+		"invalid with a command": {
+			args:     []string{"mender-shell", "--config", invalidConfig, "--validate", "daemon"},
+			exitCode: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			args := os.Args
+			defer func() { os.Args = args }()
+			os.Args = tc.args
+			assert.Equal(t, tc.exitCode, doMain())
+		})
+	}
+}
+
+func TestMainShowConfig(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "mendertest")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tdir)
+	configFile := path.Join(tdir, "mender-shell.conf")
+	err = ioutil.WriteFile(configFile, []byte(`{"ServerURL": "https://mender.io"}`), 0600)
+	assert.NoError(t, err)
+	invalidConfig := path.Join(tdir, "invalid.conf")
+	err = ioutil.WriteFile(invalidConfig, []byte(`{"ServerURL": "https://mender.io", "LogFormat": "xml"}`), 0600)
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		args     []string
+		exitCode int
+	}{
+		"text": {
+			args: []string{"mender-shell", "--config", configFile, "show-config"},
+		},
+		"json": {
+			args: []string{"mender-shell", "--config", configFile, "show-config", "--format", "json"},
+		},
+		"secrets": {
+			args: []string{"mender-shell", "--config", configFile, "show-config", "--show-secrets"},
+		},
+		"unknown format": {
+			args:     []string{"mender-shell", "--config", configFile, "show-config", "--format", "yaml"},
+			exitCode: 1,
+		},
+		"invalid": {
+			args:     []string{"mender-shell", "--config", invalidConfig, "show-config"},
+			exitCode: 1,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			args := os.Args
+			defer func() { os.Args = args }()
+			os.Args = tc.args
+			assert.Equal(t, tc.exitCode, doMain())
+		})
+	}
+}
@@ -0,0 +1,220 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Collector is fed by the session manager and the daemon; the metrics are
+// never labeled by session, to keep their cardinality bounded
+type Collector interface {
+	SessionOpened()
+	SessionClosed()
+	BytesSent(n int)
+	BytesReceived(n int)
+	Reconnected()
+	TokenRefreshed()
+	OutputQueued()
+	OutputDequeued()
+	ReconnectCircuitOpened()
+	ReconnectCircuitClosed()
+}
+
+// NopCollector is a Collector which does nothing
+type NopCollector struct{}
+
+func (NopCollector) SessionOpened()          {}
+func (NopCollector) SessionClosed()          {}
+func (NopCollector) BytesSent(n int)         {}
+func (NopCollector) BytesReceived(n int)     {}
+func (NopCollector) Reconnected()            {}
+func (NopCollector) TokenRefreshed()         {}
+func (NopCollector) OutputQueued()           {}
+func (NopCollector) OutputDequeued()         {}
+func (NopCollector) ReconnectCircuitOpened() {}
+func (NopCollector) ReconnectCircuitClosed() {}
+
+// Metrics is a Collector exposing the metrics in the Prometheus text format;
+// a nil *Metrics collects nothing
+type Metrics struct {
+	// the 64 bit values come first, to be aligned for the atomic operations
+	// on the 32 bit platforms
+	sessionsOpened uint64
+	sessionsClosed uint64
+	bytesSent      uint64
+	bytesReceived  uint64
+	reconnects     uint64
+	tokenRefreshes uint64
+	outputQueued   uint64
+	outputDequeued uint64
+	circuitOpened  uint64
+	circuitClosed  uint64
+}
+
+// NewMetrics returns a new Metrics collector
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// SessionOpened counts a shell session started
+func (m *Metrics) SessionOpened() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.sessionsOpened, 1)
+}
+
+// SessionClosed counts a shell session stopped
+func (m *Metrics) SessionClosed() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.sessionsClosed, 1)
+}
+
+// BytesSent counts the shell output bytes sent to the server
+func (m *Metrics) BytesSent(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.bytesSent, uint64(n))
+}
+
+// BytesReceived counts the shell input bytes received from the server
+func (m *Metrics) BytesReceived(n int) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.bytesReceived, uint64(n))
+}
+
+// Reconnected counts a websocket reconnection
+func (m *Metrics) Reconnected() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.reconnects, 1)
+}
+
+// TokenRefreshed counts a JWT token refresh
+func (m *Metrics) TokenRefreshed() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.tokenRefreshes, 1)
+}
+
+// OutputQueued counts a shell output message queued to be sent to the server
+func (m *Metrics) OutputQueued() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.outputQueued, 1)
+}
+
+// OutputDequeued counts a queued shell output message taken to be sent
+func (m *Metrics) OutputDequeued() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.outputDequeued, 1)
+}
+
+// ReconnectCircuitOpened counts the reconnect circuit breaker opening
+func (m *Metrics) ReconnectCircuitOpened() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.circuitOpened, 1)
+}
+
+// ReconnectCircuitClosed counts the reconnect circuit breaker closing
+func (m *Metrics) ReconnectCircuitClosed() {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.circuitClosed, 1)
+}
+
+// WriteTo writes the metrics in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	opened := atomic.LoadUint64(&m.sessionsOpened)
+	closed := atomic.LoadUint64(&m.sessionsClosed)
+	active := uint64(0)
+	if opened > closed {
+		active = opened - closed
+	}
+	queued := atomic.LoadUint64(&m.outputQueued)
+	dequeued := atomic.LoadUint64(&m.outputDequeued)
+	queueDepth := uint64(0)
+	if queued > dequeued {
+		queueDepth = queued - dequeued
+	}
+	circuitOpened := atomic.LoadUint64(&m.circuitOpened)
+	circuitOpen := uint64(0)
+	if circuitOpened > atomic.LoadUint64(&m.circuitClosed) {
+		circuitOpen = 1
+	}
+
+	metrics := []struct {
+		name       string
+		help       string
+		metricType string
+		value      uint64
+	}{
+		{"mender_shell_sessions_active", "Number of active shell sessions.", "gauge", active},
+		{"mender_shell_sessions_opened_total", "Total number of shell sessions opened.", "counter", opened},
+		{"mender_shell_bytes_sent_total", "Total shell output bytes sent to the server.", "counter",
+			atomic.LoadUint64(&m.bytesSent)},
+		{"mender_shell_bytes_received_total", "Total shell input bytes received from the server.", "counter",
+			atomic.LoadUint64(&m.bytesReceived)},
+		{"mender_shell_reconnects_total", "Total number of websocket reconnections.", "counter",
+			atomic.LoadUint64(&m.reconnects)},
+		{"mender_shell_token_refreshes_total", "Total number of JWT token refreshes.", "counter",
+			atomic.LoadUint64(&m.tokenRefreshes)},
+		{"mender_shell_output_queue_depth", "Number of shell output messages waiting to be sent to the server.", "gauge",
+			queueDepth},
+		{"mender_shell_reconnect_circuit_open", "1 if the reconnect attempts are held back after failing repeatedly.", "gauge",
+			circuitOpen},
+		{"mender_shell_reconnect_circuit_opened_total", "Total number of times the reconnect attempts were held back.", "counter",
+			circuitOpened},
+	}
+
+	var written int64
+	for _, metric := range metrics {
+		n, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n",
+			metric.name, metric.help, metric.name, metric.metricType, metric.name, metric.value)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	m.WriteTo(w)
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	testCases := map[string]struct {
+		collect  func(m Collector)
+		expected []string
+	}{
+		"empty": {
+			collect: func(m Collector) {},
+			expected: []string{
+				"# TYPE mender_shell_sessions_active gauge\nmender_shell_sessions_active 0\n",
+				"# TYPE mender_shell_sessions_opened_total counter\nmender_shell_sessions_opened_total 0\n",
+				"mender_shell_bytes_sent_total 0\n",
+				"mender_shell_bytes_received_total 0\n",
+				"mender_shell_reconnects_total 0\n",
+				"mender_shell_token_refreshes_total 0\n",
+				"# TYPE mender_shell_output_queue_depth gauge\nmender_shell_output_queue_depth 0\n",
+				"# TYPE mender_shell_reconnect_circuit_open gauge\nmender_shell_reconnect_circuit_open 0\n",
+				"mender_shell_reconnect_circuit_opened_total 0\n",
+			},
+		},
+		"sessions and bytes": {
+			collect: func(m Collector) {
+				m.SessionOpened()
+				m.SessionOpened()
+				m.SessionClosed()
+				m.BytesSent(255)
+				m.BytesSent(45)
+				m.BytesReceived(8)
+				m.Reconnected()
+				m.TokenRefreshed()
+				m.TokenRefreshed()
+				m.OutputQueued()
+				m.OutputQueued()
+				m.OutputDequeued()
+				m.ReconnectCircuitOpened()
+				m.ReconnectCircuitClosed()
+				m.ReconnectCircuitOpened()
+			},
+			expected: []string{
+				"mender_shell_sessions_active 1\n",
+				"mender_shell_sessions_opened_total 2\n",
+				"mender_shell_bytes_sent_total 300\n",
+				"mender_shell_bytes_received_total 8\n",
+				"mender_shell_reconnects_total 1\n",
+				"mender_shell_token_refreshes_total 2\n",
+				"mender_shell_output_queue_depth 1\n",
+				"mender_shell_reconnect_circuit_open 1\n",
+				"mender_shell_reconnect_circuit_opened_total 2\n",
+			},
+		},
+		"more closed than opened": {
+			collect: func(m Collector) {
+				m.SessionClosed()
+				m.OutputDequeued()
+				m.ReconnectCircuitOpened()
+				m.ReconnectCircuitClosed()
+			},
+			expected: []string{
+				"mender_shell_sessions_active 0\n",
+				"mender_shell_output_queue_depth 0\n",
+				"mender_shell_reconnect_circuit_open 0\n",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := NewMetrics()
+			tc.collect(m)
+
+			var output bytes.Buffer
+			n, err := m.WriteTo(&output)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(output.Len()), n)
+			for _, expected := range tc.expected {
+				assert.Contains(t, output.String(), expected)
+			}
+		})
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *Metrics
+	assert.NotPanics(t, func() {
+		m.SessionOpened()
+		m.SessionClosed()
+		m.BytesSent(1)
+		m.BytesReceived(1)
+		m.Reconnected()
+		m.TokenRefreshed()
+		m.OutputQueued()
+		m.OutputDequeued()
+	})
+	NopCollector{}.BytesSent(1)
+}
+
+func TestMetricsServeHTTP(t *testing.T) {
+	m := NewMetrics()
+	m.SessionOpened()
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	rsp, err := http.Get(s.URL)
+	assert.NoError(t, err)
+	defer rsp.Body.Close()
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Equal(t, contentType, rsp.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(rsp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), "mender_shell_sessions_active 1\n")
+
+	rsp, err = http.Post(s.URL, "text/plain", nil)
+	assert.NoError(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, rsp.StatusCode)
+}
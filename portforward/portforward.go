@@ -0,0 +1,117 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package portforward
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	//opens the forwarding to the PropertyTarget host:port; the reply has
+	//the same type, its status is an error and the data holds the reason if
+	//the target can't be reached
+	MessageTypePortForwardOpen = "port_forward_open"
+	//carries the bytes of the forwarded connection, in both directions
+	MessageTypePortForwardData = "port_forward_data"
+	//closes the forwarded connection, sent by either side
+	MessageTypePortForwardClose = "port_forward_close"
+)
+
+const (
+	PropertyTarget = "target"
+)
+
+const (
+	//max bytes read from the target sent in a single message
+	ChunkSize = 4096
+	//time allowed to connect to the target
+	DialTimeout = 10 * time.Second
+)
+
+var (
+	ErrTargetNotAllowed = errors.New("port forwarding target not allowed")
+	ErrInvalidTarget    = errors.New("invalid port forwarding target")
+)
+
+// TargetAllowed returns true if target is one of the allowlist host:port
+// entries; a target is never allowed if allowlist is empty
+func TargetAllowed(target string, allowlist []string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range allowlist {
+		allowedHost, allowedPort, err := net.SplitHostPort(allowed)
+		if err != nil {
+			continue
+		}
+		if allowedHost == host && allowedPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// Forward is a TCP connection to a local target, bridged over the websocket
+type Forward struct {
+	target    string
+	conn      net.Conn
+	closeOnce sync.Once
+}
+
+// Open connects to target, which has to be in the allowlist, failing if the
+// connection is not established within timeout
+func Open(target string, allowlist []string, timeout time.Duration) (*Forward, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return nil, ErrInvalidTarget
+	}
+	if !TargetAllowed(target, allowlist) {
+		return nil, ErrTargetNotAllowed
+	}
+	conn, err := net.DialTimeout("tcp", target, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Forward{
+		target: target,
+		conn:   conn,
+	}, nil
+}
+
+// Target returns the host:port the connection goes to
+func (f *Forward) Target() string {
+	return f.target
+}
+
+// Read reads the next bytes sent by the target
+func (f *Forward) Read(p []byte) (int, error) {
+	return f.conn.Read(p)
+}
+
+// Write sends the bytes to the target
+func (f *Forward) Write(p []byte) (int, error) {
+	return f.conn.Write(p)
+}
+
+// Close closes the connection to the target; it is safe to call it more than
+// once, e.g.: from the reading and the writing side
+func (f *Forward) Close() (err error) {
+	f.closeOnce.Do(func() {
+		err = f.conn.Close()
+	})
+	return err
+}
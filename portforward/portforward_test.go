@@ -0,0 +1,129 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package portforward
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetAllowed(t *testing.T) {
+	testCases := map[string]struct {
+		target    string
+		allowlist []string
+		allowed   bool
+	}{
+		"allowed": {
+			target:    "127.0.0.1:8080",
+			allowlist: []string{"127.0.0.1:22", "127.0.0.1:8080"},
+			allowed:   true,
+		},
+		"other port": {
+			target:    "127.0.0.1:8081",
+			allowlist: []string{"127.0.0.1:8080"},
+		},
+		"other host": {
+			target:    "10.0.0.1:8080",
+			allowlist: []string{"127.0.0.1:8080"},
+		},
+		"empty allowlist": {
+			target: "127.0.0.1:8080",
+		},
+		"no port": {
+			target:    "127.0.0.1",
+			allowlist: []string{"127.0.0.1:8080"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.allowed, TargetAllowed(tc.target, tc.allowlist))
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	//a port nothing listens on
+	refused, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	refusedTarget := refused.Addr().String()
+	refused.Close()
+
+	target := listener.Addr().String()
+	allowlist := []string{target, refusedTarget}
+
+	testCases := map[string]struct {
+		target string
+		err    error
+		anyErr bool
+	}{
+		"ok": {
+			target: target,
+		},
+		"not allowed": {
+			target: "127.0.0.1:1",
+			err:    ErrTargetNotAllowed,
+		},
+		"invalid": {
+			target: "localhost",
+			err:    ErrInvalidTarget,
+		},
+		"connection refused": {
+			target: refusedTarget,
+			anyErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			forward, err := Open(tc.target, allowlist, time.Second)
+			if tc.err != nil || tc.anyErr {
+				if tc.err != nil {
+					assert.Equal(t, tc.err, err)
+				}
+				assert.Error(t, err)
+				assert.Nil(t, forward)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.target, forward.Target())
+
+			_, err = forward.Write([]byte("ping"))
+			assert.NoError(t, err)
+			data := make([]byte, 4)
+			_, err = io.ReadFull(forward, data)
+			assert.NoError(t, err)
+			assert.Equal(t, "ping", string(data))
+
+			assert.NoError(t, forward.Close())
+			assert.NoError(t, forward.Close())
+		})
+	}
+}
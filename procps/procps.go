@@ -49,3 +49,28 @@ func TerminateAndWait(pid int, command *exec.Cmd, waitTimeout time.Duration) (er
 
 	return nil
 }
+
+// TerminateAndWaitExited terminates the process like TerminateAndWait, for a
+// process somebody else waits for, closing exited once the process is gone
+func TerminateAndWaitExited(pid int, exited <-chan struct{}, waitTimeout time.Duration) error {
+	select {
+	case <-exited:
+		return nil
+	default:
+	}
+	p, _ := os.FindProcess(pid)
+	defer p.Release()
+	p.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(2 * time.Second):
+	}
+	p.Signal(syscall.SIGKILL)
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(waitTimeout):
+		return errors.New("waiting for pid " + strconv.Itoa(pid) + " timeout. the process will remain as zombie.")
+	}
+}
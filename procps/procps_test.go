@@ -34,3 +34,35 @@ func TestMenderShellProcPs(t *testing.T) {
 
 	assert.False(t, ProcessExists(cmd.Process.Pid))
 }
+
+func TestMenderShellProcPsExited(t *testing.T) {
+	testCases := map[string]struct {
+		command []string
+	}{
+		"terminated": {
+			command: []string{"sleep", "16"},
+		},
+		"killed": {
+			command: []string{"sh", "-c", "trap '' TERM; sleep 16"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			cmd := exec.Command(tc.command[0], tc.command[1:]...)
+			err := cmd.Start()
+			assert.NoError(t, err)
+			exited := make(chan struct{})
+			go func() {
+				cmd.Wait()
+				close(exited)
+			}()
+			//the trap is set before the signal is sent
+			time.Sleep(100 * time.Millisecond)
+
+			err = TerminateAndWaitExited(cmd.Process.Pid, exited, time.Second)
+			assert.NoError(t, err)
+			assert.False(t, ProcessExists(cmd.Process.Pid))
+		})
+	}
+}
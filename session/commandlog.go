@@ -0,0 +1,165 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/mendersoftware/mender-shell/logging"
+)
+
+const (
+	//the longest command line logged, the input past it is dropped
+	maxCommandLineLength = 4096
+	//the most bytes of the last output line kept to look for a password
+	//prompt in
+	maxPromptLength = 256
+
+	keyInterrupt  = 0x03
+	keyBackspace  = 0x08
+	keyKillLine   = 0x15
+	keyEraseWord  = 0x17
+	keyEscape     = 0x1b
+	keyDelete     = 0x7f
+	keyEnter      = '\r'
+	keyLineFeed   = '\n'
+	keyCSI        = '['
+	keySS3        = 'O'
+	keyCSIFinalLo = 0x40
+	keyCSIFinalHi = 0x7e
+)
+
+//the prompts the input is a secret after, e.g.: the ones of sudo, su or ssh
+var passwordPromptPattern = regexp.MustCompile(`(?i)(password|passphrase|passcode|\bpin\b)[^:]*:\s*$`)
+
+//the CSI sequences of the prompt, e.g.: its colors
+var promptSequencePattern = regexp.MustCompile(`\x1b\[[0-9;?]*[@-~]`)
+
+type commandLogState int
+
+const (
+	commandLogGround commandLogState = iota
+	//after ESC
+	commandLogEscape
+	//in a CSI, ESC [, or SS3, ESC O, sequence, e.g.: an arrow key
+	commandLogSequence
+)
+
+// commandLogger logs the command lines typed in a session as they are
+// entered, reconstructed from the input: the printable characters are
+// appended to the line, and the backspace, Ctrl-U and Ctrl-W edit it; the
+// other control characters and the escape sequences, e.g.: the arrow keys,
+// are dropped, so the line may differ from the one run if the cursor was
+// moved or the shell completed it. The lines entered after a password
+// prompt are redacted, and so are the secrets logging.Redact finds
+type commandLogger struct {
+	mutex  sync.Mutex
+	ctx    context.Context
+	user   string
+	state  commandLogState
+	line   []byte
+	prompt []byte
+}
+
+// commandLogOutput passes the output to the command logger, to look for the
+// password prompts in; it never fails
+type commandLogOutput struct {
+	logger *commandLogger
+}
+
+func newCommandLogger(ctx context.Context, user string) *commandLogger {
+	return &commandLogger{
+		ctx:  ctx,
+		user: user,
+	}
+}
+
+func (l *commandLogger) input(data []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, c := range data {
+		switch l.state {
+		case commandLogEscape:
+			if c == keyCSI || c == keySS3 {
+				l.state = commandLogSequence
+			} else {
+				l.state = commandLogGround
+			}
+			continue
+		case commandLogSequence:
+			if c >= keyCSIFinalLo && c <= keyCSIFinalHi {
+				l.state = commandLogGround
+			}
+			continue
+		}
+		switch {
+		case c == keyEnter || c == keyLineFeed:
+			l.commit()
+		case c == keyBackspace || c == keyDelete:
+			_, size := utf8.DecodeLastRune(l.line)
+			l.line = l.line[:len(l.line)-size]
+		case c == keyKillLine || c == keyInterrupt:
+			l.line = l.line[:0]
+		case c == keyEraseWord:
+			line := strings.TrimRight(string(l.line), " ")
+			l.line = l.line[:strings.LastIndexByte(line, ' ')+1]
+		case c == keyEscape:
+			l.state = commandLogEscape
+		case c < ' ':
+		default:
+			if len(l.line) < maxCommandLineLength {
+				l.line = append(l.line, c)
+			}
+		}
+	}
+}
+
+//logs the line entered, unless it is empty
+func (l *commandLogger) commit() {
+	line := strings.TrimSpace(string(l.line))
+	l.line = l.line[:0]
+	if line == "" {
+		return
+	}
+	if passwordPromptPattern.Match(promptSequencePattern.ReplaceAll(l.prompt, nil)) {
+		line = logging.Redacted
+	} else {
+		line = logging.Redact(line)
+	}
+	logging.FromContext(l.ctx).WithField(logging.EventField, logging.EventSessionCommand).
+		Infof("user %s entered: %s", l.user, line)
+}
+
+//keeps the last line of the output, the prompt the input is entered after
+func (l *commandLogger) output(data []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if i := strings.LastIndexAny(string(data), "\r\n"); i >= 0 {
+		l.prompt = l.prompt[:0]
+		data = data[i+1:]
+	}
+	l.prompt = append(l.prompt, data...)
+	if len(l.prompt) > maxPromptLength {
+		l.prompt = append(l.prompt[:0], l.prompt[len(l.prompt)-maxPromptLength:]...)
+	}
+}
+
+func (o *commandLogOutput) Write(p []byte) (int, error) {
+	o.logger.output(p)
+	return len(p), nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/logging"
+	"github.com/mendersoftware/mender-shell/procps"
+)
+
+var (
+	ErrSessionAlreadyExists = errors.New("session already exists")
+	//the adopted shell is not a child of the process, its exit is noticed
+	//by polling
+	adoptedShellPollInterval = time.Second
+)
+
+// HandoverState is what a session with a running shell is made of, passed
+// with the terminal of the shell to the process taking the session over,
+// e.g.: after an update of mender-shell
+type HandoverState struct {
+	ID                string                      `json:"id"`
+	UserID            string                      `json:"user_id"`
+	AuthenticatedUser string                      `json:"authenticated_user,omitempty"`
+	CreatedAt         time.Time                   `json:"created_at"`
+	ExpiresAt         time.Time                   `json:"expires_at"`
+	ActiveAt          time.Time                   `json:"active_at"`
+	InputAt           time.Time                   `json:"input_at"`
+	IdleWarnedAt      time.Time                   `json:"idle_warned_at"`
+	DurationWarnedAt  time.Time                   `json:"duration_warned_at"`
+	ShellPid          int                         `json:"shell_pid"`
+	Terminal          MenderShellTerminalSettings `json:"terminal"`
+	Respawns          int                         `json:"respawns"`
+	Scrollback        []byte                      `json:"scrollback,omitempty"`
+}
+
+// MenderSessionPrepareHandover stops passing the output of the shells of all
+// the active sessions, and returns the sessions with the terminals of their
+// shells, in the same order; the output the shells write from now on is
+// read by the process the sessions are handed over to
+func (r *Registry) MenderSessionPrepareHandover() ([]HandoverState, []*os.File) {
+	states := []HandoverState{}
+	files := []*os.File{}
+	for _, s := range r.sessionsList() {
+		id := s.id
+		if status := s.GetStatus(); status != ActiveSession && status != HangedSession {
+			continue
+		}
+		logging.FromContext(s.ctx).Infof("session %s: handing over the shell pid %d", id, s.shellPid)
+		s.shell.Stop()
+		s.stopInput()
+		states = append(states, HandoverState{
+			ID:                s.id,
+			UserID:            s.userId,
+			AuthenticatedUser: s.authenticatedUser,
+			CreatedAt:         s.createdAt,
+			ExpiresAt:         s.expiresAt,
+			ActiveAt:          s.activeAt,
+			InputAt:           s.inputAt,
+			IdleWarnedAt:      s.idleWarnedAt,
+			DurationWarnedAt:  s.durationWarnedAt,
+			ShellPid:          s.shellPid,
+			Terminal:          s.terminal,
+			Respawns:          s.respawns,
+			Scrollback:        s.Scrollback(),
+		})
+		files = append(files, s.pseudoTTY)
+	}
+	return states, files
+}
+
+// MenderSessionReleaseHandedOver removes all the sessions once they were
+// handed over, leaving their shells running: the terminals are closed in
+// this process only, and the recordings end, the post-session scripts don't
+// run
+func (r *Registry) MenderSessionReleaseHandedOver() int {
+	count := 0
+	for _, s := range r.sessionsList() {
+		id := s.id
+		if status := s.GetStatus(); status == ActiveSession || status == HangedSession {
+			s.stopping = true
+			s.stopInput()
+			s.pseudoTTY.Close()
+			if s.recorder != nil {
+				s.recorder.close()
+				s.recorder = nil
+			}
+			s.setStatus(EmptySession)
+			count++
+		}
+		r.MenderShellDeleteById(id)
+	}
+	return count
+}
+
+// AdoptSession takes over the session handed over by the previous process,
+// with the terminal its shell is running in; the recording of the session
+// does not continue
+func (r *Registry) AdoptSession(writeMutex *sync.Mutex, ws *connection.Connection, state HandoverState, pseudoTTY *os.File) (*MenderShellSession, error) {
+	if r.MenderShellSessionGetById(state.ID) != nil {
+		return nil, ErrSessionAlreadyExists
+	}
+	if !procps.ProcessExists(state.ShellPid) {
+		return nil, ErrSessionShellNotRunning
+	}
+
+	settings := r.Settings()
+	s := &MenderShellSession{
+		writeMutex:        writeMutex,
+		ws:                ws,
+		id:                state.ID,
+		userId:            state.UserID,
+		authenticatedUser: state.AuthenticatedUser,
+		createdAt:         state.CreatedAt,
+		expiresAt:         state.ExpiresAt,
+		inputAt:           state.InputAt,
+		idleWarnedAt:      state.IdleWarnedAt,
+		durationWarnedAt:  state.DurationWarnedAt,
+		sessionType:       ShellInteractiveSession,
+		respawns:          state.Respawns,
+		ctx:               logging.WithSessionID(context.Background(), state.ID),
+		registry:          r,
+		settings:          &settings,
+	}
+	shellExited := make(chan struct{})
+	go func() {
+		for procps.ProcessExists(state.ShellPid) {
+			time.Sleep(adoptedShellPollInterval)
+		}
+		close(shellExited)
+	}()
+	scrollback := newScrollback(s.settings.ScrollbackSize, s.settings.UTF8SafeOutput)
+	scrollback.Write(state.Scrollback)
+	s.attachShell(state.Terminal, state.ShellPid, pseudoTTY, shellExited, nil, scrollback, nil)
+	s.activeAt = state.ActiveAt
+
+	r.mutex.Lock()
+	r.sessions[s.id] = s
+	r.byUserId[s.userId] = append(r.byUserId[s.userId], s)
+	r.mutex.Unlock()
+	r.metrics.SessionOpened()
+	logging.FromContext(s.ctx).Infof("session %s adopted for the user id %s, shell pid %d", s.id, s.userId, s.shellPid)
+	if notifier := r.getNotifier(); notifier != nil {
+		notifier.SessionOpened(s.id, s.userId)
+	}
+	return s, nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/procps"
+	"github.com/mendersoftware/mender-shell/shell"
+)
+
+func TestMenderSessionHandover(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 8
+	testSessions.settings.MaxSessions = 16
+	adoptedShellPollInterval = 100 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	assert.NoError(t, err)
+	ws, err := connection.NewConnection(*u, "token", time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	testSessions.MenderSessionTerminateAll()
+	s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, ws, "user-id-handover", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	s.SetAuthenticatedUser("operator@example.com")
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	pid := s.GetShellPid()
+
+	states, files := testSessions.MenderSessionPrepareHandover()
+	assert.Len(t, states, 1)
+	assert.Len(t, files, 1)
+	state := states[0]
+	assert.Equal(t, s.GetId(), state.ID)
+	assert.Equal(t, "user-id-handover", state.UserID)
+	assert.Equal(t, "operator@example.com", state.AuthenticatedUser)
+	assert.Equal(t, pid, state.ShellPid)
+	assert.Equal(t, "/bin/sh", state.Terminal.Shell)
+
+	//the terminal outlives the release, as if it was passed to another
+	//process
+	fd, err := syscall.Dup(int(files[0].Fd()))
+	assert.NoError(t, err)
+	pseudoTTY := os.NewFile(uintptr(fd), "pty")
+
+	_, err = testSessions.AdoptSession(&sync.Mutex{}, ws, state, pseudoTTY)
+	assert.Equal(t, ErrSessionAlreadyExists, err)
+
+	assert.Equal(t, 1, testSessions.MenderSessionReleaseHandedOver())
+	assert.Nil(t, testSessions.MenderShellSessionGetById(state.ID))
+	assert.True(t, procps.ProcessExists(pid))
+
+	adopted, err := testSessions.AdoptSession(&sync.Mutex{}, ws, state, pseudoTTY)
+	assert.NoError(t, err)
+	assert.Equal(t, adopted, testSessions.MenderShellSessionGetById(state.ID))
+	assert.Equal(t, ActiveSession, adopted.GetStatus())
+	assert.Equal(t, pid, adopted.GetShellPid())
+	assert.Equal(t, "/bin/sh", adopted.GetShellCommandPath())
+	assert.Nil(t, adopted.ShellExited())
+
+	err = adopted.ShellCommand(&shell.MenderShellMessage{Data: []byte("exit 3\n")})
+	assert.NoError(t, err)
+	deadline := time.Now().Add(4 * time.Second)
+	for adopted.ShellExited() == nil && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	//the exit code of a shell started by another process is not known
+	assert.Equal(t, &ShellExit{ExitCode: -1}, adopted.ShellExited())
+	adopted.CloseExitedShell()
+	testSessions.MenderShellDeleteById(state.ID)
+
+	_, err = testSessions.AdoptSession(&sync.Mutex{}, ws, state, pseudoTTY)
+	assert.Equal(t, ErrSessionShellNotRunning, err)
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// inputQueue writes the input of a session to its terminal from a goroutine
+// of its own, so that the input waiting for the rate limit, or for the shell
+// to read it, does not hold up the messages of the other sessions; at most
+// length messages wait, the next ones are rejected
+type inputQueue struct {
+	messages chan []byte
+	//closed when the queue is closed, the input still waiting is dropped
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+	//the error of the last write, returned by the next push
+	err error
+}
+
+func newInputQueue(length int) *inputQueue {
+	if length < 1 {
+		length = 1
+	}
+	return &inputQueue{
+		messages: make(chan []byte, length),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+//starts writing the queued input with write, until the queue is closed
+func (q *inputQueue) start(write func(data []byte) error) {
+	go func() {
+		defer close(q.done)
+		for {
+			select {
+			case <-q.stop:
+				return
+			case data := <-q.messages:
+				if err := write(data); err != nil {
+					q.mutex.Lock()
+					q.err = err
+					q.mutex.Unlock()
+				}
+			}
+		}
+	}()
+}
+
+//queues data, without blocking; returns ErrSessionInputQueueFull if length
+//messages are waiting already, ErrSessionShellNotRunning if the queue is
+//closed, or the error of the last write
+func (q *inputQueue) push(data []byte) error {
+	select {
+	case <-q.stop:
+		return ErrSessionShellNotRunning
+	default:
+	}
+	q.mutex.Lock()
+	err := q.err
+	q.err = nil
+	q.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case q.messages <- data:
+		return nil
+	default:
+		return ErrSessionInputQueueFull
+	}
+}
+
+//stops the writing and waits up to timeout for the message being written, if
+//any, as a write to a terminal nobody reads blocks; returns the number of the
+//messages dropped
+func (q *inputQueue) close(timeout time.Duration) int {
+	dropped := 0
+	q.closeOnce.Do(func() {
+		close(q.stop)
+		select {
+		case <-q.done:
+		case <-time.After(timeout):
+		}
+		dropped = len(q.messages)
+	})
+	return dropped
+}
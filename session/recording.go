@@ -0,0 +1,154 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	recordingVersion       = 2
+	recordingFileExtension = ".cast"
+	recordingTimeFormat    = "20060102T150405Z"
+
+	recordingEventOutput = "o"
+	recordingEventInput  = "i"
+	recordingEventResize = "r"
+)
+
+// recordingHeader is the header of an asciinema v2 recording, followed by
+// the session id and the authenticated user
+type recordingHeader struct {
+	Version   int               `json:"version"`
+	Width     uint16            `json:"width"`
+	Height    uint16            `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Env       map[string]string `json:"env"`
+	SessionId string            `json:"session_id"`
+	User      string            `json:"user"`
+}
+
+// sessionRecorder writes the input, output and resize events of a session
+// to a file, in the asciinema v2 format
+type sessionRecorder struct {
+	mutex     sync.Mutex
+	file      *os.File
+	writer    *bufio.Writer
+	startedAt time.Time
+}
+
+// recorderOutput writes to the recorder as output events, it never fails
+// so that the shell output passes through even if the recording fails
+type recorderOutput struct {
+	recorder *sessionRecorder
+}
+
+func newSessionRecorder(dir string, sessionId string, user string, terminal MenderShellTerminalSettings) (*sessionRecorder, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	startedAt := timeNow()
+	fileName := path.Join(dir, startedAt.Format(recordingTimeFormat)+"-"+sessionId+recordingFileExtension)
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := json.Marshal(&recordingHeader{
+		Version:   recordingVersion,
+		Width:     terminal.Width,
+		Height:    terminal.Height,
+		Timestamp: startedAt.Unix(),
+		Env: map[string]string{
+			"SHELL": terminal.Shell,
+			"TERM":  terminal.TerminalString,
+		},
+		SessionId: sessionId,
+		User:      user,
+	})
+	if err == nil {
+		_, err = file.Write(append(header, '\n'))
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(fileName)
+		return nil, err
+	}
+
+	return &sessionRecorder{
+		file:      file,
+		writer:    bufio.NewWriter(file),
+		startedAt: startedAt,
+	}, nil
+}
+
+func (r *sessionRecorder) event(eventType string, data string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return
+	}
+
+	elapsed := timeNow().Sub(r.startedAt).Seconds()
+	line, err := json.Marshal([]interface{}{elapsed, eventType, data})
+	if err == nil {
+		_, err = r.writer.Write(append(line, '\n'))
+	}
+	if err != nil {
+		log.Errorf("failed to record the session event to %s: %s", r.file.Name(), err.Error())
+	}
+}
+
+func (r *sessionRecorder) output(data []byte) {
+	r.event(recordingEventOutput, string(data))
+}
+
+func (r *sessionRecorder) input(data []byte) {
+	r.event(recordingEventInput, string(data))
+}
+
+func (r *sessionRecorder) resize(width uint16, height uint16) {
+	r.event(recordingEventResize, fmt.Sprintf("%dx%d", width, height))
+}
+
+// close flushes the recorded events and closes the recording file
+func (r *sessionRecorder) close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.writer.Flush()
+	if closeErr := r.file.Close(); err == nil {
+		err = closeErr
+	}
+	r.file = nil
+	return err
+}
+
+func (o *recorderOutput) Write(p []byte) (int, error) {
+	o.recorder.output(p)
+	return len(p), nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readRecording(t *testing.T, dir string) (*recordingHeader, [][]interface{}, os.FileInfo) {
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		return nil, nil, nil
+	}
+
+	f, err := os.Open(path.Join(dir, files[0].Name()))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	assert.True(t, scanner.Scan())
+	header := &recordingHeader{}
+	assert.NoError(t, json.Unmarshal(scanner.Bytes(), header))
+
+	events := [][]interface{}{}
+	for scanner.Scan() {
+		event := []interface{}{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	return header, events, files[0]
+}
+
+func TestSessionRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-recordings")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	recorder, err := newSessionRecorder(path.Join(dir, "sessions"), "session-id-1", "device-id-1", MenderShellTerminalSettings{
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         24,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, recorder)
+
+	recorder.input([]byte("echo ok\n"))
+	recorder.output([]byte("ok\r\n"))
+	recorder.resize(120, 40)
+	assert.NoError(t, recorder.close())
+	assert.NoError(t, recorder.close())
+	recorder.output([]byte("after close"))
+
+	header, events, info := readRecording(t, path.Join(dir, "sessions"))
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.True(t, strings.HasSuffix(info.Name(), "-session-id-1"+recordingFileExtension))
+	assert.Equal(t, recordingVersion, header.Version)
+	assert.Equal(t, uint16(80), header.Width)
+	assert.Equal(t, uint16(24), header.Height)
+	assert.Equal(t, "session-id-1", header.SessionId)
+	assert.Equal(t, "device-id-1", header.User)
+	assert.Equal(t, "xterm-256color", header.Env["TERM"])
+
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, []interface{}{recordingEventInput, "echo ok\n"}, events[0][1:])
+		assert.Equal(t, []interface{}{recordingEventOutput, "ok\r\n"}, events[1][1:])
+		assert.Equal(t, []interface{}{recordingEventResize, "120x40"}, events[2][1:])
+	}
+}
+
+func TestSessionRecorderError(t *testing.T) {
+	f, err := ioutil.TempFile("", "mender-shell-recordings")
+	assert.NoError(t, err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	recorder, err := newSessionRecorder(f.Name(), "session-id-1", "device-id-1", MenderShellTerminalSettings{})
+	assert.Error(t, err)
+	assert.Nil(t, recorder)
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mendersoftware/mender-shell/logging"
+	"github.com/mendersoftware/mender-shell/shell"
+)
+
+// the environment variables the session scripts get the session with
+const (
+	ScriptEnvSessionID = "MENDER_SHELL_SESSION_ID"
+	ScriptEnvUserID    = "MENDER_SHELL_USER_ID"
+	ScriptEnvUser      = "MENDER_SHELL_USER"
+)
+
+//bytes of the stderr of a failed pre-session script the session is
+//rejected with, at most
+const maxScriptStderr = 1024
+
+// preSessionScriptError is returned by StartShell when the PreSessionScript
+// fails, with what it wrote to stderr
+type preSessionScriptError struct {
+	err    error
+	stderr string
+}
+
+func (e *preSessionScriptError) Error() string {
+	message := ErrPreSessionScriptFailed.Error() + ": " + e.err.Error()
+	if e.stderr != "" {
+		message += ": " + e.stderr
+	}
+	return message
+}
+
+func (e *preSessionScriptError) Is(target error) bool {
+	return target == ErrPreSessionScriptFailed
+}
+
+//the environment of the session scripts: the daemon one, plus the session
+//id, the user id given with the MessageTypeSpawnShell message and the user
+//the shell runs as
+func (s *MenderShellSession) scriptEnv(terminal MenderShellTerminalSettings) []string {
+	return append(os.Environ(),
+		ScriptEnvSessionID+"="+s.id,
+		ScriptEnvUserID+"="+s.userId,
+		ScriptEnvUser+"="+terminal.UserName,
+	)
+}
+
+//runs the PreSessionScript, if set, before the shell starts
+func (s *MenderShellSession) runPreSessionScript(terminal MenderShellTerminalSettings) error {
+	settings := s.sessionSettings()
+	if settings.PreSessionScript == "" {
+		return nil
+	}
+	stderr, err := runSessionScript(settings.PreSessionScript, s.scriptEnv(terminal), settings.SessionScriptTimeout)
+	if err != nil {
+		logging.FromContext(s.ctx).Errorf("session %s, the pre-session script %s failed: %s",
+			s.id, settings.PreSessionScript, err.Error())
+		return &preSessionScriptError{err: err, stderr: stderr}
+	}
+	return nil
+}
+
+//runs the PostSessionScript, if set, after the shell ended, however it did
+func (s *MenderShellSession) runPostSessionScript(terminal MenderShellTerminalSettings) {
+	settings := s.sessionSettings()
+	if settings.PostSessionScript == "" {
+		return
+	}
+	_, err := runSessionScript(settings.PostSessionScript, s.scriptEnv(terminal), settings.SessionScriptTimeout)
+	if err != nil {
+		logging.FromContext(s.ctx).Errorf("session %s, the post-session script %s failed: %s",
+			s.id, settings.PostSessionScript, err.Error())
+	}
+}
+
+//runs the script with the environment, killing it, and whatever it started
+//in its process group, if it does not finish within timeout; returns the
+//beginning of what it wrote to stderr
+func runSessionScript(path string, env []string, timeout time.Duration) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(path)
+	cmd.Env = env
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		//a process which left the group can keep stderr open, it is not
+		//waited for longer
+		select {
+		case <-done:
+		case <-time.After(shellProcessWaitTimeout):
+		}
+		return "", errors.New("timed out after " + timeout.String())
+	}
+	return scriptStderr(stderr.Bytes()), err
+}
+
+func scriptStderr(stderr []byte) string {
+	if len(stderr) > maxScriptStderr {
+		stderr = shell.TrimIncompleteRunes(stderr[:maxScriptStderr])
+	}
+	return strings.TrimSpace(string(stderr))
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeScript(t *testing.T, dir string, name string, body string) string {
+	script := path.Join(dir, name)
+	err := ioutil.WriteFile(script, []byte("#!/bin/sh\n"+body+"\n"), 0755)
+	assert.NoError(t, err)
+	return script
+}
+
+func TestRunSessionScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-scripts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	testCases := map[string]struct {
+		body    string
+		timeout time.Duration
+		stderr  string
+		err     string
+	}{
+		"success": {
+			body:    "echo $" + ScriptEnvSessionID + " $" + ScriptEnvUserID + " $" + ScriptEnvUser + " >&2",
+			timeout: 4 * time.Second,
+			stderr:  "session-1 user-1 root",
+		},
+		"failure": {
+			body:    "echo mount failed >&2; exit 2",
+			timeout: 4 * time.Second,
+			stderr:  "mount failed",
+			err:     "exit status 2",
+		},
+		"long stderr": {
+			body:    "head -c 4096 /dev/zero | tr '\\0' x >&2; exit 1",
+			timeout: 4 * time.Second,
+			stderr:  strings.Repeat("x", maxScriptStderr),
+			err:     "exit status 1",
+		},
+		"timeout": {
+			body:    "sleep 60 & sleep 60",
+			timeout: 100 * time.Millisecond,
+			err:     "timed out after 100ms",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			script := writeScript(t, dir, strings.Replace(name, " ", "-", -1), tc.body)
+			env := append(os.Environ(),
+				ScriptEnvSessionID+"=session-1",
+				ScriptEnvUserID+"=user-1",
+				ScriptEnvUser+"=root",
+			)
+			start := time.Now()
+			stderr, err := runSessionScript(script, env, tc.timeout)
+			assert.Less(t, int64(time.Since(start)), int64(4*time.Second))
+			assert.Equal(t, tc.stderr, stderr)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRunSessionScriptNotFound(t *testing.T) {
+	_, err := runSessionScript("/does/not/exist", os.Environ(), time.Second)
+	assert.Error(t, err)
+}
+
+func TestPreSessionScriptError(t *testing.T) {
+	err := error(&preSessionScriptError{err: os.ErrNotExist, stderr: "no device"})
+	assert.EqualError(t, err, "pre-session script failed: file does not exist: no device")
+	assert.True(t, errors.Is(err, ErrPreSessionScriptFailed))
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"sync"
+
+	"github.com/mendersoftware/mender-shell/shell"
+)
+
+// scrollback keeps the last bytes of the shell output, to redraw the
+// terminal of a session resumed after a reconnect; it never fails so that
+// the shell output passes through
+type scrollback struct {
+	mutex sync.Mutex
+	data  []byte
+	size  int
+	//the kept output is trimmed to whole UTF-8 characters, as the oldest
+	//bytes are dropped regardless of the character boundaries
+	utf8Safe bool
+}
+
+func newScrollback(size int, utf8Safe bool) *scrollback {
+	return &scrollback{
+		data:     make([]byte, 0, size),
+		size:     size,
+		utf8Safe: utf8Safe,
+	}
+}
+
+func (b *scrollback) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if len(p) >= b.size {
+		b.data = append(b.data[:0], p[len(p)-b.size:]...)
+		return len(p), nil
+	}
+	if drop := len(b.data) + len(p) - b.size; drop > 0 {
+		b.data = append(b.data[:0], b.data[drop:]...)
+	}
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+// Bytes returns a copy of the kept output
+func (b *scrollback) Bytes() []byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	kept := b.data
+	if b.utf8Safe {
+		kept = shell.TrimIncompleteRunes(kept)
+	}
+	data := make([]byte, len(kept))
+	copy(data, kept)
+	return data
+}
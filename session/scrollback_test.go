@@ -0,0 +1,79 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package session
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrollback(t *testing.T) {
+	testCases := map[string]struct {
+		size     int
+		utf8Safe bool
+		writes   []string
+		kept     string
+	}{
+		"below the size": {
+			size:   16,
+			writes: []string{"abc", "def"},
+			kept:   "abcdef",
+		},
+		"drops the oldest bytes": {
+			size:   4,
+			writes: []string{"abc", "def"},
+			kept:   "cdef",
+		},
+		"write larger than the size": {
+			size:   4,
+			writes: []string{"ab", "cdefghij"},
+			kept:   "ghij",
+		},
+		"empty": {
+			size: 4,
+			kept: "",
+		},
+		"character cut at the start": {
+			size:     5,
+			utf8Safe: true,
+			writes:   []string{"\xc3\xa5\xc3\xa5", "abc"},
+			kept:     "\xc3\xa5abc",
+		},
+		"character cut at the end": {
+			size:     5,
+			utf8Safe: true,
+			writes:   []string{"abc", "\xf0\x9f"},
+			kept:     "abc",
+		},
+		"raw": {
+			size:   5,
+			writes: []string{"\xc3\xa5\xc3\xa5", "abc\xf0"},
+			kept:   "\xa5abc\xf0",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			b := newScrollback(tc.size, tc.utf8Safe)
+			for _, w := range tc.writes {
+				n, err := b.Write([]byte(w))
+				assert.NoError(t, err)
+				assert.Equal(t, len(w), n)
+			}
+			assert.Equal(t, tc.kept, string(b.Bytes()))
+			assert.True(t, cap(b.data) <= tc.size)
+		})
+	}
+}
@@ -14,12 +14,19 @@
 package session
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"github.com/mendersoftware/mender-shell/cgroup"
 	"github.com/mendersoftware/mender-shell/connection"
+	"github.com/mendersoftware/mender-shell/logging"
+	"github.com/mendersoftware/mender-shell/metrics"
 	"github.com/mendersoftware/mender-shell/procps"
 	"io"
 	"os"
 	"os/exec"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -53,30 +60,217 @@ const (
 	NoExpirationTimeout = time.Second * 0
 )
 
+const (
+	//bytes of the input written to the terminal at once when the input rate
+	//is limited
+	inputChunkSize = 255
+)
+
 var (
+	ErrSessionInvalidTerminalSize         = errors.New("invalid terminal size")
 	ErrSessionShellAlreadyRunning         = errors.New("shell is already running")
 	ErrSessionShellNotRunning             = errors.New("shell is not running")
 	ErrSessionShellStillRunning           = errors.New("shell is still running")
 	ErrSessionShellTooManySessionsPerUser = errors.New("user has too many open sessions")
 	ErrSessionNotFound                    = errors.New("session not found")
 	ErrSessionTooManyShellsAlreadyRunning = errors.New("too many shells spawned")
+	ErrSessionTooManySessions             = errors.New("too many active sessions")
+	ErrSessionInputTooLarge               = errors.New("input message too large")
+	ErrSessionInputQueueFull              = errors.New("input queue full")
+	ErrPreSessionScriptFailed             = errors.New("pre-session script failed")
 )
 
+// ShellExit tells how a shell exited on its own: with an exit code, e.g.:
+// after the user typed exit, or killed by a signal, i.e.: it crashed
+type ShellExit struct {
+	//the exit code, -1 if the shell was killed by a signal, or if it is not
+	//known, i.e.: the shell was started by the process the session was handed
+	//over from
+	ExitCode int
+	//the signal which killed the shell, empty if it exited
+	Signal string
+}
+
+// Crashed tells if the shell was killed by a signal
+func (e *ShellExit) Crashed() bool {
+	return e.Signal != ""
+}
+
+func (e *ShellExit) String() string {
+	if e.Crashed() {
+		return "killed by signal: " + e.Signal
+	}
+	return "exited with status " + strconv.Itoa(e.ExitCode)
+}
+
+// tooManySessionsError reports the active sessions count and the limit
+// when a shell can't be started because of MaxSessions
+type tooManySessionsError struct {
+	current int
+	limit   int
+}
+
+func (e *tooManySessionsError) Error() string {
+	return fmt.Sprintf("%s: %d/%d", ErrSessionTooManySessions.Error(), e.current, e.limit)
+}
+
+func (e *tooManySessionsError) Is(target error) bool {
+	return target == ErrSessionTooManySessions
+}
+
 var (
-	defaultSessionExpiredTimeout     = 1024 * time.Second
-	defaultSessionIdleExpiredTimeout = NoExpirationTimeout
-	defaultTimeFormat                = "Mon Jan 2 15:04:05 -0700 MST 2006"
-	shellProcessWaitTimeout          = 8 * time.Second
-	MaxUserSessions                  = 1
+	defaultSessionExpiredTimeout = 1024 * time.Second
+	defaultTimeFormat            = "Mon Jan 2 15:04:05 -0700 MST 2006"
+	shellProcessWaitTimeout      = 8 * time.Second
+	shellOutputFlushTimeout      = 2 * time.Second
 )
 
+// Settings are the limits and the settings of the sessions of a Registry;
+// a session keeps a copy of them, taken when it is created, so it does not
+// see them change while it runs
+type Settings struct {
+	MaxUserSessions         int
+	MaxSessions             int
+	RecordingDir            string
+	CommandLogging          bool
+	Cgroup                  string
+	Namespaces              *shell.Namespaces
+	MaxOutputBytesPerSecond uint32
+	MaxInputBytesPerSecond  uint32
+	MaxInputMessageSize     int
+	InputQueueLength        int
+	PtyReadBufferSize       int
+	OutputBufferSize        int
+	OutputFlushInterval     time.Duration
+	OutputQueueLength       int
+	UTF8SafeOutput          bool
+	SanitizeOutput          bool
+	InterceptInterrupt      bool
+	ScrollbackSize          int
+	//scripts run before the shell of a session starts, the session being
+	//rejected if it fails, and after it ends, with SessionScriptTimeout
+	//to finish
+	PreSessionScript     string
+	PostSessionScript    string
+	SessionScriptTimeout time.Duration
+}
+
+// DefaultSettings returns the settings a new Registry starts with
+func DefaultSettings() Settings {
+	return Settings{
+		MaxUserSessions:      1,
+		MaxSessions:          1,
+		InputQueueLength:     16,
+		PtyReadBufferSize:    shell.DefaultReadBufferSize,
+		OutputBufferSize:     4096,
+		OutputFlushInterval:  10 * time.Millisecond,
+		OutputQueueLength:    16,
+		UTF8SafeOutput:       true,
+		ScrollbackSize:       64 * 1024,
+		SessionScriptTimeout: 30 * time.Second,
+	}
+}
+
+// Registry holds the sessions of a daemon, and the settings the new ones are
+// created with; every daemon has a registry of its own, so the daemons
+// running in the same process do not see each other's sessions
+type Registry struct {
+	//guards sessions, byUserId and idleExpiredTimeout: the message loop adds
+	//the sessions, the main loop removes them, and the D-Bus API, the control
+	//socket and the diagnostics list them
+	mutex    sync.RWMutex
+	sessions map[string]*MenderShellSession
+	byUserId map[string][]*MenderShellSession
+	//the idle timeout of all the sessions, set by the last one created with
+	//an idle timeout
+	idleExpiredTimeout time.Duration
+	//guards settings and notifier, the daemon changes them when it reloads
+	//the configuration while the sessions start
+	settingsMutex sync.RWMutex
+	settings      Settings
+	notifier      SessionNotifier
+	metrics       metrics.Collector
+}
+
+// NewRegistry returns an empty registry with the default settings, counting
+// the sessions and their traffic with collector
+func NewRegistry(collector metrics.Collector) *Registry {
+	if collector == nil {
+		collector = metrics.NopCollector{}
+	}
+	return &Registry{
+		sessions:           map[string]*MenderShellSession{},
+		byUserId:           map[string][]*MenderShellSession{},
+		idleExpiredTimeout: NoExpirationTimeout,
+		settings:           DefaultSettings(),
+		metrics:            collector,
+	}
+}
+
+// Configure changes the settings of the sessions in set; the sessions keep
+// the settings they were created with, only the new ones see the changes
+func (r *Registry) Configure(set func(settings *Settings)) {
+	r.settingsMutex.Lock()
+	defer r.settingsMutex.Unlock()
+	set(&r.settings)
+}
+
+// Settings returns a copy of the settings the new sessions are created with
+func (r *Registry) Settings() Settings {
+	r.settingsMutex.RLock()
+	defer r.settingsMutex.RUnlock()
+	return r.settings
+}
+
+// SetNotifier sets the notifier told about the shells started and stopped,
+// nil for none
+func (r *Registry) SetNotifier(notifier SessionNotifier) {
+	r.settingsMutex.Lock()
+	defer r.settingsMutex.Unlock()
+	r.notifier = notifier
+}
+
+func (r *Registry) getNotifier() SessionNotifier {
+	r.settingsMutex.RLock()
+	defer r.settingsMutex.RUnlock()
+	return r.notifier
+}
+
+func (r *Registry) getIdleExpiredTimeout() time.Duration {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.idleExpiredTimeout
+}
+
+// SessionNotifier, set with SetNotifier, is told about the shells started and
+// stopped, e.g.: to let the other agents on the device know about them
+type SessionNotifier interface {
+	SessionOpened(sessionId string, userId string)
+	SessionClosed(sessionId string, userId string)
+}
+
+// SessionStoppedReason is the close reason of a shell stopped for no more
+// specific reason, e.g.: by the server
+const SessionStoppedReason = "the shell was stopped"
+
+// SessionExpiredReason is the close reason of the shells of the expired
+// sessions
+const SessionExpiredReason = "session expired"
+
 type MenderShellTerminalSettings struct {
 	Uid            uint32
 	Gid            uint32
+	Groups         []uint32
+	UserName       string
+	HomeDir        string
 	Shell          string
+	ShellArguments []string
+	Env            map[string]string
+	InheritEnv     bool
 	TerminalString string
 	Height         uint16
 	Width          uint16
+	WorkingDir     string
 }
 
 type MenderShellSession struct {
@@ -89,7 +283,9 @@ type MenderShellSession struct {
 	shell *shell.MenderShell
 	//session id, generated
 	id string
-	//user id given with the MessageTypeSpawnShell message
+	//user id given with the MessageTypeSpawnShell message, set when the
+	//session is created and never changed, so GetUserId is safe to call from
+	//any goroutine
 	userId string
 	//time at which session was created
 	createdAt time.Time
@@ -97,10 +293,17 @@ type MenderShellSession struct {
 	expiresAt time.Time
 	//time of a last received message used to determine if the session is active
 	activeAt time.Time
+	//time at which the first input was received, zero until then
+	inputAt time.Time
+	//time at which the idle warning was sent, zero if it was not
+	idleWarnedAt time.Time
+	//time at which the max duration warning was sent, zero if it was not
+	durationWarnedAt time.Time
 	//type of the session
 	sessionType MenderSessionType
-	//status of the session
-	status MenderSessionStatus
+	//status of the session, read by the other goroutines through GetStatus
+	status      MenderSessionStatus
+	statusMutex sync.Mutex
 	//terminal settings, for reference, usually it does not change
 	//in theory size of the terminal can change
 	terminal MenderShellTerminalSettings
@@ -111,27 +314,101 @@ type MenderShellSession struct {
 	//reader and writer are connected to the terminal stdio where the shell is running
 	writer    io.Writer
 	pseudoTTY *os.File
-	command   *exec.Cmd
+	//writes the input to writer, apart from the message loop
+	input   *inputQueue
+	command *exec.Cmd
+	//closed once the shell process exited and was reaped; the process is
+	//waited for only by the goroutine closing it
+	shellExited chan struct{}
+	//set while the shell is being stopped, so its exit is not taken for
+	//the shell exiting on its own
+	stopping bool
+	//times the shell exited on its own and was started again
+	respawns int
+	//authenticated user, stored in the session recording header
+	authenticatedUser string
+	//sent as the first output of the shell, e.g.: a legal warning
+	banner []byte
+	//records the session to RecordingDir, if set
+	recorder *sessionRecorder
+	//logs the command lines entered, if CommandLogging is set
+	commandLogger *commandLogger
+	//the last ScrollbackSize bytes of the shell output
+	scrollback *scrollback
+	//carries the session id, attached to the session log lines
+	ctx context.Context
+	//why the shell was closed, reported to the Notifier
+	closeReason string
+	//the registry the session belongs to
+	registry *Registry
+	//the settings at the time the session was created
+	settings *Settings
+}
+
+//returns the settings of the session, the defaults if it was not created
+//with any
+func (s *MenderShellSession) sessionSettings() *Settings {
+	if s.settings == nil {
+		settings := DefaultSettings()
+		return &settings
+	}
+	return s.settings
 }
 
-var sessionsMap = map[string]*MenderShellSession{}
-var sessionsByUserIdMap = map[string][]*MenderShellSession{}
+//returns the metrics collector of the registry of the session
+func (s *MenderShellSession) metricsCollector() metrics.Collector {
+	if s.registry == nil {
+		return metrics.NopCollector{}
+	}
+	return s.registry.metrics
+}
+
+//returns the idle timeout of the sessions of the registry of the session
+func (s *MenderShellSession) idleExpiredTimeout() time.Duration {
+	if s.registry == nil {
+		return NoExpirationTimeout
+	}
+	return s.registry.getIdleExpiredTimeout()
+}
+
+//returns the notifier of the registry of the session, nil if none
+func (s *MenderShellSession) notifier() SessionNotifier {
+	if s.registry == nil {
+		return nil
+	}
+	return s.registry.getNotifier()
+}
+
+//returns the sessions; they are walked without holding the lock, so that
+//stopping their shells does not block the other goroutines
+func (r *Registry) sessionsList() []*MenderShellSession {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	sessions := make([]*MenderShellSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
 
 func timeNow() time.Time {
 	return time.Now().UTC()
 }
 
-func NewMenderShellSession(writeMutex *sync.Mutex, ws *connection.Connection,
+func (r *Registry) NewMenderShellSession(writeMutex *sync.Mutex, ws *connection.Connection,
 	userId string,
 	expireAfter time.Duration,
 	expireAfterIdle time.Duration) (s *MenderShellSession, err error) {
-	if userSessions, ok := sessionsByUserIdMap[userId]; ok {
+	settings := r.Settings()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if userSessions, ok := r.byUserId[userId]; ok {
 		log.Debugf("user %s has %d sessions.", userId, len(userSessions))
-		if len(userSessions) >= MaxUserSessions {
+		if len(userSessions) >= settings.MaxUserSessions {
 			return nil, ErrSessionShellTooManySessionsPerUser
 		}
 	} else {
-		sessionsByUserIdMap[userId] = []*MenderShellSession{}
+		r.byUserId[userId] = []*MenderShellSession{}
 	}
 
 	uid := uuid.NewV4()
@@ -142,7 +419,7 @@ func NewMenderShellSession(writeMutex *sync.Mutex, ws *connection.Connection,
 	}
 
 	if expireAfterIdle != NoExpirationTimeout {
-		defaultSessionIdleExpiredTimeout = expireAfterIdle
+		r.idleExpiredTimeout = expireAfterIdle
 	}
 
 	createdAt := timeNow()
@@ -155,60 +432,86 @@ func NewMenderShellSession(writeMutex *sync.Mutex, ws *connection.Connection,
 		expiresAt:   createdAt.Add(expireAfter),
 		sessionType: ShellInteractiveSession,
 		status:      NewSession,
+		ctx:         logging.WithSessionID(context.Background(), id),
+		registry:    r,
+		settings:    &settings,
 	}
-	sessionsMap[id] = s
-	sessionsByUserIdMap[userId] = append(sessionsByUserIdMap[userId], s)
+	r.sessions[id] = s
+	r.byUserId[userId] = append(r.byUserId[userId], s)
 	return s, nil
 }
 
-func MenderShellSessionGetCount() int {
-	return len(sessionsMap)
+func (r *Registry) MenderShellSessionGetCount() int {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.sessions)
 }
 
-func MenderShellSessionGetSessionIds() []string {
-	keys := make([]string, 0, len(sessionsMap))
-	for k := range sessionsMap {
+// MenderShellSessionGetActiveCount returns the number of sessions with
+// a running shell
+func (r *Registry) MenderShellSessionGetActiveCount() int {
+	count := 0
+	for _, s := range r.sessionsList() {
+		if status := s.GetStatus(); status == ActiveSession || status == HangedSession {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Registry) MenderShellSessionGetSessionIds() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	keys := make([]string, 0, len(r.sessions))
+	for k := range r.sessions {
 		keys = append(keys, k)
 	}
 
 	return keys
 }
 
-func MenderShellSessionGetById(id string) *MenderShellSession {
-	if v, ok := sessionsMap[id]; ok {
+func (r *Registry) MenderShellSessionGetById(id string) *MenderShellSession {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if v, ok := r.sessions[id]; ok {
 		return v
 	} else {
 		return nil
 	}
 }
 
-func MenderShellDeleteById(id string) error {
-	if v, ok := sessionsMap[id]; ok {
-		userSessions := sessionsByUserIdMap[v.userId]
+func (r *Registry) MenderShellDeleteById(id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if v, ok := r.sessions[id]; ok {
+		userSessions := r.byUserId[v.userId]
 		for i, s := range userSessions {
 			if s.id == id {
-				sessionsByUserIdMap[v.userId] = append(userSessions[:i], userSessions[i+1:]...)
+				r.byUserId[v.userId] = append(userSessions[:i], userSessions[i+1:]...)
 				break
 			}
 		}
-		delete(sessionsMap, id)
+		delete(r.sessions, id)
 		return nil
 	} else {
 		return ErrSessionNotFound
 	}
 }
 
-func MenderShellSessionsGetByUserId(userId string) []*MenderShellSession {
-	if v, ok := sessionsByUserIdMap[userId]; ok {
-		return v
+func (r *Registry) MenderShellSessionsGetByUserId(userId string) []*MenderShellSession {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if v, ok := r.byUserId[userId]; ok {
+		return append([]*MenderShellSession{}, v...)
 	} else {
 		return nil
 	}
 }
 
-func UpdateWSConnection(ws *connection.Connection) error {
-	for id, s := range sessionsMap {
-		log.Debugf("updating ws in session %s and shell", id)
+func (r *Registry) UpdateWSConnection(ws *connection.Connection) error {
+	for _, s := range r.sessionsList() {
+		id := s.id
+		logging.FromContext(s.ctx).Debugf("updating ws in session %s and shell", id)
 		s.ws = ws
 		if s.shell != nil {
 			s.shell.UpdateWSConnection(ws)
@@ -217,8 +520,8 @@ func UpdateWSConnection(ws *connection.Connection) error {
 	return nil
 }
 
-func MenderShellStopByUserId(userId string) (count uint, err error) {
-	a := sessionsByUserIdMap[userId]
+func (r *Registry) MenderShellStopByUserId(userId string) (count uint, err error) {
+	a := r.MenderShellSessionsGetByUserId(userId)
 	log.Debugf("stopping all shells of user %s.", userId)
 	if len(a) == 0 {
 		return 0, ErrSessionNotFound
@@ -234,29 +537,34 @@ func MenderShellStopByUserId(userId string) (count uint, err error) {
 			err = e
 			continue
 		}
-		delete(sessionsMap, s.id)
+		r.mutex.Lock()
+		delete(r.sessions, s.id)
+		r.mutex.Unlock()
 		count++
 	}
-	delete(sessionsByUserIdMap, userId)
+	r.mutex.Lock()
+	delete(r.byUserId, userId)
+	r.mutex.Unlock()
 	return count, err
 }
 
-func MenderSessionTerminateAll() (shellCount int, sessionCount int, err error) {
+func (r *Registry) MenderSessionTerminateAll() (shellCount int, sessionCount int, err error) {
 	shellCount = 0
 	sessionCount = 0
-	for id, s := range sessionsMap {
+	for _, s := range r.sessionsList() {
+		id := s.id
 		e := s.StopShell()
 		if e == nil {
 			shellCount++
 		} else {
-			log.Debugf("terminate sessions: failed to stop shell for session: %s: %s", id, e.Error())
+			logging.FromContext(s.ctx).Debugf("terminate sessions: failed to stop shell for session: %s: %s", id, e.Error())
 			err = e
 		}
-		e = MenderShellDeleteById(id)
+		e = r.MenderShellDeleteById(id)
 		if e == nil {
 			sessionCount++
 		} else {
-			log.Debugf("terminate sessions: failed to remove session: %s: %s", id, e.Error())
+			logging.FromContext(s.ctx).Debugf("terminate sessions: failed to remove session: %s: %s", id, e.Error())
 			err = e
 		}
 	}
@@ -264,24 +572,26 @@ func MenderSessionTerminateAll() (shellCount int, sessionCount int, err error) {
 	return shellCount, sessionCount, err
 }
 
-func MenderSessionTerminateExpired() (shellCount int, sessionCount int, totalExpiredLeft int, err error) {
+func (r *Registry) MenderSessionTerminateExpired() (shellCount int, sessionCount int, totalExpiredLeft int, err error) {
 	shellCount = 0
 	sessionCount = 0
 	totalExpiredLeft = 0
-	for id, s := range sessionsMap {
+	for _, s := range r.sessionsList() {
+		id := s.id
 		if s.IsExpired(false) {
+			s.SetCloseReason(SessionExpiredReason)
 			e := s.StopShell()
 			if e == nil {
 				shellCount++
 			} else {
-				log.Debugf("expire sessions: failed to stop shell for session: %s: %s", id, e.Error())
+				logging.FromContext(s.ctx).Debugf("expire sessions: failed to stop shell for session: %s: %s", id, e.Error())
 				err = e
 			}
-			e = MenderShellDeleteById(id)
+			e = r.MenderShellDeleteById(id)
 			if e == nil {
 				sessionCount++
 			} else {
-				log.Debugf("expire sessions: failed to delete session: %s: %s", id, e.Error())
+				logging.FromContext(s.ctx).Debugf("expire sessions: failed to delete session: %s: %s", id, e.Error())
 				totalExpiredLeft++
 				err = e
 			}
@@ -291,10 +601,25 @@ func MenderSessionTerminateExpired() (shellCount int, sessionCount int, totalExp
 	return shellCount, sessionCount, totalExpiredLeft, err
 }
 
+// GetStatus returns the status of the session, it can be called from any
+// goroutine
 func (s *MenderShellSession) GetStatus() MenderSessionStatus {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
 	return s.status
 }
 
+func (s *MenderShellSession) setStatus(status MenderSessionStatus) {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	s.status = status
+}
+
+// GetStartedAt returns the time the session was created at
+func (s *MenderShellSession) GetStartedAt() time.Time {
+	return s.createdAt
+}
+
 func (s *MenderShellSession) GetStartedAtFmt() string {
 	return s.createdAt.Format(defaultTimeFormat)
 }
@@ -307,99 +632,656 @@ func (s *MenderShellSession) GetActiveAtFmt() string {
 	return s.activeAt.Format(defaultTimeFormat)
 }
 
+// IdleFor returns the time elapsed since the last input received from the
+// remote side; the shell output does not count as activity
+func (s *MenderShellSession) IdleFor() time.Duration {
+	return timeNow().Sub(s.activeAt)
+}
+
+// ReceivedInput returns true if any input was received from the remote side
+// since the session was opened
+func (s *MenderShellSession) ReceivedInput() bool {
+	return !s.inputAt.IsZero()
+}
+
+// IsIdleWarned returns true if the idle warning was sent since the last input
+func (s *MenderShellSession) IsIdleWarned() bool {
+	return !s.idleWarnedAt.IsZero()
+}
+
+// SetIdleWarned marks the idle warning as sent
+func (s *MenderShellSession) SetIdleWarned() {
+	s.idleWarnedAt = timeNow()
+}
+
+// OpenFor returns the time elapsed since the session was created, regardless
+// of its activity
+func (s *MenderShellSession) OpenFor() time.Duration {
+	return timeNow().Sub(s.createdAt)
+}
+
+// IsDurationWarned returns true if the max duration warning was sent
+func (s *MenderShellSession) IsDurationWarned() bool {
+	return !s.durationWarnedAt.IsZero()
+}
+
+// SetDurationWarned marks the max duration warning as sent
+func (s *MenderShellSession) SetDurationWarned() {
+	s.durationWarnedAt = timeNow()
+}
+
+// SetAuthenticatedUser sets the user the session is recorded for, it has to
+// be called before StartShell
+func (s *MenderShellSession) SetAuthenticatedUser(user string) {
+	s.authenticatedUser = user
+}
+
+// SetBanner sets the text sent before any output of the shell; it has to be
+// called before StartShell
+func (s *MenderShellSession) SetBanner(banner []byte) {
+	s.banner = banner
+}
+
+// SetCloseReason sets why the shell is being closed, e.g.: the idle timeout;
+// it has to be called before the shell is stopped
+func (s *MenderShellSession) SetCloseReason(reason string) {
+	s.closeReason = reason
+}
+
+// CloseReason tells why the shell was closed, SessionStoppedReason if no
+// reason was set; empty while the shell is running
+func (s *MenderShellSession) CloseReason() string {
+	if status := s.GetStatus(); status == ActiveSession || status == HangedSession {
+		return ""
+	}
+	if s.closeReason == "" {
+		return SessionStoppedReason
+	}
+	return s.closeReason
+}
+
 func (s *MenderShellSession) GetShellCommandPath() string {
+	//the shell of an adopted session was started by another process
+	if s.command == nil {
+		return s.terminal.Shell
+	}
 	return s.command.Path
 }
 
 func (s *MenderShellSession) StartShell(sessionId string, terminal MenderShellTerminalSettings) error {
-	if s.status == ActiveSession || s.status == HangedSession {
+	if status := s.GetStatus(); status == ActiveSession || status == HangedSession {
 		return ErrSessionShellAlreadyRunning
 	}
 
-	pid, pseudoTTY, cmd, err := shell.ExecuteShell(terminal.Uid,
-		terminal.Gid,
+	settings := s.sessionSettings()
+	if activeCount := s.registry.MenderShellSessionGetActiveCount(); activeCount >= settings.MaxSessions {
+		return &tooManySessionsError{current: activeCount, limit: settings.MaxSessions}
+	}
+
+	if terminal.WorkingDir != "" {
+		if err := shell.CheckWorkingDir(terminal.WorkingDir, terminalUser(terminal)); err != nil {
+			logging.FromContext(s.ctx).Errorf("session %s: %s", sessionId, err.Error())
+			return err
+		}
+	}
+
+	if err := s.runPreSessionScript(terminal); err != nil {
+		return err
+	}
+
+	var recorder *sessionRecorder
+	if settings.RecordingDir != "" {
+		var err error
+		recorder, err = newSessionRecorder(settings.RecordingDir, sessionId, s.authenticatedUser, terminal)
+		if err != nil {
+			logging.FromContext(s.ctx).Errorf("session %s: failed to start the recording: %s", sessionId, err.Error())
+			s.runPostSessionScript(terminal)
+			return err
+		}
+	}
+
+	err := s.spawnShell(terminal, recorder, s.banner)
+	if err != nil {
+		if recorder != nil {
+			recorder.close()
+		}
+		s.runPostSessionScript(terminal)
+		return err
+	}
+
+	s.metricsCollector().SessionOpened()
+	logging.FromContext(s.ctx).WithField(logging.EventField, logging.EventSessionOpened).
+		Infof("session %s opened for the user id %s", s.id, s.userId)
+	if notifier := s.notifier(); notifier != nil {
+		notifier.SessionOpened(s.id, s.userId)
+	}
+	return nil
+}
+
+func terminalUser(terminal MenderShellTerminalSettings) *shell.ShellUser {
+	return &shell.ShellUser{
+		Name:   terminal.UserName,
+		Home:   terminal.HomeDir,
+		Uid:    terminal.Uid,
+		Gid:    terminal.Gid,
+		Groups: terminal.Groups,
+	}
+}
+
+//starts the shell in a new terminal, passing its output, led by lead, to
+//the websocket and to the recorder, if not nil
+func (s *MenderShellSession) spawnShell(terminal MenderShellTerminalSettings, recorder *sessionRecorder, lead []byte) error {
+	settings := s.sessionSettings()
+	shellUser := terminalUser(terminal)
+	env := shell.ShellEnvironment(shellUser,
 		terminal.Shell,
 		terminal.TerminalString,
+		terminal.Env,
+		terminal.InheritEnv)
+	pid, pseudoTTY, cmd, err := shell.ExecuteShellInNamespaces(settings.Namespaces,
+		shellUser,
+		terminal.Shell,
+		terminal.ShellArguments,
+		env,
+		terminal.WorkingDir,
 		terminal.Height,
 		terminal.Width)
+	//the init command moves itself to the cgroup before running the shell
+	inCgroup := err == nil && settings.Namespaces != nil && settings.Namespaces.Cgroup != ""
+	if err != nil && settings.Namespaces != nil {
+		//e.g.: the kernel, or a container, does not allow the namespaces
+		logging.FromContext(s.ctx).Warnf("failed to start the shell in the namespaces, starting it without them: %s",
+			err.Error())
+		pid, pseudoTTY, cmd, err = shell.ExecuteShellAsUser(shellUser,
+			terminal.Shell,
+			terminal.ShellArguments,
+			env,
+			terminal.WorkingDir,
+			terminal.Height,
+			terminal.Width)
+	}
 	if err != nil {
 		return err
 	}
+	if settings.Cgroup != "" && !inCgroup {
+		//the shell may have started its children already, they stay where
+		//they are
+		if err := cgroup.AddProcess(settings.Cgroup, pid); err != nil {
+			logging.FromContext(s.ctx).Warnf("failed to move the shell %d to the cgroup %s: %s",
+				pid, settings.Cgroup, err.Error())
+		}
+	}
+	shellExited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(shellExited)
+	}()
+
+	s.command = cmd
+	s.attachShell(terminal, pid, pseudoTTY, shellExited, recorder, newScrollback(settings.ScrollbackSize, settings.UTF8SafeOutput), lead)
+	return nil
+}
+
+//passes the output of the shell running in the terminal, led by lead, to the
+//websocket, the scrollback and the recorder, if not nil, and the input to
+//the terminal
+func (s *MenderShellSession) attachShell(terminal MenderShellTerminalSettings, pid int, pseudoTTY *os.File,
+	shellExited chan struct{}, recorder *sessionRecorder, scrollback *scrollback, lead []byte) {
+	settings := s.sessionSettings()
+	outputs := []io.Writer{&metricsOutput{collector: s.metricsCollector()}, scrollback}
+	if recorder != nil {
+		outputs = append(outputs, &recorderOutput{recorder: recorder})
+	}
+	var commandLogger *commandLogger
+	if settings.CommandLogging {
+		commandLogger = newCommandLogger(s.ctx, s.userId)
+		outputs = append(outputs, &commandLogOutput{logger: commandLogger})
+	}
+	//the output is sanitized before it is kept, the scrollback and the
+	//recording are replayed to the operator terminal too
+	var output io.Reader = pseudoTTY
+	if settings.SanitizeOutput {
+		output = &sanitizedOutput{r: pseudoTTY, sanitizer: shell.NewOutputSanitizer()}
+	}
+	//the lead, e.g.: the banner, goes through the outputs too: it is
+	//recorded, and kept in the scrollback
+	reader := io.TeeReader(io.MultiReader(bytes.NewReader(lead), output), io.MultiWriter(outputs...))
 
 	//MenderShell represents a process of passing messages between backend
 	//and the shell subprocess (started above via shell.ExecuteShell) over
 	//the websocket connection
-	log.Infof("mender-shell starting shell command passing process, pid: %d", pid)
-	s.shell = shell.NewMenderShell(sessionId, s.writeMutex, s.ws, pseudoTTY, pseudoTTY)
+	logging.FromContext(s.ctx).Infof("mender-shell starting shell command passing process, pid: %d", pid)
+	s.shell = shell.NewMenderShell(s.id, s.writeMutex, s.ws, reader, pseudoTTY)
+	s.shell.SetContext(s.ctx)
+	s.shell.SetOutputRateLimit(settings.MaxOutputBytesPerSecond)
+	s.shell.SetReadBufferSize(settings.PtyReadBufferSize)
+	s.shell.SetOutputBuffering(settings.OutputBufferSize, settings.OutputFlushInterval)
+	s.shell.SetOutputQueue(settings.OutputQueueLength, s.metricsCollector())
+	s.shell.SetUTF8Safe(settings.UTF8SafeOutput)
 	s.shell.Start()
 
 	s.shellPid = pid
 	s.reader = pseudoTTY
+	input := newInputQueue(settings.InputQueueLength)
 	s.writer = pseudoTTY
-	s.status = ActiveSession
+	if settings.MaxInputBytesPerSecond > 0 {
+		s.writer = &rateLimitedInput{w: pseudoTTY, limiter: shell.NewRateLimiter(settings.MaxInputBytesPerSecond),
+			stop: input.stop}
+	}
+	s.input = input
+	s.setStatus(ActiveSession)
 	s.terminal = terminal
 	s.pseudoTTY = pseudoTTY
-	s.command = cmd
+	s.shellExited = shellExited
+	s.stopping = false
+	s.recorder = recorder
+	s.commandLogger = commandLogger
+	s.scrollback = scrollback
 	s.activeAt = timeNow()
-	return nil
+	s.closeReason = ""
+	target := s.inputTarget()
+	input.start(func(data []byte) error {
+		return s.writeInput(data, target)
+	})
 }
 
 func (s *MenderShellSession) GetId() string {
 	return s.id
 }
 
+// GetUserId returns the id of the user who opened the session
+func (s *MenderShellSession) GetUserId() string {
+	return s.userId
+}
+
+// Context returns the context of the session, carrying the session id
+func (s *MenderShellSession) Context() context.Context {
+	return s.ctx
+}
+
+// Scrollback returns the last bytes of the shell output, at most
+// ScrollbackSize, trimmed to whole UTF-8 characters unless UTF8SafeOutput
+// is disabled; nil if the shell was not started
+func (s *MenderShellSession) Scrollback() []byte {
+	if s.scrollback == nil {
+		return nil
+	}
+	return s.scrollback.Bytes()
+}
+
 func (s *MenderShellSession) GetShellPid() int {
 	return s.shellPid
 }
 
 func (s *MenderShellSession) IsExpired(setStatus bool) bool {
-	if defaultSessionIdleExpiredTimeout != NoExpirationTimeout {
-		idleTimeoutReached := s.activeAt.Add(defaultSessionIdleExpiredTimeout)
+	if idleTimeout := s.idleExpiredTimeout(); idleTimeout != NoExpirationTimeout {
+		idleTimeoutReached := s.activeAt.Add(idleTimeout)
 		return timeNow().After(idleTimeoutReached)
 	}
 	e := timeNow().After(s.expiresAt)
 	if e && setStatus {
-		s.status = ExpiredSession
+		s.setStatus(ExpiredSession)
 	}
 	return e
 }
 
 func (s *MenderShellSession) ShellCommand(m *shell.MenderShellMessage) error {
+	settings := s.sessionSettings()
+	if settings.MaxInputMessageSize > 0 && len(m.Data) > settings.MaxInputMessageSize {
+		logging.FromContext(s.ctx).Warnf("session %s: rejecting %d bytes of input, over the limit of %d",
+			s.id, len(m.Data), settings.MaxInputMessageSize)
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrSessionInputTooLarge, len(m.Data), settings.MaxInputMessageSize)
+	}
 	s.activeAt = timeNow()
-	data := m.Data
+	if s.inputAt.IsZero() {
+		s.inputAt = s.activeAt
+	}
+	s.idleWarnedAt = time.Time{}
+	if s.input == nil {
+		return s.writeInput(m.Data, s.inputTarget())
+	}
+	err := s.input.push(m.Data)
+	if errors.Is(err, ErrSessionInputQueueFull) {
+		logging.FromContext(s.ctx).Warnf("session %s: rejecting %d bytes of input, %d messages are waiting",
+			s.id, len(m.Data), settings.InputQueueLength)
+		return fmt.Errorf("%w: %d messages are waiting", ErrSessionInputQueueFull, settings.InputQueueLength)
+	}
+	return err
+}
+
+//what the input of the shell goes to; taken when the shell starts, so the
+//input queue does not read the session while it is being closed
+type inputTarget struct {
+	writer             io.Writer
+	pseudoTTY          *os.File
+	recorder           *sessionRecorder
+	commandLogger      *commandLogger
+	interceptInterrupt bool
+}
+
+func (s *MenderShellSession) inputTarget() inputTarget {
+	return inputTarget{
+		writer:             s.writer,
+		pseudoTTY:          s.pseudoTTY,
+		recorder:           s.recorder,
+		commandLogger:      s.commandLogger,
+		interceptInterrupt: s.sessionSettings().InterceptInterrupt,
+	}
+}
+
+//writes the input to the terminal, the recording and the command log; run
+//by the input queue of the session, or by ShellCommand if it has none
+func (s *MenderShellSession) writeInput(data []byte, target inputTarget) error {
 	commandLine := string(data)
-	n, err := s.writer.Write(data)
+	var n int
+	var err error
+	if target.interceptInterrupt {
+		n, err = writeInterceptingInterrupts(data, target)
+	} else {
+		n, err = target.writer.Write(data)
+	}
 	if err != nil && n != len(data) {
 		err = shell.ErrExecWriteBytesShort
 	}
+	s.metricsCollector().BytesReceived(n)
+	if target.recorder != nil {
+		target.recorder.input(data[:n])
+	}
+	if target.commandLogger != nil {
+		target.commandLogger.input(data[:n])
+	}
 	if err != nil {
-		log.Debugf("error: '%s' while running '%s'.", err.Error(), commandLine)
+		logging.FromContext(s.ctx).Debugf("error: '%s' while running '%s'.", err.Error(), commandLine)
 	} else {
-		log.Debugf("executed: '%s'", commandLine)
+		logging.FromContext(s.ctx).Debugf("executed: '%s'", commandLine)
 	}
 	return err
 }
 
+//writes the input to the terminal, sending SIGINT to its foreground process
+//group in place of each Ctrl-C, so the command is interrupted even if it put
+//the terminal in raw mode, or has a lot of input queued before the Ctrl-C
+func writeInterceptingInterrupts(data []byte, target inputTarget) (int, error) {
+	written := 0
+	for {
+		i := bytes.IndexByte(data, shell.InterruptCharacter)
+		if i < 0 {
+			n, err := target.writer.Write(data)
+			return written + n, err
+		}
+		n, err := target.writer.Write(data[:i])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if err := shell.InterruptForeground(target.pseudoTTY); err != nil {
+			return written, err
+		}
+		written++
+		data = data[i+1:]
+	}
+}
+
+// ResizeShell sets the size of the terminal the shell is running in
+func (s *MenderShellSession) ResizeShell(height uint16, width uint16) error {
+	if height == 0 || width == 0 {
+		return ErrSessionInvalidTerminalSize
+	}
+	if status := s.GetStatus(); status != ActiveSession && status != HangedSession {
+		return ErrSessionShellNotRunning
+	}
+
+	err := shell.ResizeShell(s.pseudoTTY, height, width)
+	if err != nil {
+		return err
+	}
+	s.terminal.Height = height
+	s.terminal.Width = width
+	if s.recorder != nil {
+		s.recorder.resize(width, height)
+	}
+	return nil
+}
+
 func (s *MenderShellSession) StopShell() (err error) {
-	log.Infof("session %s status:%d stopping shell", s.id, s.status)
-	if s.status != ActiveSession && s.status != HangedSession {
+	logging.FromContext(s.ctx).Infof("session %s status:%d stopping shell", s.id, s.GetStatus())
+	if status := s.GetStatus(); status != ActiveSession && status != HangedSession {
 		return ErrSessionShellNotRunning
 	}
 
+	s.stopping = true
 	p, _ := os.FindProcess(s.shellPid)
 	p.Signal(syscall.SIGINT)
 	time.Sleep(2 * time.Second)
 	s.shell.Stop()
 	time.Sleep(2 * s.shell.GetWriteTimeout())
+	s.stopInput()
 	s.pseudoTTY.Close()
 
-	err = procps.TerminateAndWait(s.shellPid, s.command, 2*time.Second)
+	err = procps.TerminateAndWaitExited(s.shellPid, s.shellExited, 2*time.Second)
 	if err != nil {
-		log.Errorf("session %s, shell pid %d, termination error: %s", s.id, s.shellPid, err.Error())
+		logging.FromContext(s.ctx).Errorf("session %s, shell pid %d, termination error: %s", s.id, s.shellPid, err.Error())
 	}
 
 	s.shell.Stop()
+	s.shellStopped()
+	return err
+}
+
+// ShellExited tells how the shell exited, if it exited on its own, i.e.: it
+// was not stopped; nil if the shell is running, or was stopped
+func (s *MenderShellSession) ShellExited() *ShellExit {
+	if status := s.GetStatus(); s.stopping || s.shellExited == nil || (status != ActiveSession && status != HangedSession) {
+		return nil
+	}
+	select {
+	case <-s.shellExited:
+	default:
+		return nil
+	}
+
+	exit := &ShellExit{ExitCode: -1}
+	if s.command == nil {
+		return exit
+	}
+	if state := s.command.ProcessState; state != nil {
+		exit.ExitCode = state.ExitCode()
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			exit.Signal = status.Signal().String()
+		}
+	}
+	return exit
+}
+
+// CloseExitedShell lets the last output of the shell which exited on its own
+// through, and releases what it was using, leaving the session without a
+// shell
+func (s *MenderShellSession) CloseExitedShell() {
+	s.releaseExitedShell()
+	s.shellStopped()
+}
+
+// RespawnShell starts a new shell in place of the one which exited on its
+// own, with the same terminal settings and recording; lead is sent before
+// the output of the new shell, e.g.: to tell the user what happened. The
+// session is left without a shell if the new one fails to start
+func (s *MenderShellSession) RespawnShell(lead []byte) error {
+	s.releaseExitedShell()
+	err := s.spawnShell(s.terminal, s.recorder, lead)
+	if err != nil {
+		logging.FromContext(s.ctx).Errorf("session %s, failed to respawn the shell: %s", s.id, err.Error())
+		s.shellStopped()
+		return err
+	}
+	s.respawns++
+	return nil
+}
+
+// GetRespawnCount returns the number of times the shell was respawned
+func (s *MenderShellSession) GetRespawnCount() int {
+	return s.respawns
+}
+
+//lets the last output of the exited shell through, and closes its terminal
+func (s *MenderShellSession) releaseExitedShell() {
+	if !s.shell.WaitOutput(shellOutputFlushTimeout) {
+		logging.FromContext(s.ctx).Debugf("session %s, the shell output was not flushed", s.id)
+	}
+	s.shell.Stop()
+	s.stopInput()
+	s.pseudoTTY.Close()
+}
+
+//stops writing the input to the terminal, the input still waiting is dropped
+func (s *MenderShellSession) stopInput() {
+	if s.input == nil {
+		return
+	}
+	if dropped := s.input.close(shellOutputFlushTimeout); dropped > 0 {
+		logging.FromContext(s.ctx).Warnf("session %s: dropping %d input messages", s.id, dropped)
+	}
+}
+
+//releases what the stopped shell was using, and reports it closed
+func (s *MenderShellSession) shellStopped() {
+	if s.recorder != nil {
+		if rErr := s.recorder.close(); rErr != nil {
+			logging.FromContext(s.ctx).Errorf("session %s, failed to close the recording: %s", s.id, rErr.Error())
+		}
+		s.recorder = nil
+	}
+	s.runPostSessionScript(s.terminal)
 	s.terminal = MenderShellTerminalSettings{}
-	s.status = EmptySession
+	s.setStatus(EmptySession)
+	s.metricsCollector().SessionClosed()
+	logging.FromContext(s.ctx).WithField(logging.EventField, logging.EventSessionClosed).
+		Infof("session %s closed for the user id %s", s.id, s.userId)
+	if notifier := s.notifier(); notifier != nil {
+		notifier.SessionClosed(s.id, s.userId)
+	}
+}
+
+//waits until deadline for the hung up shell to exit, killing it otherwise,
+//then lets its last output through and stops it
+func (s *MenderShellSession) waitHungUpShell(exited <-chan struct{}, deadline time.Time) (err error) {
+	select {
+	case <-exited:
+	case <-time.After(time.Until(deadline)):
+		logging.FromContext(s.ctx).Warnf("session %s, shell pid %d did not exit after the hang up, killing it", s.id, s.shellPid)
+		p, _ := os.FindProcess(s.shellPid)
+		p.Signal(syscall.SIGKILL)
+		select {
+		case <-exited:
+		case <-time.After(shellProcessWaitTimeout):
+			err = errors.New("waiting for pid " + strconv.Itoa(s.shellPid) + " timeout. the process will remain as zombie.")
+		}
+	}
+
+	s.releaseExitedShell()
+	s.shellStopped()
 	return err
 }
+
+// MenderSessionShutdownAll hangs up the shells of all the sessions and
+// removes the sessions; the shells get up to gracePeriod to exit, after
+// which they are killed, and their last output is sent
+func (r *Registry) MenderSessionShutdownAll(gracePeriod time.Duration) (shellCount int, sessionCount int, err error) {
+	exited := map[string]<-chan struct{}{}
+	for _, s := range r.sessionsList() {
+		id := s.id
+		if status := s.GetStatus(); status != ActiveSession && status != HangedSession {
+			continue
+		}
+		logging.FromContext(s.ctx).Infof("session %s: hanging up the shell", id)
+		s.stopping = true
+		p, _ := os.FindProcess(s.shellPid)
+		p.Signal(syscall.SIGHUP)
+		exited[id] = s.shellExited
+	}
+
+	deadline := time.Now().Add(gracePeriod)
+	for _, s := range r.sessionsList() {
+		id := s.id
+		if done, ok := exited[id]; ok {
+			e := s.waitHungUpShell(done, deadline)
+			if e == nil {
+				shellCount++
+			} else {
+				logging.FromContext(s.ctx).Errorf("session %s: %s", id, e.Error())
+				err = e
+			}
+		}
+		e := r.MenderShellDeleteById(id)
+		if e == nil {
+			sessionCount++
+		} else {
+			err = e
+		}
+	}
+	return shellCount, sessionCount, err
+}
+
+// metricsOutput counts the shell output bytes, it never fails
+type metricsOutput struct {
+	collector metrics.Collector
+}
+
+func (o *metricsOutput) Write(p []byte) (int, error) {
+	o.collector.BytesSent(len(p))
+	return len(p), nil
+}
+
+// sanitizedOutput reads the shell output without the escape sequences the
+// sanitizer drops
+type sanitizedOutput struct {
+	r         io.Reader
+	sanitizer *shell.OutputSanitizer
+	//the sanitized output not read yet
+	data []byte
+}
+
+func (o *sanitizedOutput) Read(p []byte) (int, error) {
+	for len(o.data) == 0 {
+		n, err := o.r.Read(p)
+		o.data = o.sanitizer.Filter(p[:n])
+		if err != nil && len(o.data) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, o.data)
+	o.data = o.data[n:]
+	return n, nil
+}
+
+// rateLimitedInput writes the input to the terminal in chunks, at the pace of
+// the limiter; the next input messages wait in the input queue of the
+// session meanwhile, and are rejected once it is full, which pushes back on
+// the server. It gives up between the chunks once stop is closed
+type rateLimitedInput struct {
+	w       io.Writer
+	limiter *shell.RateLimiter
+	stop    <-chan struct{}
+}
+
+func (i *rateLimitedInput) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > inputChunkSize {
+			chunk = chunk[:inputChunkSize]
+		}
+		select {
+		case <-i.stop:
+			return written, ErrSessionShellNotRunning
+		default:
+		}
+		i.limiter.Wait(len(chunk))
+		n, err := i.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
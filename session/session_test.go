@@ -14,16 +14,24 @@
 package session
 
 import (
+	"bytes"
+	"errors"
 	"github.com/mendersoftware/mender-shell/connection"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"os/exec"
 	"os/user"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -33,10 +41,14 @@ import (
 
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 
+	"github.com/mendersoftware/mender-shell/logging"
 	"github.com/mendersoftware/mender-shell/procps"
 	"github.com/mendersoftware/mender-shell/shell"
 )
 
+//the registry of the sessions of the tests
+var testSessions = NewRegistry(nil)
+
 func newShellTransaction(w http.ResponseWriter, r *http.Request) {
 	var upgrader = websocket.Upgrader{}
 	c, err := upgrader.Upgrade(w, r, nil)
@@ -51,7 +63,8 @@ func newShellTransaction(w http.ResponseWriter, r *http.Request) {
 }
 
 func TestMenderShellStartStopShell(t *testing.T) {
-	MaxUserSessions = 2
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
 	t.Log("starting mock httpd with websockets")
 	server := httptest.NewServer(http.HandlerFunc(newShellTransaction))
 	defer server.Close()
@@ -83,7 +96,7 @@ func TestMenderShellStartStopShell(t *testing.T) {
 	}
 
 	var mutex sync.Mutex
-	s, err := NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567ff", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567ff", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
 		Uid:            uint32(uid),
 		Gid:            uint32(gid),
@@ -114,7 +127,7 @@ func TestMenderShellStartStopShell(t *testing.T) {
 	assert.Equal(t, strings.Split(s.GetActiveAtFmt(), ":")[0], nowUpToHours)
 	assert.Equal(t, "/bin/sh", s.GetShellCommandPath())
 
-	sNew, err := NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567ff", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	sNew, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567ff", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = sNew.StartShell(sNew.GetId(), MenderShellTerminalSettings{
 		Uid:            uint32(uid),
 		Gid:            uint32(gid),
@@ -135,11 +148,11 @@ func TestMenderShellStartStopShell(t *testing.T) {
 	}
 	assert.False(t, procps.ProcessExists(s.shellPid))
 
-	count, err := MenderShellStopByUserId("user-id-f435678-f4567ff")
+	count, err := testSessions.MenderShellStopByUserId("user-id-f435678-f4567ff")
 	assert.NoError(t, err)
 	assert.Equal(t, uint(2), count) //the reason for 2 here: s.StopShell does not intrinsically remove the session
 
-	count, err = MenderShellStopByUserId("not-really-there")
+	count, err = testSessions.MenderShellStopByUserId("not-really-there")
 	assert.Error(t, err)
 }
 
@@ -175,7 +188,7 @@ func TestMenderShellCommand(t *testing.T) {
 	}
 
 	var mutex sync.Mutex
-	s, err := NewMenderShellSession(&mutex, ws, uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, uuid.NewV4().String(), defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
 		Uid:            uint32(uid),
 		Gid:            uint32(gid),
@@ -197,19 +210,23 @@ func TestMenderShellCommand(t *testing.T) {
 	})
 	assert.NoError(t, err)
 
-	//close terminal controlling handle, for error from inside ShellCommand
+	//close terminal controlling handle, for error from inside ShellCommand;
+	//the input is written by the input queue, the next command reports the
+	//failed write
 	s.pseudoTTY.Close()
-	err = s.ShellCommand(&shell.MenderShellMessage{
-		Type:      wsshell.MessageTypeShellCommand,
-		SessionId: s.GetId(),
-		Status:    0,
-		Data:      []byte("echo ok;\n"),
-	})
-	assert.Error(t, err)
+	assert.Eventually(t, func() bool {
+		return s.ShellCommand(&shell.MenderShellMessage{
+			Type:      wsshell.MessageTypeShellCommand,
+			SessionId: s.GetId(),
+			Status:    0,
+			Data:      []byte("echo ok;\n"),
+		}) != nil
+	}, 2*time.Second, 50*time.Millisecond)
 }
 
 func TestMenderShellShellAlreadyStartedFailedToStart(t *testing.T) {
-	MaxUserSessions = 2
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
 	t.Log("starting mock httpd with websockets")
 	server := httptest.NewServer(http.HandlerFunc(newShellTransaction))
 	defer server.Close()
@@ -242,7 +259,7 @@ func TestMenderShellShellAlreadyStartedFailedToStart(t *testing.T) {
 
 	var mutex sync.Mutex
 	userId := uuid.NewV4().String()
-	s, err := NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
 		Uid:            uint32(uid),
 		Gid:            uint32(gid),
@@ -271,7 +288,7 @@ func TestMenderShellShellAlreadyStartedFailedToStart(t *testing.T) {
 	assert.Error(t, err)
 	assert.True(t, procps.ProcessExists(s.shellPid))
 
-	sNew, err := NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	sNew, err := testSessions.NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = sNew.StartShell(sNew.GetId(), MenderShellTerminalSettings{
 		Uid:            uint32(uid),
 		Gid:            uint32(gid),
@@ -315,7 +332,7 @@ func TestMenderShellSessionExpire(t *testing.T) {
 	assert.NotNil(t, ws)
 
 	var mutex sync.Mutex
-	s, err := NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
 		Uid:            500,
 		Gid:            501,
@@ -344,7 +361,7 @@ func TestMenderShellSessionUpdateWS(t *testing.T) {
 	assert.NotNil(t, ws)
 
 	var mutex sync.Mutex
-	s, err := NewMenderShellSession(&mutex, ws, "user-id-f435678-f451212", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-f435678-f451212", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
 		Uid:            500,
 		Gid:            501,
@@ -360,7 +377,7 @@ func TestMenderShellSessionUpdateWS(t *testing.T) {
 	assert.NotNil(t, ws)
 
 	assert.True(t, s.ws == ws)
-	err = UpdateWSConnection(newWS)
+	err = testSessions.UpdateWSConnection(newWS)
 	assert.NoError(t, err)
 	assert.True(t, s.ws == newWS)
 }
@@ -380,36 +397,37 @@ func TestMenderShellSessionGetByUserId(t *testing.T) {
 
 	var mutex sync.Mutex
 	userId := "user-id-f431212-f4567ff"
-	s, err := NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 
 	anotherUserId := "user-id-f4433528-43b342b234b"
-	anotherUserSession, err := NewMenderShellSession(&mutex, ws, anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	anotherUserSession, err := testSessions.NewMenderShellSession(&mutex, ws, anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 
 	assert.NotEqual(t, anotherUserId, userId)
 
-	userSessions := MenderShellSessionsGetByUserId(userId)
+	userSessions := testSessions.MenderShellSessionsGetByUserId(userId)
 	assert.True(t, len(userSessions) > 0)
 	assert.NotNil(t, userSessions[0])
 	assert.True(t, userSessions[0].GetId() == s.id)
 	assert.True(t, userSessions[0].GetShellPid() == s.shellPid)
 
-	anotherUserSessions := MenderShellSessionsGetByUserId(anotherUserId)
+	anotherUserSessions := testSessions.MenderShellSessionsGetByUserId(anotherUserId)
 	assert.True(t, len(anotherUserSessions) > 0)
 	assert.NotNil(t, anotherUserSessions[0])
 	assert.True(t, anotherUserSessions[0].GetId() == anotherUserSession.id)
 	assert.True(t, anotherUserSessions[0].GetShellPid() == anotherUserSession.shellPid)
 
-	userSessions = MenderShellSessionsGetByUserId(userId + "-different")
+	userSessions = testSessions.MenderShellSessionsGetByUserId(userId + "-different")
 	assert.False(t, len(userSessions) > 0)
 
-	anotherUserSessions = MenderShellSessionsGetByUserId(anotherUserId + "-different")
+	anotherUserSessions = testSessions.MenderShellSessionsGetByUserId(anotherUserId + "-different")
 	assert.False(t, len(anotherUserSessions) > 0)
 }
 
 func TestMenderShellSessionGetById(t *testing.T) {
-	MaxUserSessions = 2
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
 
@@ -424,47 +442,48 @@ func TestMenderShellSessionGetById(t *testing.T) {
 
 	var mutex sync.Mutex
 	userId := "user-id-8989-f431212-f4567ff"
-	s, err := NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
-	r, err := NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	r, err := testSessions.NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 
 	anotherUserId := "user-id-8989-f4433528-43b342b234b"
-	anotherUserSession, err := NewMenderShellSession(&mutex, ws, anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	anotherUserSession, err := testSessions.NewMenderShellSession(&mutex, ws, anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
-	andAnotherUserSession, err := NewMenderShellSession(&mutex, ws, anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	andAnotherUserSession, err := testSessions.NewMenderShellSession(&mutex, ws, anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 
 	assert.NotEqual(t, anotherUserId, userId)
 
-	userSessions := MenderShellSessionsGetByUserId(userId)
+	userSessions := testSessions.MenderShellSessionsGetByUserId(userId)
 	assert.True(t, len(userSessions) == 2)
 	assert.NotNil(t, userSessions[0])
 	assert.True(t, userSessions[0].GetId() == s.id)
 
-	anotherUserSessions := MenderShellSessionsGetByUserId(anotherUserId)
+	anotherUserSessions := testSessions.MenderShellSessionsGetByUserId(anotherUserId)
 	assert.True(t, len(anotherUserSessions) == 2)
 	assert.NotNil(t, anotherUserSessions[0])
 	assert.True(t, anotherUserSessions[0].GetId() == anotherUserSession.id)
 
-	assert.NotNil(t, MenderShellSessionGetById(userSessions[0].GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(userSessions[1].GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(anotherUserSessions[0].GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(anotherUserSessions[1].GetId()))
-	assert.Nil(t, MenderShellSessionGetById("not-really-there"))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(userSessions[0].GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(userSessions[1].GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(anotherUserSessions[0].GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(anotherUserSessions[1].GetId()))
+	assert.Nil(t, testSessions.MenderShellSessionGetById("not-really-there"))
 
 	var ids []string
 
 	ids = []string{anotherUserSession.id, andAnotherUserSession.id}
-	assert.Contains(t, ids, MenderShellSessionGetById(anotherUserSessions[0].GetId()).id)
-	assert.Contains(t, ids, MenderShellSessionGetById(anotherUserSessions[1].GetId()).id)
+	assert.Contains(t, ids, testSessions.MenderShellSessionGetById(anotherUserSessions[0].GetId()).id)
+	assert.Contains(t, ids, testSessions.MenderShellSessionGetById(anotherUserSessions[1].GetId()).id)
 	ids = []string{s.id, r.id}
-	assert.Contains(t, ids, MenderShellSessionGetById(userSessions[0].GetId()).id)
-	assert.Contains(t, ids, MenderShellSessionGetById(userSessions[1].GetId()).id)
+	assert.Contains(t, ids, testSessions.MenderShellSessionGetById(userSessions[0].GetId()).id)
+	assert.Contains(t, ids, testSessions.MenderShellSessionGetById(userSessions[1].GetId()).id)
 }
 
 func TestMenderShellDeleteById(t *testing.T) {
-	MaxUserSessions = 2
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
 
@@ -479,66 +498,91 @@ func TestMenderShellDeleteById(t *testing.T) {
 
 	var mutex sync.Mutex
 	userId := "user-id-1212-8989-f431212-f4567ff"
-	s, err := NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
-	r, err := NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	r, err := testSessions.NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 
 	anotherUserId := "user-id-1212-8989-f4433528-43b342b234b"
-	anotherUserSession, err := NewMenderShellSession(&mutex, ws, anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	anotherUserSession, err := testSessions.NewMenderShellSession(&mutex, ws, anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 	assert.NotNil(t, anotherUserSession)
-	andAnotherUserSession, err := NewMenderShellSession(&mutex, ws, anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	andAnotherUserSession, err := testSessions.NewMenderShellSession(&mutex, ws, anotherUserId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.NoError(t, err)
 	assert.NotNil(t, anotherUserSession)
 
-	assert.NotNil(t, MenderShellSessionGetById(anotherUserSession.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(andAnotherUserSession.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(s.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(r.GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(anotherUserSession.GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(andAnotherUserSession.GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(s.GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(r.GetId()))
 
-	err = MenderShellDeleteById("not-really-here")
+	err = testSessions.MenderShellDeleteById("not-really-here")
 	assert.Error(t, err)
 
-	err = MenderShellDeleteById(anotherUserSession.GetId())
+	err = testSessions.MenderShellDeleteById(anotherUserSession.GetId())
 	assert.NoError(t, err)
-	assert.Nil(t, MenderShellSessionGetById(anotherUserSession.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(andAnotherUserSession.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(s.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(r.GetId()))
+	assert.Nil(t, testSessions.MenderShellSessionGetById(anotherUserSession.GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(andAnotherUserSession.GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(s.GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(r.GetId()))
 
-	err = MenderShellDeleteById("not-really-here")
+	err = testSessions.MenderShellDeleteById("not-really-here")
 	assert.Error(t, err)
 
-	err = MenderShellDeleteById(andAnotherUserSession.GetId())
+	err = testSessions.MenderShellDeleteById(andAnotherUserSession.GetId())
 	assert.NoError(t, err)
-	assert.Nil(t, MenderShellSessionGetById(anotherUserSession.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(andAnotherUserSession.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(s.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(r.GetId()))
+	assert.Nil(t, testSessions.MenderShellSessionGetById(anotherUserSession.GetId()))
+	assert.Nil(t, testSessions.MenderShellSessionGetById(andAnotherUserSession.GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(s.GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(r.GetId()))
 
-	err = MenderShellDeleteById(s.GetId())
+	err = testSessions.MenderShellDeleteById(s.GetId())
 	assert.NoError(t, err)
-	assert.Nil(t, MenderShellSessionGetById(anotherUserSession.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(andAnotherUserSession.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(s.GetId()))
-	assert.NotNil(t, MenderShellSessionGetById(r.GetId()))
+	assert.Nil(t, testSessions.MenderShellSessionGetById(anotherUserSession.GetId()))
+	assert.Nil(t, testSessions.MenderShellSessionGetById(andAnotherUserSession.GetId()))
+	assert.Nil(t, testSessions.MenderShellSessionGetById(s.GetId()))
+	assert.NotNil(t, testSessions.MenderShellSessionGetById(r.GetId()))
 
-	err = MenderShellDeleteById(r.GetId())
+	err = testSessions.MenderShellDeleteById(r.GetId())
 	assert.NoError(t, err)
-	assert.Nil(t, MenderShellSessionGetById(anotherUserSession.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(andAnotherUserSession.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(s.GetId()))
-	assert.Nil(t, MenderShellSessionGetById(r.GetId()))
+	assert.Nil(t, testSessions.MenderShellSessionGetById(anotherUserSession.GetId()))
+	assert.Nil(t, testSessions.MenderShellSessionGetById(andAnotherUserSession.GetId()))
+	assert.Nil(t, testSessions.MenderShellSessionGetById(s.GetId()))
+	assert.Nil(t, testSessions.MenderShellSessionGetById(r.GetId()))
 
-	err = MenderShellDeleteById("not-really-here")
+	err = testSessions.MenderShellDeleteById("not-really-here")
 	assert.Error(t, err)
 }
 
+func TestRegistriesAreSeparate(t *testing.T) {
+	first := NewRegistry(nil)
+	second := NewRegistry(nil)
+	second.Configure(func(settings *Settings) {
+		settings.MaxUserSessions = 2
+	})
+
+	s, err := first.NewMenderShellSession(&sync.Mutex{}, nil, "user-id-registries", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	_, err = first.NewMenderShellSession(&sync.Mutex{}, nil, "user-id-registries", NoExpirationTimeout, NoExpirationTimeout)
+	assert.Equal(t, ErrSessionShellTooManySessionsPerUser, err)
+
+	//the sessions of a registry count only against its own limits
+	for i := 0; i < 2; i++ {
+		_, err = second.NewMenderShellSession(&sync.Mutex{}, nil, "user-id-registries", NoExpirationTimeout, NoExpirationTimeout)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 1, first.MenderShellSessionGetCount())
+	assert.Equal(t, 2, second.MenderShellSessionGetCount())
+	assert.Nil(t, second.MenderShellSessionGetById(s.GetId()))
+	assert.Equal(t, 1, first.Settings().MaxUserSessions)
+	assert.Equal(t, 2, second.Settings().MaxUserSessions)
+}
+
 func TestMenderShellNewMenderShellSession(t *testing.T) {
-	MaxUserSessions = 2
-	sessionsMap = map[string]*MenderShellSession{}
-	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
+	testSessions.sessions = map[string]*MenderShellSession{}
+	testSessions.byUserId = map[string][]*MenderShellSession{}
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
 
@@ -555,32 +599,32 @@ func TestMenderShellNewMenderShellSession(t *testing.T) {
 	var createdSessonsIds []string
 	var s *MenderShellSession
 	userId := uuid.NewV4().String()
-	for i := 0; i < MaxUserSessions; i++ {
-		s, err = NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	for i := 0; i < testSessions.settings.MaxUserSessions; i++ {
+		s, err = testSessions.NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 		assert.NoError(t, err)
 		assert.NotNil(t, s)
 		createdSessonsIds = append(createdSessonsIds, s.id)
 	}
-	notFoundSession, err := NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
+	notFoundSession, err := testSessions.NewMenderShellSession(&mutex, ws, userId, defaultSessionExpiredTimeout, NoExpirationTimeout)
 	assert.Error(t, err)
 	assert.Nil(t, notFoundSession)
 
-	sessionById := MenderShellSessionGetById(s.GetId())
+	sessionById := testSessions.MenderShellSessionGetById(s.GetId())
 	assert.NotNil(t, sessionById)
 	assert.True(t, sessionById.id == s.GetId())
 
-	count := MenderShellSessionGetCount()
-	assert.Equal(t, MaxUserSessions, count)
+	count := testSessions.MenderShellSessionGetCount()
+	assert.Equal(t, testSessions.settings.MaxUserSessions, count)
 
-	sessionsIds := MenderShellSessionGetSessionIds()
+	sessionsIds := testSessions.MenderShellSessionGetSessionIds()
 	assert.Equal(t, len(createdSessonsIds), len(sessionsIds))
 	assert.ElementsMatch(t, createdSessonsIds, sessionsIds)
 }
 
 func TestMenderSessionTerminateExpired(t *testing.T) {
 	defaultSessionExpiredTimeout = 8 * time.Second
-	sessionsMap = map[string]*MenderShellSession{}
-	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	testSessions.sessions = map[string]*MenderShellSession{}
+	testSessions.byUserId = map[string][]*MenderShellSession{}
 
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
@@ -595,7 +639,7 @@ func TestMenderSessionTerminateExpired(t *testing.T) {
 	assert.NotNil(t, ws)
 
 	var mutex sync.Mutex
-	s, err := NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	t.Logf("created session:\n id:%s,\n createdAt:%s,\n expiresAt:%s\n now:%s",
 		s.id,
 		s.createdAt.Format("Mon Jan 2 15:04:05 -0700 MST 2006"),
@@ -611,7 +655,7 @@ func TestMenderSessionTerminateExpired(t *testing.T) {
 	})
 	assert.NoError(t, err)
 
-	shells, sessions, total, err := MenderSessionTerminateExpired()
+	shells, sessions, total, err := testSessions.MenderSessionTerminateExpired()
 	assert.NoError(t, err)
 	assert.Equal(t, 0, shells)
 	assert.Equal(t, 0, sessions)
@@ -620,7 +664,7 @@ func TestMenderSessionTerminateExpired(t *testing.T) {
 	time.Sleep(2 * defaultSessionExpiredTimeout)
 	assert.True(t, s.IsExpired(false))
 
-	shells, sessions, total, err = MenderSessionTerminateExpired()
+	shells, sessions, total, err = testSessions.MenderSessionTerminateExpired()
 	assert.NoError(t, err)
 	assert.Equal(t, 1, shells)
 	assert.Equal(t, 1, sessions)
@@ -629,9 +673,10 @@ func TestMenderSessionTerminateExpired(t *testing.T) {
 }
 
 func TestMenderSessionTerminateAll(t *testing.T) {
+	testSessions.settings.MaxSessions = 16
 	defaultSessionExpiredTimeout = 8 * time.Second
-	sessionsMap = map[string]*MenderShellSession{}
-	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	testSessions.sessions = map[string]*MenderShellSession{}
+	testSessions.byUserId = map[string][]*MenderShellSession{}
 
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
@@ -646,7 +691,7 @@ func TestMenderSessionTerminateAll(t *testing.T) {
 	assert.NotNil(t, ws)
 
 	var mutex sync.Mutex
-	s0, err := NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s0, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f2", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	t.Logf("created session:\n id:%s,\n createdAt:%s,\n expiresAt:%s\n now:%s",
 		s0.id,
 		s0.createdAt.Format("Mon Jan 2 15:04:05 -0700 MST 2006"),
@@ -662,7 +707,7 @@ func TestMenderSessionTerminateAll(t *testing.T) {
 	})
 	assert.NoError(t, err)
 
-	s1, err := NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f3", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	s1, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f3", defaultSessionExpiredTimeout, NoExpirationTimeout)
 	t.Logf("created session:\n id:%s,\n createdAt:%s,\n expiresAt:%s\n now:%s",
 		s1.id,
 		s1.createdAt.Format("Mon Jan 2 15:04:05 -0700 MST 2006"),
@@ -678,7 +723,7 @@ func TestMenderSessionTerminateAll(t *testing.T) {
 	})
 	assert.NoError(t, err)
 
-	MenderSessionTerminateAll()
+	testSessions.MenderSessionTerminateAll()
 	assert.True(t, !procps.ProcessExists(s0.shellPid))
 	assert.True(t, !procps.ProcessExists(s1.shellPid))
 }
@@ -686,8 +731,8 @@ func TestMenderSessionTerminateAll(t *testing.T) {
 func TestMenderSessionTerminateIdle(t *testing.T) {
 	defaultSessionExpiredTimeout = 255 * time.Second
 	idleTimeOut := 4 * time.Second
-	sessionsMap = map[string]*MenderShellSession{}
-	sessionsByUserIdMap = map[string][]*MenderShellSession{}
+	testSessions.sessions = map[string]*MenderShellSession{}
+	testSessions.byUserId = map[string][]*MenderShellSession{}
 
 	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
 	defer server.Close()
@@ -702,7 +747,7 @@ func TestMenderSessionTerminateIdle(t *testing.T) {
 	assert.NotNil(t, ws)
 
 	var mutex sync.Mutex
-	s, err := NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f2", NoExpirationTimeout, idleTimeOut)
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f2", NoExpirationTimeout, idleTimeOut)
 	t.Logf("created session:\n id:%s,\n createdAt:%s,\n expiresAt:%s\n now:%s",
 		s.id,
 		s.createdAt.Format("Mon Jan 2 15:04:05 -0700 MST 2006"),
@@ -725,7 +770,7 @@ func TestMenderSessionTerminateIdle(t *testing.T) {
 		}
 	}(s.pseudoTTY)
 
-	shells, sessions, total, err := MenderSessionTerminateExpired()
+	shells, sessions, total, err := testSessions.MenderSessionTerminateExpired()
 	assert.NoError(t, err)
 	assert.Equal(t, 0, shells)
 	assert.Equal(t, 0, sessions)
@@ -734,7 +779,7 @@ func TestMenderSessionTerminateIdle(t *testing.T) {
 	time.Sleep(2 * idleTimeOut)
 	assert.True(t, s.IsExpired(false))
 
-	shells, sessions, total, err = MenderSessionTerminateExpired()
+	shells, sessions, total, err = testSessions.MenderSessionTerminateExpired()
 	assert.NoError(t, err)
 	assert.Equal(t, 1, shells)
 	assert.Equal(t, 1, sessions)
@@ -745,3 +790,988 @@ func TestMenderSessionTerminateIdle(t *testing.T) {
 func TestMenderSessionTimeNow(t *testing.T) {
 	assert.Equal(t, timeNow().Format(defaultTimeFormat), time.Now().UTC().Format(defaultTimeFormat))
 }
+
+func TestMenderSessionIdleWarned(t *testing.T) {
+	s := &MenderShellSession{
+		activeAt: timeNow().Add(-4 * time.Second),
+		writer:   ioutil.Discard,
+	}
+	assert.True(t, s.IdleFor() >= 4*time.Second)
+	assert.False(t, s.IsIdleWarned())
+
+	s.SetIdleWarned()
+	assert.True(t, s.IsIdleWarned())
+
+	err := s.ShellCommand(&shell.MenderShellMessage{
+		Type: wsshell.MessageTypeShellCommand,
+		Data: []byte("echo;\n"),
+	})
+	assert.NoError(t, err)
+	assert.False(t, s.IsIdleWarned())
+	assert.True(t, s.IdleFor() < time.Second)
+}
+
+func TestMenderSessionReceivedInput(t *testing.T) {
+	s := &MenderShellSession{
+		createdAt: timeNow().Add(-4 * time.Second),
+		activeAt:  timeNow().Add(-4 * time.Second),
+		writer:    ioutil.Discard,
+	}
+	assert.False(t, s.ReceivedInput())
+
+	err := s.ShellCommand(&shell.MenderShellMessage{
+		Type: wsshell.MessageTypeShellCommand,
+		Data: []byte("\r"),
+	})
+	assert.NoError(t, err)
+	assert.True(t, s.ReceivedInput())
+	inputAt := s.inputAt
+
+	//the time of the first input is kept
+	err = s.ShellCommand(&shell.MenderShellMessage{
+		Type: wsshell.MessageTypeShellCommand,
+		Data: []byte("echo;\n"),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, inputAt, s.inputAt)
+}
+
+func TestMenderSessionDurationWarned(t *testing.T) {
+	s := &MenderShellSession{
+		createdAt: timeNow().Add(-4 * time.Second),
+		writer:    ioutil.Discard,
+	}
+	assert.True(t, s.OpenFor() >= 4*time.Second)
+	assert.False(t, s.IsDurationWarned())
+
+	s.SetDurationWarned()
+	assert.True(t, s.IsDurationWarned())
+
+	//the input does not reset the max duration warning
+	err := s.ShellCommand(&shell.MenderShellMessage{
+		Type: wsshell.MessageTypeShellCommand,
+		Data: []byte("echo;\n"),
+	})
+	assert.NoError(t, err)
+	assert.True(t, s.IsDurationWarned())
+	assert.True(t, s.OpenFor() >= 4*time.Second)
+}
+
+func TestMenderShellSessionContext(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 2
+	s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, nil, uuid.NewV4().String(), NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer testSessions.MenderShellDeleteById(s.GetId())
+
+	assert.Equal(t, s.GetId(), logging.SessionIDFromContext(s.Context()))
+}
+
+type recordingNotifier struct {
+	events []string
+}
+
+func (n *recordingNotifier) SessionOpened(sessionId string, userId string) {
+	n.events = append(n.events, "opened "+sessionId+" "+userId)
+}
+
+func (n *recordingNotifier) SessionClosed(sessionId string, userId string) {
+	n.events = append(n.events, "closed "+sessionId+" "+userId)
+}
+
+func TestMenderShellSessionNotifier(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
+	notifier := &recordingNotifier{}
+	testSessions.SetNotifier(notifier)
+	defer func() {
+		testSessions.SetNotifier(nil)
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	assert.NoError(t, err)
+	//StopShell waits twice the write timeout
+	ws, err := connection.NewConnection(*u, "token", time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, ws, "user-id-notifier", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer testSessions.MenderShellDeleteById(s.GetId())
+	assert.Equal(t, "user-id-notifier", s.GetUserId())
+
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"opened " + s.GetId() + " user-id-notifier"}, notifier.events)
+	assert.Equal(t, "", s.CloseReason())
+
+	s.StopShell()
+	assert.Equal(t, []string{
+		"opened " + s.GetId() + " user-id-notifier",
+		"closed " + s.GetId() + " user-id-notifier",
+	}, notifier.events)
+	assert.Equal(t, SessionStoppedReason, s.CloseReason())
+
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	s.SetCloseReason("session timed out")
+	s.StopShell()
+	assert.Equal(t, "session timed out", s.CloseReason())
+}
+
+func TestMenderShellStartShellMaxSessions(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 1
+	defer func() {
+		testSessions.settings.MaxSessions = 16
+	}()
+	testSessions.sessions = map[string]*MenderShellSession{}
+	testSessions.byUserId = map[string][]*MenderShellSession{}
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	urlString, err := url.Parse(u)
+	assert.NoError(t, err)
+
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, ws)
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+	terminal := MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         24,
+		Width:          80,
+	}
+
+	var mutex sync.Mutex
+	s0, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f9", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	s1, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567f9", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, testSessions.MenderShellSessionGetActiveCount())
+
+	err = s0.StartShell(s0.GetId(), terminal)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, testSessions.MenderShellSessionGetActiveCount())
+
+	err = s1.StartShell(s1.GetId(), terminal)
+	assert.True(t, errors.Is(err, ErrSessionTooManySessions))
+	assert.EqualError(t, err, "too many active sessions: 1/1")
+	assert.Equal(t, NewSession, s1.GetStatus())
+
+	s0.StopShell()
+	assert.Equal(t, 0, testSessions.MenderShellSessionGetActiveCount())
+
+	err = s1.StartShell(s1.GetId(), terminal)
+	assert.NoError(t, err)
+	s1.StopShell()
+}
+
+func TestMenderShellStartShellSessionScripts(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
+	testSessions.sessions = map[string]*MenderShellSession{}
+	testSessions.byUserId = map[string][]*MenderShellSession{}
+	defer func() {
+		testSessions.settings.PreSessionScript = ""
+		testSessions.settings.PostSessionScript = ""
+	}()
+
+	dir, err := ioutil.TempDir("", "mender-shell-scripts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	urlString, err := url.Parse(u)
+	assert.NoError(t, err)
+
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, ws)
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+	terminal := MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		UserName:       currentUser.Username,
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         24,
+		Width:          80,
+	}
+
+	var mutex sync.Mutex
+	logFile := path.Join(dir, "log")
+	testSessions.settings.PreSessionScript = writeScript(t, dir, "pre", "echo pre $"+ScriptEnvSessionID+" $"+ScriptEnvUser+" >> "+logFile)
+	testSessions.settings.PostSessionScript = writeScript(t, dir, "post", "echo post $"+ScriptEnvSessionID+" $"+ScriptEnvUser+" >> "+logFile)
+
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-session-scripts", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = s.StartShell(s.GetId(), terminal)
+	assert.NoError(t, err)
+	data, _ := ioutil.ReadFile(logFile)
+	assert.Equal(t, "pre "+s.GetId()+" "+currentUser.Username+"\n", string(data))
+
+	err = s.StopShell()
+	assert.NoError(t, err)
+	data, _ = ioutil.ReadFile(logFile)
+	assert.Equal(t, "pre "+s.GetId()+" "+currentUser.Username+"\n"+
+		"post "+s.GetId()+" "+currentUser.Username+"\n", string(data))
+
+	//the session is rejected with the stderr of the failed pre-session
+	//script, and the post-session script does not run; the scripts are
+	//taken when the session is created
+	os.Remove(logFile)
+	testSessions.settings.PreSessionScript = writeScript(t, dir, "pre-fail", "echo cannot mount >&2; exit 1")
+	r, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-session-scripts", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	err = r.StartShell(r.GetId(), terminal)
+	assert.True(t, errors.Is(err, ErrPreSessionScriptFailed))
+	assert.EqualError(t, err, "pre-session script failed: exit status 1: cannot mount")
+	assert.Equal(t, NewSession, r.GetStatus())
+	_, err = os.Stat(logFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestMenderShellSessionRecording(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
+	dir, err := ioutil.TempDir("", "mender-shell-recordings")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	testSessions.settings.RecordingDir = dir
+	defer func() {
+		testSessions.settings.RecordingDir = ""
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+
+	u := "ws" + strings.TrimPrefix(server.URL, "http")
+	urlString, err := url.Parse(u)
+	assert.NoError(t, err)
+
+	ws, err := connection.NewConnection(*urlString, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+	assert.NotNil(t, ws)
+
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	var mutex sync.Mutex
+	s, err := testSessions.NewMenderShellSession(&mutex, ws, "user-id-f435678-f4567fa", defaultSessionExpiredTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	s.SetAuthenticatedUser("operator@example.com")
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         24,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+
+	err = s.ShellCommand(&shell.MenderShellMessage{
+		Type:      wsshell.MessageTypeShellCommand,
+		SessionId: s.GetId(),
+		Data:      []byte("echo recorded-output\n"),
+	})
+	assert.NoError(t, err)
+	time.Sleep(time.Second)
+	s.StopShell()
+	testSessions.MenderShellDeleteById(s.GetId())
+
+	header, events, _ := readRecording(t, dir)
+	assert.Equal(t, s.GetId(), header.SessionId)
+	assert.Equal(t, "operator@example.com", header.User)
+	input, output := "", ""
+	for _, event := range events {
+		switch event[1] {
+		case recordingEventInput:
+			input += event[2].(string)
+		case recordingEventOutput:
+			output += event[2].(string)
+		}
+	}
+	assert.Equal(t, "echo recorded-output\n", input)
+	assert.Contains(t, output, "recorded-output")
+}
+
+func TestMenderShellResizeShell(t *testing.T) {
+	s := &MenderShellSession{
+		status: NewSession,
+	}
+	assert.Equal(t, ErrSessionInvalidTerminalSize, s.ResizeShell(0, 80))
+	assert.Equal(t, ErrSessionShellNotRunning, s.ResizeShell(24, 80))
+}
+
+func TestMenderShellSessionBanner(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	assert.NoError(t, err)
+	ws, err := connection.NewConnection(*u, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, ws, "user-id-banner", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer testSessions.MenderShellDeleteById(s.GetId())
+	assert.Nil(t, s.Scrollback())
+
+	banner := []byte("Authorized access only\r\n")
+	s.SetBanner(banner)
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	defer s.StopShell()
+
+	time.Sleep(time.Second)
+	//the banner is the first output, before the prompt
+	output := s.Scrollback()
+	assert.True(t, bytes.HasPrefix(output, banner), "output %q", output)
+	assert.Equal(t, 1, bytes.Count(output, banner))
+}
+
+func TestMenderSessionShutdownAll(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	assert.NoError(t, err)
+	ws, err := connection.NewConnection(*u, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		command  string
+		duration time.Duration
+	}{
+		"exits on hang up": {
+			duration: 4 * time.Second,
+		},
+		"ignores the hang up": {
+			command:  "trap '' HUP\n",
+			duration: 8 * time.Second,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			testSessions.MenderSessionTerminateAll()
+			s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, ws, "user-id-shutdown", NoExpirationTimeout, NoExpirationTimeout)
+			assert.NoError(t, err)
+			err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+				Uid:            uint32(uid),
+				Gid:            uint32(gid),
+				Shell:          "/bin/sh",
+				TerminalString: "xterm-256color",
+				Height:         40,
+				Width:          80,
+			})
+			assert.NoError(t, err)
+			if tc.command != "" {
+				err = s.ShellCommand(&shell.MenderShellMessage{Data: []byte(tc.command)})
+				assert.NoError(t, err)
+				time.Sleep(time.Second)
+			}
+			pid := s.GetShellPid()
+
+			start := time.Now()
+			shellCount, sessionCount, err := testSessions.MenderSessionShutdownAll(2 * time.Second)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, shellCount)
+			assert.Equal(t, 1, sessionCount)
+			assert.True(t, time.Since(start) < tc.duration)
+			assert.False(t, procps.ProcessExists(pid))
+			assert.Nil(t, testSessions.MenderShellSessionGetById(s.GetId()))
+			assert.Equal(t, EmptySession, s.GetStatus())
+		})
+	}
+}
+
+func TestMenderShellStartShellWorkingDir(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	assert.NoError(t, err)
+	ws, err := connection.NewConnection(*u, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, ws, "user-id-working-dir", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer testSessions.MenderShellDeleteById(s.GetId())
+
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+		WorkingDir:     "/nonexistent/mender-shell",
+	})
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.Contains(t, err.Error(), "working directory /nonexistent/mender-shell")
+	assert.Equal(t, NewSession, s.GetStatus())
+}
+
+func TestMenderShellStartShellNamespacesFallback(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 2
+	testSessions.settings.MaxSessions = 16
+	//an init command which can't start makes the shell start without the
+	//namespaces
+	testSessions.settings.Namespaces = &shell.Namespaces{Flags: syscall.CLONE_NEWNS, Init: []string{"/nonexistent/mender-shell"}}
+	defer func() {
+		testSessions.settings.Namespaces = nil
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	assert.NoError(t, err)
+	ws, err := connection.NewConnection(*u, "token", 16*time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, ws, "user-id-namespaces", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer testSessions.MenderShellDeleteById(s.GetId())
+
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ActiveSession, s.GetStatus())
+	assert.True(t, procps.ProcessExists(s.GetShellPid()))
+
+	err = s.ShellCommand(&shell.MenderShellMessage{Data: []byte("exit\n")})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return s.ShellExited() != nil
+	}, 4*time.Second, 100*time.Millisecond)
+	s.CloseExitedShell()
+}
+
+//returns true if a process with the given command line is running
+func commandRunning(args ...string) bool {
+	cmdline := []byte(strings.Join(args, "\x00") + "\x00")
+	files, _ := ioutil.ReadDir("/proc")
+	for _, f := range files {
+		if _, err := strconv.Atoi(f.Name()); err != nil {
+			continue
+		}
+		data, err := ioutil.ReadFile("/proc/" + f.Name() + "/cmdline")
+		if err == nil && bytes.Equal(data, cmdline) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMenderShellSessionInterrupt(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 8
+	testSessions.settings.MaxSessions = 16
+	defer func() { testSessions.settings.InterceptInterrupt = false }()
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	assert.NoError(t, err)
+	//StopShell waits twice the write timeout
+	ws, err := connection.NewConnection(*u, "token", time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		intercept   bool
+		setup       string
+		duration    string
+		interrupted bool
+	}{
+		"written to the terminal": {
+			duration:    "31337",
+			interrupted: true,
+		},
+		"intercepted": {
+			intercept:   true,
+			duration:    "31338",
+			interrupted: true,
+		},
+		"signals disabled": {
+			setup:    "stty -isig; ",
+			duration: "31339",
+		},
+		"signals disabled, intercepted": {
+			intercept:   true,
+			setup:       "stty -isig; ",
+			duration:    "31340",
+			interrupted: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			testSessions.settings.InterceptInterrupt = tc.intercept
+			s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, ws, "user-id-interrupt", NoExpirationTimeout, NoExpirationTimeout)
+			assert.NoError(t, err)
+			defer testSessions.MenderShellDeleteById(s.GetId())
+			err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+				Uid:            uint32(uid),
+				Gid:            uint32(gid),
+				Shell:          "/bin/sh",
+				TerminalString: "xterm-256color",
+				Height:         40,
+				Width:          80,
+			})
+			assert.NoError(t, err)
+			defer s.StopShell()
+
+			err = s.ShellCommand(&shell.MenderShellMessage{Data: []byte(tc.setup + "sleep " + tc.duration + "\n")})
+			assert.NoError(t, err)
+			assert.Eventually(t, func() bool {
+				return commandRunning("sleep", tc.duration)
+			}, 4*time.Second, 100*time.Millisecond)
+
+			err = s.ShellCommand(&shell.MenderShellMessage{Data: []byte{shell.InterruptCharacter}})
+			assert.NoError(t, err)
+			if tc.interrupted {
+				assert.Eventually(t, func() bool {
+					return !commandRunning("sleep", tc.duration)
+				}, 4*time.Second, 100*time.Millisecond)
+			} else {
+				time.Sleep(time.Second)
+				assert.True(t, commandRunning("sleep", tc.duration))
+				exec.Command("pkill", "-f", "sleep "+tc.duration).Run()
+			}
+		})
+	}
+}
+
+//counts the terminals open in the process; the other files, e.g.: the
+//connections of the previous tests, may be closed meanwhile
+func openTerminalCount() int {
+	files, _ := ioutil.ReadDir("/proc/self/fd")
+	count := 0
+	for _, f := range files {
+		target, err := os.Readlink(path.Join("/proc/self/fd", f.Name()))
+		if err == nil && (target == "/dev/ptmx" || strings.HasPrefix(target, "/dev/pts/")) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestMenderShellSessionShellExitedStopped(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 8
+	testSessions.settings.MaxSessions = 16
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	assert.NoError(t, err)
+	//StopShell waits twice the write timeout
+	ws, err := connection.NewConnection(*u, "token", time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, ws, "user-id-shell-exited", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer testSessions.MenderShellDeleteById(s.GetId())
+	err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+		Uid:            uint32(uid),
+		Gid:            uint32(gid),
+		Shell:          "/bin/sh",
+		TerminalString: "xterm-256color",
+		Height:         40,
+		Width:          80,
+	})
+	assert.NoError(t, err)
+
+	pid := s.GetShellPid()
+
+	//the shell stopped did not exit on its own
+	done := make(chan error, 1)
+	go func() {
+		done <- s.StopShell()
+	}()
+	assert.Eventually(t, func() bool {
+		return !procps.ProcessExists(pid)
+	}, 8*time.Second, 50*time.Millisecond)
+	assert.Nil(t, s.ShellExited())
+	assert.NoError(t, <-done)
+	assert.Nil(t, s.ShellExited())
+}
+
+func TestMenderShellSessionShellExited(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 8
+	testSessions.settings.MaxSessions = 16
+
+	server := httptest.NewServer(http.HandlerFunc(noopMainServerLoop))
+	defer server.Close()
+	u, err := url.Parse("ws" + strings.TrimPrefix(server.URL, "http"))
+	assert.NoError(t, err)
+	//StopShell waits twice the write timeout
+	ws, err := connection.NewConnection(*u, "token", time.Second, 256, 16*time.Second, true, "")
+	assert.NoError(t, err)
+
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	testCases := map[string]struct {
+		command string
+		exit    *ShellExit
+		respawn bool
+	}{
+		"exit": {
+			command: "exit 7\n",
+			exit:    &ShellExit{ExitCode: 7},
+		},
+		"crash": {
+			command: "kill -SEGV $$\n",
+			exit:    &ShellExit{ExitCode: -1, Signal: "segmentation fault"},
+		},
+		"crash, respawned": {
+			command: "kill -KILL $$\n",
+			exit:    &ShellExit{ExitCode: -1, Signal: "killed"},
+			respawn: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			terminals := openTerminalCount()
+			s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, ws, "user-id-shell-exited", NoExpirationTimeout, NoExpirationTimeout)
+			assert.NoError(t, err)
+			defer testSessions.MenderShellDeleteById(s.GetId())
+			err = s.StartShell(s.GetId(), MenderShellTerminalSettings{
+				Uid:            uint32(uid),
+				Gid:            uint32(gid),
+				Shell:          "/bin/sh",
+				TerminalString: "xterm-256color",
+				Height:         40,
+				Width:          80,
+			})
+			assert.NoError(t, err)
+			pid := s.GetShellPid()
+			assert.Nil(t, s.ShellExited())
+
+			err = s.ShellCommand(&shell.MenderShellMessage{Data: []byte(tc.command)})
+			assert.NoError(t, err)
+			assert.Eventually(t, func() bool {
+				return s.ShellExited() != nil
+			}, 4*time.Second, 100*time.Millisecond)
+			assert.Equal(t, tc.exit, s.ShellExited())
+			assert.Equal(t, tc.exit.Signal != "", s.ShellExited().Crashed())
+
+			if tc.respawn {
+				err = s.RespawnShell([]byte("respawned\r\n"))
+				assert.NoError(t, err)
+				assert.Equal(t, ActiveSession, s.GetStatus())
+				assert.NotEqual(t, pid, s.GetShellPid())
+				assert.Equal(t, 1, s.GetRespawnCount())
+				assert.Nil(t, s.ShellExited())
+				assert.Eventually(t, func() bool {
+					return bytes.HasPrefix(s.Scrollback(), []byte("respawned\r\n"))
+				}, 4*time.Second, 100*time.Millisecond)
+
+				assert.False(t, procps.ProcessExists(pid))
+				pid = s.GetShellPid()
+				err = s.ShellCommand(&shell.MenderShellMessage{Data: []byte("exit\n")})
+				assert.NoError(t, err)
+				assert.Eventually(t, func() bool {
+					return s.ShellExited() != nil
+				}, 4*time.Second, 100*time.Millisecond)
+				assert.Equal(t, &ShellExit{}, s.ShellExited())
+			}
+			s.CloseExitedShell()
+			assert.Equal(t, EmptySession, s.GetStatus())
+			assert.Nil(t, s.ShellExited())
+			assert.False(t, procps.ProcessExists(pid))
+			//the terminals are closed
+			assert.Equal(t, terminals, openTerminalCount())
+		})
+	}
+}
+
+type inputChunks struct {
+	chunks [][]byte
+}
+
+func (i *inputChunks) Write(p []byte) (int, error) {
+	i.chunks = append(i.chunks, append([]byte{}, p...))
+	return len(p), nil
+}
+
+func TestRateLimitedInput(t *testing.T) {
+	testCases := map[string]struct {
+		writes      int
+		size        int
+		minDuration time.Duration
+		maxDuration time.Duration
+	}{
+		"typing": {
+			writes:      64,
+			size:        1,
+			maxDuration: 100 * time.Millisecond,
+		},
+		"paste": {
+			writes:      1,
+			size:        2000,
+			minDuration: 800 * time.Millisecond,
+			maxDuration: 2 * time.Second,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			terminal := &inputChunks{}
+			input := &rateLimitedInput{w: terminal, limiter: shell.NewRateLimiter(1000)}
+			start := time.Now()
+			for i := 0; i < tc.writes; i++ {
+				n, err := input.Write(bytes.Repeat([]byte("x"), tc.size))
+				assert.NoError(t, err)
+				assert.Equal(t, tc.size, n)
+			}
+			elapsed := time.Since(start)
+			assert.True(t, elapsed >= tc.minDuration, elapsed.String())
+			assert.True(t, elapsed < tc.maxDuration, elapsed.String())
+
+			written := 0
+			for _, chunk := range terminal.chunks {
+				assert.True(t, len(chunk) <= inputChunkSize)
+				written += len(chunk)
+			}
+			assert.Equal(t, tc.writes*tc.size, written)
+		})
+	}
+
+	//the write gives up between the chunks once the input is stopped
+	stop := make(chan struct{})
+	close(stop)
+	input := &rateLimitedInput{w: &inputChunks{}, limiter: shell.NewRateLimiter(1000), stop: stop}
+	n, err := input.Write(bytes.Repeat([]byte("x"), 2000))
+	assert.Equal(t, 0, n)
+	assert.True(t, errors.Is(err, ErrSessionShellNotRunning))
+}
+
+func TestMenderShellCommandInputQueueFull(t *testing.T) {
+	//nobody reads the terminal, the first message blocks the input queue
+	r, w := io.Pipe()
+	s := &MenderShellSession{
+		id:       "session-input-queue-full",
+		writer:   w,
+		settings: &Settings{InputQueueLength: 2},
+	}
+	s.input = newInputQueue(2)
+	target := s.inputTarget()
+	s.input.start(func(data []byte) error {
+		return s.writeInput(data, target)
+	})
+
+	//one message is being written, two wait, the next ones are rejected
+	err := s.ShellCommand(&shell.MenderShellMessage{Data: []byte("echo;\n")})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return len(s.input.messages) == 0
+	}, time.Second, 10*time.Millisecond)
+	for i := 0; i < 2; i++ {
+		err = s.ShellCommand(&shell.MenderShellMessage{Data: []byte("echo;\n")})
+		assert.NoError(t, err)
+	}
+	err = s.ShellCommand(&shell.MenderShellMessage{Data: []byte("echo;\n")})
+	assert.True(t, errors.Is(err, ErrSessionInputQueueFull))
+	assert.EqualError(t, err, "input queue full: 2 messages are waiting")
+
+	//the messages still waiting are dropped once the input is stopped
+	assert.Equal(t, 2, s.input.close(100*time.Millisecond))
+	r.Close()
+	err = s.ShellCommand(&shell.MenderShellMessage{Data: []byte("echo;\n")})
+	assert.True(t, errors.Is(err, ErrSessionShellNotRunning))
+}
+
+func TestSanitizedOutput(t *testing.T) {
+	terminal := strings.NewReader("\x1b]0;title\x07\x1b[1mbold\x1b]52;c;eA==\x07\x1b[21t$ ")
+	output := &sanitizedOutput{
+		r:         iotest.OneByteReader(terminal),
+		sanitizer: shell.NewOutputSanitizer(),
+	}
+	var sanitized []byte
+	//the sequence held back is read in chunks once passed
+	p := make([]byte, 3)
+	for {
+		n, err := output.Read(p)
+		sanitized = append(sanitized, p[:n]...)
+		if err != nil {
+			assert.Equal(t, 0, n)
+			break
+		}
+		assert.NotEqual(t, 0, n)
+	}
+	assert.Equal(t, "\x1b]0;title\x07\x1b[1mbold$ ", string(sanitized))
+}
+
+func TestMenderShellSessionsConcurrentAccess(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 8
+
+	//the sessions are listed, e.g.: by the D-Bus API, while the message
+	//loop adds them and the main loop removes them
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, nil, "user-id-concurrent", NoExpirationTimeout, NoExpirationTimeout)
+			if assert.NoError(t, err) {
+				testSessions.MenderShellDeleteById(s.GetId())
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			assert.Empty(t, testSessions.MenderShellSessionsGetByUserId("user-id-concurrent"))
+			return
+		default:
+		}
+		for _, id := range testSessions.MenderShellSessionGetSessionIds() {
+			if s := testSessions.MenderShellSessionGetById(id); s != nil {
+				s.GetStatus()
+				s.GetUserId()
+			}
+		}
+		testSessions.MenderShellSessionGetActiveCount()
+	}
+}
+
+func TestMenderShellCommandInputTooLarge(t *testing.T) {
+	testSessions.settings.MaxUserSessions = 8
+	testSessions.settings.MaxInputMessageSize = 16
+	defer func() { testSessions.settings.MaxInputMessageSize = 0 }()
+
+	s, err := testSessions.NewMenderShellSession(&sync.Mutex{}, nil, "user-id-input-too-large", NoExpirationTimeout, NoExpirationTimeout)
+	assert.NoError(t, err)
+	defer testSessions.MenderShellDeleteById(s.GetId())
+
+	err = s.ShellCommand(&shell.MenderShellMessage{Data: bytes.Repeat([]byte("x"), 17)})
+	assert.True(t, errors.Is(err, ErrSessionInputTooLarge))
+	assert.EqualError(t, err, "input message too large: 17 bytes, the limit is 16")
+
+	//the session keeps the limit it was created with
+	testSessions.Configure(func(settings *Settings) { settings.MaxInputMessageSize = 0 })
+	err = s.ShellCommand(&shell.MenderShellMessage{Data: bytes.Repeat([]byte("x"), 17)})
+	assert.True(t, errors.Is(err, ErrSessionInputTooLarge))
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"sync"
+	"time"
+)
+
+// outputBuffer coalesces the shell output into fewer messages: the output
+// is sent once the buffer holds size bytes, or at the latest interval after
+// the first byte not sent yet was written
+type outputBuffer struct {
+	mutex    sync.Mutex
+	data     []byte
+	size     int
+	interval time.Duration
+	timer    *time.Timer
+	send     func(data []byte)
+}
+
+func newOutputBuffer(size int, interval time.Duration, send func(data []byte)) *outputBuffer {
+	return &outputBuffer{
+		data:     make([]byte, 0, size),
+		size:     size,
+		interval: interval,
+		send:     send,
+	}
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.data = append(b.data, p...)
+	if len(b.data) >= b.size {
+		b.flush()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(b.interval, b.Flush)
+	}
+	return len(p), nil
+}
+
+// Flush sends the output buffered so far, if any
+func (b *outputBuffer) Flush() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.flush()
+}
+
+func (b *outputBuffer) flush() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.data) == 0 {
+		return
+	}
+	b.send(b.data)
+	b.data = make([]byte, 0, b.size)
+}
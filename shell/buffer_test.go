@@ -0,0 +1,113 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type sentOutput struct {
+	mutex    sync.Mutex
+	messages [][]byte
+}
+
+func (o *sentOutput) send(data []byte) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.messages = append(o.messages, append([]byte{}, data...))
+}
+
+func (o *sentOutput) get() [][]byte {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.messages
+}
+
+func TestOutputBuffer(t *testing.T) {
+	testCases := map[string]struct {
+		size     int
+		interval time.Duration
+		writes   []string
+		wait     time.Duration
+		flush    bool
+		messages []string
+	}{
+		"held back": {
+			size:     16,
+			interval: time.Hour,
+			writes:   []string{"a", "b", "c"},
+		},
+		"size reached": {
+			size:     4,
+			interval: time.Hour,
+			writes:   []string{"ab", "cd", "ef"},
+			messages: []string{"abcd"},
+		},
+		"interval elapsed": {
+			size:     16,
+			interval: 10 * time.Millisecond,
+			writes:   []string{"a", "b", "c"},
+			wait:     100 * time.Millisecond,
+			messages: []string{"abc"},
+		},
+		"flushed": {
+			size:     4,
+			interval: time.Hour,
+			writes:   []string{"ab", "cd", "ef"},
+			flush:    true,
+			messages: []string{"abcd", "ef"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			output := &sentOutput{}
+			buffer := newOutputBuffer(tc.size, tc.interval, output.send)
+			for _, w := range tc.writes {
+				n, err := buffer.Write([]byte(w))
+				assert.NoError(t, err)
+				assert.Equal(t, len(w), n)
+			}
+			time.Sleep(tc.wait)
+			if tc.flush {
+				buffer.Flush()
+			}
+			var messages []string
+			for _, m := range output.get() {
+				messages = append(messages, string(m))
+			}
+			assert.Equal(t, tc.messages, messages)
+		})
+	}
+}
+
+func TestOutputBufferLatency(t *testing.T) {
+	output := &sentOutput{}
+	buffer := newOutputBuffer(4096, 20*time.Millisecond, output.send)
+	start := time.Now()
+	buffer.Write([]byte("x"))
+	for len(output.get()) == 0 {
+		if time.Since(start) > time.Second {
+			t.Fatal("the output was not sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Less(t, int64(time.Since(start)), int64(200*time.Millisecond))
+	assert.True(t, bytes.Equal([]byte("x"), output.get()[0]))
+}
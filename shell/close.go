@@ -0,0 +1,53 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+// CloseCode tells the server why a session, or the whole connection, was
+// closed, so that the UI can tell e.g.: a user exiting the shell from a
+// session timing out. The codes are in the range the websocket protocol
+// leaves to the applications, 4000-4999: a session is closed with the code
+// in the PropertyCloseCode property of the MessageTypeStopShell message, or
+// of the MessageTypeSpawnShell error response if the shell did not start,
+// and the connection is closed with the code in the close frame
+type CloseCode int
+
+const (
+	// CloseNormalExit is sent when the shell exited on its own, e.g.: the
+	// user typed exit
+	CloseNormalExit CloseCode = 4000
+	// CloseIdleTimeout is sent when the session was idle for longer than
+	// the idle timeout
+	CloseIdleTimeout CloseCode = 4001
+	// CloseMaxDuration is sent when the session reached the max duration
+	CloseMaxDuration CloseCode = 4002
+	// ClosePolicyDenied is sent when the device denied the session, e.g.:
+	// the user is not authorized or too many sessions are open, or the
+	// session was killed on the device
+	ClosePolicyDenied CloseCode = 4003
+	// CloseShutdown is sent when mender-shell is shutting down
+	CloseShutdown CloseCode = 4004
+	// CloseInternalError is sent on an error on the device, e.g.: the shell
+	// crashed or failed to start, or the session is gone from the device
+	CloseInternalError CloseCode = 4005
+	// CloseHandover closes the connection when mender-shell hands its
+	// sessions over to a new process, e.g.: after an update; the sessions
+	// are resumed once the new process connects
+	CloseHandover CloseCode = 4006
+	// CloseRevoked is sent when the session was revoked, by the server or
+	// because the device lost its authorization
+	CloseRevoked CloseCode = 4007
+	// CloseInitialInputTimeout is sent when the session got no input within
+	// the initial input timeout after its shell started
+	CloseInitialInputTimeout CloseCode = 4008
+)
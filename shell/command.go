@@ -0,0 +1,105 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+const (
+	//runs the command line in the message data without a terminal, the
+	//output is sent back with the same type, the PropertyStream property
+	//telling stdout from stderr
+	MessageTypeExecCommand = "exec"
+	//sent when the command finishes, with the PropertyExitCode property
+	MessageTypeExecExit = "exec_exit"
+)
+
+const (
+	PropertyStream   = "stream"
+	PropertyExitCode = "exit_code"
+	StreamStdout     = "stdout"
+	StreamStderr     = "stderr"
+)
+
+var (
+	ErrCommandEmpty      = errors.New("empty command")
+	ErrCommandNotAllowed = errors.New("command not allowed")
+)
+
+// ParseCommandLine splits the command line into the arguments separated by
+// white space; there is no shell, so no quoting, expansion nor redirection
+func ParseCommandLine(commandLine string) []string {
+	return strings.Fields(commandLine)
+}
+
+// CommandAllowed tells if the command is allowed by one of the allowlist
+// command lines: the command has to start with all of its arguments, so
+// "journalctl" allows any journalctl arguments, while "journalctl -n 100"
+// allows only this one command
+func CommandAllowed(args []string, allowlist []string) bool {
+	if len(args) < 1 {
+		return false
+	}
+	for _, allowed := range allowlist {
+		allowedArgs := ParseCommandLine(allowed)
+		if len(allowedArgs) < 1 || len(allowedArgs) > len(args) {
+			continue
+		}
+		match := true
+		for i := range allowedArgs {
+			if allowedArgs[i] != args[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// ExecuteCommand runs the command as the given user without a terminal,
+// copying its stdout and stderr to the writers, and returns its exit code;
+// err is set only if the command could not run
+func ExecuteCommand(shellUser *ShellUser,
+	args []string,
+	env []string,
+	stdout io.Writer,
+	stderr io.Writer) (exitCode int, err error) {
+	if len(args) < 1 {
+		return -1, ErrCommandEmpty
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	err = setCredential(cmd, shellUser)
+	if err != nil {
+		return -1, err
+	}
+	//a nil Env would make the command inherit the daemon environment
+	cmd.Env = append([]string{}, env...)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), nil
+	} else if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
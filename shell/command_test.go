@@ -0,0 +1,127 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"bytes"
+	"os/user"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCommandAllowed(t *testing.T) {
+	testCases := map[string]struct {
+		commandLine string
+		allowlist   []string
+		allowed     bool
+	}{
+		"any arguments": {
+			commandLine: "journalctl -n 100",
+			allowlist:   []string{"journalctl"},
+			allowed:     true,
+		},
+		"exact command": {
+			commandLine: "journalctl  -n 100",
+			allowlist:   []string{"journalctl -n 100"},
+			allowed:     true,
+		},
+		"other arguments": {
+			commandLine: "journalctl -n 1000",
+			allowlist:   []string{"journalctl -n 100"},
+			allowed:     false,
+		},
+		"other command": {
+			commandLine: "/bin/rm -rf /",
+			allowlist:   []string{"journalctl", "uptime"},
+			allowed:     false,
+		},
+		"prefix of the command name": {
+			commandLine: "journalctl-evil",
+			allowlist:   []string{"journalctl"},
+			allowed:     false,
+		},
+		"empty command": {
+			commandLine: " ",
+			allowlist:   []string{"journalctl", ""},
+			allowed:     false,
+		},
+		"empty allowlist": {
+			commandLine: "uptime",
+			allowed:     false,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			args := ParseCommandLine(tc.commandLine)
+			assert.Equal(t, tc.allowed, CommandAllowed(args, tc.allowlist))
+		})
+	}
+}
+
+func TestExecuteCommand(t *testing.T) {
+	currentUser, err := user.Current()
+	assert.NoError(t, err)
+	uid, _ := strconv.ParseUint(currentUser.Uid, 10, 32)
+	gid, _ := strconv.ParseUint(currentUser.Gid, 10, 32)
+	shellUser := &ShellUser{Uid: uint32(uid), Gid: uint32(gid)}
+
+	testCases := map[string]struct {
+		args     []string
+		env      []string
+		stdout   string
+		stderr   string
+		exitCode int
+		err      bool
+	}{
+		"output and exit code": {
+			args:     []string{"/bin/sh", "-c", "echo out; echo err >&2; exit 3"},
+			stdout:   "out\n",
+			stderr:   "err\n",
+			exitCode: 3,
+		},
+		"environment": {
+			args:   []string{"/bin/sh", "-c", "echo $MARKER"},
+			env:    []string{"MARKER=mender"},
+			stdout: "mender\n",
+		},
+		"not found": {
+			args:     []string{"/does/not/exist"},
+			exitCode: -1,
+			err:      true,
+		},
+		"empty": {
+			exitCode: -1,
+			err:      true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			stdout := &bytes.Buffer{}
+			stderr := &bytes.Buffer{}
+			exitCode, err := ExecuteCommand(shellUser, tc.args, tc.env, stdout, stderr)
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.exitCode, exitCode)
+			assert.Equal(t, tc.stdout, stdout.String())
+			assert.Equal(t, tc.stderr, stderr.String())
+		})
+	}
+}
@@ -15,18 +15,85 @@ package shell
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"io"
 	"sync"
 	"time"
 
 	"github.com/mendersoftware/mender-shell/connection"
-	log "github.com/sirupsen/logrus"
+	"github.com/mendersoftware/mender-shell/logging"
+	"github.com/mendersoftware/mender-shell/metrics"
 
 	"github.com/mendersoftware/go-lib-micro/ws"
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 )
 
+const (
+	//resizes the terminal of the session, carrying the new size in the
+	//PropertyTerminalHeight and PropertyTerminalWidth properties
+	MessageTypeResizeShell = "resize"
+	//sent by the server after a reconnect, the PropertySessionIds property
+	//lists the sessions it still considers open
+	MessageTypeResumeSessions = "resume_sessions"
+	//tells the server a session was resumed, the data carries the
+	//scrollback of the session to redraw its terminal with, replayed
+	//output marked with the PropertyReplay property
+	MessageTypeSessionResumed = "session_resumed"
+	//advertises the protocol version and the features supported, in the
+	//PropertyProtocolVersion and PropertyFeatures properties; sent by the
+	//device on connecting, and by the server in response
+	MessageTypeCapabilities = "capabilities"
+	//sent when the shell of a session exits on its own, with the
+	//PropertyExitCode property, and the PropertySignal one if the shell
+	//crashed; the status is an error if it crashed
+	MessageTypeShellExit = "shell_exit"
+	//sent by the server when the access of an operator is revoked: the
+	//sessions listed in the PropertySessionIds property, or else those of
+	//the user id in the data, or else all the sessions are terminated
+	MessageTypeRevoke = "revoke"
+)
+
+const (
+	//bytes read from the terminal at once and sent in a single message,
+	//unless set with SetReadBufferSize, and their bounds
+	DefaultReadBufferSize = 255
+	MinReadBufferSize     = 64
+	MaxReadBufferSize     = 64 * 1024
+	//the terminal is read in chunks of at least the size of the bufio
+	//default buffer, the smaller reads are served from it
+	terminalBufferSize = 4096
+)
+
+const (
+	//properties carrying the terminal size with the MessageTypeSpawnShell
+	//and MessageTypeResizeShell messages
+	PropertyTerminalHeight = "terminal_height"
+	PropertyTerminalWidth  = "terminal_width"
+	//properties of the MessageTypeSpawnShell message setting the TERM of
+	//the operator terminal, and its locale as a list of NAME=value, e.g.:
+	//["LANG=en_US.UTF-8", "LC_TIME=C"]
+	PropertyTerm   = "term"
+	PropertyLocale = "locale"
+	//property listing the session ids with the MessageTypeResumeSessions
+	//message
+	PropertySessionIds = "session_ids"
+	//properties of the MessageTypeCapabilities message
+	PropertyProtocolVersion = "protocol_version"
+	PropertyFeatures        = "features"
+	//the signal which killed the shell, with the MessageTypeShellExit
+	//message
+	PropertySignal = "signal"
+	//set to true in the messages carrying output already sent before,
+	//replayed to redraw the terminal, e.g.: MessageTypeSessionResumed;
+	//the live output never has it
+	PropertyReplay = "replay"
+	//the CloseCode telling why a session was closed, with the
+	//MessageTypeStopShell message and the MessageTypeSpawnShell error
+	//response
+	PropertyCloseCode = "close_code"
+)
+
 var (
 	ErrExecWriteBytesShort = errors.New("failed to write the whole message")
 )
@@ -46,6 +113,8 @@ type MenderShellMessage struct {
 	// * .Type===MessageTypeSpawnShell interpreted as user_id and passed
 	//   to the session.NewMenderShellSession.
 	Data []byte `json:"data" msgpack:"data"`
+	//the message header properties, e.g.: the terminal size
+	Properties map[string]interface{} `json:"properties" msgpack:"properties"`
 }
 
 type MenderShell struct {
@@ -55,6 +124,27 @@ type MenderShell struct {
 	r          io.Reader
 	w          io.Writer
 	running    bool
+	//limits the output bytes per second, nil if unlimited
+	limiter *RateLimiter
+	//bytes read from the terminal at once, DefaultReadBufferSize if 0
+	readBufferSize int
+	//the output is coalesced into messages of up to outputBufferSize
+	//bytes, sent at the latest outputFlushInterval after it was read;
+	//every read is sent on its own if outputBufferSize is not above 1
+	outputBufferSize    int
+	outputFlushInterval time.Duration
+	//up to outputQueueLength messages wait to be sent while the terminal
+	//is read further, the terminal is not read once the queue is full;
+	//every message is sent before reading further if it is 0
+	outputQueueLength int
+	collector         metrics.Collector
+	//a multibyte UTF-8 character is never split across two messages, its
+	//start is held back until the next read completes it
+	utf8Safe bool
+	//carries the session id, attached to the log lines
+	ctx context.Context
+	//closed once all the output is sent
+	outputDone chan struct{}
 }
 
 type MenderShellCommand struct {
@@ -73,15 +163,65 @@ func NewMenderShell(sessionId string, writeMutex *sync.Mutex, webSock *connectio
 		r:          r,
 		w:          w,
 		running:    false,
+		ctx:        logging.WithSessionID(context.Background(), sessionId),
 	}
 	return &shell
 }
 
+//SetContext sets the context the shell logs with, e.g.: the session one;
+//it has to be called before Start
+func (s *MenderShell) SetContext(ctx context.Context) {
+	s.ctx = ctx
+}
+
+//SetOutputRateLimit limits the shell output sent over the websocket to the
+//given bytes per second, 0 means unlimited; it has to be called before Start
+func (s *MenderShell) SetOutputRateLimit(bytesPerSecond uint32) {
+	if bytesPerSecond == 0 {
+		s.limiter = nil
+		return
+	}
+	s.limiter = NewRateLimiter(bytesPerSecond)
+}
+
+//SetReadBufferSize sets the bytes read from the terminal at once, 0 reads
+//DefaultReadBufferSize; the larger reads take fewer system calls for a lot
+//of output, e.g.: tailing logs, and the smaller ones pass the output on
+//sooner; it has to be called before Start
+func (s *MenderShell) SetReadBufferSize(size int) {
+	s.readBufferSize = size
+}
+
+//SetOutputBuffering coalesces the shell output into messages of up to size
+//bytes, sent at the latest flushInterval after the output was read; a size
+//not above 1 sends every read on its own; it has to be called before Start
+func (s *MenderShell) SetOutputBuffering(size int, flushInterval time.Duration) {
+	s.outputBufferSize = size
+	s.outputFlushInterval = flushInterval
+}
+
+//SetOutputQueue bounds the shell output waiting to be sent to length
+//messages, the terminal is not read while the queue is full; the queue depth
+//is reported to collector. A length of 0 sends every message before reading
+//the terminal further; it has to be called before Start
+func (s *MenderShell) SetOutputQueue(length int, collector metrics.Collector) {
+	s.outputQueueLength = length
+	s.collector = collector
+}
+
+//SetUTF8Safe makes the shell output never split a multibyte UTF-8 character
+//across two messages; disabled, the output is sent as read from the
+//terminal; it has to be called before Start
+func (s *MenderShell) SetUTF8Safe(enabled bool) {
+	s.utf8Safe = enabled
+}
+
 func (s *MenderShell) GetWriteTimeout() time.Duration {
 	return s.ws.GetWriteTimeout()
 }
 
 func (s *MenderShell) Start() {
+	s.outputDone = make(chan struct{})
 	go s.pipeStdout()
 	s.running = true
 }
@@ -94,39 +234,105 @@ func (s *MenderShell) IsRunning() bool {
 	return s.running
 }
 
+//WaitOutput waits up to timeout for the whole output of the shell to be
+//sent, i.e.: until the terminal is closed; it returns false on timeout
+func (s *MenderShell) WaitOutput(timeout time.Duration) bool {
+	select {
+	case <-s.outputDone:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
 func (s *MenderShell) UpdateWSConnection(webSock *connection.Connection) error {
 	s.ws = webSock
 	return nil
 }
 
+func (s *MenderShell) sendOutput(data []byte) {
+	msg := &ws.ProtoMsg{
+		Header: ws.ProtoHdr{
+			Proto:     ws.ProtoTypeShell,
+			MsgType:   wsshell.MessageTypeShellCommand,
+			SessionID: s.sessionId,
+			Properties: map[string]interface{}{
+				"status": wsshell.NormalMessage,
+			},
+		},
+		Body: data,
+	}
+	//not connected yet, e.g.: the session was handed over by the previous
+	//process; the output is kept in the scrollback, replayed on resume
+	if s.ws == nil {
+		return
+	}
+	s.ws.WriteMessageContext(s.ctx, msg)
+}
+
 func (s *MenderShell) pipeStdout() {
-	sr := bufio.NewReader(s.r)
+	defer close(s.outputDone)
+	send := s.sendOutput
+	if s.outputQueueLength > 0 {
+		queue := newOutputQueue(s.outputQueueLength, s.sendOutput, s.collector)
+		//deferred first, the queue is drained after the output held back
+		//below is pushed
+		defer queue.Close()
+		send = queue.Push
+	}
+	if s.outputBufferSize > 1 {
+		buffer := newOutputBuffer(s.outputBufferSize, s.outputFlushInterval, send)
+		//the output still buffered is sent as soon as the terminal is closed
+		defer buffer.Flush()
+		send = func(data []byte) {
+			buffer.Write(data)
+		}
+	}
+	//the start of a multibyte character not read whole yet
+	var partial []byte
+	defer func() {
+		if len(partial) > 0 {
+			send(partial)
+		}
+	}()
+	readSize := s.readBufferSize
+	if readSize <= 0 {
+		readSize = DefaultReadBufferSize
+	}
+	bufferSize := readSize
+	if bufferSize < terminalBufferSize {
+		bufferSize = terminalBufferSize
+	}
+	sr := bufio.NewReaderSize(s.r, bufferSize)
 	for {
 		if !s.IsRunning() {
 			return
 		}
-		raw := make([]byte, 255)
+		raw := make([]byte, readSize)
 		n, err := sr.Read(raw)
 		if err != nil {
 			if !s.IsRunning() {
 				return
 			}
 
-			log.Errorf("error reading stdout: '%s'; restart is needed.", err)
+			logging.FromContext(s.ctx).Errorf("error reading stdout: '%s'; restart is needed.", err)
 			break
 		}
 
-		msg := &ws.ProtoMsg{
-			Header: ws.ProtoHdr{
-				Proto:     ws.ProtoTypeShell,
-				MsgType:   wsshell.MessageTypeShellCommand,
-				SessionID: s.sessionId,
-				Properties: map[string]interface{}{
-					"status": wsshell.NormalMessage,
-				},
-			},
-			Body: raw[:n],
+		data := raw[:n]
+		if s.utf8Safe {
+			data = append(partial, data...)
+			held := incompleteRuneLen(data)
+			partial = append([]byte(nil), data[len(data)-held:]...)
+			data = data[:len(data)-held]
+			if len(data) == 0 {
+				continue
+			}
+		}
+
+		if s.limiter != nil {
+			s.limiter.Wait(len(data))
 		}
-		err = s.ws.WriteMessage(msg)
+		send(data)
 	}
 }
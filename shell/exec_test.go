@@ -19,6 +19,7 @@ import (
 	wsshell "github.com/mendersoftware/go-lib-micro/ws/shell"
 	"github.com/mendersoftware/mender-shell/connection"
 	"github.com/vmihailenco/msgpack"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -29,6 +30,7 @@ import (
 	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/creack/pty"
@@ -205,3 +207,284 @@ func TestPipeStdout(t *testing.T) {
 	reader.Close()
 	writer.Close()
 }
+
+func TestPipeStdoutBuffering(t *testing.T) {
+	testCases := map[string]struct {
+		bufferSize int
+		frames     func(t *testing.T, frames int)
+	}{
+		"unbuffered": {
+			frames: func(t *testing.T, frames int) {
+				assert.Equal(t, 100, frames)
+			},
+		},
+		"buffered": {
+			bufferSize: 4096,
+			frames: func(t *testing.T, frames int) {
+				assert.Less(t, frames, 10)
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var output []byte
+			frames := 0
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upgrader := websocket.Upgrader{}
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				for {
+					_, data, err := c.ReadMessage()
+					if err != nil {
+						return
+					}
+					m := &ws.ProtoMsg{}
+					if msgpack.Unmarshal(data, m) != nil {
+						continue
+					}
+					mutex.Lock()
+					frames++
+					output = append(output, m.Body...)
+					mutex.Unlock()
+				}
+			}))
+			defer s.Close()
+
+			u, err := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+			assert.NoError(t, err)
+			webSock, err := connection.NewConnection(*u, "token", time.Second, 526, time.Second, true, "")
+			assert.NoError(t, err)
+			defer webSock.Close()
+
+			r, w := io.Pipe()
+			shell := NewMenderShell("unit-tests-sessions-id", &sync.Mutex{}, webSock, r, w)
+			shell.SetOutputBuffering(tc.bufferSize, time.Second)
+			shell.Start()
+			for i := 0; i < 100; i++ {
+				w.Write([]byte("x"))
+			}
+			w.Close()
+			//the output held back is sent as soon as the terminal is closed
+			assert.True(t, shell.WaitOutput(500*time.Millisecond))
+
+			assert.Eventually(t, func() bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return len(output) == 100
+			}, time.Second, 10*time.Millisecond)
+			mutex.Lock()
+			defer mutex.Unlock()
+			tc.frames(t, frames)
+		})
+	}
+}
+
+func TestPipeStdoutUTF8Safe(t *testing.T) {
+	//a 4 byte emoji split across the reads from the terminal
+	emoji := []string{"a\xf0", "\x9f", "\x98", "\x80b\xf0\x9f", "\x98\x80"}
+	testCases := map[string]struct {
+		writes   []string
+		utf8Safe bool
+		frames   []string
+	}{
+		"utf8 safe": {
+			writes:   emoji,
+			utf8Safe: true,
+			frames:   []string{"a", "\xf0\x9f\x98\x80b", "\xf0\x9f\x98\x80"},
+		},
+		"raw": {
+			writes: emoji,
+			frames: emoji,
+		},
+		"utf8 safe, truncated": {
+			writes:   []string{"a\xf0\x9f"},
+			utf8Safe: true,
+			frames:   []string{"a", "\xf0\x9f"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var frames [][]byte
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upgrader := websocket.Upgrader{}
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				for {
+					_, data, err := c.ReadMessage()
+					if err != nil {
+						return
+					}
+					m := &ws.ProtoMsg{}
+					if msgpack.Unmarshal(data, m) != nil {
+						continue
+					}
+					mutex.Lock()
+					frames = append(frames, m.Body)
+					mutex.Unlock()
+				}
+			}))
+			defer s.Close()
+
+			u, err := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+			assert.NoError(t, err)
+			webSock, err := connection.NewConnection(*u, "token", time.Second, 526, time.Second, true, "")
+			assert.NoError(t, err)
+			defer webSock.Close()
+
+			r, w := io.Pipe()
+			shell := NewMenderShell("unit-tests-sessions-id", &sync.Mutex{}, webSock, r, w)
+			shell.SetUTF8Safe(tc.utf8Safe)
+			shell.Start()
+			for _, data := range tc.writes {
+				w.Write([]byte(data))
+			}
+			w.Close()
+			assert.True(t, shell.WaitOutput(500*time.Millisecond))
+
+			//the output is sent whole, the bytes held back included
+			expected := strings.Join(tc.writes, "")
+			assert.Eventually(t, func() bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				var output []byte
+				for _, frame := range frames {
+					output = append(output, frame...)
+				}
+				return string(output) == expected
+			}, time.Second, 10*time.Millisecond)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			assert.Len(t, frames, len(tc.frames))
+			for i, frame := range frames {
+				assert.Equal(t, tc.frames[i], string(frame))
+				//only the last bytes, sent as the terminal is closed, can
+				//be a partial character in the utf8 safe mode
+				if tc.utf8Safe && i < len(frames)-1 {
+					assert.True(t, utf8.Valid(frame))
+				}
+			}
+		})
+	}
+}
+
+func TestPipeStdoutReadBufferSize(t *testing.T) {
+	testCases := map[string]struct {
+		readBufferSize int
+		frameSize      int
+	}{
+		"default": {
+			frameSize: DefaultReadBufferSize,
+		},
+		"small": {
+			readBufferSize: MinReadBufferSize,
+			frameSize:      MinReadBufferSize,
+		},
+		"large": {
+			readBufferSize: 8192,
+			frameSize:      8192,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var mutex sync.Mutex
+			var frames [][]byte
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upgrader := websocket.Upgrader{}
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				for {
+					_, data, err := c.ReadMessage()
+					if err != nil {
+						return
+					}
+					m := &ws.ProtoMsg{}
+					if msgpack.Unmarshal(data, m) != nil {
+						continue
+					}
+					mutex.Lock()
+					frames = append(frames, m.Body)
+					mutex.Unlock()
+				}
+			}))
+			defer s.Close()
+
+			u, err := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+			assert.NoError(t, err)
+			webSock, err := connection.NewConnection(*u, "token", time.Second, 526, time.Second, true, "")
+			assert.NoError(t, err)
+			defer webSock.Close()
+
+			r, w := io.Pipe()
+			shell := NewMenderShell("unit-tests-sessions-id", &sync.Mutex{}, webSock, r, w)
+			shell.SetReadBufferSize(tc.readBufferSize)
+			shell.Start()
+			w.Write([]byte(strings.Repeat("x", 10000)))
+			w.Close()
+			assert.True(t, shell.WaitOutput(500*time.Millisecond))
+
+			assert.Eventually(t, func() bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				size := 0
+				for _, frame := range frames {
+					size += len(frame)
+				}
+				return size == 10000
+			}, time.Second, 10*time.Millisecond)
+
+			//every read from the terminal is sent on its own
+			mutex.Lock()
+			defer mutex.Unlock()
+			maxFrameSize := 0
+			for _, frame := range frames {
+				if len(frame) > maxFrameSize {
+					maxFrameSize = len(frame)
+				}
+			}
+			assert.Equal(t, tc.frameSize, maxFrameSize)
+		})
+	}
+}
+
+//reads 1MiB of output from a pipe per iteration, passing it through the
+//shell with the output buffering, like the sessions
+func BenchmarkPipeStdoutReadBufferSize(b *testing.B) {
+	const outputSize = 1024 * 1024
+	chunk := []byte(strings.Repeat("x", 4096))
+	for _, size := range []int{DefaultReadBufferSize, 4096, MaxReadBufferSize} {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			b.SetBytes(outputSize)
+			for i := 0; i < b.N; i++ {
+				r, w, err := os.Pipe()
+				if err != nil {
+					b.Fatal(err)
+				}
+				shell := NewMenderShell("unit-tests-sessions-id", &sync.Mutex{}, nil, r, w)
+				shell.SetReadBufferSize(size)
+				shell.SetOutputBuffering(4096, 10*time.Millisecond)
+				shell.Start()
+				for written := 0; written < outputSize; written += len(chunk) {
+					w.Write(chunk)
+				}
+				w.Close()
+				shell.WaitOutput(time.Minute)
+				r.Close()
+			}
+		})
+	}
+}
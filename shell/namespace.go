@@ -0,0 +1,207 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/mendersoftware/mender-shell/cgroup"
+)
+
+const (
+	// NamespacePID runs the shell in a new PID namespace: the shell is its
+	// init process, and it can't see, with the NamespaceMount one too, nor
+	// signal the processes of the host
+	NamespacePID = "pid"
+	// NamespaceMount runs the shell in a new mount namespace: its mounts
+	// are private, and /proc shows only the processes of its own PID
+	// namespace, if any
+	NamespaceMount = "mount"
+)
+
+// ErrNamespacesUnsupported is returned when the namespaces can't be created
+// on the device, e.g.: not running as root, or on a kernel without them
+var ErrNamespacesUnsupported = errors.New("the namespaces are not supported")
+
+var namespaceFlags = map[string]uintptr{
+	NamespacePID:   syscall.CLONE_NEWPID,
+	NamespaceMount: syscall.CLONE_NEWNS,
+}
+
+// the /proc/self/ns entry of every namespace
+var namespaceFiles = map[uintptr]string{
+	syscall.CLONE_NEWPID: "pid",
+	syscall.CLONE_NEWNS:  "mnt",
+}
+
+// Namespaces, if not nil, makes ExecuteShellInNamespaces start the shell in
+// new namespaces, and in a cgroup, through the Init command line, e.g.:
+// mender-shell namespace-init, which sets them up and calls RunNamespaceInit
+type Namespaces struct {
+	// the clone flags of the namespaces, from NamespaceFlags
+	Flags uintptr
+	// the command line setting the namespaces up before running the shell
+	Init []string
+	// the cgroup v2 directory the Init command moves itself to before it
+	// runs the shell, none if empty
+	Cgroup string
+}
+
+// NamespaceFlags returns the clone flags of the named namespaces,
+// NamespacePID or NamespaceMount
+func NamespaceFlags(names []string) (uintptr, error) {
+	flags := uintptr(0)
+	for _, name := range names {
+		flag, ok := namespaceFlags[name]
+		if !ok {
+			return 0, fmt.Errorf("unsupported namespace: %s; it must be %s or %s",
+				name, NamespacePID, NamespaceMount)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// CheckNamespaces verifies the namespaces of the clone flags can be created:
+// mender-shell runs as root, and the kernel has them
+func CheckNamespaces(flags uintptr) error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("%w: creating them requires root", ErrNamespacesUnsupported)
+	}
+	for flag, file := range namespaceFiles {
+		if flags&flag == 0 {
+			continue
+		}
+		if _, err := os.Stat("/proc/self/ns/" + file); err != nil {
+			return fmt.Errorf("%w: %s", ErrNamespacesUnsupported, err.Error())
+		}
+	}
+	return nil
+}
+
+//the init command line running the shell as the user in the namespaces:
+//the namespaces are entered as root, the init command drops to the user
+func namespaceInitCommand(namespaces *Namespaces, shellUser *ShellUser, shell string,
+	args []string) *exec.Cmd {
+	groups := make([]string, 0, len(shellUser.Groups))
+	for _, group := range shellUser.Groups {
+		groups = append(groups, strconv.FormatUint(uint64(group), 10))
+	}
+	initArgs := append([]string{}, namespaces.Init[1:]...)
+	initArgs = append(initArgs,
+		"-flags", strconv.FormatUint(uint64(namespaces.Flags), 10),
+		"-uid", strconv.FormatUint(uint64(shellUser.Uid), 10),
+		"-gid", strconv.FormatUint(uint64(shellUser.Gid), 10),
+		"-groups", strings.Join(groups, ","))
+	if namespaces.Cgroup != "" {
+		initArgs = append(initArgs, "-cgroup", namespaces.Cgroup)
+	}
+	initArgs = append(initArgs, "--", shell)
+	initArgs = append(initArgs, args...)
+
+	cmd := exec.Command(namespaces.Init[0], initArgs...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: namespaces.Flags}
+	return cmd
+}
+
+// RunNamespaceInit, run by the Init command of the Namespaces with its
+// arguments, sets the namespaces up and replaces itself with the shell: in
+// a new mount namespace the mounts are made private, and /proc is mounted
+// again to show the processes of the new PID namespace only. With a cgroup,
+// it moves itself to it first, so the shell never runs outside of it
+func RunNamespaceInit(args []string) error {
+	flags := flag.NewFlagSet("namespace-init", flag.ContinueOnError)
+	namespaces := flags.Uint64("flags", 0, "")
+	uid := flags.Uint64("uid", 0, "")
+	gid := flags.Uint64("gid", 0, "")
+	groupList := flags.String("groups", "", "")
+	cgroupDir := flags.String("cgroup", "", "")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 {
+		return errors.New("namespace-init: missing the shell")
+	}
+
+	//the mounts below would change the host ones if run outside of the
+	//namespaces, e.g.: from the command line
+	if *namespaces&syscall.CLONE_NEWPID != 0 && os.Getpid() != 1 {
+		return errors.New("namespace-init: not in a new PID namespace")
+	}
+	if *namespaces&syscall.CLONE_NEWNS != 0 {
+		self, _ := os.Readlink("/proc/self/ns/mnt")
+		host, _ := os.Readlink("/proc/1/ns/mnt")
+		if self == "" || self == host {
+			return errors.New("namespace-init: not in a new mount namespace")
+		}
+	}
+
+	//moved while still root; the pid is resolved in the PID namespace of
+	//this process, as the kernel does for the writer of cgroup.procs
+	if *cgroupDir != "" {
+		if err := cgroup.AddProcess(*cgroupDir, os.Getpid()); err != nil {
+			return fmt.Errorf("namespace-init: can't move to the cgroup %s: %s", *cgroupDir, err.Error())
+		}
+	}
+
+	if *namespaces&syscall.CLONE_NEWNS != 0 {
+		//the mounts must not propagate back to the host
+		err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+		if err != nil {
+			return fmt.Errorf("namespace-init: can't make the mounts private: %s", err.Error())
+		}
+		if *namespaces&syscall.CLONE_NEWPID != 0 {
+			err = syscall.Mount("proc", "/proc", "proc",
+				syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "")
+			if err != nil {
+				return fmt.Errorf("namespace-init: can't mount /proc: %s", err.Error())
+			}
+		}
+	}
+
+	groups := []int{}
+	if *groupList != "" {
+		for _, group := range strings.Split(*groupList, ",") {
+			id, err := strconv.Atoi(group)
+			if err != nil {
+				return fmt.Errorf("namespace-init: invalid group %q", group)
+			}
+			groups = append(groups, id)
+		}
+	}
+	//the credentials of all the threads are changed, which needs Go 1.16:
+	//before, Setuid and Setgid failed with EOPNOTSUPP on Linux
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("namespace-init: can't set the groups: %s", err.Error())
+	}
+	if err := syscall.Setgid(int(*gid)); err != nil {
+		return fmt.Errorf("namespace-init: can't set the gid: %s", err.Error())
+	}
+	if err := syscall.Setuid(int(*uid)); err != nil {
+		return fmt.Errorf("namespace-init: can't set the uid: %s", err.Error())
+	}
+
+	shell, err := exec.LookPath(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("namespace-init: %s", err.Error())
+	}
+	return syscall.Exec(shell, flags.Args(), os.Environ())
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//the test binary is the init command of the namespaces too
+const testNamespaceInit = "namespace-init"
+
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == testNamespaceInit {
+		err := RunNamespaceInit(os.Args[2:])
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(127)
+	}
+	os.Exit(m.Run())
+}
+
+func TestNamespaceFlags(t *testing.T) {
+	testCases := map[string]struct {
+		names []string
+		flags uintptr
+		err   string
+	}{
+		"none": {},
+		"pid": {
+			names: []string{"pid"},
+			flags: syscall.CLONE_NEWPID,
+		},
+		"pid and mount": {
+			names: []string{"pid", "mount"},
+			flags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+		},
+		"unsupported": {
+			names: []string{"pid", "net"},
+			err:   "unsupported namespace: net; it must be pid or mount",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			flags, err := NamespaceFlags(tc.names)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.flags, flags)
+			}
+		})
+	}
+}
+
+func TestExecuteShellInNamespaces(t *testing.T) {
+	flags, _ := NamespaceFlags([]string{NamespacePID, NamespaceMount})
+	if err := CheckNamespaces(flags); err != nil {
+		t.Skip(err.Error())
+	}
+	shellUser, err := LookupShellUser("")
+	assert.NoError(t, err)
+
+	namespaces := &Namespaces{Flags: flags, Init: []string{os.Args[0], testNamespaceInit}}
+	env := ShellEnvironment(shellUser, "/bin/sh", "xterm-256color", nil, false)
+	pid, pseudoTTY, cmd, err := ExecuteShellInNamespaces(namespaces, shellUser, "/bin/sh",
+		[]string{"-c", "echo pid:$$; echo processes:$(ls -d /proc/[0-9]* | wc -l)"}, env, "", 24, 80)
+	assert.NoError(t, err)
+	assert.NotZero(t, pid)
+
+	data, _ := ioutil.ReadAll(pseudoTTY)
+	pseudoTTY.Close()
+	cmd.Wait()
+	output := strings.ReplaceAll(string(data), "\r", "")
+	//the shell is the init of its PID namespace, and sees only itself and
+	//the command substitution pipeline
+	assert.Contains(t, output, "pid:1\n")
+	assert.Regexp(t, "processes:[1-3]\n", output)
+
+	//the host still sees its own processes
+	_, err = os.Stat("/proc/" + strconv.Itoa(os.Getpid()))
+	assert.NoError(t, err)
+}
+
+func TestExecuteShellInNamespacesInitFailure(t *testing.T) {
+	flags, _ := NamespaceFlags([]string{NamespacePID, NamespaceMount})
+	if err := CheckNamespaces(flags); err != nil {
+		t.Skip(err.Error())
+	}
+	shellUser, err := LookupShellUser("")
+	assert.NoError(t, err)
+
+	namespaces := &Namespaces{Flags: flags, Init: []string{os.Args[0], testNamespaceInit}}
+	_, pseudoTTY, cmd, err := ExecuteShellInNamespaces(namespaces, shellUser, "/no/such/shell",
+		nil, nil, "", 24, 80)
+	assert.NoError(t, err)
+
+	data, _ := ioutil.ReadAll(pseudoTTY)
+	pseudoTTY.Close()
+	assert.Error(t, cmd.Wait())
+	assert.Contains(t, string(data), "namespace-init:")
+}
+
+func TestExecuteShellInCgroup(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the init command sets the credentials, which requires root")
+	}
+	shellUser, err := LookupShellUser("")
+	assert.NoError(t, err)
+	//a fake cgroup, the init command writes its pid to cgroup.procs
+	dir, err := ioutil.TempDir("", "cgroup")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(path.Join(dir, "cgroup.procs"), nil, 0644))
+
+	namespaces := &Namespaces{Init: []string{os.Args[0], testNamespaceInit}, Cgroup: dir}
+	pid, pseudoTTY, cmd, err := ExecuteShellInNamespaces(namespaces, shellUser, "/bin/sh",
+		[]string{"-c", "echo pid:$$"}, nil, "", 24, 80)
+	assert.NoError(t, err)
+
+	data, _ := ioutil.ReadAll(pseudoTTY)
+	pseudoTTY.Close()
+	assert.NoError(t, cmd.Wait())
+	//the shell replaced the init command, which was moved before running it
+	assert.Contains(t, strings.ReplaceAll(string(data), "\r", ""), "pid:"+strconv.Itoa(pid)+"\n")
+	procs, err := ioutil.ReadFile(path.Join(dir, "cgroup.procs"))
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(pid)+"\n", string(procs))
+
+	//the shell does not run if it can't be moved
+	namespaces.Cgroup = path.Join(dir, "missing")
+	_, pseudoTTY, cmd, err = ExecuteShellInNamespaces(namespaces, shellUser, "/bin/sh",
+		[]string{"-c", "echo started"}, nil, "", 24, 80)
+	assert.NoError(t, err)
+	data, _ = ioutil.ReadAll(pseudoTTY)
+	pseudoTTY.Close()
+	assert.Error(t, cmd.Wait())
+	assert.Contains(t, string(data), "namespace-init: can't move to the cgroup")
+	assert.NotContains(t, string(data), "started")
+}
+
+func TestCheckNamespacesNotRoot(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("running as root")
+	}
+	err := CheckNamespaces(syscall.CLONE_NEWPID)
+	assert.True(t, errors.Is(err, ErrNamespacesUnsupported))
+}
+
+func TestRunNamespaceInitOutsideNamespaces(t *testing.T) {
+	err := RunNamespaceInit([]string{"-flags", strconv.Itoa(syscall.CLONE_NEWPID | syscall.CLONE_NEWNS),
+		"--", "/bin/true"})
+	assert.EqualError(t, err, "namespace-init: not in a new PID namespace")
+	err = RunNamespaceInit([]string{"-flags", strconv.Itoa(syscall.CLONE_NEWNS), "--", "/bin/true"})
+	assert.EqualError(t, err, "namespace-init: not in a new mount namespace")
+}
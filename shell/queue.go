@@ -0,0 +1,71 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"github.com/mendersoftware/mender-shell/metrics"
+)
+
+// outputQueue decouples reading the terminal from writing the output to the
+// websocket: up to length messages wait to be sent, and once it is full Push
+// blocks; the terminal is not read in the meantime, which pauses the shell
+// once the terminal buffer is full, instead of the output piling up in memory
+type outputQueue struct {
+	messages  chan []byte
+	send      func(data []byte)
+	collector metrics.Collector
+	//closed once all the queued messages are sent
+	done chan struct{}
+}
+
+func newOutputQueue(length int, send func(data []byte), collector metrics.Collector) *outputQueue {
+	if collector == nil {
+		collector = metrics.NopCollector{}
+	}
+	q := &outputQueue{
+		messages:  make(chan []byte, length),
+		send:      send,
+		collector: collector,
+		done:      make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Push queues the message, blocking while the queue is full; data must not
+// be modified afterwards
+func (q *outputQueue) Push(data []byte) {
+	q.messages <- data
+	q.collector.OutputQueued()
+}
+
+// Len returns the number of messages waiting to be sent
+func (q *outputQueue) Len() int {
+	return len(q.messages)
+}
+
+// Close waits for the queued messages to be sent; Push must not be called
+// afterwards
+func (q *outputQueue) Close() {
+	close(q.messages)
+	<-q.done
+}
+
+func (q *outputQueue) run() {
+	defer close(q.done)
+	for data := range q.messages {
+		q.collector.OutputDequeued()
+		q.send(data)
+	}
+}
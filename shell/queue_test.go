@@ -0,0 +1,97 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"bytes"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mendersoftware/mender-shell/metrics"
+)
+
+func TestOutputQueue(t *testing.T) {
+	output := &sentOutput{}
+	queue := newOutputQueue(2, output.send, nil)
+	queue.Push([]byte("a"))
+	queue.Push([]byte("b"))
+	queue.Push([]byte("c"))
+	queue.Close()
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, output.get())
+	assert.Equal(t, 0, queue.Len())
+}
+
+func TestOutputQueueSlowWriter(t *testing.T) {
+	const length = 4
+	const chunks = 100
+	chunk := bytes.Repeat([]byte("x"), DefaultReadBufferSize)
+
+	//the network is stalled until released
+	released := make(chan struct{})
+	output := &sentOutput{}
+	collector := metrics.NewMetrics()
+	queue := newOutputQueue(length, func(data []byte) {
+		<-released
+		output.send(data)
+	}, collector)
+
+	//the pipe blocks the writes until read, like the terminal once its
+	//buffer is full
+	r, w := io.Pipe()
+	var written int32
+	go func() {
+		for i := 0; i < chunks; i++ {
+			w.Write(chunk)
+			atomic.AddInt32(&written, 1)
+		}
+		w.Close()
+	}()
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		for {
+			data := make([]byte, DefaultReadBufferSize)
+			n, err := r.Read(data)
+			if err != nil {
+				return
+			}
+			queue.Push(data[:n])
+		}
+	}()
+
+	assert.Eventually(t, func() bool {
+		return queue.Len() == length
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	//one message being sent, length queued and one waiting to be queued,
+	//the shell is blocked writing the next one
+	assert.Equal(t, length, queue.Len())
+	assert.LessOrEqual(t, atomic.LoadInt32(&written), int32(length+2))
+	var metricsOutput bytes.Buffer
+	collector.WriteTo(&metricsOutput)
+	assert.Contains(t, metricsOutput.String(), "mender_shell_output_queue_depth 4\n")
+
+	close(released)
+	<-readDone
+	queue.Close()
+	assert.Equal(t, int32(chunks), atomic.LoadInt32(&written))
+	assert.Equal(t, bytes.Repeat(chunk, chunks), bytes.Join(output.get(), nil))
+	metricsOutput.Reset()
+	collector.WriteTo(&metricsOutput)
+	assert.Contains(t, metricsOutput.String(), "mender_shell_output_queue_depth 0\n")
+}
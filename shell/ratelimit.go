@@ -0,0 +1,65 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the bytes per second, e.g.: of the
+// shell output; the bucket holds at most one second worth of bytes, and never
+// less than one read of DefaultReadBufferSize from the terminal
+type RateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+func NewRateLimiter(bytesPerSecond uint32) *RateLimiter {
+	burst := float64(bytesPerSecond)
+	if burst < DefaultReadBufferSize {
+		burst = DefaultReadBufferSize
+	}
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// Wait blocks until n bytes can be passed; while it blocks the output of the
+// terminal is not read, which pauses the shell once the terminal buffer is
+// full
+func (l *RateLimiter) Wait(n int) {
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+		l.sleep(delay)
+		l.tokens = 0
+		l.last = l.last.Add(delay)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	testCases := map[string]struct {
+		bytesPerSecond uint32
+		reads          []int
+		pause          time.Duration
+		slept          time.Duration
+	}{
+		"within the burst": {
+			bytesPerSecond: 1000,
+			reads:          []int{255, 255, 255, 235},
+			slept:          0,
+		},
+		"throttled": {
+			bytesPerSecond: 1000,
+			reads:          []int{255, 255, 255, 255, 255, 255, 255, 255},
+			slept:          1040 * time.Millisecond,
+		},
+		"refilled after a pause": {
+			bytesPerSecond: 1000,
+			reads:          []int{255, 255, 255, 235, 255, 255, 255, 235},
+			pause:          time.Second,
+			slept:          0,
+		},
+		"rate below a single read": {
+			bytesPerSecond: 100,
+			reads:          []int{255, 255},
+			slept:          2550 * time.Millisecond,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			var slept time.Duration
+			l := NewRateLimiter(tc.bytesPerSecond)
+			l.last = now
+			l.now = func() time.Time {
+				return now
+			}
+			l.sleep = func(d time.Duration) {
+				slept += d
+				now = now.Add(d)
+			}
+
+			for i, n := range tc.reads {
+				if tc.pause > 0 && i == len(tc.reads)/2 {
+					now = now.Add(tc.pause)
+				}
+				l.Wait(n)
+			}
+			assert.InDelta(t, float64(tc.slept), float64(slept), float64(time.Millisecond))
+		})
+	}
+}
+
+func TestSetOutputRateLimit(t *testing.T) {
+	var mutex sync.Mutex
+	s := NewMenderShell("", &mutex, nil, nil, nil)
+	s.SetOutputRateLimit(0)
+	assert.Nil(t, s.limiter)
+	s.SetOutputRateLimit(1024)
+	assert.NotNil(t, s.limiter)
+	s.SetOutputRateLimit(0)
+	assert.Nil(t, s.limiter)
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+const (
+	// RestrictedShellPrompt is printed by the restricted shell before
+	// reading every command line
+	RestrictedShellPrompt = "$ "
+	// AnyArguments as the last argument of a restricted command allows any
+	// further arguments, e.g.: "journalctl -u * ..."
+	AnyArguments = "..."
+)
+
+// RestrictedCommandAllowed tells if the command is allowed by one of the
+// allowlist command lines. Every argument of an allowlist entry is a pattern
+// matched with path.Match against the argument in the same position, and
+// the command must have as many arguments as the entry, unless the last one
+// is AnyArguments; e.g.: "systemctl status *.service" allows the status of
+// one service, while "journalctl ..." allows any journalctl arguments
+func RestrictedCommandAllowed(args []string, allowlist []string) bool {
+	if len(args) < 1 {
+		return false
+	}
+	for _, allowed := range allowlist {
+		if restrictedCommandMatch(args, ParseCommandLine(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+func restrictedCommandMatch(args []string, patterns []string) bool {
+	if len(patterns) < 1 || patterns[0] == AnyArguments {
+		return false
+	}
+	anyArguments := patterns[len(patterns)-1] == AnyArguments
+	if anyArguments {
+		patterns = patterns[:len(patterns)-1]
+		if len(args) < len(patterns) {
+			return false
+		}
+	} else if len(args) != len(patterns) {
+		return false
+	}
+	for i, pattern := range patterns {
+		//a malformed pattern matches nothing
+		if match, err := path.Match(pattern, args[i]); err != nil || !match {
+			return false
+		}
+	}
+	return true
+}
+
+// RunRestrictedShell is the command interpreter of the restricted shell: it
+// reads the command lines from in, one per line, and runs only the ones
+// allowed by the allowlist, see RestrictedCommandAllowed, printing the usage
+// otherwise. There is no quoting, expansion nor redirection, and the only
+// built-ins are help and exit; it returns when in is closed or on exit
+func RunRestrictedShell(in io.Reader, out io.Writer, allowlist []string,
+	run func(args []string) error) error {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, RestrictedShellPrompt)
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return scanner.Err()
+		}
+		args := ParseCommandLine(scanner.Text())
+		if len(args) < 1 {
+			continue
+		}
+		switch {
+		case len(args) == 1 && (args[0] == "exit" || args[0] == "logout"):
+			return nil
+		case len(args) == 1 && args[0] == "help":
+			printRestrictedShellUsage(out, allowlist)
+		case !RestrictedCommandAllowed(args, allowlist):
+			fmt.Fprintf(out, "%s: %s\n", args[0], ErrCommandNotAllowed.Error())
+			printRestrictedShellUsage(out, allowlist)
+		default:
+			if err := run(args); err != nil {
+				fmt.Fprintf(out, "%s: %s\n", args[0], err.Error())
+			}
+		}
+	}
+}
+
+func printRestrictedShellUsage(out io.Writer, allowlist []string) {
+	if len(allowlist) < 1 {
+		fmt.Fprintln(out, "no command is allowed in this shell; type exit to leave")
+		return
+	}
+	fmt.Fprintln(out, "the commands allowed in this shell are:")
+	for _, allowed := range allowlist {
+		fmt.Fprintln(out, "  "+strings.Join(ParseCommandLine(allowed), " "))
+	}
+	fmt.Fprintln(out, "a * matches any text in an argument, and a trailing "+
+		AnyArguments+" any further arguments; type exit to leave")
+}
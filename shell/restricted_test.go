@@ -0,0 +1,161 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestrictedCommandAllowed(t *testing.T) {
+	testCases := map[string]struct {
+		commandLine string
+		allowlist   []string
+		allowed     bool
+	}{
+		"exact command": {
+			commandLine: "uptime",
+			allowlist:   []string{"uptime"},
+			allowed:     true,
+		},
+		"extra arguments": {
+			commandLine: "uptime -p",
+			allowlist:   []string{"uptime"},
+			allowed:     false,
+		},
+		"any arguments": {
+			commandLine: "journalctl -n 100 -f",
+			allowlist:   []string{"journalctl ..."},
+			allowed:     true,
+		},
+		"any arguments, none given": {
+			commandLine: "journalctl",
+			allowlist:   []string{"journalctl ..."},
+			allowed:     true,
+		},
+		"argument pattern": {
+			commandLine: "systemctl status mender-client.service",
+			allowlist:   []string{"systemctl status *.service"},
+			allowed:     true,
+		},
+		"argument pattern not matching": {
+			commandLine: "systemctl stop mender-client.service",
+			allowlist:   []string{"systemctl status *.service"},
+			allowed:     false,
+		},
+		"pattern does not match the slashes": {
+			commandLine: "cat /var/log/../../etc/shadow",
+			allowlist:   []string{"cat /var/log/*"},
+			allowed:     false,
+		},
+		"malformed pattern": {
+			commandLine: "ls [",
+			allowlist:   []string{"ls ["},
+			allowed:     false,
+		},
+		"any command": {
+			commandLine: "rm -rf /",
+			allowlist:   []string{"...", "* ..."},
+			allowed:     true,
+		},
+		"empty command": {
+			commandLine: " ",
+			allowlist:   []string{"uptime", ""},
+			allowed:     false,
+		},
+		"empty allowlist": {
+			commandLine: "uptime",
+			allowed:     false,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			args := ParseCommandLine(tc.commandLine)
+			assert.Equal(t, tc.allowed, RestrictedCommandAllowed(args, tc.allowlist))
+		})
+	}
+}
+
+func TestRunRestrictedShell(t *testing.T) {
+	testCases := map[string]struct {
+		input     string
+		allowlist []string
+		runErr    error
+		ran       [][]string
+		output    []string
+		notOutput []string
+	}{
+		"allowed commands": {
+			input:     "uptime\n\n  journalctl  -n 10\n",
+			allowlist: []string{"uptime", "journalctl ..."},
+			ran:       [][]string{{"uptime"}, {"journalctl", "-n", "10"}},
+			notOutput: []string{ErrCommandNotAllowed.Error()},
+		},
+		"command not allowed": {
+			input:     "rm -rf /\nuptime\n",
+			allowlist: []string{"uptime"},
+			ran:       [][]string{{"uptime"}},
+			output: []string{
+				"rm: " + ErrCommandNotAllowed.Error(),
+				"the commands allowed in this shell are:\n  uptime\n",
+			},
+		},
+		"no command allowed": {
+			input:  "uptime\n",
+			output: []string{"no command is allowed in this shell"},
+		},
+		"help": {
+			input:     "help\n",
+			allowlist: []string{"systemctl   status *.service"},
+			output:    []string{"  systemctl status *.service\n"},
+		},
+		"exit": {
+			input:     "exit\nuptime\n",
+			allowlist: []string{"uptime"},
+		},
+		"command failed": {
+			input:     "uptime\n",
+			allowlist: []string{"uptime"},
+			runErr:    errors.New("file not found"),
+			ran:       [][]string{{"uptime"}},
+			output:    []string{"uptime: file not found\n"},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var ran [][]string
+			out := &bytes.Buffer{}
+			err := RunRestrictedShell(strings.NewReader(tc.input), out, tc.allowlist,
+				func(args []string) error {
+					ran = append(ran, args)
+					return tc.runErr
+				})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.ran, ran)
+			assert.True(t, strings.HasPrefix(out.String(), RestrictedShellPrompt))
+			for _, s := range tc.output {
+				assert.Contains(t, out.String(), s)
+			}
+			for _, s := range tc.notOutput {
+				assert.NotContains(t, out.String(), s)
+			}
+		})
+	}
+}
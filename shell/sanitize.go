@@ -0,0 +1,233 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+const (
+	controlBEL = 0x07
+	controlCAN = 0x18
+	controlSUB = 0x1a
+	controlESC = 0x1b
+	//the longest CSI sequence passed, the longer ones are dropped
+	maxCSILength = 64
+	//the most digits of an OSC number
+	maxOSCNumberLength = 4
+)
+
+// the OSC sequences passed through by the OutputSanitizer, by number
+var allowedOSC = map[string]bool{
+	//icon name and window title
+	"0": true, "1": true, "2": true,
+	//color palette, and its reset
+	"4": true, "104": true,
+	//dynamic colors, e.g.: the foreground and background, and their reset
+	"10": true, "11": true, "12": true, "13": true, "14": true,
+	"15": true, "16": true, "17": true, "18": true, "19": true,
+	"110": true, "111": true, "112": true, "113": true, "114": true,
+	"115": true, "116": true, "117": true, "118": true, "119": true,
+}
+
+type sanitizerState int
+
+const (
+	stateGround sanitizerState = iota
+	//after ESC
+	stateEscape
+	//in a CSI sequence, ESC [, held back until its final byte
+	stateCSI
+	//in a CSI sequence too long to be held back, dropped
+	stateCSIDrop
+	//in the number of an OSC sequence, ESC ], held back until known
+	stateOSCNumber
+	//in the rest of an OSC, DCS, SOS, PM or APC sequence, passed if
+	//passString, dropped otherwise
+	stateString
+	//after ESC in one of those, ESC \ terminates it
+	stateStringEscape
+)
+
+// OutputSanitizer removes the escape sequences a compromised device could
+// abuse to manipulate the terminal of the operator from the shell output,
+// while the colors, the cursor movements and the other sequences of the
+// terminal applications pass through. The sequences dropped as a whole are:
+//  * the OSC sequences, ESC ], except for the icon name and window title, 0,
+//    1 and 2, the color palette, 4 and 104, and the dynamic colors, 10 to 19
+//    and 110 to 119; e.g.: the clipboard access, 52, the hyperlinks, 8, or
+//    the proprietary ones, like the iTerm2 file transfers, 1337
+//  * the DCS, ESC P, SOS, ESC X, PM, ESC ^, and APC, ESC _, strings; e.g.:
+//    the settings requests, DECRQSS, or the terminal multiplexer passthrough
+//  * the CSI window manipulation sequences, CSI ... t, which resize, move,
+//    iconify the window or report its title back as if it was typed
+//  * the CSI sequences over 64 bytes
+//
+// The strings end with BEL or ST, ESC \, and are aborted by CAN, SUB or ESC
+// like in xterm. The 8-bit C1 controls are not interpreted in the UTF-8
+// terminals, and are passed through.
+//
+// The sequences may be split across the output chunks: the start of one is
+// held back until the sanitizer knows if it is passed
+type OutputSanitizer struct {
+	state sanitizerState
+	//the start of the sequence held back
+	pending []byte
+	//the current string is passed through, it is dropped otherwise
+	passString bool
+}
+
+func NewOutputSanitizer() *OutputSanitizer {
+	return &OutputSanitizer{}
+}
+
+// Filter returns the output p without the dangerous sequences, and without
+// the start of a sequence held back until the next chunk
+func (s *OutputSanitizer) Filter(p []byte) []byte {
+	out := make([]byte, 0, len(p)+len(s.pending))
+	for _, b := range p {
+		out = s.filterByte(out, b)
+	}
+	return out
+}
+
+func (s *OutputSanitizer) filterByte(out []byte, b byte) []byte {
+	switch s.state {
+	case stateGround:
+		if b == controlESC {
+			s.startEscape()
+			return out
+		}
+		return append(out, b)
+
+	case stateEscape:
+		switch b {
+		case '[':
+			s.pending = append(s.pending, b)
+			s.state = stateCSI
+		case ']':
+			s.pending = append(s.pending, b)
+			s.state = stateOSCNumber
+		case 'P', 'X', '^', '_':
+			s.startString(false)
+		case controlESC:
+			out = append(out, s.pending...)
+			s.startEscape()
+		default:
+			//the other escape sequences pass through
+			out = append(append(out, s.pending...), b)
+			s.reset()
+		}
+		return out
+
+	case stateCSI:
+		switch {
+		case b >= 0x40 && b <= 0x7e:
+			if b != 't' {
+				out = append(append(out, s.pending...), b)
+			}
+			s.reset()
+		case b == controlESC:
+			s.startEscape()
+		case b == controlCAN || b == controlSUB:
+			s.reset()
+		case len(s.pending) >= maxCSILength:
+			s.pending = s.pending[:0]
+			s.state = stateCSIDrop
+		default:
+			s.pending = append(s.pending, b)
+		}
+		return out
+
+	case stateCSIDrop:
+		switch {
+		case b >= 0x40 && b <= 0x7e, b == controlCAN, b == controlSUB:
+			s.reset()
+		case b == controlESC:
+			s.startEscape()
+		}
+		return out
+
+	case stateOSCNumber:
+		if b >= '0' && b <= '9' && len(s.pending) < 2+maxOSCNumberLength {
+			s.pending = append(s.pending, b)
+			return out
+		}
+		allowed := allowedOSC[string(s.pending[2:])]
+		if allowed {
+			out = append(out, s.pending...)
+		}
+		switch b {
+		case ';':
+			if allowed {
+				out = append(out, b)
+			}
+			s.startString(allowed)
+		case controlBEL, controlCAN, controlSUB:
+			if allowed {
+				out = append(out, b)
+			}
+			s.reset()
+		case controlESC:
+			s.startString(allowed)
+			s.state = stateStringEscape
+		default:
+			//not a number
+			s.startString(false)
+		}
+		return out
+
+	case stateString:
+		switch b {
+		case controlBEL, controlCAN, controlSUB:
+			if s.passString {
+				out = append(out, b)
+			}
+			s.reset()
+		case controlESC:
+			s.state = stateStringEscape
+		default:
+			if s.passString {
+				out = append(out, b)
+			}
+		}
+		return out
+
+	case stateStringEscape:
+		if b == '\\' {
+			if s.passString {
+				out = append(out, controlESC, b)
+			}
+			s.reset()
+			return out
+		}
+		//the ESC aborts the string, and starts a new sequence
+		s.startEscape()
+		return s.filterByte(out, b)
+	}
+	return out
+}
+
+func (s *OutputSanitizer) startEscape() {
+	s.pending = append(s.pending[:0], controlESC)
+	s.state = stateEscape
+}
+
+func (s *OutputSanitizer) startString(pass bool) {
+	s.pending = s.pending[:0]
+	s.passString = pass
+	s.state = stateString
+}
+
+func (s *OutputSanitizer) reset() {
+	s.pending = s.pending[:0]
+	s.passString = false
+	s.state = stateGround
+}
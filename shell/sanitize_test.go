@@ -0,0 +1,103 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputSanitizer(t *testing.T) {
+	testCases := map[string]struct {
+		chunks []string
+		output string
+	}{
+		"text": {
+			chunks: []string{"ls -l\r\n", "total 0\r\n"},
+			output: "ls -l\r\ntotal 0\r\n",
+		},
+		"colors and cursor": {
+			chunks: []string{"\x1b[1;31mred\x1b[0m\x1b[2J\x1b[H\x1b[?25l\x1b[6n"},
+			output: "\x1b[1;31mred\x1b[0m\x1b[2J\x1b[H\x1b[?25l\x1b[6n",
+		},
+		"other escape sequences": {
+			chunks: []string{"\x1b7\x1b(B\x1b=\x1bc\x1b8"},
+			output: "\x1b7\x1b(B\x1b=\x1bc\x1b8",
+		},
+		"window title": {
+			chunks: []string{"\x1b]0;user@device: ~\x07$ ", "\x1b]2;title\x1b\\"},
+			output: "\x1b]0;user@device: ~\x07$ \x1b]2;title\x1b\\",
+		},
+		"colors": {
+			chunks: []string{"\x1b]4;1;rgb:ff/00/00\x07\x1b]11;?\x07\x1b]104\x07"},
+			output: "\x1b]4;1;rgb:ff/00/00\x07\x1b]11;?\x07\x1b]104\x07",
+		},
+		"clipboard": {
+			chunks: []string{"a\x1b]52;c;ZWNobyBwd25lZA==\x07b\x1b]52;c;?\x1b\\c"},
+			output: "abc",
+		},
+		"hyperlink": {
+			chunks: []string{"\x1b]8;;https://evil.example.com\x1b\\link\x1b]8;;\x1b\\"},
+			output: "link",
+		},
+		"proprietary": {
+			chunks: []string{"\x1b]1337;File=name=eA==:eA==\x07done"},
+			output: "done",
+		},
+		"not a number": {
+			chunks: []string{"\x1b]L;label\x1b\\\x1b];x\x07\x1b]123456;x\x07ok"},
+			output: "ok",
+		},
+		"window manipulation": {
+			chunks: []string{"\x1b[21t\x1b[8;100;200t\x1b[2t\x1b[1m"},
+			output: "\x1b[1m",
+		},
+		"strings": {
+			chunks: []string{"a\x1bP$qm\x1b\\b\x1b_tmux\x1b\\c\x1b^pm\x1b\\d\x1bXsos\x1b\\e"},
+			output: "abcde",
+		},
+		"split": {
+			chunks: []string{"a\x1b", "]", "5", "2;c;", "ZWNo\x1b", "\\b\x1b[", "1;", "3", "1m", "c\x1b]", "0;t", "\x07"},
+			output: "ab\x1b[1;31mc\x1b]0;t\x07",
+		},
+		"aborted": {
+			chunks: []string{"\x1b]52;c;eA==\x18a\x1b]52;c;eA==\x1b[1mb\x1b[21\x1b[2mc\x1b[31\x1ad"},
+			output: "a\x1b[1mb\x1b[2mcd",
+		},
+		"escape escape": {
+			chunks: []string{"\x1b\x1b[1m"},
+			output: "\x1b\x1b[1m",
+		},
+		"long csi": {
+			chunks: []string{"\x1b[" + string(make([]byte, 100)) + "mok"},
+			output: "ok",
+		},
+		"utf-8": {
+			chunks: []string{"\x1b]2;h\xc3\xa9\x07\xf0\x9f\x98\x80"},
+			output: "\x1b]2;h\xc3\xa9\x07\xf0\x9f\x98\x80",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			s := NewOutputSanitizer()
+			var output []byte
+			for _, chunk := range tc.chunks {
+				output = append(output, s.Filter([]byte(chunk))...)
+			}
+			assert.Equal(t, tc.output, string(output))
+		})
+	}
+}
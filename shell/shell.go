@@ -19,6 +19,10 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"unsafe"
 
@@ -26,46 +30,307 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	defaultTermString = "xterm-256color"
+	defaultPath       = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+)
+
+const (
+	// InterruptCharacter is the INTR control character, Ctrl-C; the
+	// terminal sends SIGINT to its foreground process group when it reads it
+	InterruptCharacter = 0x03
+)
+
+var (
+	ErrNotDirectory = errors.New("not a directory")
+)
+
+// ShellUser is the user the shell process runs as
+type ShellUser struct {
+	Name   string
+	Home   string
+	Uid    uint32
+	Gid    uint32
+	Groups []uint32
+}
+
+// LookupShellUser resolves the user with the given name, along with its
+// supplementary groups; the current user if name is empty
+func LookupShellUser(name string) (*ShellUser, error) {
+	var u *user.User
+	var err error
+	if name == "" {
+		u, err = user.Current()
+	} else {
+		u, err = user.Lookup(name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't resolve the shell user %q: %s", name, err.Error())
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("can't get the groups of the shell user %q: %s", u.Username, err.Error())
+	}
+	groups := make([]uint32, 0, len(groupIds))
+	for _, groupId := range groupIds {
+		group, err := strconv.ParseUint(groupId, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, uint32(group))
+	}
+
+	return &ShellUser{
+		Name:   u.Username,
+		Home:   u.HomeDir,
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: groups,
+	}, nil
+}
+
 func ExecuteShell(uid uint32,
 	gid uint32,
 	shell string,
+	args []string,
 	termString string,
 	height uint16,
 	width uint16) (pid int, pseudoTTY *os.File, cmd *exec.Cmd, err error) {
-	cmd = exec.Command(shell)
+	shellUser := &ShellUser{Uid: uid, Gid: gid}
+	env := ShellEnvironment(shellUser, shell, termString, nil, false)
+	return ExecuteShellAsUser(shellUser, shell, args, env, "", height, width)
+}
+
+var (
+	//the terminal types, e.g.: xterm-256color or screen.xterm-256color
+	termPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]{0,63}$`)
+	//the locale variables and their values, e.g.: en_US.UTF-8, or
+	//sv_SE:en for LANGUAGE
+	localeNamePattern  = regexp.MustCompile(`^(LANG|LANGUAGE|LC_[A-Z]+)$`)
+	localeValuePattern = regexp.MustCompile(`^[A-Za-z0-9_.@:-]{1,64}$`)
+)
+
+// ValidTerm tells if term looks like a terminal type, so that it can be
+// taken from the server as the TERM of a session without injecting anything
+// else in the environment
+func ValidTerm(term string) bool {
+	return termPattern.MatchString(term)
+}
+
+// ValidLocale tells if name is one of the locale variables, LANG, LANGUAGE
+// or LC_*, and if value looks like a locale
+func ValidLocale(name string, value string) bool {
+	return localeNamePattern.MatchString(name) && localeValuePattern.MatchString(value)
+}
+
+// ShellEnvironment returns the environment of the shell process: the daemon
+// environment if inheritEnv is true, overridden by the minimal set of TERM,
+// PATH, SHELL and, from the user entry, HOME and USER, and finally by the
+// configured session environment
+func ShellEnvironment(shellUser *ShellUser,
+	shell string,
+	termString string,
+	sessionEnv map[string]string,
+	inheritEnv bool) []string {
+	var env []string
+	if inheritEnv {
+		env = os.Environ()
+	}
+
+	if termString == "" {
+		termString = defaultTermString
+	}
+	env = append(env, "TERM="+termString)
+	if !inheritEnv {
+		env = append(env, "PATH="+defaultPath)
+	}
+	env = append(env, "SHELL="+shell)
+	if shellUser.Name != "" {
+		env = append(env, "USER="+shellUser.Name)
+	}
+	if shellUser.Home != "" {
+		env = append(env, "HOME="+shellUser.Home)
+	}
+
+	names := make([]string, 0, len(sessionEnv))
+	for name := range sessionEnv {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		//an empty TERM breaks the curses applications
+		if name == "TERM" && sessionEnv[name] == "" {
+			continue
+		}
+		env = append(env, name+"="+sessionEnv[name])
+	}
+
+	return dedupEnv(env)
+}
+
+//dedupEnv removes the duplicated variables, the last value wins
+func dedupEnv(env []string) []string {
+	index := make(map[string]int, len(env))
+	deduped := make([]string, 0, len(env))
+	for _, kv := range env {
+		name := kv
+		if i := strings.Index(kv, "="); i >= 0 {
+			name = kv[:i]
+		}
+		if i, ok := index[name]; ok {
+			deduped[i] = kv
+			continue
+		}
+		index[name] = len(deduped)
+		deduped = append(deduped, kv)
+	}
+	return deduped
+}
 
+// ExecuteShellAsUser starts the shell in a new terminal with the given
+// environment, running as the given user with its supplementary groups, in
+// the dir working directory; in the daemon one if dir is empty
+func ExecuteShellAsUser(shellUser *ShellUser,
+	shell string,
+	args []string,
+	env []string,
+	dir string,
+	height uint16,
+	width uint16) (pid int, pseudoTTY *os.File, cmd *exec.Cmd, err error) {
+	return ExecuteShellInNamespaces(nil, shellUser, shell, args, env, dir, height, width)
+}
+
+// ExecuteShellInNamespaces is ExecuteShellAsUser starting the shell in the
+// given new namespaces and cgroup, if not nil, through their init command
+func ExecuteShellInNamespaces(namespaces *Namespaces,
+	shellUser *ShellUser,
+	shell string,
+	args []string,
+	env []string,
+	dir string,
+	height uint16,
+	width uint16) (pid int, pseudoTTY *os.File, cmd *exec.Cmd, err error) {
+	if namespaces != nil && (namespaces.Flags != 0 || namespaces.Cgroup != "") {
+		cmd = namespaceInitCommand(namespaces, shellUser, shell, args)
+	} else {
+		cmd = exec.Command(shell, args...)
+		err = setCredential(cmd, shellUser)
+		if err != nil {
+			return -1, nil, nil, err
+		}
+	}
+	cmd.Dir = dir
+
+	//a nil Env would make the shell inherit the daemon environment
+	cmd.Env = append([]string{}, env...)
+	pseudoTTY, err = pty.Start(cmd)
+	if err != nil {
+		return -1, nil, nil, err
+	}
+
+	pid = cmd.Process.Pid
+	log.Debugf("started shell: %s pid:%d", shell, pid)
+
+	err = ResizeShell(pseudoTTY, height, width)
+	if err != nil {
+		log.Debugf("failed to resize terminal: %s", err.Error())
+	}
+
+	return pid, pseudoTTY, cmd, nil
+}
+
+// CheckWorkingDir verifies dir is a directory the user can change to
+func CheckWorkingDir(dir string, shellUser *ShellUser) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("working directory %s: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("working directory %s: %w", dir, ErrNotDirectory)
+	}
+	if !dirSearchable(info, shellUser) {
+		return fmt.Errorf("working directory %s: %w", dir, os.ErrPermission)
+	}
+	return nil
+}
+
+//returns true if the user has the search permission on the directory,
+//which changing to it requires
+func dirSearchable(info os.FileInfo, shellUser *ShellUser) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || shellUser.Uid == 0 {
+		return true
+	}
+	mode := info.Mode().Perm()
+	if stat.Uid == shellUser.Uid {
+		return mode&0100 != 0
+	}
+	inGroup := stat.Gid == shellUser.Gid
+	for _, gid := range shellUser.Groups {
+		inGroup = inGroup || stat.Gid == gid
+	}
+	if inGroup {
+		return mode&0010 != 0
+	}
+	return mode&0001 != 0
+}
+
+//setCredential makes the command run as the given user, with its groups
+func setCredential(cmd *exec.Cmd, shellUser *ShellUser) error {
 	currentUser, err := user.Current()
 	if err != nil {
 		log.Debugf("cant get current user: %s", err.Error())
-		return -1, nil, nil, errors.New("unknown error with exec.Command(" + shell + ")")
+		return errors.New("unknown error with exec.Command(" + cmd.Path + ")")
 	}
 
 	//in order to set uid and gid we have to be root, at the moment lets check
 	//if our uid is 0
 	if currentUser.Uid == "0" {
 		cmd.SysProcAttr = &syscall.SysProcAttr{}
-		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    shellUser.Uid,
+			Gid:    shellUser.Gid,
+			Groups: shellUser.Groups,
+		}
 	}
+	return nil
+}
 
-	cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", termString))
-	pseudoTTY, err = pty.Start(cmd)
-	if err != nil {
-		return -1, nil, nil, err
+// InterruptForeground sends SIGINT to the foreground process group of the
+// terminal, i.e.: to the command running in the shell, or to the shell if it
+// is waiting for a command
+func InterruptForeground(pseudoTTY *os.File) error {
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, pseudoTTY.Fd(), uintptr(syscall.TIOCGPGRP),
+		uintptr(unsafe.Pointer(&pgrp)))
+	if errno != 0 {
+		return errno
 	}
+	log.Debugf("interrupting the foreground process group %d of terminal %s", pgrp, pseudoTTY.Name())
+	return syscall.Kill(-int(pgrp), syscall.SIGINT)
+}
 
-	pid = cmd.Process.Pid
-	log.Debugf("started shell: %s pid:%d", shell, pid)
-
-	log.Debugf("resizing terminal %v to %dx%d", *pseudoTTY, height, width)
-	_, _, err = syscall.Syscall(syscall.SYS_IOCTL, pseudoTTY.Fd(), uintptr(syscall.TIOCSWINSZ),
+// ResizeShell sets the size of the terminal, the shell running in it
+// receives SIGWINCH
+func ResizeShell(pseudoTTY *os.File, height uint16, width uint16) error {
+	log.Debugf("resizing terminal %s to %dx%d", pseudoTTY.Name(), height, width)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, pseudoTTY.Fd(), uintptr(syscall.TIOCSWINSZ),
 		uintptr(unsafe.Pointer(&struct {
 			h, w, x, y uint16
 		}{
 			height, width, 0, 0,
 		})))
-	if err != nil {
-		log.Debugf("failed to resize terminal: %s", err.Error())
+	if errno != 0 {
+		return errno
 	}
-
-	return pid, pseudoTTY, cmd, nil
+	return nil
 }
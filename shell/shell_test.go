@@ -14,10 +14,15 @@
 package shell
 
 import (
+	"errors"
 	"github.com/mendersoftware/mender-shell/procps"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"os/user"
+	"path"
 	"strconv"
+	"strings"
 	"syscall"
 	"testing"
 	"time"
@@ -44,13 +49,13 @@ func TestMenderShellExecShell(t *testing.T) {
 	}
 
 	//command does not exist
-	pid, pseudoTTY, cmd, err := ExecuteShell(uint32(uid), uint32(gid), "thatissomethingthatdoesnotexecute", "xterm-256color", 24, 80)
+	pid, pseudoTTY, cmd, err := ExecuteShell(uint32(uid), uint32(gid), "thatissomethingthatdoesnotexecute", nil, "xterm-256color", 24, 80)
 	assert.Error(t, err)
 	assert.Equal(t, pid, -1)
 	assert.Nil(t, pseudoTTY)
 	assert.Nil(t, cmd)
 
-	pid, pseudoTTY, cmd, err = ExecuteShell(uint32(uid), uint32(gid), "/bin/sh", "xterm-256color", 24, 80)
+	pid, pseudoTTY, cmd, err = ExecuteShell(uint32(uid), uint32(gid), "/bin/sh", nil, "xterm-256color", 24, 80)
 	assert.Nil(t, err)
 	assert.NotZero(t, pid)
 	assert.NotNil(t, pseudoTTY)
@@ -84,3 +89,336 @@ func TestMenderShellExecShell(t *testing.T) {
 		t.Logf("process is still running after kill -9")
 	}
 }
+
+func TestMenderShellExecShellArguments(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	pid, pseudoTTY, cmd, err := ExecuteShell(uint32(uid), uint32(gid), "/bin/sh",
+		[]string{"-c", "echo arguments-passed; sleep 1"}, "xterm-256color", 24, 80)
+	assert.NoError(t, err)
+	assert.NotZero(t, pid)
+	assert.Equal(t, []string{"/bin/sh", "-c", "echo arguments-passed; sleep 1"}, cmd.Args)
+
+	data, _ := ioutil.ReadAll(pseudoTTY)
+	assert.Contains(t, string(data), "arguments-passed")
+	pseudoTTY.Close()
+	cmd.Wait()
+}
+
+func TestResizeShell(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not available")
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+	uid, err := strconv.ParseUint(currentUser.Uid, 10, 32)
+	assert.NoError(t, err)
+	gid, err := strconv.ParseUint(currentUser.Gid, 10, 32)
+	assert.NoError(t, err)
+
+	pid, pseudoTTY, cmd, err := ExecuteShell(uint32(uid), uint32(gid), bash, nil, "xterm-256color", 24, 80)
+	assert.NoError(t, err)
+	defer func() {
+		pseudoTTY.Close()
+		procps.TerminateAndWait(pid, cmd, 2*time.Second)
+	}()
+
+	output := make(chan string, 1)
+	go func() {
+		var read string
+		buffer := make([]byte, 255)
+		for {
+			n, err := pseudoTTY.Read(buffer)
+			if err != nil {
+				return
+			}
+			read += string(buffer[:n])
+			if strings.Contains(read, "size=132x50") {
+				output <- read
+				return
+			}
+		}
+	}()
+
+	err = ResizeShell(pseudoTTY, 50, 132)
+	assert.NoError(t, err)
+	time.Sleep(time.Second)
+	pseudoTTY.Write([]byte("echo size=${COLUMNS}x${LINES}\n"))
+
+	select {
+	case <-output:
+	case <-time.After(8 * time.Second):
+		t.Error("the shell did not report the new terminal size")
+	}
+}
+
+func TestLookupShellUser(t *testing.T) {
+	currentUser, err := user.Current()
+	if err != nil {
+		t.Errorf("cant get current user: %s", err.Error())
+		return
+	}
+
+	testCases := map[string]struct {
+		name     string
+		expected string
+		err      bool
+	}{
+		"ok": {
+			name:     currentUser.Username,
+			expected: currentUser.Username,
+		},
+		"ok, current user": {
+			name:     "",
+			expected: currentUser.Username,
+		},
+		"ko, unknown user": {
+			name: "thisoneisnotknown",
+			err:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			shellUser, err := LookupShellUser(tc.name)
+			if tc.err {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tc.name)
+				assert.Nil(t, shellUser)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, shellUser.Name)
+			assert.Equal(t, currentUser.HomeDir, shellUser.Home)
+			assert.Equal(t, currentUser.Uid, strconv.Itoa(int(shellUser.Uid)))
+			assert.Equal(t, currentUser.Gid, strconv.Itoa(int(shellUser.Gid)))
+			assert.NotEmpty(t, shellUser.Groups)
+		})
+	}
+}
+
+func TestExecuteShellAsUserEnvironment(t *testing.T) {
+	shellUser, err := LookupShellUser("")
+	assert.NoError(t, err)
+
+	env := ShellEnvironment(shellUser, "/bin/sh", "xterm-256color", nil, false)
+	pid, pseudoTTY, cmd, err := ExecuteShellAsUser(shellUser, "/bin/sh",
+		[]string{"-c", "echo env:$USER:$HOME:$SHELL"}, env, "", 24, 80)
+	assert.NoError(t, err)
+	assert.NotZero(t, pid)
+
+	data, _ := ioutil.ReadAll(pseudoTTY)
+	assert.Contains(t, string(data), "env:"+shellUser.Name+":"+shellUser.Home+":/bin/sh")
+	pseudoTTY.Close()
+	cmd.Wait()
+}
+
+func TestExecuteShellAsUserWorkingDir(t *testing.T) {
+	shellUser, err := LookupShellUser("")
+	assert.NoError(t, err)
+	dir, err := ioutil.TempDir("", "mender-shell-workdir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	env := ShellEnvironment(shellUser, "/bin/sh", "xterm-256color", nil, false)
+	pid, pseudoTTY, cmd, err := ExecuteShellAsUser(shellUser, "/bin/sh",
+		[]string{"-c", "echo pwd:$(pwd)"}, env, dir, 24, 80)
+	assert.NoError(t, err)
+	assert.NotZero(t, pid)
+
+	data, _ := ioutil.ReadAll(pseudoTTY)
+	assert.Contains(t, string(data), "pwd:"+dir)
+	pseudoTTY.Close()
+	cmd.Wait()
+}
+
+func TestCheckWorkingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-workdir")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "file")
+	assert.NoError(t, ioutil.WriteFile(file, nil, 0644))
+	private := path.Join(dir, "private")
+	assert.NoError(t, os.Mkdir(private, 0700))
+	shared := path.Join(dir, "shared")
+	assert.NoError(t, os.Mkdir(shared, 0701))
+	assert.NoError(t, os.Chmod(shared, 0701))
+	owner := &ShellUser{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}
+	other := &ShellUser{Uid: 54321, Gid: 54321}
+
+	testCases := map[string]struct {
+		dir       string
+		shellUser *ShellUser
+		err       error
+	}{
+		"ok": {
+			dir:       dir,
+			shellUser: owner,
+		},
+		"missing": {
+			dir:       path.Join(dir, "missing"),
+			shellUser: owner,
+			err:       os.ErrNotExist,
+		},
+		"not a directory": {
+			dir:       file,
+			shellUser: owner,
+			err:       ErrNotDirectory,
+		},
+		"owner only": {
+			dir:       private,
+			shellUser: owner,
+		},
+		"not searchable by the user": {
+			dir:       private,
+			shellUser: other,
+			err:       os.ErrPermission,
+		},
+		"searchable by the others": {
+			dir:       shared,
+			shellUser: other,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := CheckWorkingDir(tc.dir, tc.shellUser)
+			if tc.err != nil {
+				assert.True(t, errors.Is(err, tc.err), "unexpected error: %v", err)
+				assert.Contains(t, err.Error(), tc.dir)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestValidTerm(t *testing.T) {
+	testCases := map[string]struct {
+		term  string
+		valid bool
+	}{
+		"xterm":              {term: "xterm-256color", valid: true},
+		"screen":             {term: "screen.xterm-256color", valid: true},
+		"rxvt-unicode":       {term: "rxvt-unicode-256color", valid: true},
+		"empty":              {term: ""},
+		"variable injection": {term: "xterm\nLD_PRELOAD=/tmp/x.so"},
+		"command injection":  {term: "xterm;rm -rf /"},
+		"leading dash":       {term: "-xterm"},
+		"too long":           {term: strings.Repeat("x", 65)},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.valid, ValidTerm(tc.term))
+		})
+	}
+}
+
+func TestValidLocale(t *testing.T) {
+	testCases := map[string]struct {
+		name  string
+		value string
+		valid bool
+	}{
+		"LANG":             {name: "LANG", value: "en_US.UTF-8", valid: true},
+		"LC_ALL":           {name: "LC_ALL", value: "C", valid: true},
+		"LC_TIME modifier": {name: "LC_TIME", value: "sv_SE.utf8@euro", valid: true},
+		"LANGUAGE list":    {name: "LANGUAGE", value: "sv_SE:en", valid: true},
+		"not a locale":     {name: "LD_PRELOAD", value: "C"},
+		"lowercase LC":     {name: "lc_all", value: "C"},
+		"empty value":      {name: "LANG", value: ""},
+		"path value":       {name: "LANG", value: "/tmp/locale"},
+		"space in value":   {name: "LANG", value: "C PATH=/tmp"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.valid, ValidLocale(tc.name, tc.value))
+		})
+	}
+}
+
+func TestShellEnvironment(t *testing.T) {
+	os.Setenv("MENDER_SHELL_TEST_SECRET", "secret")
+	defer os.Unsetenv("MENDER_SHELL_TEST_SECRET")
+	shellUser := &ShellUser{Name: "operator", Home: "/home/operator"}
+
+	testCases := map[string]struct {
+		termString string
+		sessionEnv map[string]string
+		inheritEnv bool
+		contains   []string
+		excludes   []string
+	}{
+		"minimal": {
+			termString: "xterm-256color",
+			contains: []string{
+				"TERM=xterm-256color",
+				"PATH=" + defaultPath,
+				"SHELL=/bin/sh",
+				"USER=operator",
+				"HOME=/home/operator",
+			},
+			excludes: []string{"MENDER_SHELL_TEST_SECRET=secret"},
+		},
+		"session env": {
+			termString: "xterm-256color",
+			sessionEnv: map[string]string{
+				"PROMPT_MARKER":  "mender",
+				"CORRELATION_ID": "1234",
+				"TERM":           "vt100",
+			},
+			contains: []string{
+				"TERM=vt100",
+				"PROMPT_MARKER=mender",
+				"CORRELATION_ID=1234",
+			},
+			excludes: []string{"TERM=xterm-256color", "MENDER_SHELL_TEST_SECRET=secret"},
+		},
+		"default TERM": {
+			sessionEnv: map[string]string{"TERM": ""},
+			contains:   []string{"TERM=" + defaultTermString},
+			excludes:   []string{"TERM="},
+		},
+		"inherit env": {
+			termString: "xterm-256color",
+			inheritEnv: true,
+			contains: []string{
+				"TERM=xterm-256color",
+				"MENDER_SHELL_TEST_SECRET=secret",
+				"USER=operator",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			env := ShellEnvironment(shellUser, "/bin/sh", tc.termString, tc.sessionEnv, tc.inheritEnv)
+			for _, kv := range tc.contains {
+				assert.Contains(t, env, kv)
+			}
+			for _, kv := range tc.excludes {
+				assert.NotContains(t, env, kv)
+			}
+			names := map[string]bool{}
+			for _, kv := range env {
+				name := strings.SplitN(kv, "=", 2)[0]
+				assert.False(t, names[name], "duplicated variable "+name)
+				names[name] = true
+			}
+		})
+	}
+}
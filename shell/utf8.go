@@ -0,0 +1,49 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"unicode/utf8"
+)
+
+// incompleteRuneLen returns the length of the incomplete UTF-8 sequence at
+// the end of p, i.e.: the start of a multibyte character the next read
+// completes; 0 if p ends with a whole character, or with bytes which can't
+// be one
+func incompleteRuneLen(p []byte) int {
+	//a sequence is at most utf8.UTFMax bytes long, so only the last
+	//utf8.UTFMax-1 bytes can be the start of an incomplete one
+	for i := 1; i < utf8.UTFMax && i <= len(p); i++ {
+		b := p[len(p)-i]
+		if !utf8.RuneStart(b) {
+			continue
+		}
+		if b >= utf8.RuneSelf && !utf8.FullRune(p[len(p)-i:]) {
+			return i
+		}
+		return 0
+	}
+	return 0
+}
+
+// TrimIncompleteRunes returns p without the continuation bytes it starts
+// with, i.e.: the rest of a multibyte character cut off at the start, and
+// without the incomplete UTF-8 sequence it ends with, so that p decodes on
+// its own; e.g.: the output kept from the middle of a stream
+func TrimIncompleteRunes(p []byte) []byte {
+	for i := 0; i < utf8.UTFMax-1 && len(p) > 0 && !utf8.RuneStart(p[0]); i++ {
+		p = p[1:]
+	}
+	return p[:len(p)-incompleteRuneLen(p)]
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package shell
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncompleteRuneLen(t *testing.T) {
+	testCases := map[string]struct {
+		data     []byte
+		expected int
+	}{
+		"empty": {
+			data: []byte{},
+		},
+		"ascii": {
+			data: []byte("abc"),
+		},
+		"whole emoji": {
+			data: []byte("a\xf0\x9f\x98\x80"),
+		},
+		"emoji lead byte": {
+			data:     []byte("a\xf0"),
+			expected: 1,
+		},
+		"emoji without the last byte": {
+			data:     []byte("a\xf0\x9f\x98"),
+			expected: 3,
+		},
+		"two byte character start": {
+			data:     []byte("\xc3"),
+			expected: 1,
+		},
+		"whole two byte character": {
+			data: []byte("\xc3\xa5"),
+		},
+		"continuation bytes only": {
+			data: []byte("\x9f\x98\x80"),
+		},
+		"invalid lead byte": {
+			data: []byte("a\xff"),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, incompleteRuneLen(tc.data))
+		})
+	}
+}
+
+func TestTrimIncompleteRunes(t *testing.T) {
+	testCases := map[string]struct {
+		data     []byte
+		expected []byte
+	}{
+		"empty": {
+			data:     []byte{},
+			expected: []byte{},
+		},
+		"whole characters": {
+			data:     []byte("a\xc3\xa5\xf0\x9f\x98\x80"),
+			expected: []byte("a\xc3\xa5\xf0\x9f\x98\x80"),
+		},
+		"cut at the start": {
+			data:     []byte("\x98\x80abc"),
+			expected: []byte("abc"),
+		},
+		"cut at the end": {
+			data:     []byte("abc\xf0\x9f"),
+			expected: []byte("abc"),
+		},
+		"cut at both ends": {
+			data:     []byte("\xa5abc\xc3"),
+			expected: []byte("abc"),
+		},
+		"continuation bytes only": {
+			data:     []byte("\x9f\x98\x80"),
+			expected: []byte{},
+		},
+		"more continuation bytes than a character has": {
+			data:     []byte("\x80\x80\x80\x80abc"),
+			expected: []byte("\x80abc"),
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, TrimIncompleteRunes(tc.data))
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// Ready tells systemd the service finished starting up
+	Ready = "READY=1"
+	// Stopping tells systemd the service is shutting down
+	Stopping = "STOPPING=1"
+	// Watchdog keeps the watchdog of the service from firing
+	Watchdog = "WATCHDOG=1"
+)
+
+// Status returns the notification setting the status line of the service,
+// shown by systemctl status
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// MainPID returns the notification making the given process the main
+// process of the service, e.g.: the process taking over after an update;
+// systemd accepts it from the other processes of the service only with
+// NotifyAccess=all
+func MainPID(pid int) string {
+	return "MAINPID=" + strconv.Itoa(pid)
+}
+
+// Notify sends the state to the notification socket of the service manager,
+// i.e.: sd_notify(3); it does nothing and returns false if the service was not
+// started with Type=notify, i.e.: NOTIFY_SOCKET is not set
+func Notify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	//a leading @ stands for the Linux abstract namespace
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the interval the service has to send Watchdog
+// within, i.e.: sd_watchdog_enabled(3); 0 if the watchdog is not enabled for
+// this process
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	value, err := strconv.ParseUint(usec, 10, 63)
+	if err != nil || value == 0 {
+		return 0, errors.New("invalid WATCHDOG_USEC: " + usec)
+	}
+	return time.Duration(value) * time.Microsecond, nil
+}
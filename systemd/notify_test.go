@@ -0,0 +1,150 @@
+// Copyright 2020 Northern.tech AS
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//        http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//sets the environment variables for the duration of the test
+func setenv(variables map[string]string) func() {
+	saved := map[string]*string{}
+	for name, value := range variables {
+		if old, ok := os.LookupEnv(name); ok {
+			saved[name] = &old
+		} else {
+			saved[name] = nil
+		}
+		if value == "" {
+			os.Unsetenv(name)
+		} else {
+			os.Setenv(name, value)
+		}
+	}
+	return func() {
+		for name, value := range saved {
+			if value == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *value)
+			}
+		}
+	}
+}
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mender-shell-notify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := path.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	testCases := map[string]struct {
+		socket   string
+		notified bool
+		err      bool
+	}{
+		"not under systemd": {},
+		"notified": {
+			socket:   socketPath,
+			notified: true,
+		},
+		"missing socket": {
+			socket: path.Join(dir, "missing"),
+			err:    true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			defer setenv(map[string]string{"NOTIFY_SOCKET": tc.socket})()
+			notified, err := Notify(Status("connected"))
+			assert.Equal(t, tc.notified, notified)
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if tc.notified {
+				buf := make([]byte, 64)
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				n, err := conn.Read(buf)
+				assert.NoError(t, err)
+				assert.Equal(t, "STATUS=connected", string(buf[:n]))
+			}
+		})
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	testCases := map[string]struct {
+		usec     string
+		pid      string
+		interval time.Duration
+		err      bool
+	}{
+		"disabled": {},
+		"enabled": {
+			usec:     "30000000",
+			interval: 30 * time.Second,
+		},
+		"enabled for this process": {
+			usec:     "500000",
+			pid:      strconv.Itoa(os.Getpid()),
+			interval: 500 * time.Millisecond,
+		},
+		"enabled for another process": {
+			usec: "500000",
+			pid:  strconv.Itoa(os.Getpid() + 1),
+		},
+		"invalid": {
+			usec: "soon",
+			err:  true,
+		},
+		"zero": {
+			usec: "0",
+			err:  true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			defer setenv(map[string]string{
+				"WATCHDOG_USEC": tc.usec,
+				"WATCHDOG_PID":  tc.pid,
+			})()
+			interval, err := WatchdogInterval()
+			assert.Equal(t, tc.interval, interval)
+			if tc.err {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMainPID(t *testing.T) {
+	assert.Equal(t, "MAINPID=1234", MainPID(1234))
+}